@@ -86,7 +86,7 @@ TARGET_ARTIFACT=$DEPLOYMENT_SOURCE/_target/$ARTIFACT_NAME
 echo $TARGET_ARTIFACT > _artifact.txt
 
 echo Building go artifact $TARGET_ARTIFACT from commit $DEPLOYMENT_ID
-go build -v -o $TARGET_ARTIFACT
+go build -v -ldflags "-X main.version=$DEPLOYMENT_ID" -o $TARGET_ARTIFACT
 
 ##################################################################################################################################
 # Deployment
@@ -99,10 +99,10 @@ if [[ "$IN_PLACE_DEPLOYMENT" -ne "1" ]]; then
   exitWithMessageOnError "Kudu Sync failed"
 fi
 
-echo Removing old artifacts
-find ${TARGET_ARTIFACT%/*} $DEPLOYMENT_TARGET/_target -type f -name ${ARTIFACT_NAME%-*}-*.exe -maxdepth 1 -print0 |
-grep -zv $ARTIFACT_NAME |
-xargs -0 rm -v
+echo Removing old artifacts, keeping the previous one for rollback
+for dir in ${TARGET_ARTIFACT%/*} $DEPLOYMENT_TARGET/_target; do
+  ls -t $dir/${ARTIFACT_NAME%-*}-*.exe 2>/dev/null | grep -v $ARTIFACT_NAME | tail -n +2 | xargs -r rm -v
+done
 
 ##################################################################################################################################
 
@@ -0,0 +1,128 @@
+package goazure
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// adminOnly guards operational endpoints: requests must carry -adminToken
+// as a bearer token, and the endpoints are disabled without one. Loopback
+// clients are not trusted either, as behind IIS httpPlatformHandler every
+// request comes from 127.0.0.1.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			httpjson.Fail(w, r, http.StatusNotFound, "admin endpoints are disabled, set -adminToken")
+			return
+		}
+		if !adminAuthorized(r) {
+			httpjson.Fail(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+		if cs := ConnFromContext(r.Context()); cs != nil {
+			cs.Tag("admin")
+		}
+		h(w, r)
+	}
+}
+
+func adminAuthorized(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return false
+	}
+	want := "Bearer " + config.AdminToken
+	got := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// adminEndpoint tells the CLI subcommands where the local server listens.
+type adminEndpoint struct {
+	PID  int  `json:"pid"`
+	Port int  `json:"port"`
+	TLS  bool `json:"tls"`
+}
+
+// adminEndpointFile returns where the endpoint is recorded: in a directory of
+// the user's own, as the CLI sends the admin token to the port it finds
+// there, and named after the instance, as HOME may be shared storage.
+func adminEndpointFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-azure-website", "admin-"+instanceID+".json"), nil
+}
+
+// publishAdminEndpoint records the port being served on and returns a
+// function removing the record again.
+func publishAdminEndpoint() func() {
+	e := adminEndpoint{PID: os.Getpid(), Port: listenPort(), TLS: tlsEnabled()}
+	b, _ := json.Marshal(e)
+	f, err := adminEndpointFile()
+	if err == nil {
+		err = writePrivateFile(f, b)
+	}
+	if err != nil {
+		log.Printf("Could not record the admin endpoint: %v", err)
+		return func() {}
+	}
+	return func() {
+		// Only remove the record if a newer process has not replaced it.
+		if cur, ok := readAdminEndpoint(); ok && cur.PID == e.PID {
+			os.Remove(f)
+		}
+	}
+}
+
+// writePrivateFile replaces file with b, readable by the user only, in a
+// directory only the user can write to.
+func writePrivateFile(file string, b []byte) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(dir); err != nil || !isPrivate(fi) {
+		return fmt.Errorf("%s is not private to the user", dir)
+	}
+	tmp, err := ioutil.TempFile(dir, ".admin-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// readAdminEndpoint returns the recorded endpoint, trusted only if the user
+// owns the record and no one else can write it.
+func readAdminEndpoint() (adminEndpoint, bool) {
+	var e adminEndpoint
+	f, err := adminEndpointFile()
+	if err != nil {
+		return e, false
+	}
+	for _, p := range []string{filepath.Dir(f), f} {
+		if fi, err := os.Lstat(p); err != nil || !isPrivate(fi) {
+			return e, false
+		}
+	}
+	b, err := ioutil.ReadFile(f)
+	if err != nil || json.Unmarshal(b, &e) != nil || e.Port == 0 {
+		return e, false
+	}
+	return e, true
+}
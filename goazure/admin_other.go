@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package goazure
+
+import "os"
+
+// isPrivate reports whether fi is not a symbolic link. On Windows the
+// user's configuration directory is private to the user already.
+func isPrivate(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeSymlink == 0
+}
@@ -0,0 +1,32 @@
+package goazure
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestAdminEndpointPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced")
+	}
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	defer func(port int) { config.Port = port }(config.Port)
+	config.Port = 8123
+	remove := publishAdminEndpoint()
+	defer remove()
+
+	e, ok := readAdminEndpoint()
+	if !ok || e.Port != 8123 {
+		t.Fatalf("got %+v, %v, want the published endpoint", e, ok)
+	}
+	f, _ := adminEndpointFile()
+	if fi, err := os.Stat(f); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("endpoint file mode %v, want 0600: %v", fi.Mode(), err)
+	}
+	os.Chmod(f, 0666)
+	if _, ok := readAdminEndpoint(); ok {
+		t.Fatal("trusted an endpoint file others can write")
+	}
+}
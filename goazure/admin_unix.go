@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package goazure
+
+import (
+	"os"
+	"syscall"
+)
+
+// isPrivate reports whether fi is owned by the user and not writable by
+// anyone else.
+func isPrivate(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid() && fi.Mode()&0022 == 0 && fi.Mode()&os.ModeSymlink == 0
+}
@@ -0,0 +1,169 @@
+package goazure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const featureFlagPrefix = ".appconfig.featureflag/"
+
+// appConfig polls an Azure App Configuration store for dynamic settings.
+// Keys below the configured prefix become settings with the prefix removed;
+// feature flags are read from the store's feature flag namespace.
+type appConfig struct {
+	endpoint string
+	id       string
+	secret   []byte
+	prefix   string
+	label    string
+	client   *http.Client
+}
+
+// newAppConfig parses a connection string of the form
+// "Endpoint=https://...;Id=...;Secret=...".
+func newAppConfig(connStr, prefix, label string) (*appConfig, error) {
+	c := &appConfig{prefix: prefix, label: label, client: &http.Client{Timeout: 30 * time.Second}}
+	for _, part := range strings.Split(connStr, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Endpoint":
+			c.endpoint = strings.TrimSuffix(kv[1], "/")
+		case "Id":
+			c.id = kv[1]
+		case "Secret":
+			s, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid App Configuration secret: %v", err)
+			}
+			c.secret = s
+		}
+	}
+	if c.endpoint == "" || c.id == "" || c.secret == nil {
+		return nil, errors.New("App Configuration connection string needs Endpoint, Id and Secret")
+	}
+	return c, nil
+}
+
+type appConfigItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (c *appConfig) list(keyFilter string) ([]appConfigItem, error) {
+	q := url.Values{"key": {keyFilter}, "api-version": {"1.0"}}
+	if c.label != "" {
+		q.Set("label", c.label)
+	}
+	next := "/kv?" + q.Encode()
+
+	var items []appConfigItem
+	for next != "" {
+		var page struct {
+			Items []appConfigItem `json:"items"`
+			Next  string          `json:"@nextLink"`
+		}
+		if err := c.get(next, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		next = page.Next
+	}
+	return items, nil
+}
+
+func (c *appConfig) get(pathAndQuery string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.endpoint+pathAndQuery, nil)
+	if err != nil {
+		return err
+	}
+	c.sign(req, pathAndQuery)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("App Configuration returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sign adds HMAC-SHA256 authentication headers to a bodiless request.
+func (c *appConfig) sign(req *http.Request, pathAndQuery string) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	empty := sha256.Sum256(nil)
+	contentHash := base64.StdEncoding.EncodeToString(empty[:])
+
+	toSign := strings.Join([]string{
+		req.Method,
+		pathAndQuery,
+		date + ";" + req.URL.Host + ";" + contentHash,
+	}, "\n")
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(toSign))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("x-ms-date", date)
+	req.Header.Set("x-ms-content-sha256", contentHash)
+	req.Header.Set("Authorization", "HMAC-SHA256 Credential="+c.id+"&SignedHeaders=x-ms-date;host;x-ms-content-sha256&Signature="+sig)
+}
+
+func (c *appConfig) load() (map[string]string, map[string]bool, error) {
+	items, err := c.list(c.prefix + "*")
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string]string, len(items))
+	for _, it := range items {
+		values[strings.TrimPrefix(it.Key, c.prefix)] = it.Value
+	}
+
+	flags, err := c.list(featureFlagPrefix + "*")
+	if err != nil {
+		return nil, nil, err
+	}
+	features := make(map[string]bool, len(flags))
+	for _, it := range flags {
+		var ff struct {
+			ID      string `json:"id"`
+			Enabled bool   `json:"enabled"`
+		}
+		if err := json.Unmarshal([]byte(it.Value), &ff); err != nil {
+			log.Printf("Invalid feature flag %s: %v", it.Key, err)
+			continue
+		}
+		features[strings.TrimPrefix(it.Key, featureFlagPrefix)] = ff.Enabled
+	}
+	return values, features, nil
+}
+
+// poll refreshes s every interval until stop is closed.
+func (c *appConfig) poll(s *settings, interval time.Duration, stop <-chan struct{}) {
+	for {
+		values, features, err := c.load()
+		if err != nil {
+			log.Printf("Could not refresh App Configuration: %v", err)
+		} else if s.replace(values, features) {
+			log.Printf("Dynamic settings updated: %d values, %d feature flags", len(values), len(features))
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
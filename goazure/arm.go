@@ -0,0 +1,305 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// armField is a property of an armObject, which keeps properties in order so
+// that templates read like hand-written ones.
+type armField struct {
+	key   string
+	value interface{}
+}
+
+type armObject []armField
+
+func (o armObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// armParam refers to a template parameter.
+type armParam string
+
+func (p armParam) MarshalJSON() ([]byte, error) {
+	return json.Marshal("[parameters('" + string(p) + "')]")
+}
+
+type armParameter struct {
+	// kind is a template type; securestring is a string @secure() in Bicep.
+	name, kind string
+	// defaultValue is a literal or armExpr, absent if nil.
+	defaultValue interface{}
+}
+
+// armExpr is a template expression, written in both syntaxes.
+type armExpr struct{ bicep, json string }
+
+func (e armExpr) MarshalJSON() ([]byte, error) {
+	return json.Marshal("[" + e.json + "]")
+}
+
+var armLocation = armExpr{"resourceGroup().location", "resourceGroup().location"}
+
+type armTemplate struct {
+	params     []armParameter
+	symbol     string // resource name in Bicep
+	kind       string // resource type
+	apiVersion string
+	body       armObject
+}
+
+// writeJSON writes an ARM deployment template.
+func (t *armTemplate) writeJSON(w io.Writer) error {
+	var params armObject
+	for _, p := range t.params {
+		o := armObject{{"type", p.kind}}
+		if p.defaultValue != nil {
+			o = append(o, armField{"defaultValue", p.defaultValue})
+		}
+		params = append(params, armField{p.name, o})
+	}
+	resource := append(armObject{{"type", t.kind}, {"apiVersion", t.apiVersion}}, t.body...)
+	doc := armObject{
+		{"$schema", "https://schema.management.azure.com/schemas/2019-04-01/deploymentTemplate.json#"},
+		{"contentVersion", "1.0.0.0"},
+		{"parameters", params},
+		{"resources", []interface{}{resource}},
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// writeBicep writes the same template in Bicep.
+func (t *armTemplate) writeBicep(w io.Writer) error {
+	var b bytes.Buffer
+	for _, p := range t.params {
+		kind := p.kind
+		if kind == "securestring" {
+			b.WriteString("@secure()\n")
+			kind = "string"
+		}
+		fmt.Fprintf(&b, "param %s %s", p.name, kind)
+		if p.defaultValue != nil {
+			b.WriteString(" = ")
+			writeBicepValue(&b, p.defaultValue, "")
+		}
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "\nresource %s '%s@%s' = ", t.symbol, t.kind, t.apiVersion)
+	writeBicepValue(&b, t.body, "")
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func writeBicepValue(b *bytes.Buffer, v interface{}, indent string) {
+	switch v := v.(type) {
+	case armObject:
+		b.WriteString("{\n")
+		for _, f := range v {
+			fmt.Fprintf(b, "%s  %s: ", indent, f.key)
+			writeBicepValue(b, f.value, indent+"  ")
+			b.WriteByte('\n')
+		}
+		b.WriteString(indent + "}")
+	case []interface{}:
+		b.WriteString("[\n")
+		for _, e := range v {
+			b.WriteString(indent + "  ")
+			writeBicepValue(b, e, indent+"  ")
+			b.WriteByte('\n')
+		}
+		b.WriteString(indent + "]")
+	case armParam:
+		b.WriteString(string(v))
+	case armExpr:
+		b.WriteString(v.bicep)
+	case string:
+		b.WriteString("'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "${", `\${`).Replace(v) + "'")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int:
+		b.WriteString(strconv.Itoa(v))
+	}
+}
+
+func appSettings(settings [][2]string) []interface{} {
+	var list []interface{}
+	for _, s := range settings {
+		list = append(list, armObject{{"name", s[0]}, {"value", s[1]}})
+	}
+	return list
+}
+
+// initARM writes a Bicep or ARM template deploying the server with the
+// current configuration: to an App Service on an existing plan, or with kind
+// "containerapp" to a Container App in an existing environment. Readiness
+// doubles as the health check, so that the platform stops routing to
+// instances that are draining or warming up.
+func initARM(w io.Writer, fs *flag.FlagSet, platform, kind, format, name string) error {
+	grace := config.MaxWait + int(stopMargin/time.Second)
+	t := &armTemplate{params: []armParameter{
+		{"name", "string", name},
+		{"location", "string", armLocation},
+	}}
+	// Secrets are parameters given at deployment, passed in the
+	// environment rather than on the command line.
+	secrets := givenSecrets(fs)
+	switch kind {
+	case "appservice":
+		args := serverArgs(fs, "os", "o", "port", "kind", "format", "name")
+		settings := [][2]string{
+			// Swaps wait for the new slot to be ready, see withWarmup.
+			{"WEBSITE_SWAP_WARMUP_PING_PATH", "/readyz"},
+			{"WEBSITE_SWAP_WARMUP_PING_STATUSES", "200"},
+		}
+		siteConfig := armObject{{"alwaysOn", true}, {"healthCheckPath", "/readyz"}}
+		siteKind := "app"
+		switch platform {
+		case "linux":
+			siteKind = "app,linux"
+			watchDir := fs.Arg(0)
+			if watchDir == "" {
+				watchDir = "/home/site/wwwroot/_target"
+			}
+			args = append([]string{`-port "${PORT:-8000}"`}, args...)
+			args = append(args, watchDir)
+			siteConfig = append(siteConfig, armField{"appCommandLine",
+				fmt.Sprintf("sh -c 'exec \"$(cat /home/site/wwwroot/_artifact.txt)\" %s'", strings.Join(args, " "))})
+			settings = append(settings, [2]string{"WEBSITES_PORT", "8000"}, [2]string{"WEBSITES_ENABLE_APP_SERVICE_STORAGE", "true"})
+		case "windows":
+			settings = append(settings, [2]string{"SCM_COMMAND_IDLE_TIMEOUT", "600"})
+			fmt.Fprintln(os.Stderr, "Windows apps start through web.config, generate it with: go-azure-website init azure -os windows [flags]")
+		default:
+			return fmt.Errorf("unknown platform %q", platform)
+		}
+		list := appSettings(settings)
+		for _, s := range secrets {
+			list = append(list, armObject{{"name", secretEnv(s)}, {"value", armParam(s)}})
+		}
+		siteConfig = append(siteConfig, armField{"appSettings", list})
+
+		t.params = append(t.params, armParameter{"planId", "string", nil})
+		t.symbol, t.kind, t.apiVersion = "site", "Microsoft.Web/sites", "2022-09-01"
+		t.body = armObject{
+			{"name", armParam("name")},
+			{"location", armParam("location")},
+			{"kind", siteKind},
+			{"identity", armObject{{"type", "SystemAssigned"}}},
+			{"properties", armObject{
+				{"serverFarmId", armParam("planId")},
+				{"httpsOnly", true},
+				{"siteConfig", siteConfig},
+			}},
+		}
+	case "containerapp":
+		// Container arguments are not split by a shell, so unlike
+		// serverArgs these are left unquoted, as in initDocker.
+		args := []interface{}{"-port=8000"}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "os", "o", "port", "kind", "format", "name", "k8s":
+				return
+			}
+			if !isSecretFlag(f.Name) {
+				args = append(args, "-"+f.Name+"="+f.Value.String())
+			}
+		})
+		// Follow the pod lifecycle, as Container Apps run on Kubernetes.
+		args = append(args, "-k8s")
+		watchDir := fs.Arg(0)
+		if watchDir == "" {
+			watchDir = "/home/site/wwwroot/_target"
+		}
+		args = append(args, watchDir)
+		probe := func(kind, path string) armObject {
+			return armObject{{"type", kind}, {"httpGet", armObject{{"path", path}, {"port", 8000}}}, {"periodSeconds", 5}}
+		}
+		configuration := armObject{
+			{"ingress", armObject{{"external", true}, {"targetPort", 8000}}},
+		}
+		env := []interface{}{
+			armObject{{"name", "TERMINATION_GRACE_PERIOD_SECONDS"}, {"value", strconv.Itoa(grace + config.PreStopDelay)}},
+		}
+		if len(secrets) > 0 {
+			var list []interface{}
+			for _, s := range secrets {
+				// Secret names are lower case with dashes.
+				ref := strings.ToLower(strings.Replace(strings.TrimPrefix(secretEnv(s), "GOAZURE_"), "_", "-", -1))
+				list = append(list, armObject{{"name", ref}, {"value", armParam(s)}})
+				env = append(env, armObject{{"name", secretEnv(s)}, {"secretRef", ref}})
+			}
+			configuration = append(configuration, armField{"secrets", list})
+		}
+
+		t.params = append(t.params, armParameter{"environmentId", "string", nil}, armParameter{"image", "string", nil})
+		t.symbol, t.kind, t.apiVersion = "app", "Microsoft.App/containerApps", "2023-05-01"
+		t.body = armObject{
+			{"name", armParam("name")},
+			{"location", armParam("location")},
+			{"identity", armObject{{"type", "SystemAssigned"}}},
+			{"properties", armObject{
+				{"managedEnvironmentId", armParam("environmentId")},
+				{"configuration", configuration},
+				{"template", armObject{
+					{"terminationGracePeriodSeconds", grace + config.PreStopDelay},
+					{"containers", []interface{}{armObject{
+						{"name", "web"},
+						{"image", armParam("image")},
+						{"args", args},
+						{"env", env},
+						{"probes", []interface{}{
+							probe("Liveness", "/healthz"),
+							probe("Readiness", "/readyz"),
+							probe("Startup", "/healthz"),
+						}},
+					}}},
+				}},
+			}},
+		}
+	default:
+		return fmt.Errorf("unknown kind %q, expected appservice or containerapp", kind)
+	}
+	for _, s := range secrets {
+		t.params = append(t.params, armParameter{s, "securestring", nil})
+	}
+
+	if config.AdminToken == "" {
+		fmt.Fprintln(os.Stderr, "Consider setting -adminToken, admin endpoints and /metrics are disabled without it")
+	}
+	switch format {
+	case "bicep":
+		return t.writeBicep(w)
+	case "json":
+		return t.writeJSON(w)
+	}
+	return fmt.Errorf("unknown format %q, expected bicep or json", format)
+}
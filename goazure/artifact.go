@@ -0,0 +1,102 @@
+package goazure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// runningHash is the SHA-256 of the executable serving this process.
+var runningHash string
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func executableHash() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return fileHash(exe)
+}
+
+// waitStable blocks until the file at path stops changing, as a freshly
+// created artifact is typically still being written when it is detected.
+// Closing stop abandons the wait.
+func waitStable(path string, maxWait time.Duration, stop <-chan struct{}) error {
+	const interval = 500 * time.Millisecond
+
+	var last os.FileInfo
+	deadline := time.Now().Add(maxWait)
+	for time.Now().Before(deadline) {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %v", ErrArtifactInvalid, err)
+		}
+		if err != nil {
+			return err
+		}
+		if last != nil && fi.Size() == last.Size() && fi.ModTime().Equal(last.ModTime()) {
+			return nil
+		}
+		last = fi
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return errors.New("stopped waiting for artifact")
+		}
+	}
+	return errors.New("artifact still changing after " + maxWait.String())
+}
+
+// validateArtifact checks that the artifact at path can be run: it must be a
+// non-empty regular file.
+func validateArtifact(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrArtifactInvalid, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is not a regular file", ErrArtifactInvalid, path)
+	}
+	if fi.Size() == 0 {
+		return fmt.Errorf("%w: %s is empty", ErrArtifactInvalid, path)
+	}
+	return nil
+}
+
+// artifactChanged reports whether the artifact at path differs from the
+// running executable once it has stopped changing. It fails with
+// ErrArtifactInvalid for artifacts that cannot be run; other errors are
+// treated as a change so that a deployment is never silently dropped.
+func artifactChanged(path string, stop <-chan struct{}) (bool, string, error) {
+	if err := waitStable(path, 30*time.Second, stop); err != nil {
+		if errors.Is(err, ErrArtifactInvalid) {
+			return false, "", err
+		}
+		return true, "", nil
+	}
+	if err := validateArtifact(path); err != nil {
+		return false, "", err
+	}
+	h, err := fileHash(path)
+	if err != nil || runningHash == "" {
+		return true, h, nil
+	}
+	return h != runningHash, h, nil
+}
@@ -0,0 +1,319 @@
+package goazure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	proxyRetries         = newCounter("goazure_proxy_retries_total", "Proxied requests retried against the backend")
+	proxyBreakerOpenings = newCounter("goazure_proxy_breaker_openings_total", "Times a backend circuit breaker opened")
+	proxyRejected        = newCounter("goazure_proxy_rejected_total", "Proxied requests failed fast by an open circuit breaker")
+)
+
+// errBreakerOpen is returned for requests to a backend whose circuit breaker
+// is open.
+var errBreakerOpen = errors.New("backend circuit breaker is open")
+
+// backend is the transport of the proxy targets, set up by defineHandlers.
+var backend *backendTransport
+
+// backendTransport is the RoundTripper of proxy targets. It bounds the
+// connections to each backend, gives each try a deadline for the response
+// headers, retries idempotent requests that failed to get a response within
+// a retry budget, and stops calling a backend that keeps failing, such as
+// one whose process is being swapped, for a cooldown.
+type backendTransport struct {
+	transport  *http.Transport
+	tryTimeout time.Duration
+	maxTries   int
+	budget     *retryBudget
+
+	breakerFailures int
+	breakerCooldown time.Duration
+	mu              sync.Mutex
+	breakers        map[string]*breaker
+}
+
+func newBackendTransport() *backendTransport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = config.ProxyMaxConns
+	if config.ProxyMaxIdle > 0 {
+		t.MaxIdleConnsPerHost = config.ProxyMaxIdle
+		t.MaxIdleConns = 0
+	}
+	return &backendTransport{
+		transport:       t,
+		tryTimeout:      time.Duration(config.ProxyTryTimeout) * time.Millisecond,
+		maxTries:        1 + config.ProxyRetries,
+		budget:          newRetryBudget(float64(config.ProxyRetryBudget) / 100),
+		breakerFailures: config.BreakerFailures,
+		breakerCooldown: time.Duration(config.BreakerCooldown) * time.Second,
+		breakers:        make(map[string]*breaker),
+	}
+}
+
+// retryable reports whether req can be sent again after failing with err.
+// Idempotent requests can after any failure, others only when they never
+// reached the backend, such as while it restarts. The body must be absent or
+// replayable, see withRequestBuffer.
+func retryable(req *http.Request, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if req.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+func (b *backendTransport) breaker(host string) *breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.breakers[host]
+	if !ok {
+		br = &breaker{}
+		b.breakers[host] = br
+	}
+	return br
+}
+
+func (b *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return b.roundTrip(req, nil)
+}
+
+// poolTransport sends the requests of a virtual host to the backends of its
+// pool, each try going to the backend the pool picks.
+type poolTransport struct {
+	b    *backendTransport
+	pool *upstreamPool
+}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.b.roundTrip(req, t.pool)
+}
+
+func (b *backendTransport) roundTrip(req *http.Request, pool *upstreamPool) (*http.Response, error) {
+	var br *breaker
+	if b.breakerFailures > 0 {
+		key := req.URL.Host
+		if pool != nil {
+			key = pool.name
+		}
+		br = b.breaker(key)
+	}
+	b.budget.request()
+
+	var resp *http.Response
+	var err error
+	for try := 1; ; try++ {
+		if br != nil && !br.allow(b.breakerCooldown) {
+			proxyRejected.inc()
+			return nil, errBreakerOpen
+		}
+		resp, err = b.tryPool(req, pool)
+		failed := err != nil || resp.StatusCode == http.StatusServiceUnavailable
+		if br != nil && br.record(!failed, b.breakerFailures) {
+			proxyBreakerOpenings.inc()
+			log.Printf("Backend %s failing, circuit breaker open for %v", req.URL.Host, b.breakerCooldown)
+		}
+		if !failed || try >= b.maxTries || !retryable(req, err) || req.Context().Err() != nil || !b.budget.retry() {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		proxyRetries.inc()
+		// Back off exponentially with jitter, 25ms before the second try.
+		backoff := time.Duration(25<<uint(try-1)) * time.Millisecond
+		backoff += time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// tryPool sends req once to the backend picked by pool, if any, and records
+// the outcome for outlier detection.
+func (b *backendTransport) tryPool(req *http.Request, pool *upstreamPool) (*http.Response, error) {
+	if pool == nil {
+		return b.try(req)
+	}
+	u, setCookie := pool.pick(req)
+	out := req.Clone(req.Context())
+	out.URL.Scheme, out.URL.Host = u.URL.Scheme, u.URL.Host
+	resp, err := b.try(out)
+	pool.record(u, err == nil && resp.StatusCode < 500)
+	if err == nil && setCookie {
+		c := &http.Cookie{Name: pool.affinityName, Value: u.id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+	return resp, err
+}
+
+// try sends req once, cancelling it if the response headers take longer than
+// the per-try timeout.
+func (b *backendTransport) try(req *http.Request) (*http.Response, error) {
+	if b.tryTimeout <= 0 {
+		return b.transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(b.tryTimeout, cancel)
+	resp, err := b.transport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && err != nil && req.Context().Err() == nil {
+		err = fmt.Errorf("no response within %v: %w", b.tryTimeout, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of a try once the body is done with.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// retryBudget allows retries up to a ratio of the requests seen over the
+// last ten seconds, plus a few per window so that a quiet backend still
+// gets retried. It keeps retries from multiplying the load on a backend
+// that is down.
+type retryBudget struct {
+	ratio float64
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	retries  int
+}
+
+const retryBudgetWindow = 10 * time.Second
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, start: time.Now()}
+}
+
+func (rb *retryBudget) roll() {
+	if time.Since(rb.start) >= retryBudgetWindow {
+		rb.start, rb.requests, rb.retries = time.Now(), 0, 0
+	}
+}
+
+func (rb *retryBudget) request() {
+	rb.mu.Lock()
+	rb.roll()
+	rb.requests++
+	rb.mu.Unlock()
+}
+
+// retry reports whether a retry fits in the budget, taking it if so.
+func (rb *retryBudget) retry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll()
+	if float64(rb.retries) >= 3+rb.ratio*float64(rb.requests) {
+		return false
+	}
+	rb.retries++
+	return true
+}
+
+// breaker is the circuit breaker of one backend. It opens after a number of
+// consecutive failures, and once the cooldown has passed lets a single
+// request through to probe the backend, closing again if it succeeds.
+type breaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (br *breaker) allow(cooldown time.Duration) bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.openedAt.IsZero() {
+		return true
+	}
+	if br.probing || time.Since(br.openedAt) < cooldown {
+		return false
+	}
+	br.probing = true
+	return true
+}
+
+// record notes the outcome of a request, reporting whether it opened the
+// breaker.
+func (br *breaker) record(ok bool, threshold int) bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if ok {
+		br.failures, br.openedAt, br.probing = 0, time.Time{}, false
+		return false
+	}
+	br.failures++
+	if br.probing {
+		// The probe failed; wait for another cooldown.
+		br.openedAt, br.probing = time.Now(), false
+		return false
+	}
+	if br.openedAt.IsZero() && br.failures >= threshold {
+		br.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// proxyErrorHandler answers proxied requests that got no response from the
+// backend: 503 with a Retry-After while its breaker is open, 504 when a try
+// timed out and 502 otherwise.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	var ne net.Error
+	switch {
+	case errors.Is(err, errBreakerOpen):
+		status = http.StatusServiceUnavailable
+		if backend != nil {
+			w.Header().Set("Retry-After", fmt.Sprint(int(backend.breakerCooldown/time.Second)))
+		}
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		// The client went away; nobody reads the answer.
+		return
+	case errors.Is(err, context.Canceled), errors.As(err, &ne) && ne.Timeout():
+		status = http.StatusGatewayTimeout
+	}
+	log.Printf("Proxying %s %s failed: %v", r.Method, r.URL.Path, err)
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,141 @@
+package goazure
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runBench implements the "bench" subcommand, which sends the same request
+// from a number of concurrent clients for a while and reports the statuses
+// and latencies, to see how shedding, queueing and drain settings hold up
+// under load where no load testing tool can be installed. A URL given as a
+// path goes to the local server.
+func runBench(args []string) {
+	fs := commandFlags("bench")
+	concurrency := fs.Int("concurrency", 16, "Number of requests in flight")
+	duration := fs.Int("duration", 10, "Seconds to run for")
+	n := fs.Int("n", 0, "Number of requests to send at most, 0 for as many as -duration allows")
+	rate := fs.Float64("rate", 0, "Requests per second to send at most, 0 for as fast as the concurrency allows")
+	method := fs.String("method", "GET", "Request method")
+	body := fs.String("body", "", "Request body")
+	host := fs.String("host", "", "Host header to send, the host of the URL if empty")
+	timeout := fs.Int("timeout", 30, "Seconds to wait for each response")
+	header := headerList{}
+	fs.Var(header, "header", "Header to add to every request as \"Name: value\", can be repeated")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		printUsage()
+	}
+	if *concurrency < 1 || *duration < 1 {
+		log.Fatal("-concurrency and -duration must be positive")
+	}
+
+	client := &http.Client{
+		Timeout:       time.Duration(*timeout) * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	target := fs.Arg(0)
+	if strings.HasPrefix(target, "/") {
+		locateAdmin(fs)
+		scheme := "http"
+		if adminTLS {
+			scheme = "https"
+		}
+		target = fmt.Sprintf("%s://127.0.0.1:%d%s", scheme, config.Port, target)
+		client.Transport = loopbackClient(0).Transport
+	} else {
+		client.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	client.Transport.(*http.Transport).MaxIdleConnsPerHost = *concurrency
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid URL %q", fs.Arg(0))
+	}
+	base := &url.URL{Scheme: u.Scheme, Host: u.Host}
+	req := &replayRequest{method: strings.ToUpper(*method), uri: u.RequestURI(), header: http.Header{}, body: []byte(*body)}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	var once sync.Once
+	finish := func() { once.Do(func() { close(done) }) }
+	time.AfterFunc(time.Duration(*duration)*time.Second, finish)
+
+	work := make(chan struct{})
+	go func() {
+		defer close(work)
+		var tick <-chan time.Time
+		if *rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := 0; *n == 0 || i < *n; i++ {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-done:
+					return
+				}
+			}
+			select {
+			case work <- struct{}{}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	results := make(chan replayResult)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range work {
+				results <- replayOne(client, base, *host, http.Header(header), req)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	fmt.Printf("Sending %s %s from %d clients for %ds\n", req.method, target, *concurrency, *duration)
+	start := time.Now()
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+	var s replaySummary
+	sent, last, failed, errors5xx := 0, 0, 0, 0
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				fmt.Println()
+				s.print(os.Stdout, time.Since(start))
+				return
+			}
+			s.add(res)
+			sent++
+			if res.err != nil {
+				failed++
+			} else if res.status >= 500 {
+				errors5xx++
+			}
+		case <-progress.C:
+			// Show how the server copes as it goes, such as when shedding starts.
+			fmt.Printf("%4ds  %6d requests  %5d/s  %d 5xx  %d failed\n", int(time.Since(start).Seconds()+0.5), sent, sent-last, errors5xx, failed)
+			last = sent
+		case <-sig:
+			finish()
+		}
+	}
+}
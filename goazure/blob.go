@@ -0,0 +1,165 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	blobAPIVersion = "2020-10-02"
+	blobBlockSize  = 4 << 20
+)
+
+// blobContainer is an Azure Blob Storage container, authorized with a SAS
+// token in the query of its URL or else with the managed identity.
+type blobContainer struct {
+	u        *url.URL
+	identity *managedIdentity
+	client   *http.Client
+}
+
+func newBlobContainer(containerURL, clientID string) (*blobContainer, error) {
+	u, err := url.Parse(containerURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid blob container URL %q", containerURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	c := &blobContainer{u: u, client: &http.Client{Timeout: 5 * time.Minute}}
+	if u.Query().Get("sig") == "" {
+		c.identity = newManagedIdentity("https://storage.azure.com/", clientID)
+	}
+	return c, nil
+}
+
+// String returns the container URL without its SAS token.
+func (c *blobContainer) String() string {
+	u := *c.u
+	u.RawQuery = ""
+	return u.String()
+}
+
+func (c *blobContainer) blobURL(name string, params url.Values) string {
+	u := *c.u
+	if name != "" {
+		u.Path += "/" + name
+	}
+	q := u.Query()
+	for k, vs := range params {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (c *blobContainer) do(method, name string, params url.Values, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.blobURL(name, params), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("x-ms-version", blobAPIVersion)
+	if c.identity != nil {
+		token, err := c.identity.get()
+		if err != nil {
+			return nil, fmt.Errorf("could not get storage token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && c.identity != nil {
+			c.identity.invalidate()
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, name, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+// create returns a writer storing a block blob, uploaded in blocks as it is
+// written and committed on Close.
+func (c *blobContainer) create(name, contentType string) *blobWriter {
+	return &blobWriter{c: c, name: name, contentType: contentType}
+}
+
+type blobWriter struct {
+	c           *blobContainer
+	name        string
+	contentType string
+	buf         []byte
+	blocks      []string
+	err         error
+}
+
+func (bw *blobWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && bw.err == nil {
+		if bw.buf == nil {
+			bw.buf = make([]byte, 0, blobBlockSize)
+		}
+		k := copy(bw.buf[len(bw.buf):cap(bw.buf)], p)
+		bw.buf, p = bw.buf[:len(bw.buf)+k], p[k:]
+		if len(bw.buf) == cap(bw.buf) {
+			bw.flush()
+		}
+	}
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	return n, nil
+}
+
+func (bw *blobWriter) flush() {
+	if len(bw.buf) == 0 || bw.err != nil {
+		return
+	}
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(bw.blocks))))
+	resp, err := bw.c.do("PUT", bw.name, url.Values{"comp": {"block"}, "blockid": {id}}, bw.buf, nil)
+	if err != nil {
+		bw.err = err
+		return
+	}
+	resp.Body.Close()
+	bw.blocks = append(bw.blocks, id)
+	bw.buf = bw.buf[:0]
+}
+
+// Close commits the blocks written.
+func (bw *blobWriter) Close() error {
+	bw.flush()
+	if bw.err != nil {
+		return bw.err
+	}
+	list := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: bw.blocks}
+	body, _ := xml.Marshal(list)
+	h := http.Header{"Content-Type": {"application/xml"}}
+	if bw.contentType != "" {
+		h.Set("x-ms-blob-content-type", bw.contentType)
+	}
+	resp, err := bw.c.do("PUT", bw.name, url.Values{"comp": {"blocklist"}}, body, h)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
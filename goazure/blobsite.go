@@ -0,0 +1,293 @@
+package goazure
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	blobSyncs      = newCounter("goazure_static_blob_syncs_total", "Syncs of the -staticBlob container")
+	blobSyncErrors = newCounter("goazure_static_blob_sync_errors_total", "Failed syncs of the -staticBlob container")
+	blobDownloads  = newCounter("goazure_static_blob_downloads_total", "Blobs downloaded into the -staticBlobCache")
+)
+
+// blobEntry is what the sync keeps of a blob.
+type blobEntry struct {
+	ETag     string    `json:"etag"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// blobSite mirrors an Azure Blob container into a local directory, which
+// staticHandler serves from with the blobs' ETags. The directory holds the
+// blobs under content/ and the ETags they were downloaded with in
+// index.json, so that a restart serves the mirror at once and only
+// downloads what changed meanwhile. Blobs are synced in the background, so
+// that updating the site is a matter of uploading to the container.
+type blobSite struct {
+	c   *blobContainer
+	dir string
+
+	mu    sync.Mutex
+	index map[string]blobEntry
+
+	syncing sync.Mutex
+	synced  chan struct{} // closed after the first sync
+	once    sync.Once
+}
+
+// blobStatic is set up by defineHandlers with -staticBlob and started by Run.
+var blobStatic *blobSite
+
+// blobWarmup registers the warm-up routine waiting for the first sync once.
+var blobWarmup sync.Once
+
+func newBlobSite(containerURL, dir, clientID string) (*blobSite, error) {
+	c, err := newBlobContainer(containerURL, clientID)
+	if err != nil {
+		return nil, err
+	}
+	bs := &blobSite{c: c, dir: dir, index: map[string]blobEntry{}, synced: make(chan struct{})}
+	for _, d := range []string{bs.content(), filepath.Join(dir, "tmp")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "index.json")); err == nil {
+		if err := json.Unmarshal(b, &bs.index); err != nil {
+			log.Printf("Ignoring invalid blob index in %s: %v", dir, err)
+			bs.index = map[string]blobEntry{}
+		}
+	}
+	return bs, nil
+}
+
+// content returns the directory served.
+func (bs *blobSite) content() string {
+	return filepath.Join(bs.dir, "content")
+}
+
+// etag returns the ETag of the blob served for a static path, the index.html
+// of a directory, empty if it was not synced from the container.
+func (bs *blobSite) etag(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b, ok := bs.index[name]; ok {
+		return b.ETag
+	}
+	return bs.index[strings.TrimPrefix(path.Join(name, "index.html"), "/")].ETag
+}
+
+type blobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ETag          string `xml:"Etag"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// list returns the blobs in the container, by name.
+func (bs *blobSite) list() (map[string]blobEntry, error) {
+	blobs := make(map[string]blobEntry)
+	marker := ""
+	for {
+		params := url.Values{"restype": {"container"}, "comp": {"list"}}
+		if marker != "" {
+			params.Set("marker", marker)
+		}
+		resp, err := bs.c.do("GET", "", params, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var l blobList
+		err = xml.NewDecoder(resp.Body).Decode(&l)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse blob list: %v", err)
+		}
+		for _, b := range l.Blobs {
+			if !validBlobPath(b.Name) {
+				continue
+			}
+			modified, _ := http.ParseTime(b.Properties.LastModified)
+			tag := b.Properties.ETag
+			if !strings.HasPrefix(tag, `"`) {
+				tag = `"` + tag + `"`
+			}
+			blobs[b.Name] = blobEntry{ETag: tag, Size: b.Properties.ContentLength, Modified: modified}
+		}
+		if marker = l.NextMarker; marker == "" {
+			return blobs, nil
+		}
+	}
+}
+
+// validBlobPath rejects blob names that would not map into the content
+// directory, or would be hidden or a directory there.
+func validBlobPath(name string) bool {
+	if name == "" || strings.HasSuffix(name, "/") || strings.Contains(name, `\`) {
+		return false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return path.Clean("/"+name) == "/"+name
+}
+
+// sync downloads the blobs added or changed since the last sync and removes
+// the local copies of those deleted.
+func (bs *blobSite) sync() error {
+	bs.syncing.Lock()
+	defer bs.syncing.Unlock()
+	blobSyncs.inc()
+
+	blobs, err := bs.list()
+	if err != nil {
+		blobSyncErrors.inc()
+		return err
+	}
+	bs.mu.Lock()
+	index := make(map[string]blobEntry, len(bs.index))
+	for k, v := range bs.index {
+		index[k] = v
+	}
+	bs.mu.Unlock()
+
+	changed := 0
+	var failed []string
+	for name, b := range blobs {
+		if cur, ok := index[name]; ok && cur.ETag == b.ETag {
+			if _, err := os.Stat(bs.local(name)); err == nil {
+				continue
+			}
+		}
+		if err := bs.download(name, b); err != nil {
+			log.Printf("Could not download blob %s: %v", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		index[name] = b
+		changed++
+	}
+	for name := range index {
+		if _, ok := blobs[name]; !ok {
+			os.Remove(bs.local(name))
+			delete(index, name)
+			changed++
+		}
+	}
+
+	bs.mu.Lock()
+	bs.index = index
+	bs.mu.Unlock()
+	if changed > 0 {
+		if b, err := json.Marshal(index); err == nil {
+			writeFileAtomic(filepath.Join(bs.dir, "index.json"), b)
+		}
+		if cache != nil {
+			cache.purge()
+		}
+		log.Printf("Synced %d changed blobs from %s", changed, bs.c)
+	}
+	if len(failed) > 0 {
+		blobSyncErrors.inc()
+		return fmt.Errorf("could not download %d blobs, such as %s", len(failed), failed[0])
+	}
+	return nil
+}
+
+func (bs *blobSite) local(name string) string {
+	return filepath.Join(bs.content(), filepath.FromSlash(name))
+}
+
+// download fetches a blob through a temporary file, so that requests never
+// see it half written.
+func (bs *blobSite) download(name string, b blobEntry) error {
+	resp, err := bs.c.do("GET", name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	tmp, err := ioutil.TempFile(filepath.Join(bs.dir, "tmp"), "blob")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	dst := bs.local(name)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+	}
+	if err == nil && !b.Modified.IsZero() {
+		err = os.Chtimes(tmp.Name(), b.Modified, b.Modified)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	blobDownloads.inc()
+	return nil
+}
+
+// start syncs now and every interval until stop is closed.
+func (bs *blobSite) start(interval time.Duration, stop <-chan struct{}) {
+	if bs == nil {
+		return
+	}
+	goBackground(func() {
+		for {
+			if err := bs.sync(); err != nil {
+				log.Printf("Blob sync failed: %v", err)
+			}
+			bs.once.Do(func() { close(bs.synced) })
+			select {
+			case <-clk.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// warmup waits for the first sync, so that a fresh instance is not ready
+// before it has the site to serve.
+func (bs *blobSite) warmup(stop <-chan struct{}) error {
+	select {
+	case <-bs.synced:
+	case <-stop:
+	}
+	return nil
+}
+
+// writeFileAtomic replaces name with b through a temporary file.
+func writeFileAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,225 @@
+package goazure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// brownoutHeader is set on requests handled during a brownout, so that the
+// application and proxied backends can skip optional work as well.
+const brownoutHeader = "X-Goazure-Brownout"
+
+var (
+	brownoutDegraded = newCounter("goazure_brownout_degraded_total", "Requests degraded by a brownout rule")
+	brownoutStarts   = newCounter("goazure_brownout_starts_total", "Times brownout mode started")
+)
+
+// brownoutRule degrades requests whose path matches, as a prefix if it ends
+// in a slash and exactly otherwise, and whose method matches if set, while
+// in brownout mode: by serving cached responses past their TTL, skipping
+// middleware plugins, or answering with Status instead of handling them,
+// such as to skip a proxied call that only personalizes a page.
+type brownoutRule struct {
+	Path        string `json:"path"`
+	Method      string `json:"method,omitempty"`
+	Stale       bool   `json:"stale,omitempty"`
+	SkipPlugins bool   `json:"skipPlugins,omitempty"`
+	Status      int    `json:"status,omitempty"`
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+func (br *brownoutRule) matches(r *http.Request) bool {
+	if br.Method != "" && !strings.EqualFold(br.Method, r.Method) {
+		return false
+	}
+	if strings.HasSuffix(br.Path, "/") {
+		return strings.HasPrefix(r.URL.Path, br.Path)
+	}
+	return r.URL.Path == br.Path
+}
+
+func loadBrownoutRules(file string) ([]*brownoutRule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*brownoutRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for i, br := range rules {
+		if !strings.HasPrefix(br.Path, "/") {
+			return nil, fmt.Errorf("brownout rule %d: invalid path %q", i, br.Path)
+		}
+		if br.Status != 0 && (br.Status < 200 || br.Status > 599) {
+			return nil, fmt.Errorf("brownout rule %d: invalid status %d", i, br.Status)
+		}
+	}
+	return rules, nil
+}
+
+// brownoutMode is a degraded mode giving up optional features rather than
+// failing requests. It is entered manually through the admin API or the
+// "brownout" dynamic setting, or automatically once the load shedding
+// signals reach -brownoutAt percent of their thresholds, so that it
+// degrades service before shedding has to reject requests.
+type brownoutMode struct {
+	rules  []*brownoutRule
+	manual int32
+	active int32
+}
+
+// brownout is set up by defineHandlers and started by Run.
+var brownout = &brownoutMode{}
+
+func init() {
+	newGaugeFunc("goazure_brownout", "1 while in brownout mode", func() float64 {
+		if brownout.isActive() {
+			return 1
+		}
+		return 0
+	})
+}
+
+func (b *brownoutMode) isActive() bool {
+	return atomic.LoadInt32(&b.active) == 1
+}
+
+// reason returns why the server should be in brownout, empty if it should
+// not.
+func (b *brownoutMode) reason() string {
+	if atomic.LoadInt32(&b.manual) == 1 {
+		return "requested through the admin API"
+	}
+	if on, _ := strconv.ParseBool(dynamic.get("brownout")); on {
+		return "set in dynamic settings"
+	}
+	if config.BrownoutAt > 0 {
+		if p := shedder.pressure(); p*100 >= float64(config.BrownoutAt) {
+			return fmt.Sprintf("load at %.0f%% of the shedding thresholds", p*100)
+		}
+	}
+	return ""
+}
+
+// update enters or leaves brownout according to reason.
+func (b *brownoutMode) update() {
+	reason := b.reason()
+	switch {
+	case reason != "" && atomic.CompareAndSwapInt32(&b.active, 0, 1):
+		brownoutStarts.inc()
+		log.Printf("Entering brownout mode, %s", reason)
+	case reason == "" && atomic.CompareAndSwapInt32(&b.active, 1, 0):
+		log.Println("Leaving brownout mode")
+	}
+}
+
+// start reevaluates the mode every second until stop is closed.
+func (b *brownoutMode) start(stop <-chan struct{}) {
+	atomic.StoreInt32(&b.active, 0)
+	b.update()
+	goBackground(func() {
+		for {
+			select {
+			case <-clk.After(time.Second):
+			case <-stop:
+				return
+			}
+			b.update()
+		}
+	})
+}
+
+type brownoutKey struct{}
+
+// brownoutRuleFrom returns the rule degrading the request, nil outside of
+// brownout mode.
+func brownoutRuleFrom(ctx context.Context) *brownoutRule {
+	br, _ := ctx.Value(brownoutKey{}).(*brownoutRule)
+	return br
+}
+
+// withBrownout marks requests with brownoutHeader while in brownout mode and
+// applies the first matching rule, passing it on to withCache and
+// withPlugins through the request context.
+func withBrownout(h http.Handler, b *brownoutMode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.isActive() {
+			r.Header.Del(brownoutHeader)
+			h.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Set(brownoutHeader, "1")
+		for _, br := range b.rules {
+			if !br.matches(r) {
+				continue
+			}
+			brownoutDegraded.inc()
+			if br.Status != 0 {
+				if br.ContentType != "" {
+					w.Header().Set("Content-Type", br.ContentType)
+				}
+				w.Header().Set(brownoutHeader, "1")
+				w.WriteHeader(br.Status)
+				io.WriteString(w, br.Body)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), brownoutKey{}, br))
+			break
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type brownoutStatus struct {
+	Active bool   `json:"active"`
+	Manual bool   `json:"manual"`
+	Reason string `json:"reason,omitempty"`
+	Rules  int    `json:"rules"`
+}
+
+// brownoutHandler reports the brownout mode, or enters or leaves it:
+//
+//	GET /admin/brownout
+//	POST /admin/brownout?enabled=true
+//
+// Leaving it only takes effect once no other reason to be in it remains.
+func brownoutHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			httpjson.Fail(w, r, http.StatusBadRequest, "enabled must be true or false")
+			return
+		}
+		v := int32(0)
+		if enabled {
+			v = 1
+		}
+		atomic.StoreInt32(&brownout.manual, v)
+		brownout.update()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	httpjson.Write(w, http.StatusOK, brownoutStatus{
+		Active: brownout.isActive(),
+		Manual: atomic.LoadInt32(&brownout.manual) == 1,
+		Reason: brownout.reason(),
+		Rules:  len(brownout.rules),
+	})
+}
@@ -0,0 +1,46 @@
+package goazure
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// bufferPool recycles the copy buffers of reverse proxies.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+var proxyBuffers *bufferPool
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
+
+// readFrom copies r to w through w's io.ReaderFrom if it has one, so that
+// response writer wrappers keep the sendfile path of the underlying
+// connection for static files.
+func readFrom(w http.ResponseWriter, r io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
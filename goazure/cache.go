@@ -0,0 +1,288 @@
+package goazure
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (e *cacheEntry) size() int {
+	n := len(e.key) + len(e.body)
+	for k, vs := range e.header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	return n
+}
+
+// responseCache is an LRU cache of GET responses bounded by total size.
+// Responses are keyed by URL and the request values of the headers named in
+// their Vary header.
+type responseCache struct {
+	mu      sync.Mutex
+	maxSize int
+	maxItem int
+	ttl     time.Duration
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+	vary    map[string][]string
+}
+
+var cache *responseCache
+
+func newResponseCache(maxSize int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		maxSize: maxSize,
+		maxItem: maxSize / 8,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		vary:    map[string][]string{},
+	}
+}
+
+func primaryKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+func variantKey(primary string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b bytes.Buffer
+	b.WriteString(primary)
+	for _, h := range vary {
+		b.WriteString("\x00")
+		b.WriteString(strings.Join(r.Header[h], ","))
+	}
+	return b.String()
+}
+
+// get returns the cached response to r, or with stale set one that expired
+// but was not evicted yet. Expired entries are kept for that until a fresh
+// response replaces them or they fall off the LRU.
+func (c *responseCache) get(r *http.Request, stale bool) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	primary := primaryKey(r)
+	el, ok := c.entries[variantKey(primary, c.vary[primary], r)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !stale && time.Now().After(e.expires) {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+func (c *responseCache) put(r *http.Request, e *cacheEntry, vary []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	primary := primaryKey(r)
+	c.vary[primary] = vary
+	e.key = variantKey(primary, vary, r)
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// purge drops every entry, e.g. when a deployment changes what would be
+// served.
+func (c *responseCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.vary = map[string][]string{}
+	c.size = 0
+}
+
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != "GET" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	if r.URL.Path == "/healthz" || strings.HasPrefix(r.URL.Path, "/admin/") {
+		return false
+	}
+	cc := r.Header.Get("Cache-Control")
+	return !strings.Contains(cc, "no-cache") && !strings.Contains(cc, "no-store")
+}
+
+// responseTTL returns how long a response may be cached, or zero if it may
+// not be cached at all.
+func (c *responseCache) responseTTL(status int, h http.Header) time.Duration {
+	if status != http.StatusOK || privateResponse(h) {
+		return 0
+	}
+
+	ttl := c.ttl
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(strings.ToLower(d))
+		if strings.HasPrefix(d, "max-age=") {
+			if secs, err := strconv.Atoi(d[len("max-age="):]); err == nil && time.Duration(secs)*time.Second < ttl {
+				ttl = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return ttl
+}
+
+// privateResponse reports whether a response is meant for the client that
+// asked for it alone, so that it must not be handed to others.
+func privateResponse(h http.Header) bool {
+	if h.Get("Set-Cookie") != "" {
+		return true
+	}
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		switch strings.TrimSpace(strings.ToLower(d)) {
+		case "no-store", "no-cache", "private":
+			return true
+		}
+	}
+	return false
+}
+
+func parseVary(h http.Header) ([]string, bool) {
+	var vary []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary, true
+}
+
+// cacheRecorder passes a response through while keeping a copy of it, as
+// long as it stays within the cache's item size limit.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > rec.max {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func withCache(h http.Handler, c *responseCache) http.Handler {
+	if c == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cacheableRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		br := brownoutRuleFrom(r.Context())
+		if e := c.get(r, br != nil && br.Stale); e != nil {
+			for k, vs := range e.header {
+				w.Header()[k] = vs
+			}
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored)/time.Second)))
+			if time.Now().After(e.expires) {
+				w.Header().Set("X-Cache", "STALE")
+				w.Header().Set("Warning", `110 - "Response is Stale"`)
+			} else {
+				w.Header().Set("X-Cache", "HIT")
+			}
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{ResponseWriter: w, max: c.maxItem}
+		h.ServeHTTP(rec, r)
+		if rec.overflow || rec.status == 0 {
+			return
+		}
+
+		header := make(http.Header, len(w.Header()))
+		for k, vs := range w.Header() {
+			if k != "X-Cache" {
+				header[k] = append([]string(nil), vs...)
+			}
+		}
+		ttl := c.responseTTL(rec.status, header)
+		vary, ok := parseVary(header)
+		if ttl <= 0 || !ok {
+			return
+		}
+
+		now := time.Now()
+		c.put(r, &cacheEntry{
+			status:  rec.status,
+			header:  header,
+			body:    append([]byte(nil), rec.body.Bytes()...),
+			stored:  now,
+			expires: now.Add(ttl),
+		}, vary)
+	})
+}
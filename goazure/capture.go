@@ -0,0 +1,432 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+const (
+	captureMaxEntries = 1000
+	captureMaxBody    = 1 << 20
+)
+
+// captureRedacted are the headers whose values captures leave out.
+var captureRedacted = map[string]bool{
+	"Authorization":                true,
+	"Proxy-Authorization":          true,
+	"Cookie":                       true,
+	"Set-Cookie":                   true,
+	"X-Api-Key":                    true,
+	"X-Ms-Token-Aad-Id-Token":      true,
+	"X-Ms-Token-Aad-Access-Token":  true,
+	"X-Ms-Token-Aad-Refresh-Token": true,
+}
+
+// captureRedactedParams are the query parameters, in lower case, whose
+// values captures leave out: signatures of SAS URLs, OAuth codes and tokens,
+// and keys.
+var captureRedactedParams = map[string]bool{
+	"sig":           true,
+	"code":          true,
+	"access_token":  true,
+	"id_token":      true,
+	"refresh_token": true,
+	"token":         true,
+	"client_secret": true,
+	"password":      true,
+	"api_key":       true,
+	"apikey":        true,
+	"key":           true,
+}
+
+// capture records full request and response pairs while enabled through
+// /admin/capture, for up to limit requests whose path starts with path,
+// keeping at most bodyBytes of each body. The entries are kept once it
+// stops, until it is started again, and downloaded as a HAR file from
+// /admin/capture.har to be replayed or opened in browser developer tools.
+var capture struct {
+	sync.Mutex
+	enabled   bool
+	path      string
+	limit     int
+	bodyBytes int
+	started   time.Time
+	entries   []harEntry
+	gen       int // of the current capture, so that requests from a previous one do not fill its slots
+}
+
+type captureStatus struct {
+	Enabled   bool      `json:"enabled"`
+	Path      string    `json:"path,omitempty"`
+	Limit     int       `json:"limit"`
+	BodyBytes int       `json:"bodyBytes"`
+	Started   time.Time `json:"started,omitempty"`
+	Captured  int       `json:"captured"`
+}
+
+func currentCaptureStatus() captureStatus {
+	capture.Lock()
+	defer capture.Unlock()
+	return captureStatus{capture.enabled, capture.path, capture.limit, capture.bodyBytes, capture.started, len(capture.entries)}
+}
+
+// HAR 1.2, http://www.softwareishard.com/blog/har-12-spec/
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harPair   `json:"cookies"`
+	Headers     []harPair   `json:"headers"`
+	QueryString []harPair   `json:"queryString"`
+	PostData    *harContent `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harPair  `json:"cookies"`
+	Headers     []harPair  `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harContent serves as both the postData of requests and the content of
+// responses. Size is the full body size, Text at most -bodyBytes of it.
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harPair {
+	pairs := []harPair{}
+	for k, vs := range h {
+		for _, v := range vs {
+			if captureRedacted[k] {
+				v = "REDACTED"
+			} else if k == "Location" || k == "Referer" {
+				v = harURL(v)
+			}
+			pairs = append(pairs, harPair{k, v})
+		}
+	}
+	return pairs
+}
+
+// harQuery returns the pairs of a raw query in order, with the values of
+// captureRedactedParams left out, and the query made of them.
+func harQuery(rawQuery string) ([]harPair, string) {
+	pairs := []harPair{}
+	if rawQuery == "" {
+		return pairs, ""
+	}
+	parts := strings.Split(rawQuery, "&")
+	for i, p := range parts {
+		k, v, _ := strings.Cut(p, "=")
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		if captureRedactedParams[strings.ToLower(name)] {
+			v = "REDACTED"
+			parts[i] = k + "=" + v
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			value = v
+		}
+		pairs = append(pairs, harPair{name, value})
+	}
+	return pairs, strings.Join(parts, "&")
+}
+
+// harURL returns u with the values of captureRedactedParams left out, from
+// its query and from a fragment holding parameters as OAuth redirects do.
+func harURL(u string) string {
+	u, fragment, hasFragment := strings.Cut(u, "#")
+	if base, rawQuery, ok := strings.Cut(u, "?"); ok {
+		_, q := harQuery(rawQuery)
+		u = base + "?" + q
+	}
+	if hasFragment {
+		if strings.Contains(fragment, "=") {
+			_, fragment = harQuery(fragment)
+		}
+		u += "#" + fragment
+	}
+	return u
+}
+
+func harBody(b []byte, size int64, mimeType string) harContent {
+	c := harContent{Size: size, MimeType: mimeType}
+	if utf8.Valid(b) {
+		c.Text = string(b)
+	} else {
+		c.Text, c.Encoding = base64.StdEncoding.EncodeToString(b), "base64"
+	}
+	if int64(len(b)) < size {
+		c.Comment = "truncated to " + strconv.Itoa(len(b)) + " bytes"
+	}
+	return c
+}
+
+// capBuffer keeps the first max bytes written to it and counts the rest.
+type capBuffer struct {
+	bytes.Buffer
+	max  int
+	size int64
+}
+
+func (cb *capBuffer) Write(p []byte) (int, error) {
+	cb.size += int64(len(p))
+	if room := cb.max - cb.Len(); room > 0 {
+		if len(p) > room {
+			cb.Buffer.Write(p[:room])
+		} else {
+			cb.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// captureWriter tees what is written to the response into a capBuffer.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   *capBuffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(b)
+	cw.body.Write(b[:n])
+	return n, err
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// captureSlot reports whether r is to be captured, taking a slot if so.
+// The slot is identified by its index and the generation of the capture.
+func captureSlot(r *http.Request) (bodyBytes, slot, gen int, ok bool) {
+	capture.Lock()
+	defer capture.Unlock()
+	if !capture.enabled || !strings.HasPrefix(r.URL.Path, capture.path) {
+		return 0, 0, 0, false
+	}
+	// Reserve the slot so that concurrent requests do not go over limit.
+	capture.entries = append(capture.entries, harEntry{})
+	if len(capture.entries) >= capture.limit {
+		capture.enabled = false
+	}
+	return capture.bodyBytes, len(capture.entries) - 1, capture.gen, true
+}
+
+// withCapture records requests while capturing, except for health checks
+// and the admin API.
+func withCapture(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPriorityRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		bodyBytes, slot, gen, ok := captureSlot(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		reqBody := &capBuffer{max: bodyBytes}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		reqHeader := r.Header.Clone()
+		cw := &captureWriter{ResponseWriter: w, body: &capBuffer{max: bodyBytes}}
+		h.ServeHTTP(cw, r)
+		elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+		// Keep the part of the body the handler did not read too.
+		if r.Body != nil && reqBody.Len() < bodyBytes {
+			io.CopyN(ioutil.Discard, r.Body, int64(bodyBytes-reqBody.Len()))
+		}
+		if r.ContentLength > reqBody.size {
+			reqBody.size = r.ContentLength
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		e := harEntry{StartedDateTime: start, Time: elapsed, Timings: harTimings{Wait: elapsed}}
+		e.Request = harRequest{
+			Method:      r.Method,
+			URL:         harURL(scheme + "://" + r.Host + r.URL.RequestURI()),
+			HTTPVersion: r.Proto,
+			Cookies:     []harPair{},
+			Headers:     harHeaders(reqHeader),
+			HeadersSize: -1,
+			BodySize:    reqBody.size,
+		}
+		e.Request.QueryString, _ = harQuery(r.URL.RawQuery)
+		if reqBody.size > 0 {
+			body := harBody(reqBody.Bytes(), reqBody.size, reqHeader.Get("Content-Type"))
+			e.Request.PostData = &body
+		}
+		status := cw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		e.Response = harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: r.Proto,
+			Cookies:     []harPair{},
+			Headers:     harHeaders(w.Header()),
+			Content:     harBody(cw.body.Bytes(), cw.body.size, w.Header().Get("Content-Type")),
+			RedirectURL: harURL(w.Header().Get("Location")),
+			HeadersSize: -1,
+			BodySize:    cw.body.size,
+		}
+
+		capture.Lock()
+		if capture.gen == gen {
+			capture.entries[slot] = e
+		}
+		capture.Unlock()
+	})
+}
+
+// captureHandler reports, starts or stops the capture:
+//
+//	GET /admin/capture
+//	POST /admin/capture?enabled=true&limit=100&path=/api/&bodyBytes=65536
+//
+// Starting discards the entries of the previous capture.
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		q := r.URL.Query()
+		enabled, err := strconv.ParseBool(q.Get("enabled"))
+		if err != nil {
+			httpjson.Fail(w, r, http.StatusBadRequest, "enabled must be true or false")
+			return
+		}
+		limit, bodyBytes := 100, 64<<10
+		if v := q.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > captureMaxEntries {
+				httpjson.Fail(w, r, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(captureMaxEntries))
+				return
+			}
+		}
+		if v := q.Get("bodyBytes"); v != "" {
+			if bodyBytes, err = strconv.Atoi(v); err != nil || bodyBytes < 0 || bodyBytes > captureMaxBody {
+				httpjson.Fail(w, r, http.StatusBadRequest, "bodyBytes must be between 0 and "+strconv.Itoa(captureMaxBody))
+				return
+			}
+		}
+		path := q.Get("path")
+		if path != "" && !strings.HasPrefix(path, "/") {
+			httpjson.Fail(w, r, http.StatusBadRequest, "path must start with /")
+			return
+		}
+
+		capture.Lock()
+		if enabled {
+			capture.enabled, capture.path, capture.limit, capture.bodyBytes = true, path, limit, bodyBytes
+			capture.started, capture.entries = time.Now().UTC(), nil
+			capture.gen++
+		} else {
+			capture.enabled = false
+		}
+		capture.Unlock()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	httpjson.Write(w, http.StatusOK, currentCaptureStatus())
+}
+
+// captureHARHandler serves the captured requests as a HAR file:
+//
+//	GET /admin/capture.har
+func captureHARHandler(w http.ResponseWriter, r *http.Request) {
+	var har harLog
+	har.Log.Version = "1.2"
+	har.Log.Creator = harCreator{"go-azure-website", version}
+	har.Log.Entries = []harEntry{}
+	capture.Lock()
+	for _, e := range capture.entries {
+		if !e.StartedDateTime.IsZero() {
+			har.Log.Entries = append(har.Log.Entries, e)
+		}
+	}
+	capture.Unlock()
+	w.Header().Set("Content-Disposition", `attachment; filename="capture.har"`)
+	httpjson.Write(w, http.StatusOK, har)
+}
@@ -0,0 +1,74 @@
+package goazure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaptureRedactsQuery(t *testing.T) {
+	for u, want := range map[string]string{
+		"https://a.example/x":                             "https://a.example/x",
+		"https://a.example/x?page=2&sig=abc%2F&se=2030":   "https://a.example/x?page=2&sig=REDACTED&se=2030",
+		"https://a.example/cb?Code=123&state=s":           "https://a.example/cb?Code=REDACTED&state=s",
+		"https://a.example/cb#access_token=t&expires=300": "https://a.example/cb#access_token=REDACTED&expires=300",
+		"https://a.example/docs#section":                  "https://a.example/docs#section",
+	} {
+		if got := harURL(u); got != want {
+			t.Errorf("harURL(%q) = %q, want %q", u, got, want)
+		}
+	}
+
+	pairs, _ := harQuery("q=a+b&access_token=xyz")
+	if len(pairs) != 2 || pairs[0] != (harPair{"q", "a b"}) || pairs[1] != (harPair{"access_token", "REDACTED"}) {
+		t.Fatalf("got query string %v", pairs)
+	}
+}
+
+// TestCaptureGeneration restarts a capture while a request taken by the
+// previous one is in flight: it must not fill a slot of the new capture.
+func TestCaptureGeneration(t *testing.T) {
+	defer func() {
+		capture.Lock()
+		capture.enabled, capture.entries = false, nil
+		capture.Unlock()
+	}()
+	start := func() {
+		w := httptest.NewRecorder()
+		captureHandler(w, httptest.NewRequest("POST", "/admin/capture?enabled=true&limit=10", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("starting the capture: %d %s", w.Code, w.Body)
+		}
+	}
+
+	start()
+	inFlight, release := make(chan struct{}), make(chan struct{})
+	h := withCapture(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(inFlight)
+			<-release
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow?token=secret", nil))
+		close(done)
+	}()
+	<-inFlight
+
+	start()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	close(release)
+	<-done
+
+	w := httptest.NewRecorder()
+	captureHARHandler(w, httptest.NewRequest("GET", "/admin/capture.har", nil))
+	if strings.Contains(w.Body.String(), "/slow") {
+		t.Fatal("a request of the previous capture was recorded in the new one")
+	}
+	if !strings.Contains(w.Body.String(), "/fast") {
+		t.Fatal("the request of the new capture was not recorded")
+	}
+}
@@ -0,0 +1,248 @@
+package goazure
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// certEntry is a certificate served for a host name selected by SNI. Host is
+// an exact name or "*.domain" for any single-label subdomain of domain. The
+// certificate comes either from PEM files or from a Key Vault secret URL,
+// such as https://myvault.vault.azure.net/secrets/www, holding the
+// certificate chain and key as PEM.
+type certEntry struct {
+	Host     string `json:"host"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	KeyVault string `json:"keyVault,omitempty"`
+
+	current atomic.Value // *tls.Certificate
+	// version is the modification times of the files or the secret
+	// version last loaded.
+	version string
+}
+
+func (c *certEntry) validate() error {
+	c.Host = strings.ToLower(c.Host)
+	if c.Host == "" {
+		return errors.New("certificate needs a host")
+	}
+	switch {
+	case c.KeyVault != "" && c.Cert == "" && c.Key == "":
+		if !strings.HasPrefix(c.KeyVault, "https://") || !strings.Contains(c.KeyVault, "/secrets/") {
+			return fmt.Errorf("invalid Key Vault secret URL %q", c.KeyVault)
+		}
+	case c.KeyVault == "" && c.Cert != "" && c.Key != "":
+	default:
+		return errors.New("certificate needs either cert and key or keyVault")
+	}
+	return nil
+}
+
+func (c *certEntry) source() string {
+	if c.KeyVault != "" {
+		return c.KeyVault
+	}
+	return c.Cert
+}
+
+// load (re)loads the certificate if it changed, reporting whether it did.
+func (c *certEntry) load(kv *keyVault) (bool, error) {
+	if c.KeyVault != "" {
+		return c.loadKeyVault(kv)
+	}
+
+	var version string
+	for _, f := range []string{c.Cert, c.Key} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		version += fi.ModTime().String()
+	}
+	if version == c.version {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return false, err
+	}
+	c.current.Store(&cert)
+	c.version = version
+	return true, nil
+}
+
+func (c *certEntry) loadKeyVault(kv *keyVault) (bool, error) {
+	s, err := kv.secret(c.KeyVault)
+	if err != nil {
+		return false, err
+	}
+	if s.ID == c.version {
+		return false, nil
+	}
+	if s.ContentType == "application/x-pkcs12" {
+		return false, errors.New("PKCS#12 certificates are not supported, import the certificate as PEM")
+	}
+	cert, err := tls.X509KeyPair([]byte(s.Value), []byte(s.Value))
+	if err != nil {
+		return false, err
+	}
+	c.current.Store(&cert)
+	c.version = s.ID
+	return true, nil
+}
+
+// keyVault reads secrets from Azure Key Vault with the managed identity.
+type keyVault struct {
+	identity *managedIdentity
+	client   *http.Client
+}
+
+type keyVaultSecret struct {
+	ID          string `json:"id"`
+	Value       string `json:"value"`
+	ContentType string `json:"contentType"`
+}
+
+func newKeyVault(clientID string) *keyVault {
+	return &keyVault{
+		identity: newManagedIdentity("https://vault.azure.net", clientID),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// secret fetches the latest version of a secret, or the given one if the URL
+// names a version.
+func (kv *keyVault) secret(secretURL string) (*keyVaultSecret, error) {
+	token, err := kv.identity.get()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", secretURL+"?api-version=7.4", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := kv.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		kv.identity.invalidate()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Key Vault returned %s", resp.Status)
+	}
+	var s keyVaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// certStore selects the certificate for a TLS handshake by server name.
+type certStore struct {
+	entries []*certEntry
+	kv      *keyVault
+	// hasDefault is set when -tlsCert serves clients matching no entry.
+	hasDefault bool
+}
+
+func loadCertEntries(file string) ([]*certEntry, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*certEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	for i, c := range entries {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("certificate %d: %v", i, err)
+		}
+	}
+	return entries, nil
+}
+
+// newCertStore loads every certificate listed in file, failing if any of
+// them cannot be loaded.
+func newCertStore(file string, hasDefault bool) (*certStore, error) {
+	entries, err := loadCertEntries(file)
+	if err != nil {
+		return nil, err
+	}
+	cs := &certStore{entries: entries, kv: newKeyVault(config.IdentityClientID), hasDefault: hasDefault}
+	for _, c := range entries {
+		if _, err := c.load(cs.kv); err != nil {
+			return nil, fmt.Errorf("could not load certificate for %s from %s: %v", c.Host, c.source(), err)
+		}
+	}
+	return cs, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. An exact host name
+// takes precedence over a wildcard. Clients matching no entry get the
+// -tlsCert certificate, or that of the first entry if there is none.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	var wildcard *certEntry
+	for _, c := range cs.entries {
+		if c.Host == name {
+			return c.current.Load().(*tls.Certificate), nil
+		}
+		if wildcard == nil && strings.HasPrefix(c.Host, "*.") {
+			if i := strings.Index(name, "."); i > 0 && name[i:] == c.Host[1:] {
+				wildcard = c
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard.current.Load().(*tls.Certificate), nil
+	}
+	if cs.hasDefault || len(cs.entries) == 0 {
+		return nil, nil
+	}
+	return cs.entries[0].current.Load().(*tls.Certificate), nil
+}
+
+// watch reloads changed certificate files every fileInterval and Key Vault
+// certificates every vaultInterval, one host at a time, keeping the
+// certificate in use when a reload fails.
+func (cs *certStore) watch(fileInterval, vaultInterval time.Duration, stop <-chan struct{}) {
+	goBackground(func() {
+		lastVault := time.Now()
+		for {
+			select {
+			case <-time.After(fileInterval):
+			case <-stop:
+				return
+			}
+			vault := time.Since(lastVault) >= vaultInterval
+			if vault {
+				lastVault = time.Now()
+			}
+			for _, c := range cs.entries {
+				if c.KeyVault != "" && !vault {
+					continue
+				}
+				changed, err := c.load(cs.kv)
+				if err != nil {
+					log.Printf("Could not reload certificate for %s from %s: %v", c.Host, c.source(), err)
+				} else if changed {
+					log.Printf("Reloaded certificate for %s from %s", c.Host, c.source())
+				}
+			}
+		}
+	})
+}
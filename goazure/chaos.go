@@ -0,0 +1,141 @@
+package goazure
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var chaosFaults = newCounter("goazure_chaos_faults_total", "Faults injected by chaos rules")
+
+// chaosRule injects faults into a share of the matching requests, for
+// checking that clients cope with what a deployment may do to them. Rates
+// are fractions between 0 and 1.
+type chaosRule struct {
+	Path        string  `json:"path,omitempty"`
+	Header      string  `json:"header,omitempty"`
+	LatencyMs   int     `json:"latencyMs,omitempty"`
+	LatencyRate float64 `json:"latencyRate,omitempty"`
+	ResetRate   float64 `json:"resetRate,omitempty"`
+	ErrorRate   float64 `json:"errorRate,omitempty"`
+	Status      int     `json:"status,omitempty"`
+}
+
+func (c *chaosRule) validate() error {
+	for _, rate := range []float64{c.LatencyRate, c.ResetRate, c.ErrorRate} {
+		if rate < 0 || rate > 1 {
+			return errors.New("rates must be between 0 and 1")
+		}
+	}
+	if c.LatencyRate > 0 && c.LatencyMs <= 0 {
+		return errors.New("latencyRate requires latencyMs")
+	}
+	if c.Status == 0 {
+		c.Status = http.StatusInternalServerError
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to r. Path is a prefix, and
+// Header is either a header name that must be present or Name=value.
+func (c *chaosRule) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, c.Path) {
+		return false
+	}
+	if c.Header == "" {
+		return true
+	}
+	if i := strings.Index(c.Header, "="); i >= 0 {
+		return r.Header.Get(c.Header[:i]) == c.Header[i+1:]
+	}
+	return r.Header.Get(c.Header) != ""
+}
+
+func loadChaosRules(file string) ([]*chaosRule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*chaosRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for i, c := range rules {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("chaos rule %d: %v", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// withChaos applies the first chaos rule matching a request. Health and
+// readiness checks and admin endpoints are never affected.
+func withChaos(h http.Handler, rules []*chaosRule) http.Handler {
+	if len(rules) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		for _, c := range rules {
+			if !c.matches(r) {
+				continue
+			}
+			if c.LatencyRate > 0 && rand.Float64() < c.LatencyRate {
+				chaosFaults.inc()
+				w.Header().Add("X-Chaos-Injected", "latency")
+				select {
+				case <-time.After(time.Duration(c.LatencyMs) * time.Millisecond):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if c.ResetRate > 0 && rand.Float64() < c.ResetRate {
+				chaosFaults.inc()
+				if resetConnection(w) {
+					return
+				}
+			}
+			if c.ErrorRate > 0 && rand.Float64() < c.ErrorRate {
+				chaosFaults.inc()
+				w.Header().Add("X-Chaos-Injected", "error")
+				http.Error(w, http.StatusText(c.Status), c.Status)
+				return
+			}
+			break
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// resetConnection aborts the client connection with a TCP reset, reporting
+// false if the connection could not be taken over.
+func resetConnection(w http.ResponseWriter) bool {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return false
+	}
+	c := conn
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if sc, ok := c.(semConn); ok {
+		c = sc.Conn
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,431 @@
+package goazure
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// command is a subcommand given as the first argument. Without one the
+// arguments are handled by serve.
+type command struct {
+	name string
+	args string
+	run  func(args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags] <dir_to_watch>", runServe},
+		{"check", "[flags] <dir_to_watch>", runCheck},
+		{"version", "", runVersion},
+		{"selftest", "[-v] [flags]", runSelftest},
+		{"replay-events", "[flags] <events_file>", runReplayEvents},
+		{"bench", "[-concurrency n] [-duration s] [-n count] [-rate r] [-method m] [-body b] [-header h] [flags] <url_or_path>", runBench},
+		{"replay", "-target url [-concurrency n] [-rate r] [-host h] [-methods m] [-header h] [-v] <har_or_log_file>", runReplay},
+		{"config", "dump [-format json|yaml] [flags] [dir_to_watch] | schema rules|vhosts|headers|chaos|plugins | openapi", runConfig},
+		{"status", "[-port n] [-adminToken t] [-json]", runStatus},
+		{"top", "[-port n] [-adminToken t] [-interval s]", runTop},
+		{"drain", "[-port n] [-adminToken t] [-json]", runDrain},
+		{"simulate", "[-port n] [-adminToken t] [-wait]", runSimulate},
+		{"rollback", "[-port n] [-adminToken t] [-to hash]", runRollback},
+		{"init", "arm [-kind appservice|containerapp] [-format bicep|json] [-os windows|linux] [-name name] [-o file] [flags] [dir_to_watch]", runInit},
+		{"init", "azure [-os windows|linux] [-o file] [flags] [dir_to_watch]", runInit},
+		{"init", "docker [-o file] [flags] [dir_to_watch]", runInit},
+		{"init", "systemd [-unit service|socket] [-watchdogSec s] [-o file] [flags] [dir_to_watch]", runInit},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// commandFlags returns a flag set for the named subcommand that shares the
+// server flags, so that a command sees the same configuration as serve.
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// runCheck implements the "check" subcommand, which loads everything the
+// given flags refer to and reports problems without serving.
+func runCheck(args []string) {
+	fs := commandFlags("check")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		printUsage()
+	}
+	config.WatchDir = fs.Arg(0)
+
+	var errs []error
+	if err := setSecretsFromEnv(fs); err != nil {
+		errs = append(errs, err)
+	}
+	if fi, err := os.Stat(config.WatchDir); err != nil {
+		errs = append(errs, err)
+	} else if !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("%s is not a directory", config.WatchDir))
+	}
+	if _, err := defineHandlers(); err != nil {
+		errs = append(errs, err)
+	}
+	if tlsEnabled() {
+		if config.TLSCert != "" {
+			if _, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey); err != nil {
+				errs = append(errs, fmt.Errorf("could not load TLS certificate: %v", err))
+			}
+		}
+		if config.CertsFile != "" {
+			if _, err := loadCertEntries(config.CertsFile); err != nil {
+				errs = append(errs, fmt.Errorf("could not load certificates: %v", err))
+			}
+		}
+	} else if config.HTTPRedirectPort > 0 {
+		errs = append(errs, errors.New("-httpRedirectPort requires -tlsCert and -tlsKey or -certs"))
+	}
+	if config.TicketKeyDir != "" && config.TicketKeyRotation <= 0 {
+		errs = append(errs, errors.New("-ticketKeyDir requires -ticketKeyRotation"))
+	}
+	if config.CDNPurge != "" {
+		if _, err := newCDNPurger(config.CDNPurge, config.CDNPurgePaths, config.IdentityClientID); err != nil {
+			errs = append(errs, err)
+		}
+		if config.HistoryFile == "" {
+			errs = append(errs, errors.New("-cdnPurge requires -historyFile"))
+		}
+	}
+	if config.RotationHook != "" {
+		if _, err := newRotationHook(config.RotationHook); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := parseDrainPolicies(config.DrainPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if len(config.WaitFor) > 0 && config.WaitForTimeout <= 0 {
+		errs = append(errs, errors.New("-waitFor requires a positive -waitForTimeout"))
+	}
+	if config.TemplatesDir != "" {
+		if _, err := loadTemplates(config.TemplatesDir); err != nil {
+			errs = append(errs, fmt.Errorf("could not load templates: %v", err))
+		}
+	}
+	if config.UploadRoutes != "" {
+		if _, err := loadUploadRoutes(config.UploadRoutes); err != nil {
+			errs = append(errs, fmt.Errorf("could not load upload routes: %v", err))
+		}
+	}
+	if config.StaticBlob != "" {
+		if config.StaticDir != "" {
+			errs = append(errs, errors.New("-staticBlob and -staticDir are exclusive"))
+		}
+		if _, err := newBlobContainer(config.StaticBlob, config.IdentityClientID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch config.LogFormat {
+	case logFormatAuto, logFormatPlain, logFormatDev, logFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("unknown -logFormat %q, expected auto, plain, dev or json", config.LogFormat))
+	}
+	if config.DeployQueue != "" {
+		if _, err := newQueueSource(config.DeployQueue, config.DeployQueuePoison); err != nil {
+			errs = append(errs, fmt.Errorf("could not create deployment queue source: %v", err))
+		}
+	}
+	if cs := os.Getenv("AZURE_APPCONFIG_CONNECTION_STRING"); cs != "" {
+		if _, err := newAppConfig(cs, config.AppConfigPrefix, config.AppConfigLabel); err != nil {
+			errs = append(errs, fmt.Errorf("could not configure App Configuration: %v", err))
+		}
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("Configuration OK")
+}
+
+// runVersion implements the "version" subcommand.
+func runVersion(args []string) {
+	fmt.Printf("go-azure-website %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if h, err := executableHash(); err == nil {
+		fmt.Printf("sha256 %s\n", h)
+	}
+}
+
+// runStatus implements the "status" subcommand, which prints the status of
+// the local server.
+func runStatus(args []string) {
+	fs := commandFlags("status")
+	asJSON := fs.Bool("json", false, "Print the raw JSON status")
+	fs.Parse(args)
+	locateAdmin(fs)
+
+	b, err := adminRequest(http.MethodGet, "/admin/status")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		os.Stdout.Write(b)
+		return
+	}
+	var s serverStatus
+	if err := json.Unmarshal(b, &s); err != nil {
+		log.Fatal(err)
+	}
+	printStatus(os.Stdout, s)
+}
+
+// runDrain implements the "drain" subcommand, which asks the local server to
+// drain and exit so that the platform restarts it.
+func runDrain(args []string) {
+	fs := commandFlags("drain")
+	asJSON := fs.Bool("json", false, "Print the raw JSON response")
+	fs.Parse(args)
+	locateAdmin(fs)
+
+	b, err := adminRequest(http.MethodPost, "/admin/drain")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		os.Stdout.Write(b)
+		return
+	}
+	var d struct {
+		AlreadyDraining bool `json:"alreadyDraining"`
+		MaxWait         int  `json:"maxWait"`
+	}
+	json.Unmarshal(b, &d)
+	if d.AlreadyDraining {
+		fmt.Println("Server is already draining")
+		return
+	}
+	fmt.Printf("Server is draining, waiting up to %d seconds for clients\n", d.MaxWait)
+}
+
+func printStatus(w io.Writer, s serverStatus) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	row := func(k, format string, args ...interface{}) {
+		fmt.Fprintf(tw, "%s\t"+format+"\n", append([]interface{}{k}, args...)...)
+	}
+	row("Instance", "%s", s.Instance)
+	row("Version", "%s", s.Version)
+	row("Started", "%s (up %s)", s.Started.Format(time.RFC3339), s.Uptime)
+	if s.ArtifactHash != "" {
+		row("Artifact", "%.12s", s.ArtifactHash)
+	}
+	row("Watching", "%s storage, %s mode", s.StorageMode, s.WatchMode)
+	if s.DeployWindows != "" {
+		row("Deploy windows", "%s", s.DeployWindows)
+	}
+	if p := s.PendingDeployment; p != nil {
+		switch {
+		case p.Handover:
+			row("Pending", "%s, for the next process", p.Artifact)
+		case p.ScheduledAt != nil:
+			row("Pending", "%s, at %s", p.Artifact, p.ScheduledAt.Format(time.RFC3339))
+		default:
+			row("Pending", "%s, no deployment window", p.Artifact)
+		}
+	}
+	row("Draining", "%t", s.Draining)
+	row("Connections", "%d", s.Connections)
+	row("Requests", "%d", s.Requests)
+	if s.Workers != nil {
+		row("Workers", "%d/%d busy, %d queued", s.Workers.Active, s.Workers.Size, s.Workers.Queued)
+	}
+	row("Maintenance", "%t", s.Maintenance)
+	for _, k := range sortedKeys(s.Settings) {
+		row("Setting", "%s=%s", k, s.Settings[k])
+	}
+	features := make(map[string]string, len(s.Features))
+	for k, on := range s.Features {
+		features[k] = strconv.FormatBool(on)
+	}
+	for _, k := range sortedKeys(features) {
+		row("Feature", "%s=%s", k, features[k])
+	}
+	tw.Flush()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runSimulate implements the "simulate" subcommand, which rehearses a
+// deployment on the local server without a new artifact. With -wait it
+// follows the server through the restart and reports what held up the
+// drain.
+func runSimulate(args []string) {
+	fs := commandFlags("simulate")
+	wait := fs.Bool("wait", false, "Wait for the restart and report what held up the drain, which the server keeps across restarts with -historyFile")
+	fs.Parse(args)
+	locateAdmin(fs)
+
+	requested := time.Now()
+	if _, err := adminRequest(http.MethodPost, "/admin/simulate"); err != nil {
+		log.Fatal(err)
+	}
+	if !*wait {
+		fmt.Println("Simulated deployment accepted, see go-azure-website top or /admin/deployments for the drain")
+		return
+	}
+	fmt.Println("Simulated deployment accepted, waiting for the drain")
+	for deadline := time.Now().Add(10 * time.Minute); time.Now().Before(deadline); {
+		time.Sleep(time.Second)
+		// The next process may publish another port.
+		locateAdmin(fs)
+		b, err := adminRequest(http.MethodGet, "/admin/deployments")
+		if err != nil {
+			continue
+		}
+		var events []deployEvent
+		json.Unmarshal(b, &events)
+		for i := len(events) - 1; i >= 0 && events[i].Time.After(requested); i-- {
+			if e := events[i]; e.Kind == eventRestart || e.Kind == eventForcedTermination {
+				printDrainOutcome(os.Stdout, e)
+				return
+			}
+		}
+		var s serverStatus
+		if b, err := adminRequest(http.MethodGet, "/admin/status"); err == nil && json.Unmarshal(b, &s) == nil && s.Started.After(requested) {
+			log.Fatal("Server restarted without a record of the drain, run it with -historyFile to keep it")
+		}
+	}
+	log.Fatal("No drain after 10 minutes, see /admin/status for a pending deployment")
+}
+
+func printDrainOutcome(w io.Writer, e deployEvent) {
+	if e.Kind == eventForcedTermination {
+		fmt.Fprintf(w, "Drain cut short after %s (%s)\n", e.Duration, e.Outcome)
+	} else {
+		fmt.Fprintf(w, "Drained in %s\n", e.Duration)
+	}
+	if e.Drain == nil {
+		fmt.Fprintln(w, "No connection held up the drain")
+		return
+	}
+	printDrainReport(w, e.Drain)
+}
+
+// runRollback implements the "rollback" subcommand, which asks the local
+// server to restart on a previously deployed artifact.
+func runRollback(args []string) {
+	fs := commandFlags("rollback")
+	to := fs.String("to", "", "Hash prefix of the deployment to roll back to, the previous one if empty")
+	fs.Parse(args)
+	locateAdmin(fs)
+
+	path := "/admin/rollback"
+	if *to != "" {
+		path += "?to=" + *to
+	}
+	b, err := adminRequest(http.MethodPost, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(b)
+}
+
+// adminTLS is set by locateAdmin when the local server serves HTTPS.
+var adminTLS bool
+
+var adminClient = loopbackClient(10 * time.Second)
+
+// locateAdmin finds the port of the local server, preferring -port, then the
+// endpoint published by a running server, then the port App Service assigns.
+// The admin token is read from the environment too unless given on fs.
+func locateAdmin(fs *flag.FlagSet) {
+	if err := setSecretsFromEnv(fs); err != nil {
+		log.Fatal(err)
+	}
+	adminTLS = tlsEnabled()
+	explicit := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			explicit = true
+		}
+	})
+	if explicit {
+		return
+	}
+	if e, ok := readAdminEndpoint(); ok {
+		config.Port, adminTLS = e.Port, e.TLS
+		return
+	}
+	for _, env := range []string{"HTTP_PLATFORM_PORT", "PORT"} {
+		if p, err := strconv.Atoi(os.Getenv(env)); err == nil && p > 0 {
+			config.Port = p
+			return
+		}
+	}
+}
+
+// adminRequest calls an admin endpoint of the local server and returns the
+// response body.
+func adminRequest(method, path string) ([]byte, error) {
+	scheme := "http"
+	if adminTLS {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://127.0.0.1:%d%s", scheme, config.Port, path)
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.AdminToken)
+	}
+
+	resp, err := adminClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct{ Error httpjson.Error }
+		if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Error.Message)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
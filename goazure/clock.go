@@ -0,0 +1,14 @@
+package goazure
+
+import "github.com/hruan/go-azure/goazure/internal/clock"
+
+// Clock is the source of time for drain timeouts and deployment scheduling,
+// so that tests can expire them without waiting. goazuretest.FakeClock is
+// one that only moves when advanced.
+type Clock = clock.Clock
+
+// ClockTimer is a timer created by Clock.AfterFunc.
+type ClockTimer = clock.Timer
+
+// clk is the clock in use, set from Config by Run.
+var clk Clock = clock.Real{}
@@ -0,0 +1,130 @@
+package goazure
+
+import (
+	"net/http"
+	"sync"
+)
+
+const maxCoalescedBody = 1 << 20
+
+var requestsCoalesced = newCounter("goazure_requests_coalesced_total", "GET requests answered from a concurrent identical request")
+
+type flight struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+	ok     bool
+}
+
+// coalescer lets concurrent identical GETs share one upstream call. The
+// first request is handled normally while its response is recorded; the
+// others wait and replay it, or are handled themselves if the response
+// turned out too large to record.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{flights: map[string]*flight{}}
+}
+
+// coalescedHeaders are the request headers a coalesced response may vary
+// on, as they are part of the key.
+var coalescedHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+func coalesceKey(r *http.Request) (string, bool) {
+	if r.Method != "GET" || r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return "", false
+	}
+	key := r.Host + r.URL.RequestURI()
+	for _, name := range coalescedHeaders {
+		key += "\x00" + r.Header.Get(name)
+	}
+	return key, true
+}
+
+// shareable reports whether a response may be replayed to the requests
+// coalesced with the one it answered, which it may not if it is private to
+// that client, as when it sets a cookie, or varies on other headers.
+func shareable(h http.Header) bool {
+	if privateResponse(h) {
+		return false
+	}
+	vary, ok := parseVary(h)
+	if !ok {
+		return false
+	}
+	for _, name := range vary {
+		found := false
+		for _, k := range coalescedHeaders {
+			found = found || name == k
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *coalescer) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := coalesceKey(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		c.mu.Lock()
+		f, inFlight := c.flights[key]
+		if !inFlight {
+			f = &flight{done: make(chan struct{})}
+			c.flights[key] = f
+		}
+		c.mu.Unlock()
+
+		if inFlight {
+			select {
+			case <-f.done:
+			case <-r.Context().Done():
+				return
+			}
+			if !f.ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+			requestsCoalesced.inc()
+			for k, vs := range f.header {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(f.status)
+			w.Write(f.body)
+			return
+		}
+
+		rec := &cacheRecorder{ResponseWriter: w, max: maxCoalescedBody}
+		defer func() {
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+
+			if !rec.overflow && rec.status != 0 && shareable(w.Header()) {
+				f.status = rec.status
+				f.header = cloneHeader(w.Header())
+				f.body = append([]byte(nil), rec.body.Bytes()...)
+				f.ok = true
+			}
+			close(f.done)
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vs := range h {
+		c[k] = append([]string(nil), vs...)
+	}
+	return c
+}
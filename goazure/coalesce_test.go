@@ -0,0 +1,73 @@
+package goazure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// coalesced sends n concurrent identical GETs through a coalescer to a
+// handler setting header, and returns how often the handler ran.
+func coalesced(t *testing.T, n int, header http.Header) int64 {
+	t.Helper()
+	var calls int64
+	release := make(chan struct{})
+	h := newCoalescer().wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-release
+		}
+		for k, vs := range header {
+			w.Header()[k] = vs
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+			if w.Body.String() != "hello" {
+				t.Errorf("got body %q", w.Body.String())
+			}
+		}()
+		if i == 0 {
+			for atomic.LoadInt64(&calls) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	// Give the others time to join the flight of the first.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return atomic.LoadInt64(&calls)
+}
+
+func TestCoalesceShares(t *testing.T) {
+	header := http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}
+	if calls := coalesced(t, 5, header); calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+}
+
+func TestCoalesceKeepsPrivateResponses(t *testing.T) {
+	for name, header := range map[string]http.Header{
+		"Set-Cookie": {"Set-Cookie": {"session=abc"}},
+		"private":    {"Cache-Control": {"private, max-age=60"}},
+		"no-store":   {"Cache-Control": {"no-store"}},
+		"Vary":       {"Vary": {"User-Agent"}},
+		"Vary *":     {"Vary": {"*"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if calls := coalesced(t, 5, header); calls != 5 {
+				t.Fatalf("handler ran %d times, want 5", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package goazure
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const minCompressSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding allows enc.
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if name != enc && name != "*" {
+			continue
+		}
+		for _, p := range fields[1:] {
+			p = strings.Replace(p, " ", "", -1)
+			if p == "q=0" || p == "q=0.0" || p == "q=0.00" || p == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func compressible(contentType string) bool {
+	ct, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(ct, "text/"):
+		return true
+	case strings.HasSuffix(ct, "+xml"), strings.HasSuffix(ct, "+json"):
+		return true
+	}
+	switch ct {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml", "application/wasm":
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses everything written through it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	h := g.Header()
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if status != http.StatusNotModified && status != http.StatusNoContent {
+		h.Set("Content-Encoding", "gzip")
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	return g.gz.Write(b)
+}
+
+// serveCompressed serves a precompressed .br or .gz sibling of name if the
+// client accepts it, falling back to on-the-fly gzip for compressible
+// content. It returns false if the response should be served uncompressed.
+func (s *staticHandler) serveCompressed(w http.ResponseWriter, r *http.Request, f http.File, name string, fi os.FileInfo) bool {
+	ct := mime.TypeByExtension(path.Ext(name))
+
+	for _, v := range []struct{ enc, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+		if !acceptsEncoding(r, v.enc) {
+			continue
+		}
+		cf, cfi, err := s.open(name + v.ext)
+		if err != nil {
+			continue
+		}
+		defer cf.Close()
+
+		tag, err := s.etagFor(cf, name+v.ext, cfi)
+		if err != nil {
+			continue
+		}
+		h := w.Header()
+		h.Add("Vary", "Accept-Encoding")
+		h.Set("Content-Encoding", v.enc)
+		h.Set("ETag", tag)
+		if ct != "" {
+			h.Set("Content-Type", ct)
+		}
+		http.ServeContent(w, r, name, cfi.ModTime(), cf)
+		return true
+	}
+
+	if fi.Size() < minCompressSize || !compressible(ct) || r.Header.Get("Range") != "" || !acceptsEncoding(r, "gzip") {
+		return false
+	}
+
+	tag, err := s.etagFor(f, name, fi)
+	if err != nil {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	h.Set("ETag", strings.TrimSuffix(tag, `"`)+`-gzip"`)
+	h.Set("Content-Type", ct)
+
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(w)
+	defer func() {
+		gz.Close()
+		gz.Reset(io.Discard)
+		gzipWriters.Put(gz)
+	}()
+	http.ServeContent(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r, name, fi.ModTime(), f)
+	return true
+}
@@ -0,0 +1,361 @@
+package goazure
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// configEnv lists the environment variables the server reads.
+var configEnv = []string{
+	"AZURE_APPCONFIG_CONNECTION_STRING",
+	"GOAZURE_ADMIN_TOKEN",
+	"GOAZURE_DEPLOY_QUEUE",
+	"GOAZURE_DEPLOY_QUEUE_POISON",
+	"GOAZURE_ROTATION_HOOK",
+	"GOAZURE_SLO_WEBHOOK",
+	"GOAZURE_STATIC_BLOB",
+	"GOMAXPROCS",
+	"GOMEMLIMIT",
+	"HOME",
+	"IDENTITY_ENDPOINT",
+	"LISTEN_FDS",
+	"NOTIFY_SOCKET",
+	"TERMINATION_GRACE_PERIOD_SECONDS",
+	"WATCHDOG_USEC",
+	"WEBROOT_PATH",
+	"WEBSITES_CONTAINER_STOP_TIME_LIMIT",
+	"WEBSITE_INSTANCE_ID",
+	"WEBSITE_LOCAL_CACHE_OPTION",
+	"WEBSITE_MEMORY_LIMIT_MB",
+	"WEBSITE_SITE_NAME",
+}
+
+// configFiles maps the names accepted by "config schema" to the element type
+// of the JSON arrays read from the corresponding config files.
+var configFiles = map[string]interface{}{
+	"rules":    rule{},
+	"vhosts":   vhost{},
+	"headers":  headerRule{},
+	"chaos":    chaosRule{},
+	"plugins":  plugin{},
+	"certs":    certEntry{},
+	"brownout": brownoutRule{},
+	"uploads":  uploadRoute{},
+}
+
+// runConfig implements the "config" subcommand.
+func runConfig(args []string) {
+	if len(args) < 1 {
+		printUsage()
+	}
+	switch args[0] {
+	case "dump":
+		runConfigDump(args[1:])
+	case "openapi":
+		b, _ := json.MarshalIndent(openAPISpec(), "", "  ")
+		fmt.Printf("%s\n", b)
+	case "schema":
+		if len(args) < 2 || configFiles[args[1]] == nil {
+			log.Fatalf("Usage: go-azure-website config schema %s", strings.Join(configFileNames(), "|"))
+		}
+		b, _ := json.MarshalIndent(fileSchema(args[1], configFiles[args[1]]), "", "  ")
+		fmt.Printf("%s\n", b)
+	default:
+		log.Fatalf("Unknown config action %q", args[0])
+	}
+}
+
+func configFileNames() []string {
+	var names []string
+	for n := range configFiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runConfigDump prints the configuration resolved from the given flags,
+// their defaults and the environment, with secrets redacted.
+func runConfigDump(args []string) {
+	fs := commandFlags("config dump")
+	format := fs.String("format", "json", "Output format: json or yaml")
+	fs.Parse(args)
+	if err := setSecretsFromEnv(fs); err != nil {
+		log.Fatal(err)
+	}
+	config.WatchDir = fs.Arg(0)
+
+	doc := configDump()
+	switch *format {
+	case "json":
+		b, _ := json.MarshalIndent(doc, "", "  ")
+		fmt.Printf("%s\n", b)
+	case "yaml":
+		writeYAML(os.Stdout, doc, 0)
+	default:
+		log.Fatalf("Unknown format %q", *format)
+	}
+}
+
+// configDump returns the resolved flags, environment and derived settings.
+func configDump() map[string]interface{} {
+	flags := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = redactFlag(f.Name, flagValue(f.Value))
+	})
+	env := make(map[string]interface{})
+	for _, k := range configEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			env[k] = redactEnv(k, v)
+		}
+	}
+	storage := storageMode(config.WatchDir)
+	derived := map[string]interface{}{
+		"instance":    instanceID,
+		"storageMode": storage,
+		"watchMode":   watchModeFor(config.WatchMode, storage),
+		"profileDir":  profileDir(),
+	}
+	return map[string]interface{}{
+		"watchDir":    config.WatchDir,
+		"flags":       flags,
+		"environment": env,
+		"derived":     derived,
+	}
+}
+
+// configHandler serves the configuration as "config dump" prints it:
+//
+//	GET /admin/config
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	httpjson.Write(w, http.StatusOK, configDump())
+}
+
+// flagValue returns the typed value of builtin flags and the string form of
+// the others.
+func flagValue(v flag.Value) interface{} {
+	if g, ok := v.(flag.Getter); ok {
+		return g.Get()
+	}
+	return v.String()
+}
+
+const redacted = "REDACTED"
+
+// secretFlags hold credentials. Each can be set in the environment instead,
+// as named by secretEnv, so that deployments keep them off command lines.
+var secretFlags = []string{"adminToken", "deployQueue", "deployQueuePoison", "rotationHook", "sloWebhook", "staticBlob"}
+
+func isSecretFlag(name string) bool {
+	for _, s := range secretFlags {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// secretEnv returns the environment variable of a secret flag, such as
+// GOAZURE_ADMIN_TOKEN for -adminToken.
+func secretEnv(name string) string {
+	var b strings.Builder
+	b.WriteString("GOAZURE_")
+	for i, r := range name {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToUpper(b.String())
+}
+
+// setSecretsFromEnv sets the secret flags not given on fs from the
+// environment.
+func setSecretsFromEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, name := range secretFlags {
+		v, ok := os.LookupEnv(secretEnv(name))
+		if !ok || given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("%s: %v", secretEnv(name), err)
+		}
+	}
+	return nil
+}
+
+func redactFlag(name string, v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return v
+	}
+	switch name {
+	case "adminToken":
+		return redacted
+	case "deployQueue", "deployQueuePoison", "staticBlob", "logAnalytics":
+		return redactURL(s)
+	case "sloWebhook", "rotationHook":
+		return redactWebhook(s)
+	case "dependency", "waitFor":
+		// Comma separated URLs, each possibly after NAME=.
+		parts := strings.Split(s, ",")
+		for i, p := range parts {
+			if j := strings.Index(p, "://"); j >= 0 {
+				k := strings.LastIndex(p[:j], "=") + 1
+				parts[i] = p[:k] + redactURL(p[k:])
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return v
+}
+
+func redactEnv(name, v string) string {
+	for _, f := range secretFlags {
+		if name == secretEnv(f) {
+			return redactFlag(f, v).(string)
+		}
+	}
+	if name != "AZURE_APPCONFIG_CONNECTION_STRING" {
+		return v
+	}
+	parts := strings.Split(v, ";")
+	for i, p := range parts {
+		if strings.HasPrefix(p, "Secret=") {
+			parts[i] = "Secret=" + redacted
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// redactURL hides the credentials of a URL and the values of its query,
+// such as the signature of a SAS URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	q := u.Query()
+	for k := range q {
+		q[k] = []string{redacted}
+	}
+	u.RawQuery = q.Encode()
+	u.Fragment = ""
+	return u.String()
+}
+
+// redactWebhook hides the path of a webhook URL too, as services such as
+// Slack and Teams embed the secret in it. Values that are not URLs are
+// kept.
+func redactWebhook(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(redactURL(s))
+	if err != nil {
+		return redacted
+	}
+	if u.Path != "" && u.Path != "/" {
+		u.Path, u.RawPath = "/"+redacted, ""
+	}
+	return u.String()
+}
+
+// writeYAML writes the maps and scalars making up a config dump as YAML.
+func writeYAML(w io.Writer, v interface{}, indent int) {
+	m := v.(map[string]interface{})
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pad := strings.Repeat("  ", indent)
+	for _, k := range keys {
+		switch v := m[k].(type) {
+		case map[string]interface{}:
+			if len(v) == 0 {
+				fmt.Fprintf(w, "%s%s: {}\n", pad, k)
+				continue
+			}
+			fmt.Fprintf(w, "%s%s:\n", pad, k)
+			writeYAML(w, v, indent+1)
+		case string:
+			fmt.Fprintf(w, "%s%s: %s\n", pad, k, strconv.Quote(v))
+		default:
+			fmt.Fprintf(w, "%s%s: %v\n", pad, k, v)
+		}
+	}
+}
+
+// fileSchema derives a JSON Schema for a config file holding an array of
+// elements shaped like elem from its json tags.
+func fileSchema(name string, elem interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   "go-azure-website " + name + " file",
+		"type":    "array",
+		"items":   typeSchema(reflect.TypeOf(elem)),
+	}
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if f.PkgPath != "" || tag == "" || tag == "-" {
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			props[parts[0]] = typeSchema(f.Type)
+			if len(parts) == 1 {
+				required = append(required, parts[0])
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,321 @@
+package goazure
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnTracker is what we track about an accepted connection. Handlers find
+// it with ConnFromContext and may tag the connection, which selects the drain
+// policy applied to it and is counted on /admin/status.
+type ConnTracker struct {
+	start    time.Time
+	requests int64
+	bytesIn  int64
+	bytesOut int64
+	once     sync.Once
+	listener *groupListener // that accepted it, nil outside of Run
+	conn     net.Conn       // unwrapped, closed by drain policies
+	maxAge   time.Duration  // -maxConnAge with jitter, unlimited if 0
+	inFlight int64
+	agedOut  int32
+	state    int32 // http.ConnState, as reported to connState
+	h2       int32 // set once HTTP/2 was negotiated
+	writing  int64 // UnixNano start of the write in progress, 0 if none
+
+	mu       sync.Mutex
+	tags     []string
+	protocol string // of the first request, such as HTTP/1.1
+	tls      *tls.ConnectionState
+	request  string // the latest, such as "GET /index.html"
+	since    time.Time
+}
+
+// liveConns holds the ConnTracker of every open connection.
+var liveConns sync.Map
+
+// Tag adds tag to the connection.
+func (cs *ConnTracker) Tag(tag string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, t := range cs.tags {
+		if t == tag {
+			return
+		}
+	}
+	cs.tags = append(cs.tags, tag)
+}
+
+// Tags returns the tags of the connection.
+func (cs *ConnTracker) Tags() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return append([]string(nil), cs.tags...)
+}
+
+// Start returns when the connection was accepted.
+func (cs *ConnTracker) Start() time.Time { return cs.start }
+
+// Requests returns the number of requests received on the connection.
+func (cs *ConnTracker) Requests() int64 { return atomic.LoadInt64(&cs.requests) }
+
+// Protocol returns the protocol negotiated on the connection, empty until
+// its first request.
+func (cs *ConnTracker) Protocol() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.protocol
+}
+
+// TLS returns the state of the TLS connection, nil for plain connections.
+func (cs *ConnTracker) TLS() *tls.ConnectionState {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.tls
+}
+
+// observe records the protocol and TLS state from the first request, and
+// the latest request for drain reports.
+func (cs *ConnTracker) observe(r *http.Request) {
+	cs.mu.Lock()
+	if cs.protocol == "" {
+		cs.protocol, cs.tls = r.Proto, r.TLS
+	}
+	cs.request, cs.since = r.Method+" "+r.URL.Path, time.Now()
+	cs.mu.Unlock()
+}
+
+// latest returns the latest request on the connection and when it came.
+func (cs *ConnTracker) latest() (string, time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.request, cs.since
+}
+
+var (
+	connDuration = newHistogram("goazure_connection_duration_seconds", "Lifetime of client connections",
+		exponentialBuckets(0.01, 4, 10))
+	connBytesIn = newHistogram("goazure_connection_received_bytes", "Bytes received per client connection",
+		exponentialBuckets(256, 4, 10))
+	connBytesOut = newHistogram("goazure_connection_sent_bytes", "Bytes sent per client connection",
+		exponentialBuckets(256, 4, 12))
+	connRequests = newHistogram("goazure_connection_requests", "Requests served per client connection",
+		exponentialBuckets(1, 2, 10))
+	requestsTotal  = newCounter("goazure_requests_total", "Requests received")
+	activeConns    int64
+	activeRequests int64
+)
+
+func init() {
+	newGaugeFunc("goazure_active_connections", "Open client connections", func() float64 {
+		return float64(atomic.LoadInt64(&activeConns))
+	})
+}
+
+func (cs *ConnTracker) opened() {
+	atomic.AddInt64(&activeConns, 1)
+	liveConns.Store(cs, struct{}{})
+	if cs.listener != nil {
+		cs.listener.opened()
+	}
+}
+
+func (cs *ConnTracker) closed() {
+	atomic.AddInt64(&activeConns, -1)
+	liveConns.Delete(cs)
+	if cs.listener != nil {
+		cs.listener.closed()
+	}
+	connClosed()
+	connDuration.observe(time.Since(cs.start).Seconds())
+	connBytesIn.observe(float64(atomic.LoadInt64(&cs.bytesIn)))
+	connBytesOut.observe(float64(atomic.LoadInt64(&cs.bytesOut)))
+	connRequests.observe(float64(atomic.LoadInt64(&cs.requests)))
+}
+
+func (c semConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.state.bytesIn, int64(n))
+	return n, err
+}
+
+func (c semConn) Write(b []byte) (int, error) {
+	atomic.StoreInt64(&c.state.writing, time.Now().UnixNano())
+	n, err := c.Conn.Write(b)
+	atomic.StoreInt64(&c.state.writing, 0)
+	atomic.AddInt64(&c.state.bytesOut, int64(n))
+	return n, err
+}
+
+type connTrackerKey struct{}
+
+// ReadFrom exposes the sendfile/splice fast path of the wrapped TCP
+// connection, which net/http uses to serve files without userland copies.
+func (c semConn) ReadFrom(r io.Reader) (n int64, err error) {
+	atomic.StoreInt64(&c.state.writing, time.Now().UnixNano())
+	defer atomic.StoreInt64(&c.state.writing, 0)
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.Conn}, r)
+	}
+	atomic.AddInt64(&c.state.bytesOut, n)
+	return
+}
+
+// connContext makes the state of the underlying semConn available to
+// handlers through the request context.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if sc, ok := c.(semConn); ok {
+		return context.WithValue(ctx, connTrackerKey{}, sc.state)
+	}
+	return ctx
+}
+
+// connState records the state of connections as http.Server reports it.
+func connState(c net.Conn, state http.ConnState) {
+	tc, isTLS := c.(*tls.Conn)
+	if isTLS {
+		c = tc.NetConn()
+	}
+	sc, ok := c.(semConn)
+	if !ok {
+		return
+	}
+	atomic.StoreInt32(&sc.state.state, int32(state))
+	// HTTP/2 reports its states once the handshake is done.
+	if isTLS && state != http.StateNew && atomic.LoadInt32(&sc.state.h2) == 0 &&
+		tc.ConnectionState().NegotiatedProtocol == "h2" {
+		atomic.StoreInt32(&sc.state.h2, 1)
+	}
+}
+
+// closableIdle reports whether the connection is an HTTP/1 connection
+// waiting for its next request, which closing does not cut short. HTTP/2
+// connections are left to the server, which sends a GOAWAY before closing
+// them: after a response with Connection: close, as withKeepAlivePolicy
+// sets, or once idle for its idle timeout.
+func (cs *ConnTracker) closableIdle() bool {
+	return cs.conn != nil && atomic.LoadInt32(&cs.state) == int32(http.StateIdle) && atomic.LoadInt32(&cs.h2) == 0
+}
+
+// ConnFromContext returns the tracker of the connection a request came in
+// on, nil for requests not served by Run.
+func ConnFromContext(ctx context.Context) *ConnTracker {
+	cs, _ := ctx.Value(connTrackerKey{}).(*ConnTracker)
+	return cs
+}
+
+// withKeepAlivePolicy asks clients to close connections that have served
+// -maxConnRequests requests or are older than -maxConnAge, and all
+// connections once draining has started.
+func withKeepAlivePolicy(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cs := ConnFromContext(r.Context()); cs != nil {
+			n := atomic.AddInt64(&cs.requests, 1)
+			cs.observe(r)
+			switch {
+			case isDraining(),
+				cs.listener != nil && cs.listener.l.isRetired(),
+				config.MaxConnRequests > 0 && n >= int64(config.MaxConnRequests),
+				cs.maxAge > 0 && time.Since(cs.start) >= cs.maxAge:
+				w.Header().Set("Connection", "close")
+			}
+			atomic.AddInt64(&cs.inFlight, 1)
+			defer atomic.AddInt64(&cs.inFlight, -1)
+		}
+
+		requestsTotal.inc()
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// connTagCounts counts the open connections by tag, and by protocol as
+// "proto:HTTP/2.0".
+func connTagCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	liveConns.Range(func(k, _ interface{}) bool {
+		cs := k.(*ConnTracker)
+		for _, t := range cs.Tags() {
+			counts[t]++
+		}
+		if p := cs.Protocol(); p != "" {
+			counts["proto:"+p]++
+		}
+		return true
+	})
+	return counts
+}
+
+// drainPolicies maps connection tags to how long connections carrying them
+// are given once draining starts, from -drainPolicy.
+var drainPolicies map[string]time.Duration
+
+// parseDrainPolicies parses TAG=SECONDS pairs separated by commas.
+func parseDrainPolicies(spec string) (map[string]time.Duration, error) {
+	policies := make(map[string]time.Duration)
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		i := strings.Index(p, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("drain policy %q is not TAG=SECONDS", p)
+		}
+		secs, err := strconv.Atoi(strings.TrimSpace(p[i+1:]))
+		if err != nil || secs < 0 {
+			return nil, fmt.Errorf("drain policy %q is not TAG=SECONDS", p)
+		}
+		policies[strings.TrimSpace(p[:i])] = time.Duration(secs) * time.Second
+	}
+	return policies, nil
+}
+
+// applyDrainPolicies closes the connections with a tag in drainPolicies once
+// its time is up, rather than letting them hold the drain up to -maxWait.
+// A connection with several such tags goes with the earliest.
+func applyDrainPolicies() {
+	for tag, d := range drainPolicies {
+		tag, d := tag, d
+		go func() {
+			if d > 0 {
+				<-clk.After(d)
+			}
+			// A later Run resets draining, and its connections are not
+			// this drain's.
+			if !isDraining() {
+				return
+			}
+			n := 0
+			liveConns.Range(func(k, _ interface{}) bool {
+				cs := k.(*ConnTracker)
+				for _, t := range cs.Tags() {
+					if t == tag && cs.conn != nil {
+						cs.conn.Close()
+						n++
+						break
+					}
+				}
+				return true
+			})
+			if n > 0 {
+				log.Printf("Closed %d %s connections after draining for %v", n, tag, d)
+			}
+		}()
+	}
+}
@@ -0,0 +1,39 @@
+package goazure
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestClosableIdle(t *testing.T) {
+	c, peer := net.Pipe()
+	defer c.Close()
+	defer peer.Close()
+	cs := &ConnTracker{conn: c}
+	sc := semConn{Conn: c, state: cs, conns: new(sync.WaitGroup)}
+
+	for _, tc := range []struct {
+		state http.ConnState
+		want  bool
+	}{
+		{http.StateNew, false},
+		{http.StateActive, false},
+		{http.StateIdle, true},
+		{http.StateHijacked, false},
+	} {
+		connState(sc, tc.state)
+		if got := cs.closableIdle(); got != tc.want {
+			t.Errorf("%v: closableIdle() = %v, want %v", tc.state, got, tc.want)
+		}
+	}
+
+	// HTTP/2 connections are idle between streams, but closing them would
+	// skip the GOAWAY.
+	cs.h2 = 1
+	connState(sc, http.StateIdle)
+	if cs.closableIdle() {
+		t.Error("idle HTTP/2 connection is closable")
+	}
+}
@@ -0,0 +1,65 @@
+package goazure
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+var connsAgedOut = newCounter("goazure_connections_aged_out_total", "Idle connections closed for exceeding -maxConnAge")
+
+// connAgeLimit returns the age after which a new connection is closed,
+// spread by up to 10% either way so that connections accepted together,
+// such as after a restart, do not all reconnect at once.
+func connAgeLimit() time.Duration {
+	if config.MaxConnAge <= 0 {
+		return 0
+	}
+	d := time.Duration(config.MaxConnAge) * time.Second
+	return d - d/10 + time.Duration(rand.Int63n(int64(d/5)+1))
+}
+
+// enforceConnAge closes HTTP/1 connections older than their age limit while
+// they wait for a request, until stop is closed. withKeepAlivePolicy
+// asks clients to close them after a request, which leaves connections that
+// stay idle, or pool their requests on other connections, open for as long
+// as the client likes. Bounding their age bounds the drain and lets load
+// balancers spread clients over instances added since. Hijacked connections
+// such as WebSockets are left to their own timeouts.
+func enforceConnAge(stop <-chan struct{}) {
+	if config.MaxConnAge <= 0 {
+		return
+	}
+	interval := time.Duration(config.MaxConnAge) * time.Second / 10
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	goBackground(func() {
+		for {
+			select {
+			case <-clk.After(interval):
+			case <-stop:
+				return
+			}
+			now := time.Now()
+			liveConns.Range(func(k, _ interface{}) bool {
+				cs := k.(*ConnTracker)
+				if cs.maxAge <= 0 || now.Sub(cs.start) < cs.maxAge || !cs.closableIdle() {
+					return true
+				}
+				for _, t := range cs.Tags() {
+					if t == "websocket" {
+						return true
+					}
+				}
+				if atomic.CompareAndSwapInt32(&cs.agedOut, 0, 1) {
+					connsAgedOut.inc()
+					cs.conn.Close()
+				}
+				return true
+			})
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package goazure
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stopMargin is left of the container stop grace period for logging and
+// exiting after the drain gives up.
+const stopMargin = 2 * time.Second
+
+// stopTimeLimit returns the time App Service waits between SIGTERM and
+// SIGKILL when stopping a container, from WEBSITES_CONTAINER_STOP_TIME_LIMIT
+// given as seconds, a Go duration or HH:MM:SS.
+func stopTimeLimit() (time.Duration, bool) {
+	v := strings.TrimSpace(os.Getenv("WEBSITES_CONTAINER_STOP_TIME_LIMIT"))
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, s > 0
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, d > 0
+	}
+	if t, err := time.Parse("15:04:05", v); err == nil {
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+		return d, d > 0
+	}
+	log.Printf("Ignoring unparsable WEBSITES_CONTAINER_STOP_TIME_LIMIT %q", v)
+	return 0, false
+}
+
+// fitShutdownBudget fits the shutdown sequence into the time the platform
+// waits between SIGTERM and SIGKILL, the smallest of the container stop time
+// limit and the pod's grace period, less stopMargin. The delays spent in and
+// out of rotation before draining take at most half of it, shortened in
+// proportion when they exceed that, and -maxWait is capped to the rest, also
+// when given explicitly: a drain cut short by SIGKILL is neither logged nor
+// recorded.
+func fitShutdownBudget() {
+	var limit time.Duration
+	for _, get := range []func() (time.Duration, bool){stopTimeLimit, terminationGracePeriod} {
+		if l, ok := get(); ok && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	if limit == 0 {
+		return
+	}
+	budget := int((limit - stopMargin) / time.Second)
+	if budget < 1 {
+		budget = 1
+	}
+
+	preStop, rotationDelay := 0, 0
+	if config.K8s {
+		preStop = config.PreStopDelay
+	}
+	if config.RotationHook != "" {
+		rotationDelay = config.RotationDelay
+	}
+	if delays := preStop + rotationDelay; delays > budget/2 {
+		preStop = preStop * (budget / 2) / delays
+		rotationDelay = rotationDelay * (budget / 2) / delays
+		log.Printf("Shutdown budget is %d seconds, shortening the delays before draining to %d seconds", budget, preStop+rotationDelay)
+		if config.K8s {
+			config.PreStopDelay = preStop
+		}
+		if config.RotationHook != "" {
+			config.RotationDelay = rotationDelay
+		}
+	}
+
+	wait := budget - preStop - rotationDelay
+	if wait < 1 {
+		wait = 1
+	}
+	if wait < config.MaxWait {
+		log.Printf("Platform stops the instance %v after SIGTERM, waiting for clients for up to %d seconds", limit, wait)
+		config.MaxWait = wait
+	}
+}
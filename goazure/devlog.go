@@ -0,0 +1,224 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Console log formats selected with -logFormat.
+const (
+	logFormatAuto  = "auto"
+	logFormatPlain = "plain"
+	logFormatDev   = "dev"
+	logFormatJSON  = "json"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+	ansiGray   = "\x1b[90m"
+)
+
+// setupLogFormat puts the format -logFormat asks for on the console. With
+// auto, that is dev when stdout is a terminal, as it is when running the
+// server locally, and JSON otherwise, as on App Service or in a container.
+// Log sinks, which -logSink tees off the console later, keep getting the
+// plain lines.
+func setupLogFormat() {
+	format := config.LogFormat
+	switch format {
+	case logFormatPlain:
+		return
+	case logFormatAuto:
+		format = logFormatJSON
+		if isTerminal(os.Stdout) {
+			format = logFormatDev
+		}
+	case logFormatDev, logFormatJSON:
+	default:
+		log.Fatalf("Unknown -logFormat %q, expected auto, plain, dev or json", config.LogFormat)
+	}
+	var mu sync.Mutex
+	if format == logFormatJSON {
+		log.SetOutput(&jsonLogWriter{out: os.Stderr, mu: &mu, stream: "lifecycle"})
+		connLog.SetOutput(&jsonLogWriter{out: os.Stderr, mu: &mu, stream: "access"})
+		return
+	}
+	log.SetOutput(&devWriter{out: os.Stderr, mu: &mu})
+	connLog.SetOutput(&devWriter{out: os.Stderr, mu: &mu, access: true})
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// devWriter rewrites the lines of a standard logger for reading on a
+// terminal: a compact timestamp, a colored level guessed from the message,
+// keys of key=value fields dimmed, and a JSON record ending a line, such as
+// the startup report, spread over aligned lines.
+type devWriter struct {
+	out    io.Writer
+	mu     *sync.Mutex // shared by the writers of a terminal
+	access bool        // for connLog, whose lines are all alike
+}
+
+const stdLogLayout = "2006/01/02 15:04:05 "
+
+var logField = regexp.MustCompile(`(^|\s)([A-Za-z][\w.-]*)=`)
+
+// parseLogLine splits a line of a standard logger into its time, which is
+// now if it has none, its message and a JSON record ending it, if any.
+func parseLogLine(p []byte) (t time.Time, msg string, record map[string]interface{}) {
+	msg = strings.TrimRight(string(p), "\n")
+	t = time.Now()
+	if len(msg) >= len(stdLogLayout) {
+		if lt, err := time.ParseInLocation(stdLogLayout, msg[:len(stdLogLayout)], time.Local); err == nil {
+			t, msg = lt, msg[len(stdLogLayout):]
+		}
+	}
+	if i := strings.Index(msg, "{"); i >= 0 && strings.HasSuffix(msg, "}") {
+		if json.Unmarshal([]byte(msg[i:]), &record) == nil {
+			msg = strings.TrimRight(msg[:i], " ")
+		}
+	}
+	return t, msg, record
+}
+
+func (dw *devWriter) Write(p []byte) (int, error) {
+	t, msg, record := parseLogLine(p)
+	level, color := logLevel(msg)
+	if dw.access {
+		level, color = "CONN", ansiGray
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s%s%s %s%-5s%s %s\n", ansiDim, t.Format("15:04:05"), ansiReset, color, level, ansiReset,
+		logField.ReplaceAllString(msg, "$1"+ansiDim+"$2="+ansiReset))
+	if record != nil {
+		fields := make(map[string]string)
+		flattenRecord("", record, fields)
+		keys := make([]string, 0, len(fields))
+		width := 0
+		for k := range fields {
+			keys = append(keys, k)
+			if len(k) > width {
+				width = len(k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%15s%s%-*s%s  %s\n", "", ansiCyan, width, k, ansiReset, fields[k])
+		}
+	}
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if _, err := dw.out.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// jsonLogWriter rewrites the lines of a standard logger as JSON objects, one
+// per line, for log collectors to query in production:
+//
+//	{"time": "...", "level": "INFO", "stream": "lifecycle", "msg": "...", "fields": {...}, "record": {...}}
+//
+// Fields holds the key=value pairs of the message and record the JSON
+// record ending it, such as the startup report.
+type jsonLogWriter struct {
+	out    io.Writer
+	mu     *sync.Mutex // shared by the writers of a console
+	stream string      // lifecycle or access
+}
+
+// logFieldValue matches the key=value pairs of a message, with quoted values
+// as %q writes them.
+var logFieldValue = regexp.MustCompile(`(?:^|\s)([A-Za-z][\w.-]*)=("(?:[^"\\]|\\.)*"|\S*)`)
+
+func (jw *jsonLogWriter) Write(p []byte) (int, error) {
+	t, msg, record := parseLogLine(p)
+	level, _ := logLevel(msg)
+	if jw.stream == "access" {
+		level = "INFO"
+	}
+	entry := struct {
+		Time   string                 `json:"time"`
+		Level  string                 `json:"level"`
+		Stream string                 `json:"stream"`
+		Msg    string                 `json:"msg"`
+		Fields map[string]string      `json:"fields,omitempty"`
+		Record map[string]interface{} `json:"record,omitempty"`
+	}{t.UTC().Format(time.RFC3339Nano), level, jw.stream, msg, nil, record}
+	for _, m := range logFieldValue.FindAllStringSubmatch(msg, -1) {
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]string)
+		}
+		v := m[2]
+		if uq, err := strconv.Unquote(v); err == nil && strings.HasPrefix(v, `"`) {
+			v = uq
+		}
+		entry.Fields[m[1]] = v
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if _, err := jw.out.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logLevel guesses the level of a message, as the standard logger has none.
+func logLevel(msg string) (level, color string) {
+	lower := strings.ToLower(msg)
+	for _, s := range []string{"panic", "fatal", "terminating"} {
+		if strings.Contains(lower, s) {
+			return "ERROR", ansiRed
+		}
+	}
+	for _, s := range []string{"could not", "cannot", "failed", "error", "invalid", "ignoring", "timed out"} {
+		if strings.Contains(lower, s) {
+			return "WARN", ansiYellow
+		}
+	}
+	return "INFO", ansiCyan
+}
+
+// flattenRecord adds the scalars of v to fields under dotted keys.
+func flattenRecord(prefix string, v interface{}, fields map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flattenRecord(k, e, fields)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenRecord(fmt.Sprintf("%s.%d", prefix, i), e, fields)
+		}
+	default:
+		b, _ := json.Marshal(v)
+		fields[prefix] = strings.Trim(string(b), `"`)
+	}
+}
@@ -0,0 +1,35 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestJSONLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	jw := &jsonLogWriter{out: &out, mu: &sync.Mutex{}, stream: "lifecycle"}
+	jw.Write([]byte(`2026/10/15 12:30:00 Could not reach backend addr=10.0.0.4:80 reason="connection refused" {"attempt": 2}` + "\n"))
+
+	var entry struct {
+		Time, Level, Stream, Msg string
+		Fields                   map[string]string
+		Record                   map[string]interface{}
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("not a JSON line: %q", out.String())
+	}
+	if entry.Level != "WARN" || entry.Stream != "lifecycle" || entry.Msg != `Could not reach backend addr=10.0.0.4:80 reason="connection refused"` {
+		t.Fatalf("got %+v", entry)
+	}
+	if entry.Fields["addr"] != "10.0.0.4:80" || entry.Fields["reason"] != "connection refused" {
+		t.Fatalf("got fields %v", entry.Fields)
+	}
+	if entry.Record["attempt"] != 2.0 {
+		t.Fatalf("got record %v", entry.Record)
+	}
+	if entry.Time == "" || entry.Time[len(entry.Time)-1] != 'Z' {
+		t.Fatalf("got time %q, want UTC", entry.Time)
+	}
+}
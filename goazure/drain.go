@@ -0,0 +1,106 @@
+package goazure
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// draining is set once the server stops accepting new connections.
+var draining int32
+
+// drainRequests carries drains requested through the admin API to Run.
+var drainRequests = make(chan struct{}, 1)
+
+// lastConnClose holds the UnixNano time a connection last closed.
+var lastConnClose int64
+
+func init() {
+	newGaugeFunc("goazure_draining", "Whether the server is draining", func() float64 {
+		if isDraining() {
+			return 1
+		}
+		return 0
+	})
+	newGaugeFunc("goazure_drain_remaining_connections", "Connections left to close before the drain completes", func() float64 {
+		if !isDraining() {
+			return 0
+		}
+		return float64(atomic.LoadInt64(&activeConns))
+	})
+	newGaugeFunc("goazure_drain_remaining_requests", "Requests left to finish before the drain completes", func() float64 {
+		if !isDraining() {
+			return 0
+		}
+		return float64(atomic.LoadInt64(&activeRequests))
+	})
+}
+
+func connClosed() {
+	atomic.StoreInt64(&lastConnClose, clk.Now().UnixNano())
+}
+
+// drainStalled reports whether no connection has closed for stall, counting
+// from since if none closed after it.
+func drainStalled(since time.Time, stall time.Duration) bool {
+	last := time.Unix(0, atomic.LoadInt64(&lastConnClose))
+	if last.Before(since) {
+		last = since
+	}
+	return clk.Now().Sub(last) >= stall
+}
+
+func startDraining() {
+	atomic.StoreInt32(&draining, 1)
+	applyDrainPolicies()
+	webSocketSessions.goAway("server is restarting")
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// withDrainGuard rejects requests waiting for 100 Continue once draining has
+// started. The body has not been sent yet, so turning the client away now
+// saves it from uploading something that forced termination might cut short.
+func withDrainGuard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDraining() && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "server is restarting", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func requestDrain() {
+	select {
+	case drainRequests <- struct{}{}:
+	default:
+	}
+}
+
+type drainResult struct {
+	Draining        bool `json:"draining"`
+	AlreadyDraining bool `json:"alreadyDraining,omitempty"`
+	MaxWait         int  `json:"maxWait"`
+}
+
+// drainHandler starts a drain on POST, after which the process exits and is
+// restarted by the platform.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	alreadyDraining := isDraining()
+	requestDrain()
+
+	httpjson.Write(w, http.StatusAccepted, drainResult{true, alreadyDraining, config.MaxWait})
+}
@@ -0,0 +1,220 @@
+package goazure
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Why a connection held up a drain.
+const (
+	blockedIdle      = "idle-keepalive"
+	blockedRequest   = "long-request"
+	blockedWebSocket = "websocket"
+	blockedSlow      = "slow-client"
+)
+
+// slowWrite is how long a write must have been blocked for its connection to
+// count as a slow client, which does not take what it is sent.
+const slowWrite = time.Second
+
+// drainReport is what held up a drain and what configuration would shorten
+// it, recorded with its restart or forced termination in the deployment
+// history. A simulated deployment produces one without deploying anything.
+type drainReport struct {
+	Blockers    []drainBlocker `json:"blockers"`
+	Suggestions []string       `json:"suggestions,omitempty"`
+}
+
+// drainBlocker sums up the connections of a class that were still open a
+// second into the drain. Held is how far into the drain the last of them
+// was seen open.
+type drainBlocker struct {
+	Class       string   `json:"class"`
+	Connections int      `json:"connections"`
+	Held        string   `json:"held"`
+	Examples    []string `json:"examples"`
+}
+
+// drainConn is what the analysis last saw of a connection.
+type drainConn struct {
+	class   string
+	example string
+	request string
+	tags    []string
+	held    time.Duration
+}
+
+// drainAnalysis classifies the open connections every second of a drain.
+type drainAnalysis struct {
+	start time.Time
+	mu    sync.Mutex
+	conns map[*ConnTracker]*drainConn
+}
+
+// analyzeDrain samples the connections until done is closed.
+func analyzeDrain(done <-chan struct{}) *drainAnalysis {
+	da := &drainAnalysis{start: clk.Now(), conns: make(map[*ConnTracker]*drainConn)}
+	goBackground(func() {
+		for {
+			select {
+			case <-clk.After(time.Second):
+			case <-done:
+				return
+			}
+			da.sample()
+		}
+	})
+	return da
+}
+
+func (da *drainAnalysis) sample() {
+	now := clk.Now()
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	liveConns.Range(func(k, _ interface{}) bool {
+		cs := k.(*ConnTracker)
+		dc := da.conns[cs]
+		if dc == nil {
+			dc = &drainConn{}
+			da.conns[cs] = dc
+		}
+		dc.class, dc.example = classifyConn(cs, now)
+		dc.request, _ = cs.latest()
+		dc.tags = cs.Tags()
+		dc.held = now.Sub(da.start)
+		return true
+	})
+}
+
+// classifyConn returns why cs is open, along with a description of it.
+func classifyConn(cs *ConnTracker, now time.Time) (class, example string) {
+	remote := "unknown client"
+	if cs.conn != nil {
+		remote = cs.conn.RemoteAddr().String()
+	}
+	req, since := cs.latest()
+	proto := cs.Protocol()
+	if proto == "" {
+		proto = "no request yet"
+	}
+	for _, t := range cs.Tags() {
+		if t == "websocket" {
+			return blockedWebSocket, fmt.Sprintf("%s %s, open for %v", remote, req, now.Sub(cs.start).Round(time.Second))
+		}
+	}
+	if w := atomic.LoadInt64(&cs.writing); w != 0 && now.Sub(time.Unix(0, w)) >= slowWrite {
+		return blockedSlow, fmt.Sprintf("%s %s, write blocked for %v", remote, req, now.Sub(time.Unix(0, w)).Round(time.Second))
+	}
+	if atomic.LoadInt64(&cs.inFlight) > 0 {
+		return blockedRequest, fmt.Sprintf("%s %s, running for %v", remote, req, now.Sub(since).Round(time.Second))
+	}
+	return blockedIdle, fmt.Sprintf("%s %s, %d requests served", remote, proto, cs.Requests())
+}
+
+// report sums up the connections that held up the drain, nil if none did,
+// with suggestions if it was forced to end or took over half of -maxWait.
+func (da *drainAnalysis) report(forced bool) *drainReport {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	if len(da.conns) == 0 {
+		return nil
+	}
+
+	byClass := make(map[string][]*drainConn)
+	var longest time.Duration
+	tags := make(map[string]bool)
+	for _, dc := range da.conns {
+		byClass[dc.class] = append(byClass[dc.class], dc)
+		if dc.held > longest {
+			longest = dc.held
+		}
+		for _, t := range dc.tags {
+			tags[t] = true
+		}
+	}
+	r := &drainReport{}
+	for class, conns := range byClass {
+		// The connections held longest first.
+		sort.Slice(conns, func(i, j int) bool { return conns[i].held > conns[j].held })
+		b := drainBlocker{Class: class, Connections: len(conns), Held: conns[0].held.Round(time.Millisecond).String()}
+		for i := 0; i < len(conns) && i < 3; i++ {
+			b.Examples = append(b.Examples, conns[i].example)
+		}
+		r.Blockers = append(r.Blockers, b)
+	}
+	sort.Slice(r.Blockers, func(i, j int) bool { return r.Blockers[i].Connections > r.Blockers[j].Connections })
+
+	maxWait := time.Duration(config.MaxWait) * time.Second
+	if forced || longest >= maxWait/2 {
+		r.Suggestions = drainSuggestions(byClass, tags)
+	}
+	return r
+}
+
+func drainSuggestions(byClass map[string][]*drainConn, tags map[string]bool) []string {
+	var s []string
+	if conns := byClass[blockedRequest]; conns != nil {
+		route := "PATH"
+		if i := strings.Index(conns[0].request, " "); i > 0 {
+			route = conns[0].request[i+1:]
+		}
+		s = append(s, fmt.Sprintf("Requests ran into the drain: bound their routes with -routeTimeout %s=SECONDS below -maxWait (%d), or raise -maxWait if they must finish", route, config.MaxWait))
+	}
+	if byClass[blockedWebSocket] != nil {
+		if d, ok := drainPolicies["websocket"]; !ok {
+			s = append(s, "WebSockets stayed open after being told the server is going away: close them a few seconds into the drain with -drainPolicy websocket=5")
+		} else if d >= time.Duration(config.MaxWait)*time.Second {
+			s = append(s, fmt.Sprintf("WebSockets stayed open: -drainPolicy websocket=%d only closes them after -maxWait (%d), lower it", int(d.Seconds()), config.MaxWait))
+		}
+	}
+	if byClass[blockedSlow] != nil {
+		s = append(s, "Clients were slow to take responses, which only the 15 second write timeout bounds: serve large downloads from a CDN rather than the site")
+	}
+	if byClass[blockedIdle] != nil && config.MaxConnAge == 0 {
+		s = append(s, "Idle connections, such as HTTP/2 ones the client keeps open, lived as long as clients liked: bound their age with -maxConnAge 300")
+	}
+	if (byClass[blockedIdle] != nil || byClass[blockedSlow] != nil) && config.DrainStallTimeout == 0 {
+		s = append(s, "End the drain once no connection has closed for a while with -drainStallTimeout 5, rather than waiting for idle or slow connections up to -maxWait")
+	}
+	var untreated []string
+	for t := range tags {
+		if _, ok := drainPolicies[t]; !ok && t != "websocket" {
+			untreated = append(untreated, t)
+		}
+	}
+	sort.Strings(untreated)
+	for _, t := range untreated {
+		s = append(s, fmt.Sprintf("Connections tagged %s held up the drain: give them a deadline with -drainPolicy %s=SECONDS", t, t))
+	}
+	return s
+}
+
+// logDrainReport logs what held up a drain.
+func logDrainReport(r *drainReport) {
+	if r == nil {
+		return
+	}
+	var b strings.Builder
+	printDrainReport(&b, r)
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		log.Print(line)
+	}
+}
+
+func printDrainReport(w io.Writer, r *drainReport) {
+	for _, b := range r.Blockers {
+		fmt.Fprintf(w, "Held up by %d %s connections, for up to %s\n", b.Connections, b.Class, b.Held)
+		for _, e := range b.Examples {
+			fmt.Fprintf(w, "    %s\n", e)
+		}
+	}
+	for _, s := range r.Suggestions {
+		fmt.Fprintf(w, "Suggestion: %s\n", s)
+	}
+}
@@ -0,0 +1,165 @@
+package goazure
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+var errorStatuses = []int{http.StatusNotFound, http.StatusInternalServerError, http.StatusServiceUnavailable}
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body><h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}</p></body></html>
+`
+
+type errorData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message,omitempty"`
+}
+
+// errorPages renders error responses from "<status>.html" templates and
+// "<status>.json" files in a directory, using built-in defaults for those
+// missing.
+type errorPages struct {
+	html map[int]*template.Template
+	json map[int][]byte
+}
+
+func loadErrorPages(dir string) (*errorPages, error) {
+	p := &errorPages{html: map[int]*template.Template{}, json: map[int][]byte{}}
+	def := template.Must(template.New("default").Parse(defaultErrorPage))
+
+	for _, code := range errorStatuses {
+		name := filepath.Join(dir, strconv.Itoa(code))
+		t, err := template.ParseFiles(name + ".html")
+		switch {
+		case err == nil:
+			p.html[code] = t
+		case os.IsNotExist(err):
+			p.html[code] = def
+		default:
+			return nil, err
+		}
+
+		b, err := ioutil.ReadFile(name + ".json")
+		if err == nil {
+			p.json[code] = b
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "html")
+}
+
+func (p *errorPages) render(w http.ResponseWriter, r *http.Request, d errorData) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("X-Content-Type-Options")
+
+	if wantsJSON(r) {
+		if b, ok := p.json[d.Status]; ok {
+			h.Set("Content-Type", "application/json")
+			w.WriteHeader(d.Status)
+			w.Write(b)
+			return
+		}
+		httpjson.WriteError(w, r, &httpjson.Error{Status: d.Status, StatusText: d.StatusText, Message: d.Message})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := p.html[d.Status].Execute(&buf, d); err != nil {
+		log.Printf("Could not render %d error page: %v", d.Status, err)
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(d.Status)
+	w.Write(buf.Bytes())
+}
+
+// errorPageWriter holds back plain text error responses so they can be
+// replaced by a rendered page. Responses with any other content type, such
+// as proxied error pages, pass through untouched.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages     *errorPages
+	status    int
+	intercept bool
+	message   bytes.Buffer
+}
+
+func (e *errorPageWriter) WriteHeader(status int) {
+	if e.status != 0 {
+		return
+	}
+	e.status = status
+
+	if _, ok := e.pages.html[status]; ok {
+		ct := e.Header().Get("Content-Type")
+		if ct == "" || strings.HasPrefix(ct, "text/plain") {
+			e.intercept = true
+			return
+		}
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorPageWriter) Write(b []byte) (int, error) {
+	if e.status == 0 {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.intercept {
+		if e.message.Len() < 512 {
+			e.message.Write(b)
+		}
+		return len(b), nil
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+func (e *errorPageWriter) ReadFrom(r io.Reader) (int64, error) {
+	if e.status == 0 {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.intercept {
+		return io.Copy(struct{ io.Writer }{e}, r)
+	}
+	return readFrom(e.ResponseWriter, r)
+}
+
+func (e *errorPageWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+func withErrorPages(h http.Handler, pages *errorPages) http.Handler {
+	if pages == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorPageWriter{ResponseWriter: w, pages: pages}
+		h.ServeHTTP(ew, r)
+		if ew.intercept {
+			pages.render(w, r, errorData{
+				Status:     ew.status,
+				StatusText: http.StatusText(ew.status),
+				Message:    strings.TrimSpace(ew.message.String()),
+			})
+		}
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package goazure
+
+import (
+	"errors"
+	"io"
+)
+
+func newEventLogWriter(source string) (io.Writer, error) {
+	return nil, errors.New("the Windows Event Log is only available on Windows")
+}
@@ -0,0 +1,48 @@
+package goazure
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const eventLogInformation = 4 // EVENTLOG_INFORMATION_TYPE
+
+var (
+	advapi32                = syscall.NewLazyDLL("advapi32.dll")
+	procRegisterEventSource = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent         = advapi32.NewProc("ReportEventW")
+)
+
+// eventLogWriter reports each log line as an information event of the
+// Application log. Without a registered message file Event Viewer shows a
+// notice about the missing description, followed by the line itself.
+type eventLogWriter struct {
+	h uintptr
+}
+
+func newEventLogWriter(source string) (*eventLogWriter, error) {
+	name, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(name)))
+	if h == 0 {
+		return nil, fmt.Errorf("could not register event source %s: %v", source, err)
+	}
+	return &eventLogWriter{h: h}, nil
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg, err := syscall.UTF16PtrFromString(logMessage(p))
+	if err != nil {
+		return 0, err
+	}
+	strs := []*uint16{msg}
+	ok, _, err := procReportEvent.Call(w.h, eventLogInformation, 0, 1, 0, 1, 0,
+		uintptr(unsafe.Pointer(&strs[0])), 0)
+	if ok == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,198 @@
+package goazure
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+	"github.com/hruan/go-azure/goazure/internal/clock"
+)
+
+// watchEvent is a raw file watcher event as recorded by -recordEvents.
+type watchEvent struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	Bits uint32    `json:"bits"`
+	Name string    `json:"name"`
+}
+
+// eventRecorder appends watcher events to a file as JSON lines. A nil
+// recorder records nothing.
+type eventRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newEventRecorder(path string) (*eventRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *eventRecorder) record(op fsnotify.Op, name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := watchEvent{Time: time.Now().UTC(), Op: opString(op), Bits: uint32(op), Name: name}
+	if err := r.enc.Encode(e); err != nil {
+		log.Printf("Could not record watcher event: %v", err)
+	}
+}
+
+func (r *eventRecorder) close() {
+	if r != nil {
+		r.f.Close()
+	}
+}
+
+func opString(op fsnotify.Op) string {
+	var ops []string
+	for _, o := range []struct {
+		op   fsnotify.Op
+		name string
+	}{
+		{fsnotify.Create, "CREATE"},
+		{fsnotify.Write, "WRITE"},
+		{fsnotify.Remove, "REMOVE"},
+		{fsnotify.Rename, "RENAME"},
+		{fsnotify.Chmod, "CHMOD"},
+	} {
+		if op&o.op == o.op {
+			ops = append(ops, o.name)
+		}
+	}
+	return strings.Join(ops, "|")
+}
+
+// watcherDeployment decides whether a watcher event is a deployment, giving
+// the reason when it is not.
+func watcherDeployment(op fsnotify.Op, name string) (deployment, string) {
+	switch {
+	case op&fsnotify.Create != fsnotify.Create:
+		return deployment{}, "not a create event"
+	case hiddenFile(name):
+		return deployment{}, "hidden file"
+	}
+	return deployment{artifact: name, trigger: "watcher"}, ""
+}
+
+// runReplayEvents implements the "replay-events" subcommand. It feeds events
+// recorded by -recordEvents through the same filtering, debouncing and
+// deployment window logic as the watcher, on a clock following the recorded
+// timestamps, and explains what happened to each event.
+func runReplayEvents(args []string) {
+	fs := commandFlags("replay-events")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		printUsage()
+	}
+
+	events, err := readWatchEvents(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(events) == 0 {
+		fmt.Println("No events recorded")
+		return
+	}
+
+	runningHash, _ = executableHash()
+	fc := clock.NewFake(events[0].Time)
+	clk = fc
+	// The debouncer fires from a goroutine of its own; the replay waits for
+	// it whenever a restart is due, so the output follows the clock.
+	fired := make(chan time.Time)
+	d := newDebouncer(restartSchedule(), func() { fired <- fc.Now() })
+	due := false
+
+	for _, e := range events {
+		if due && !e.Time.Before(d.at) {
+			fc.Advance(d.at.Sub(fc.Now()))
+			reportFired(<-fired)
+			due = false
+		}
+		if e.Time.After(fc.Now()) {
+			fc.Advance(e.Time.Sub(fc.Now()))
+		}
+
+		dep, reason := watcherDeployment(fsnotify.Op(e.Bits), e.Name)
+		if reason != "" {
+			fmt.Printf("%s  %-14s %s: ignored, %s\n", e.Time.Format(time.RFC3339Nano), e.Op, e.Name, reason)
+			continue
+		}
+		if outcome, reason := deploymentSkipped(replayArtifactChanged(dep.artifact)); outcome != "" {
+			fmt.Printf("%s  %-14s %s: deployment %s, %s\n", e.Time.Format(time.RFC3339Nano), e.Op, e.Name, outcome, reason)
+			continue
+		}
+		outcome := d.trigger(dep.artifact)
+		fmt.Printf("%s  %-14s %s: deployment %s\n", e.Time.Format(time.RFC3339Nano), e.Op, e.Name, outcome)
+		switch outcome {
+		case "accepted":
+			reportFired(<-fired)
+		case "deferred":
+			fmt.Printf("    restart scheduled for %s\n", d.at.Format(time.RFC3339))
+			due = true
+		}
+	}
+	// Let a pending restart fire to show when it would have happened.
+	if due {
+		fc.Advance(d.at.Sub(fc.Now()))
+		reportFired(<-fired)
+	} else if !d.fired {
+		fmt.Println("No restart would have been triggered")
+	}
+}
+
+func reportFired(t time.Time) {
+	fmt.Printf("%s  restart triggered\n", t.Format(time.RFC3339Nano))
+}
+
+// replayArtifactChanged checks a recorded artifact as acceptDeployment
+// does, without waiting for it to be written as it was long ago. One no
+// longer on disk cannot be checked and counts as changed.
+func replayArtifactChanged(path string) (string, bool, string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, true, "", nil
+	}
+	if err := validateArtifact(path); err != nil {
+		return path, false, "", err
+	}
+	h, err := fileHash(path)
+	if err != nil || runningHash == "" {
+		return path, true, h, nil
+	}
+	return path, h != runningHash, h, nil
+}
+
+func readWatchEvents(path string) ([]watchEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []watchEvent
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if len(strings.TrimSpace(s.Text())) == 0 {
+			continue
+		}
+		var e watchEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		events = append(events, e)
+	}
+	return events, s.Err()
+}
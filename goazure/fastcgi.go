@@ -0,0 +1,344 @@
+package goazure
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/textproto"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FastCGI record types and roles, from the FastCGI 1.0 specification.
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiMaxContent = 65535
+)
+
+// fcgiHandler serves requests through a FastCGI application such as
+// php-fpm, listening on "tcp://HOST:PORT" or "unix:///PATH". Connections are
+// kept open and reused, and at most maxConns are used at a time.
+type fcgiHandler struct {
+	network, addr string
+	root          string // document root, for SCRIPT_FILENAME
+	prefix        string // vhost path stripped from requests
+	index         string
+	idle          chan net.Conn
+	slots         chan struct{}
+}
+
+func newFastCGIHandler(addr, root, prefix, index string, maxConns int) (*fcgiHandler, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	h := &fcgiHandler{root: root, prefix: strings.TrimSuffix(prefix, "/"), index: index}
+	switch u.Scheme {
+	case "tcp":
+		h.network, h.addr = "tcp", u.Host
+	case "unix":
+		h.network, h.addr = "unix", u.Path
+	default:
+		return nil, fmt.Errorf("FastCGI address %q is neither tcp:// nor unix://", addr)
+	}
+	if h.index == "" {
+		h.index = "index.php"
+	}
+	if maxConns <= 0 {
+		maxConns = 16
+	}
+	h.idle = make(chan net.Conn, maxConns)
+	h.slots = make(chan struct{}, maxConns)
+	return h, nil
+}
+
+// script splits a request path into the script to run and the path info
+// following it, as in /index.php/users/1.
+func (h *fcgiHandler) script(p string) (string, string) {
+	if strings.HasSuffix(p, "/") {
+		p += h.index
+	}
+	if i := strings.Index(p, ".php/"); i >= 0 {
+		return p[:i+4], p[i+4:]
+	}
+	return p, ""
+}
+
+func (h *fcgiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	case <-r.Context().Done():
+		return
+	}
+
+	conn, err := h.conn()
+	if err != nil {
+		log.Printf("Could not connect to FastCGI application %s: %v", h.addr, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	reusable, err := h.roundTrip(conn, w, r)
+	if err != nil {
+		log.Printf("FastCGI request %s %s failed: %v", r.Method, r.URL.Path, err)
+	}
+	if !reusable {
+		conn.Close()
+		return
+	}
+	select {
+	case h.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (h *fcgiHandler) conn() (net.Conn, error) {
+	select {
+	case c := <-h.idle:
+		return c, nil
+	default:
+		return net.Dial(h.network, h.addr)
+	}
+}
+
+// roundTrip runs request r over conn, reporting whether conn can be reused.
+// If the application fails before answering, a 502 is sent.
+func (h *fcgiHandler) roundTrip(conn net.Conn, w http.ResponseWriter, r *http.Request) (bool, error) {
+	scriptName, pathInfo := h.script(r.URL.Path)
+	env := cgiEnv(r)
+	env["SCRIPT_NAME"] = h.prefix + scriptName
+	env["SCRIPT_FILENAME"] = filepath.Join(h.root, filepath.FromSlash(path.Clean(scriptName)))
+	env["DOCUMENT_ROOT"] = h.root
+	if pathInfo != "" {
+		env["PATH_INFO"] = pathInfo
+	}
+
+	bw := bufio.NewWriter(conn)
+	err := writeRecord(bw, fcgiBeginRequest, []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0})
+	if err == nil {
+		err = writeStream(bw, fcgiParams, encodeParams(env))
+	}
+	if err == nil && r.Body != nil {
+		err = writeStream(bw, fcgiStdin, r.Body)
+	} else if err == nil {
+		err = writeRecord(bw, fcgiStdin, nil)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return false, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := readResponse(bufio.NewReader(conn), pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err = writeCGIResponse(w, pr)
+	// Drain the rest so that the connection can be reused.
+	io.Copy(ioutil.Discard, pr)
+	if rerr := <-done; rerr != nil {
+		return false, rerr
+	}
+	return err == nil, err
+}
+
+// readResponse copies the stdout records of a response to out until the end
+// of the request, logging stderr.
+func readResponse(br *bufio.Reader, out io.Writer) error {
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(hdr[4:6]))
+		pad := int(hdr[6])
+		content := make([]byte, n+pad)
+		if _, err := io.ReadFull(br, content); err != nil {
+			return err
+		}
+		content = content[:n]
+		switch hdr[1] {
+		case fcgiStdout:
+			if _, err := out.Write(content); err != nil {
+				return err
+			}
+		case fcgiStderr:
+			if len(content) > 0 {
+				log.Printf("FastCGI: %s", strings.TrimSpace(string(content)))
+			}
+		case fcgiEndRequest:
+			if len(content) >= 5 && content[4] != 0 {
+				return fmt.Errorf("FastCGI application ended the request with protocol status %d", content[4])
+			}
+			return nil
+		}
+	}
+}
+
+// writeCGIResponse sends a response in the CGI format of RFC 3875: headers,
+// of which Status gives the status code and Location may redirect, then the
+// body.
+func writeCGIResponse(w http.ResponseWriter, body io.Reader) error {
+	br := bufio.NewReader(body)
+	hdr, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(hdr) > 0) {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return fmt.Errorf("invalid response headers: %v", err)
+	}
+	status := http.StatusOK
+	if s := hdr.Get("Status"); s != "" {
+		if status, err = strconv.Atoi(strings.Fields(s)[0]); err != nil || status < 100 || status > 599 {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return fmt.Errorf("invalid status %q", s)
+		}
+		hdr.Del("Status")
+	} else if hdr.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for k, vs := range hdr {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, br)
+	return err
+}
+
+func writeRecord(w io.Writer, typ byte, content []byte) error {
+	// Request ID 1 is the only request on the connection at a time.
+	hdr := []byte{1, typ, 0, 1, byte(len(content) >> 8), byte(len(content)), 0, 0}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// writeStream sends r as a stream of records ended by an empty one.
+func writeStream(w io.Writer, typ byte, r io.Reader) error {
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := writeRecord(w, typ, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return writeRecord(w, typ, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// encodeParams encodes name-value pairs for a params stream.
+func encodeParams(env map[string]string) io.Reader {
+	var b []byte
+	length := func(n int) {
+		if n < 128 {
+			b = append(b, byte(n))
+			return
+		}
+		b = append(b, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+	}
+	for k, v := range env {
+		length(len(k))
+		length(len(v))
+		b = append(b, k...)
+		b = append(b, v...)
+	}
+	return strings.NewReader(string(b))
+}
+
+// cgiEnv returns the CGI meta-variables of RFC 3875 describing r, but for
+// those naming the script.
+func cgiEnv(r *http.Request) map[string]string {
+	host, port, _ := net.SplitHostPort(r.Host)
+	if host == "" {
+		host, port = r.Host, "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteHost, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "go-azure-website",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.RequestURI,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"REMOTE_ADDR":       remoteHost,
+		"REMOTE_PORT":       remotePort,
+	}
+	if r.TLS != nil {
+		env["HTTPS"] = "on"
+	}
+	if r.ContentLength > 0 {
+		env["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		env["CONTENT_TYPE"] = ct
+	}
+	for k, vs := range r.Header {
+		k = strings.ToUpper(strings.Replace(k, "-", "_", -1))
+		if k == "PROXY" || k == "CONTENT_TYPE" || k == "CONTENT_LENGTH" {
+			// HTTP_PROXY would be taken for proxy settings (httpoxy).
+			continue
+		}
+		env["HTTP_"+k] = strings.Join(vs, ", ")
+	}
+	return env
+}
+
+// newCGIHandler runs a CGI program for each request, at most maxProcs at a
+// time; further requests wait for one to finish.
+func newCGIHandler(program, dir string, maxProcs int) (http.Handler, error) {
+	if program == "" {
+		return nil, errors.New("missing CGI program")
+	}
+	if maxProcs <= 0 {
+		maxProcs = 8
+	}
+	h := &cgi.Handler{Path: program, Dir: dir}
+	slots := make(chan struct{}, maxProcs)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-r.Context().Done():
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,64 @@
+package goazure
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	fdOpen, fdLimit int64
+	fdPressure      int32
+
+	acceptThrottled = newCounter("goazure_accept_throttled_total", "Times accepting connections was paused for file descriptor pressure")
+	acceptErrors    = newCounter("goazure_accept_errors_total", "Errors accepting connections")
+)
+
+func init() {
+	newGaugeFunc("goazure_open_fds", "Open file descriptors", func() float64 { return float64(atomic.LoadInt64(&fdOpen)) })
+	newGaugeFunc("goazure_max_fds", "File descriptor limit", func() float64 { return float64(atomic.LoadInt64(&fdLimit)) })
+}
+
+// startFDMonitor samples file descriptor usage, flagging pressure once more
+// than highWater percent of the limit is in use. It does nothing on platforms
+// without a file descriptor limit. Closing stop ends the monitor.
+func startFDMonitor(highWater int, stop <-chan struct{}) {
+	if _, _, ok := fdUsage(); !ok {
+		return
+	}
+
+	goBackground(func() {
+		for {
+			open, limit, _ := fdUsage()
+			atomic.StoreInt64(&fdOpen, int64(open))
+			atomic.StoreInt64(&fdLimit, int64(limit))
+
+			high := limit > 0 && open*100 >= limit*highWater
+			if high && atomic.CompareAndSwapInt32(&fdPressure, 0, 1) {
+				log.Printf("Warning: %d of %d file descriptors in use, pausing accept", open, limit)
+			} else if !high && atomic.CompareAndSwapInt32(&fdPressure, 1, 0) {
+				log.Printf("%d of %d file descriptors in use, resuming accept", open, limit)
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// waitFDs blocks while file descriptors are scarce, or until stop is closed.
+func waitFDs(stop <-chan struct{}) {
+	if atomic.LoadInt32(&fdPressure) == 0 {
+		return
+	}
+	acceptThrottled.inc()
+	for atomic.LoadInt32(&fdPressure) == 1 {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-stop:
+			return
+		}
+	}
+}
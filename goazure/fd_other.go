@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package goazure
+
+func fdUsage() (open, limit int, ok bool) {
+	return 0, 0, false
+}
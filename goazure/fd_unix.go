@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd
+
+package goazure
+
+import (
+	"os"
+	"syscall"
+)
+
+func fdUsage() (open, limit int, ok bool) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, 0, false
+	}
+
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		d, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			continue
+		}
+		// One descriptor is used for reading the directory itself.
+		return len(names) - 1, int(rl.Cur), true
+	}
+	return 0, 0, false
+}
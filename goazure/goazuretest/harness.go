@@ -0,0 +1,188 @@
+// Package goazuretest runs the goazure server in-process for integration
+// tests: over an in-memory listener, with deployments fed in directly and a
+// clock that only moves when advanced, so that restart and drain behavior
+// can be tested without sockets or sleeps.
+package goazuretest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hruan/go-azure/goazure"
+	"github.com/hruan/go-azure/goazure/internal/clock"
+)
+
+// FakeClock is a goazure.Clock that only moves when advanced.
+type FakeClock = clock.Fake
+
+// NewFakeClock returns a FakeClock reading now until advanced.
+func NewFakeClock(now time.Time) *FakeClock {
+	return clock.NewFake(now)
+}
+
+// pipeListener is an in-memory net.Listener whose connections are created by
+// Dial with net.Pipe.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+// Dial connects to the listener, failing once it is closed like a real
+// listener refusing connections.
+func (l *pipeListener) Dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("connection refused")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// Harness runs the server in-process over an in-memory listener, so that
+// the deployment and drain lifecycle can be exercised without sockets.
+type Harness struct {
+	// Client sends requests to the server; any host in the URL will do.
+	Client *http.Client
+
+	l      *pipeListener
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+	tmp    string
+}
+
+// NewHarness starts goazure.Run with cfg and waits until /healthz answers.
+// Start from goazure.DefaultConfig for the flag defaults. A temporary watch
+// directory is used if cfg has none. Setting cfg.Clock to a FakeClock lets a
+// test expire restart delays and drain timeouts with Advance.
+func NewHarness(cfg goazure.Config) (*Harness, error) {
+	h := &Harness{l: newPipeListener(), done: make(chan struct{})}
+	if cfg.WatchDir == "" {
+		dir, err := ioutil.TempDir("", "go-azure-harness")
+		if err != nil {
+			return nil, err
+		}
+		cfg.WatchDir, h.tmp = dir, dir
+	}
+	cfg.Listener = h.l
+	h.Client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return h.l.Dial()
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go func() {
+		h.err = goazure.Run(ctx, cfg)
+		close(h.done)
+	}()
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp, err := h.Client.Get("http://harness/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return h, nil
+			}
+		}
+		select {
+		case <-h.done:
+			h.cleanup()
+			return nil, fmt.Errorf("server stopped: %v", h.err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			h.Stop()
+			return nil, errors.New("server did not become healthy")
+		}
+	}
+}
+
+// Deploy feeds a deployment of artifact into the deployment pipeline as if
+// a watcher had found it. An empty artifact deploys the running binary; an
+// artifact that cannot be run fails with goazure.ErrArtifactInvalid.
+func (h *Harness) Deploy(artifact string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-h.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := goazure.Deploy(ctx, artifact, "harness"); err != context.Canceled {
+		return err
+	}
+	return errors.New("server is not running")
+}
+
+// Dial opens a connection to the server, for tests that need to control
+// what is sent on it.
+func (h *Harness) Dial() (net.Conn, error) {
+	return h.l.Dial()
+}
+
+// Done is closed once Run has returned.
+func (h *Harness) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until Run returns, for instance after a deployment, and
+// returns its error.
+func (h *Harness) Wait() error {
+	<-h.done
+	h.cleanup()
+	return h.err
+}
+
+// Stop shuts the server down as on SIGTERM and waits for it to drain.
+func (h *Harness) Stop() error {
+	h.cancel()
+	return h.Wait()
+}
+
+func (h *Harness) cleanup() {
+	h.cancel()
+	if h.tmp != "" {
+		os.RemoveAll(h.tmp)
+	}
+}
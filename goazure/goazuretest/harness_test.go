@@ -0,0 +1,156 @@
+package goazuretest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hruan/go-azure/goazure"
+)
+
+// harnessConfig is the flag defaults, with deployments restarting right away
+// and the deployment history kept in a file of the test's.
+func harnessConfig(t *testing.T) goazure.Config {
+	cfg := goazure.DefaultConfig()
+	cfg.WatchMode = "poll"
+	cfg.MinRestartInterval = 0
+	cfg.IMDS = false
+	cfg.HistoryFile = filepath.Join(t.TempDir(), "history.json")
+	return cfg
+}
+
+type deployEvent struct {
+	Kind     string `json:"kind"`
+	Duration string `json:"duration"`
+	Outcome  string `json:"outcome"`
+}
+
+// lastDeployEvent returns the latest event of kind in the history of cfg.
+func lastDeployEvent(t *testing.T, cfg goazure.Config, kind string) *deployEvent {
+	var events []deployEvent
+	b, err := ioutil.ReadFile(cfg.HistoryFile)
+	if err == nil {
+		err = json.Unmarshal(b, &events)
+	}
+	if err != nil {
+		t.Fatalf("could not read the deployment history: %v", err)
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Kind == kind {
+			return &events[i]
+		}
+	}
+	return nil
+}
+
+func TestHarnessDeploy(t *testing.T) {
+	cfg := harnessConfig(t)
+	h, err := NewHarness(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.Client.Get("http://harness/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if err := h.Deploy(""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.Done():
+	case <-time.After(10 * time.Second):
+		h.Stop()
+		t.Fatal("server did not restart after the deployment")
+	}
+	if err := h.Wait(); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	if e := lastDeployEvent(t, cfg, "restart"); e == nil || e.Outcome != "drained" {
+		t.Fatalf("got restart event %+v, want a drained one", e)
+	}
+}
+
+func TestHarnessDeployInvalidArtifact(t *testing.T) {
+	h, err := NewHarness(harnessConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+	if err := h.Deploy("/nonexistent/app.exe"); !errors.Is(err, goazure.ErrArtifactInvalid) {
+		t.Fatalf("got %v, want ErrArtifactInvalid", err)
+	}
+}
+
+// TestHarnessDrainTimeout holds a connection open through a drain and
+// expires -maxWait on a fake clock rather than waiting for it.
+func TestHarnessDrainTimeout(t *testing.T) {
+	fc := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	cfg := harnessConfig(t)
+	cfg.Clock = fc
+	cfg.MaxWait = 600
+	h, err := NewHarness(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request whose headers never end keeps its connection busy.
+	c, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Write([]byte("GET /slow HTTP/1.1\r\nHost: harness\r\n"))
+
+	if err := h.Deploy(""); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case <-h.Done():
+			done = true
+		case <-time.After(10 * time.Millisecond):
+			fc.Advance(time.Duration(cfg.MaxWait) * time.Second)
+		case <-deadline:
+			t.Fatal("drain did not time out")
+		}
+	}
+	if err := h.Wait(); !errors.Is(err, goazure.ErrDrainTimeout) {
+		t.Fatalf("got %v, want ErrDrainTimeout", err)
+	}
+	e := lastDeployEvent(t, cfg, "forced-termination")
+	if e == nil || e.Outcome != "timeout" {
+		t.Fatalf("got forced termination event %+v, want a timeout", e)
+	}
+	if d, _ := time.ParseDuration(e.Duration); d < time.Duration(cfg.MaxWait)*time.Second {
+		t.Fatalf("drain recorded as taking %v, want at least -maxWait on the fake clock", d)
+	}
+}
+
+func TestHarnessRunsInTurn(t *testing.T) {
+	h, err := NewHarness(harnessConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goazure.Run(context.Background(), harnessConfig(t)); !errors.Is(err, goazure.ErrAlreadyRunning) {
+		h.Stop()
+		t.Fatalf("got %v, want ErrAlreadyRunning", err)
+	}
+	if err := h.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = NewHarness(harnessConfig(t))
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if err := h.Stop(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package goazure
+
+import "net/http"
+
+// h2cTransport speaks HTTP/2 without TLS, as gRPC servers listening on a
+// plain port expect.
+func h2cTransport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	t.Protocols = protocols
+	return t, nil
+}
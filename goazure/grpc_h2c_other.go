@@ -0,0 +1,14 @@
+//go:build !go1.24
+
+package goazure
+
+import (
+	"errors"
+	"net/http"
+)
+
+// h2cTransport is unavailable: net/http speaks HTTP/2 without TLS as of Go
+// 1.24 only.
+func h2cTransport() (*http.Transport, error) {
+	return nil, errors.New("grpc:// needs a build with Go 1.24 or later, use grpcs://")
+}
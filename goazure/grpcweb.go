@@ -0,0 +1,377 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var grpcTranslated = newCounter("goazure_grpc_translated_total", "gRPC-Web and JSON requests translated to gRPC")
+
+// grpcMaxMessage bounds translated request bodies, as gRPC servers take
+// messages of up to 4MB by default.
+const grpcMaxMessage = 4 << 20
+
+// grpcHandler exposes a gRPC backend to clients that cannot speak gRPC over
+// HTTP/2 end to end, such as browsers and the front end of App Service:
+//
+//   - application/grpc requests are passed through, trailers included;
+//   - application/grpc-web and grpc-web-text requests are translated, the
+//     trailers of the response going in a trailer frame of the body;
+//   - application/json POSTs to /package.Service/Method call the method
+//     with the JSON codec, application/grpc+json, which the backend has to
+//     register. The response message, or a JSON array of them for server
+//     streaming, comes back with the gRPC status mapped to an HTTP one.
+type grpcHandler struct {
+	target    *url.URL
+	transport http.RoundTripper
+	origins   []string
+}
+
+// newGRPCHandler proxies to target, grpc://HOST:PORT for HTTP/2 without TLS
+// or grpcs://HOST:PORT, allowing browsers from origins, "*" for any.
+func newGRPCHandler(target string, origins []string) (*grpcHandler, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	var t *http.Transport
+	switch u.Scheme {
+	case "grpc":
+		u.Scheme = "http"
+		if t, err = h2cTransport(); err != nil {
+			return nil, err
+		}
+	case "grpcs":
+		// HTTP/2 is negotiated with ALPN.
+		u.Scheme = "https"
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	default:
+		return nil, fmt.Errorf("gRPC address %q is neither grpc:// nor grpcs://", target)
+	}
+	return &grpcHandler{target: u, transport: t, origins: origins}, nil
+}
+
+// grpcMode classifies a request content type: "grpc", "grpc-web",
+// "grpc-web-text" or "json", and the codec subtype such as "+proto".
+func grpcMode(contentType string) (string, string) {
+	ct, _, _ := mime.ParseMediaType(contentType)
+	if ct == "application/json" {
+		return "json", "+json"
+	}
+	if !strings.HasPrefix(ct, "application/grpc") {
+		return "", ""
+	}
+	mode, subtype := strings.TrimPrefix(ct, "application/"), ""
+	if i := strings.Index(mode, "+"); i >= 0 {
+		mode, subtype = mode[:i], mode[i:]
+	}
+	switch mode {
+	case "grpc", "grpc-web", "grpc-web-text":
+		return mode, subtype
+	}
+	return "", ""
+}
+
+func (g *grpcHandler) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, o := range g.origins {
+		if o == "*" || o == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message")
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+func (g *grpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.allowOrigin(w, r)
+	if r.Method == http.MethodOptions {
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "POST")
+			w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	mode, subtype := grpcMode(r.Header.Get("Content-Type"))
+	if cs := ConnFromContext(r.Context()); cs != nil && mode != "" {
+		cs.Tag("grpc")
+	}
+	if mode == "" {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if mode != "grpc" {
+		grpcTranslated.inc()
+	}
+
+	out := r.Clone(r.Context())
+	out.URL = &url.URL{Scheme: g.target.Scheme, Host: g.target.Host, Path: singleJoiningSlash(g.target.Path, r.URL.Path)}
+	out.Host, out.RequestURI = g.target.Host, ""
+	out.Header.Set("Content-Type", "application/grpc"+subtype)
+	out.Header.Set("Te", "trailers")
+	out.Header.Del("Connection")
+	out.Header.Del("Accept-Encoding")
+	out.Header.Del("X-Grpc-Web")
+	out.Header.Del("Content-Length")
+	if mode != "grpc" && mode != "grpc-web" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, grpcMaxMessage))
+		if err == nil && mode == "grpc-web-text" {
+			body, err = decodeBase64Chunks(body)
+		}
+		if err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if mode == "json" {
+			if len(bytes.TrimSpace(body)) == 0 {
+				body = []byte("{}")
+			}
+			body = append(grpcFrameHeader(0, len(body)), body...)
+		}
+		out.Body, out.ContentLength = ioutil.NopCloser(bytes.NewReader(body)), int64(len(body))
+	}
+
+	resp, err := g.transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("gRPC call %s failed: %v", r.URL.Path, err)
+		if mode == "json" {
+			writeGRPCJSONError(w, 14, err.Error())
+			return
+		}
+		// A trailers-only response, which every flavour understands.
+		w.Header().Set("Content-Type", "application/"+mode+subtype)
+		w.Header().Set("Grpc-Status", "14")
+		w.Header().Set("Grpc-Message", url.PathEscape(err.Error()))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch mode {
+	case "json":
+		g.writeJSON(w, resp)
+	case "grpc":
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		flushCopy(w, resp.Body, nil)
+		for k, vs := range resp.Trailer {
+			for _, v := range vs {
+				w.Header().Add(http.TrailerPrefix+k, v)
+			}
+		}
+	default:
+		copyHeader(w.Header(), resp.Header)
+		w.Header().Set("Content-Type", "application/"+mode+subtype)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		encode := func(b []byte) []byte { return b }
+		if mode == "grpc-web-text" {
+			// Each chunk is encoded on its own, padding included, which
+			// gRPC-Web clients decode.
+			encode = func(b []byte) []byte {
+				return []byte(base64.StdEncoding.EncodeToString(b))
+			}
+		}
+		if err := flushCopy(w, resp.Body, encode); err != nil {
+			return
+		}
+		if len(resp.Trailer) > 0 {
+			var t bytes.Buffer
+			for k, vs := range resp.Trailer {
+				for _, v := range vs {
+					fmt.Fprintf(&t, "%s: %s\r\n", strings.ToLower(k), v)
+				}
+			}
+			w.Write(encode(append(grpcFrameHeader(0x80, t.Len()), t.Bytes()...)))
+		}
+	}
+}
+
+// writeJSON answers a transcoded call with its response messages, or the
+// error of its status.
+func (g *grpcHandler) writeJSON(w http.ResponseWriter, resp *http.Response) {
+	var messages [][]byte
+	var err error
+	for {
+		var msg []byte
+		if msg, err = readGRPCMessage(resp.Body); err != nil {
+			break
+		}
+		messages = append(messages, msg)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Trailers-only responses carry the status in the headers.
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if err != io.EOF && status == "" {
+		writeGRPCJSONError(w, 13, "invalid gRPC response: "+err.Error())
+		return
+	}
+	if code, _ := strconv.Atoi(status); status != "0" {
+		if status == "" {
+			code, message = 2, "missing grpc-status"
+		}
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		writeGRPCJSONError(w, code, message)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(messages) == 1 {
+		w.Write(messages[0])
+		return
+	}
+	w.Write([]byte("["))
+	for i, m := range messages {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		w.Write(m)
+	}
+	w.Write([]byte("]"))
+}
+
+// grpcHTTPStatus maps gRPC status codes to HTTP status codes as the gRPC
+// gateway does.
+var grpcHTTPStatus = map[int]int{
+	1:  499,
+	2:  http.StatusInternalServerError,
+	3:  http.StatusBadRequest,
+	4:  http.StatusGatewayTimeout,
+	5:  http.StatusNotFound,
+	6:  http.StatusConflict,
+	7:  http.StatusForbidden,
+	8:  http.StatusTooManyRequests,
+	9:  http.StatusBadRequest,
+	10: http.StatusConflict,
+	11: http.StatusBadRequest,
+	12: http.StatusNotImplemented,
+	13: http.StatusInternalServerError,
+	14: http.StatusServiceUnavailable,
+	15: http.StatusInternalServerError,
+	16: http.StatusUnauthorized,
+}
+
+func writeGRPCJSONError(w http.ResponseWriter, code int, message string) {
+	status, ok := grpcHTTPStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{code, message})
+}
+
+// grpcFrameHeader is the 5 byte header of a length-prefixed message: flags,
+// 0x80 marking gRPC-Web trailers, then the length.
+func grpcFrameHeader(flags byte, n int) []byte {
+	h := make([]byte, 5)
+	h[0] = flags
+	binary.BigEndian.PutUint32(h[1:], uint32(n))
+	return h
+}
+
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var h [5]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[0]&1 != 0 {
+		return nil, errors.New("compressed message")
+	}
+	n := binary.BigEndian.Uint32(h[1:])
+	if n > grpcMaxMessage {
+		return nil, fmt.Errorf("message of %d bytes", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg, nil
+}
+
+// decodeBase64Chunks decodes a grpc-web-text body, which may be several
+// padded base64 chunks one after the other.
+func decodeBase64Chunks(b []byte) ([]byte, error) {
+	b = bytes.Join(bytes.Fields(b), nil)
+	if len(b)%4 != 0 {
+		return nil, errors.New("truncated base64")
+	}
+	out := make([]byte, 0, len(b)/4*3)
+	var dst [3]byte
+	for i := 0; i < len(b); i += 4 {
+		n, err := base64.StdEncoding.Decode(dst[:], b[i:i+4])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, dst[:n]...)
+	}
+	return out, nil
+}
+
+// copyHeader copies response headers but for the hop-by-hop ones.
+func copyHeader(dst, src http.Header) {
+	for k, vs := range src {
+		switch k {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Content-Length":
+			continue
+		}
+		dst[k] = vs
+	}
+}
+
+// flushCopy copies a streamed body, flushing after each read so that
+// streamed messages reach the client as they come.
+func flushCopy(w http.ResponseWriter, r io.Reader, encode func([]byte) []byte) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			b := buf[:n]
+			if encode != nil {
+				b = encode(b)
+			}
+			if _, werr := w.Write(b); werr != nil {
+				return werr
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
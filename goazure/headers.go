@@ -0,0 +1,123 @@
+package goazure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type headerOps struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+func (o *headerOps) apply(h http.Header) {
+	if o == nil {
+		return
+	}
+	for _, k := range o.Remove {
+		h.Del(k)
+	}
+	for k, v := range o.Set {
+		h.Set(k, v)
+	}
+	for k, v := range o.Add {
+		h.Add(k, v)
+	}
+}
+
+// headerRule modifies request and response headers of requests whose path
+// matches, as a prefix if it ends in a slash and exactly otherwise.
+type headerRule struct {
+	Path     string     `json:"path"`
+	Request  *headerOps `json:"request,omitempty"`
+	Response *headerOps `json:"response,omitempty"`
+}
+
+func (hr *headerRule) matches(p string) bool {
+	if strings.HasSuffix(hr.Path, "/") {
+		return strings.HasPrefix(p, hr.Path)
+	}
+	return p == hr.Path
+}
+
+func loadHeaderRules(file string) ([]*headerRule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*headerRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for i, hr := range rules {
+		if !strings.HasPrefix(hr.Path, "/") {
+			return nil, fmt.Errorf("header rule %d: invalid path %q", i, hr.Path)
+		}
+	}
+	return rules, nil
+}
+
+// headerRewriter applies response header rules just before the header is
+// written, so they also cover headers copied from proxied responses.
+type headerRewriter struct {
+	http.ResponseWriter
+	ops     []*headerOps
+	written bool
+}
+
+func (hw *headerRewriter) WriteHeader(status int) {
+	if !hw.written {
+		hw.written = true
+		for _, o := range hw.ops {
+			o.apply(hw.Header())
+		}
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerRewriter) Write(b []byte) (int, error) {
+	if !hw.written {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *headerRewriter) ReadFrom(r io.Reader) (int64, error) {
+	if !hw.written {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return readFrom(hw.ResponseWriter, r)
+}
+
+func (hw *headerRewriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// withHeaders applies every matching header rule, in order.
+func withHeaders(h http.Handler, rules []*headerRule) http.Handler {
+	if len(rules) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp []*headerOps
+		for _, hr := range rules {
+			if !hr.matches(r.URL.Path) {
+				continue
+			}
+			hr.Request.apply(r.Header)
+			if hr.Response != nil {
+				resp = append(resp, hr.Response)
+			}
+		}
+		if len(resp) > 0 {
+			w = &headerRewriter{ResponseWriter: w, ops: resp}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
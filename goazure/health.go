@@ -0,0 +1,60 @@
+package goazure
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// selfURL returns the URL of path on this server's own loopback listener.
+func selfURL(path string) string {
+	scheme := "http"
+	if tlsEnabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://127.0.0.1:%d%s", scheme, listenPort(), path)
+}
+
+// waitHealthy polls url until it answers 200 OK or timeout expires. It is
+// meant for probing our own listener, so certificates are not verified.
+// Closing stop abandons the wait.
+func waitHealthy(url string, timeout time.Duration, stop <-chan struct{}) error {
+	c := loopbackClient(2 * time.Second)
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := c.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("health check returned %s", resp.Status)
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-stop:
+			return errors.New("stopped waiting for health check")
+		}
+	}
+}
+
+// loopbackClient returns a client for talking to our own listener, which
+// does not verify certificates.
+func loopbackClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
@@ -0,0 +1,49 @@
+package goazure
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var lastHeartbeat int64
+
+func init() {
+	newGaugeFunc("goazure_last_heartbeat_timestamp_seconds", "Unix time of the last heartbeat log line", func() float64 {
+		return float64(atomic.LoadInt64(&lastHeartbeat))
+	})
+}
+
+// startHeartbeat logs a one-line summary of the server's state every
+// interval until stop is closed, so that log-based monitoring can tell a hung
+// instance from an idle one without scraping metrics.
+func startHeartbeat(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	goBackground(func() {
+		last, lastTime := requestsTotal.value(), time.Now()
+		for {
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+
+			now := time.Now()
+			total := requestsTotal.value()
+			rate := float64(total-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = total, now
+
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			log.Printf("heartbeat uptime=%s connections=%d requests=%d rps=%.2f heap_mb=%.1f sys_mb=%.1f goroutines=%d draining=%t",
+				now.Sub(started).Round(time.Second), atomic.LoadInt64(&activeConns), atomic.LoadInt64(&activeRequests),
+				rate, float64(ms.HeapAlloc)/(1<<20), float64(ms.Sys)/(1<<20),
+				runtime.NumGoroutine(), isDraining())
+			atomic.StoreInt64(&lastHeartbeat, now.Unix())
+		}
+	})
+}
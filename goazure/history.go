@@ -0,0 +1,122 @@
+package goazure
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+const (
+	eventDeployment        = "deployment"
+	eventRestart           = "restart"
+	eventForcedTermination = "forced-termination"
+	eventRollback          = "rollback"
+	eventCDNPurge          = "cdn-purge"
+	eventSlotSwap          = "slot-swap"
+)
+
+type deployEvent struct {
+	Time     time.Time    `json:"time"`
+	Kind     string       `json:"kind"`
+	Artifact string       `json:"artifact,omitempty"`
+	Hash     string       `json:"hash,omitempty"`
+	Trigger  string       `json:"trigger,omitempty"`
+	Slot     string       `json:"slot,omitempty"`
+	Duration string       `json:"duration,omitempty"`
+	Outcome  string       `json:"outcome"`
+	Drain    *drainReport `json:"drain,omitempty"`
+}
+
+// history is a bounded log of deployment lifecycle events, optionally
+// persisted so that it survives the restarts it records.
+type history struct {
+	mu     sync.Mutex
+	path   string
+	max    int
+	events []deployEvent
+}
+
+var deployments = &history{max: 100}
+
+func (h *history) load(path string, max int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.path, h.max, h.events = path, max, nil
+	if path == "" {
+		return
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read deployment history: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(b, &h.events); err != nil {
+		log.Printf("Could not parse deployment history: %v", err)
+	}
+	h.trim()
+}
+
+func (h *history) record(e deployEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.events = append(h.events, e)
+	h.trim()
+	if err := h.save(); err != nil {
+		log.Printf("Could not persist deployment history: %v", err)
+	}
+}
+
+func (h *history) trim() {
+	if h.max > 0 && len(h.events) > h.max {
+		h.events = append([]deployEvent(nil), h.events[len(h.events)-h.max:]...)
+	}
+}
+
+func (h *history) save() error {
+	if h.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(h.events, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), ".history")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), h.path)
+}
+
+func (h *history) snapshot() []deployEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]deployEvent{}, h.events...)
+}
+
+func deploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	httpjson.Write(w, http.StatusOK, deployments.snapshot())
+}
@@ -0,0 +1,185 @@
+package goazure
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	requestsHeld     = newCounter("goazure_requests_held_total", "Requests parked during a drain to be replayed against the next instance")
+	requestsReplayed = newCounter("goazure_requests_replayed_total", "Parked requests replayed against the next instance")
+)
+
+const (
+	// replayedHeader marks replayed requests, which are never parked again.
+	replayedHeader = "X-Goazure-Replayed"
+	// pidHeader carries the process ID on readiness responses, so a draining
+	// process can tell its successor's answers from anyone else's.
+	pidHeader = "X-Goazure-Pid"
+)
+
+// holdQueue parks requests arriving on kept-alive connections once draining
+// has started, until the process replacing this one has recorded its
+// endpoint and answers readiness checks there. They are then proxied to it,
+// so that clients that do not retry see the new deployment instead of a
+// connection closed under them. This only helps where the platform starts
+// the next process before this one exits. A request that finds the queue
+// full, or is still waiting at the deadline, is served here.
+type holdQueue struct {
+	slots   chan struct{}
+	timeout time.Duration
+	client  *http.Client
+	local   http.Handler // serves requests the next instance could not take
+
+	mu      sync.Mutex
+	up      chan struct{} // closed once the next instance answers
+	proxy   *httputil.ReverseProxy
+	probing bool
+	waiting int
+}
+
+func newHoldQueue(size int, timeout time.Duration) *holdQueue {
+	return &holdQueue{
+		slots:   make(chan struct{}, size),
+		timeout: timeout,
+		client:  loopbackClient(time.Second),
+		up:      make(chan struct{}),
+	}
+}
+
+// holdable reports whether r may be parked and replayed: idempotent requests
+// without a body, other than health checks and admin calls.
+func holdable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return r.ContentLength == 0 && r.Header.Get(replayedHeader) == "" &&
+		r.URL.Path != "/healthz" && r.URL.Path != "/readyz" && !strings.HasPrefix(r.URL.Path, "/admin/")
+}
+
+// park waits for the next instance, returning the proxy to it, or nil if it
+// did not come up in time.
+func (q *holdQueue) park(r *http.Request) *httputil.ReverseProxy {
+	select {
+	case q.slots <- struct{}{}:
+		defer func() { <-q.slots }()
+	default:
+		return nil
+	}
+
+	q.mu.Lock()
+	if q.proxy != nil {
+		q.mu.Unlock()
+		return q.proxy
+	}
+	q.waiting++
+	if !q.probing {
+		q.probing = true
+		goBackground(q.probe)
+	}
+	q.mu.Unlock()
+	requestsHeld.inc()
+
+	defer func() {
+		q.mu.Lock()
+		q.waiting--
+		q.mu.Unlock()
+	}()
+	select {
+	case <-q.up:
+		return q.proxy
+	case <-time.After(q.timeout):
+	case <-r.Context().Done():
+	}
+	return nil
+}
+
+// probe polls for the next instance while requests are waiting.
+func (q *holdQueue) probe() {
+	for {
+		target := q.successor()
+		q.mu.Lock()
+		if target != nil {
+			q.proxy = httputil.NewSingleHostReverseProxy(target)
+			q.proxy.Transport = q.client.Transport
+			if proxyBuffers != nil {
+				q.proxy.BufferPool = proxyBuffers
+			}
+			q.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("Could not replay %s on the next instance, serving it here: %v", r.URL.Path, err)
+				q.local.ServeHTTP(w, r)
+			}
+			q.probing = false
+			close(q.up)
+			q.mu.Unlock()
+			log.Printf("Replaying held requests on the next instance at %s", target.Host)
+			return
+		}
+		if q.waiting == 0 {
+			q.probing = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// successor returns the base URL of the process replacing this one, once
+// the endpoint record names another process and that process reports ready
+// at the recorded port under its own process ID.
+func (q *holdQueue) successor() *url.URL {
+	e, ok := readAdminEndpoint()
+	if !ok || e.PID == os.Getpid() {
+		return nil
+	}
+	target := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", e.Port)}
+	if e.TLS {
+		target.Scheme = "https"
+	}
+	resp, err := q.client.Get(target.String() + "/readyz")
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(pidHeader) != strconv.Itoa(e.PID) {
+		return nil
+	}
+	return target
+}
+
+// withHoldReplay parks holdable requests received while draining and
+// replays them against the next instance. It does nothing when the server
+// does not own its listener, as then no endpoint is recorded to find the
+// next instance by.
+func withHoldReplay(h http.Handler, q *holdQueue) http.Handler {
+	if q == nil || config.Listener != nil {
+		return h
+	}
+
+	q.local = h
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isDraining() || !holdable(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		proxy := q.park(r)
+		if proxy == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		requestsReplayed.inc()
+		r.Header.Set(replayedHeader, instanceID)
+		proxy.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package goazure
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHoldReplaysOnSuccessor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced")
+	}
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	defer atomic.StoreInt32(&draining, 0)
+
+	const successorPID = 1<<22 + 7
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" {
+			w.Header().Set(pidHeader, strconv.Itoa(successorPID))
+			return
+		}
+		w.Write([]byte("next " + r.Header.Get(replayedHeader)))
+	}))
+	defer next.Close()
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local"))
+	})
+	h := withHoldReplay(local, newHoldQueue(1, 2*time.Second))
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+		return rec.Body.String()
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	done := make(chan string)
+	go func() { done <- get() }()
+
+	// The request waits until another process records its endpoint.
+	time.Sleep(300 * time.Millisecond)
+	u, _ := url.Parse(next.URL)
+	port, _ := strconv.Atoi(u.Port())
+	b, _ := json.Marshal(adminEndpoint{PID: successorPID, Port: port})
+	f, _ := adminEndpointFile()
+	if err := writePrivateFile(f, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-done; got != "next "+instanceID {
+		t.Fatalf("held request got %q, want it replayed on the successor", got)
+	}
+	if got := get(); got != "next "+instanceID {
+		t.Fatalf("later request got %q, want it replayed on the successor", got)
+	}
+}
+
+func TestHoldServesLocallyWithoutSuccessor(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	defer atomic.StoreInt32(&draining, 0)
+
+	// Our own record must not be mistaken for a successor's.
+	defer publishAdminEndpoint()()
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local"))
+	})
+	h := withHoldReplay(local, newHoldQueue(1, 300*time.Millisecond))
+
+	atomic.StoreInt32(&draining, 1)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+	if b, _ := ioutil.ReadAll(rec.Body); string(b) != "local" {
+		t.Fatalf("got %q, want the request served here at the deadline", b)
+	}
+}
@@ -0,0 +1,90 @@
+package goazure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// managedIdentity obtains access tokens for a resource from the managed
+// identity endpoint of App Service, or from the instance metadata service
+// elsewhere in Azure, and caches them until shortly before they expire.
+type managedIdentity struct {
+	resource string
+	clientID string
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newManagedIdentity(resource, clientID string) *managedIdentity {
+	return &managedIdentity{resource: resource, clientID: clientID, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// get returns a valid access token.
+func (m *managedIdentity) get() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Now().Before(m.expires.Add(-5*time.Minute)) {
+		return m.token, nil
+	}
+
+	q := url.Values{"resource": {m.resource}}
+	if m.clientID != "" {
+		q.Set("client_id", m.clientID)
+	}
+	var req *http.Request
+	var err error
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		q.Set("api-version", "2019-08-01")
+		req, err = http.NewRequest("GET", endpoint+"?"+q.Encode(), nil)
+		if err == nil {
+			req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+		}
+	} else {
+		q.Set("api-version", "2018-02-01")
+		req, err = http.NewRequest("GET", "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not reach managed identity endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("managed identity endpoint returned %s", resp.Status)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	expiresOn, err := strconv.ParseInt(t.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid token expiry %q", t.ExpiresOn)
+	}
+	m.token, m.expires = t.AccessToken, time.Unix(expiresOn, 0)
+	return m.token, nil
+}
+
+// invalidate drops the cached token after it was rejected.
+func (m *managedIdentity) invalidate() {
+	m.mu.Lock()
+	m.token = ""
+	m.mu.Unlock()
+}
@@ -0,0 +1,351 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runInit implements the "init <target>" subcommand, which generates
+// deployment scaffolding for the configuration given by the remaining flags.
+func runInit(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: go-azure-website init arm|azure|docker|systemd [flags] [dir_to_watch]")
+		os.Exit(2)
+	}
+
+	target := args[0]
+	fs := commandFlags("init " + target)
+	platform := fs.String("os", "windows", "App Service platform: windows or linux")
+	output := fs.String("o", "", "File to write to, stdout if empty")
+	unit := fs.String("unit", "service", "systemd unit to generate: service or socket")
+	watchdogSec := fs.Int("watchdogSec", 30, "WatchdogSec of the systemd service, no watchdog if 0")
+	kind := fs.String("kind", "appservice", "Resource to generate with arm: appservice or containerapp")
+	format := fs.String("format", "bicep", "Template format with arm: bicep or json")
+	name := fs.String("name", "go-azure-website", "Default resource name with arm")
+	fs.Parse(args[1:])
+
+	var buf bytes.Buffer
+	switch target {
+	case "arm":
+		if err := initARM(&buf, fs, *platform, *kind, *format, *name); err != nil {
+			log.Fatal(err)
+		}
+	case "azure":
+		if err := initAzure(&buf, fs, *platform); err != nil {
+			log.Fatal(err)
+		}
+	case "docker":
+		if err := initDocker(&buf, fs); err != nil {
+			log.Fatal(err)
+		}
+	case "systemd":
+		if err := initSystemd(&buf, fs, *unit, *watchdogSec); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown init target %q", target)
+	}
+
+	if *output == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %s", *output)
+}
+
+// serverArgs renders the flags explicitly set on fs as command line
+// arguments, leaving out those in skip.
+func serverArgs(fs *flag.FlagSet, skip ...string) []string {
+	return formatArgs(fs, quoteArg, skip...)
+}
+
+// formatArgs returns the flags set on fs other than skip and the secret
+// flags as -name=value, with values quoted by quote.
+func formatArgs(fs *flag.FlagSet, quote func(string) string, skip ...string) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		if isSecretFlag(f.Name) {
+			return
+		}
+		for _, s := range skip {
+			if f.Name == s {
+				return
+			}
+		}
+		args = append(args, "-"+f.Name+"="+quote(f.Value.String()))
+	})
+	return args
+}
+
+// givenSecrets returns the secret flags set on fs, which generated command
+// lines leave to the environment.
+func givenSecrets(fs *flag.FlagSet) []string {
+	var names []string
+	fs.Visit(func(f *flag.Flag) {
+		if isSecretFlag(f.Name) {
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
+
+// printSecretSettings lists the environment variables to set for the secret
+// flags given on fs, each line starting with prefix.
+func printSecretSettings(fs *flag.FlagSet, prefix string) {
+	for _, name := range givenSecrets(fs) {
+		fmt.Fprintf(os.Stderr, "  %s%s=<value of -%s>\n", prefix, secretEnv(name), name)
+	}
+}
+
+func quoteArg(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"") {
+		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+	}
+	return s
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// systemdQuote quotes s as a single word of a systemd unit setting, where %
+// starts a specifier.
+func systemdQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(s) + `"`
+}
+
+func initAzure(w io.Writer, fs *flag.FlagSet, platform string) error {
+	args := serverArgs(fs, "os", "o", "port")
+	watchDir := fs.Arg(0)
+
+	switch platform {
+	case "windows":
+		if watchDir == "" {
+			watchDir = `%HOME%\site\wwwroot\_target`
+		}
+		args = append([]string{"-port %HTTP_PLATFORM_PORT%"}, args...)
+		args = append(args, watchDir)
+
+		var attr bytes.Buffer
+		xml.EscapeText(&attr, []byte(strings.Join(args, " ")))
+		fmt.Fprintf(w, webConfigTemplate, attr.String())
+
+		fmt.Fprintln(os.Stderr, "Recommended App Settings:")
+		fmt.Fprintln(os.Stderr, "  SCM_COMMAND_IDLE_TIMEOUT=600")
+		printSecretSettings(fs, "")
+	case "linux":
+		if watchDir == "" {
+			watchDir = "/home/site/wwwroot/_target"
+		}
+		// The startup command is run by sh, so values are quoted for it,
+		// then the whole script once more for sh -c.
+		args = formatArgs(fs, shellQuote, "os", "o", "port")
+		args = append([]string{`-port "${PORT:-8000}"`}, args...)
+		args = append(args, shellQuote(watchDir))
+		script := `exec "$(cat /home/site/wwwroot/_artifact.txt)" ` + strings.Join(args, " ")
+		fmt.Fprintf(w, "sh -c %s\n", shellQuote(script))
+
+		fmt.Fprintln(os.Stderr, "Recommended App Settings:")
+		fmt.Fprintln(os.Stderr, "  WEBSITES_PORT=8000")
+		fmt.Fprintln(os.Stderr, "  WEBSITES_ENABLE_APP_SERVICE_STORAGE=true")
+		printSecretSettings(fs, "")
+	default:
+		return fmt.Errorf("unknown platform %q", platform)
+	}
+
+	if config.AdminToken == "" {
+		fmt.Fprintln(os.Stderr, "  Consider setting -adminToken, admin endpoints and /metrics are disabled without it")
+	}
+	return nil
+}
+
+// initDocker writes a Dockerfile running the server as PID 1. The entrypoint
+// prefers the artifact named in _artifact.txt on App Service storage, so that
+// deployments picked up by the watcher survive the container restarting.
+func initDocker(w io.Writer, fs *flag.FlagSet) error {
+	args := []string{"-port=8000"}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "os", "o", "port":
+			return
+		}
+		if !isSecretFlag(f.Name) {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	watchDir := fs.Arg(0)
+	if watchDir == "" {
+		watchDir = "/home/site/wwwroot/_target"
+	}
+	args = append(args, watchDir)
+	cmd, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, dockerfileTemplate, cmd)
+
+	fmt.Fprintln(os.Stderr, "Recommended App Settings:")
+	fmt.Fprintln(os.Stderr, "  WEBSITES_PORT=8000")
+	fmt.Fprintln(os.Stderr, "  WEBSITES_ENABLE_APP_SERVICE_STORAGE=true")
+	fmt.Fprintf(os.Stderr, "  WEBSITES_CONTAINER_STOP_TIME_LIMIT=%d\n", config.MaxWait+int(stopMargin/time.Second))
+	printSecretSettings(fs, "")
+	return nil
+}
+
+const dockerfileTemplate = `FROM golang:1 AS build
+# Dependencies are vendored under src/, as for the Kudu build in deploy.sh.
+ENV GOPATH=/src GO111MODULE=off
+WORKDIR /src
+COPY . .
+ARG VERSION=dev
+RUN CGO_ENABLED=0 go build -ldflags "-X main.version=$VERSION" -o /go-azure-website .
+
+FROM alpine:3
+COPY --from=build /go-azure-website /usr/local/bin/go-azure-website
+EXPOSE 8000
+# exec keeps the server as PID 1 so that it receives SIGTERM and drains.
+ENTRYPOINT ["/bin/sh", "-c", "exec \"$(cat /home/site/wwwroot/_artifact.txt 2>/dev/null || echo /usr/local/bin/go-azure-website)\" \"$@\"", "--"]
+CMD %s
+`
+
+// initSystemd writes a Type=notify service, or with unit "socket" the socket
+// unit to go with it when -socketActivation is set. Like the Linux startup
+// command for App Service, the service runs the artifact named in
+// _artifact.txt next to the watched directory.
+func initSystemd(w io.Writer, fs *flag.FlagSet, unit string, watchdogSec int) error {
+	if unit == "socket" {
+		fmt.Fprintf(w, systemdSocketTemplate, config.Port)
+		return nil
+	}
+	if unit != "service" {
+		return fmt.Errorf("unknown systemd unit %q", unit)
+	}
+
+	watchDir := fs.Arg(0)
+	if watchDir == "" {
+		return errors.New("init systemd requires the directory to watch")
+	}
+	watchDir, err := filepath.Abs(watchDir)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	siteDir := filepath.Dir(watchDir)
+
+	args := formatArgs(fs, shellQuote, "os", "o", "unit", "watchdogSec")
+	args = append(args, shellQuote(watchDir))
+	script := fmt.Sprintf(`exec "$(cat %s 2>/dev/null || echo %s)" %s`,
+		shellQuote(filepath.Join(siteDir, "_artifact.txt")), shellQuote(exe), strings.Join(args, " "))
+
+	var extra bytes.Buffer
+	if config.SocketActivation {
+		fmt.Fprintln(&extra, "Requires=go-azure-website.socket")
+		fmt.Fprintln(&extra, "After=go-azure-website.socket")
+	}
+	var caps string
+	if config.Port < 1024 && !config.SocketActivation {
+		caps = "AmbientCapabilities=CAP_NET_BIND_SERVICE\nCapabilityBoundingSet=CAP_NET_BIND_SERVICE\n"
+	} else {
+		caps = "CapabilityBoundingSet=\n"
+	}
+
+	var watchdog string
+	if watchdogSec > 0 {
+		watchdog = fmt.Sprintf("# Pinged at half this interval while the server answers requests, and while\n# draining.\nWatchdogSec=%d\n", watchdogSec)
+	}
+
+	fmt.Fprintf(w, systemdServiceTemplate, extra.String(),
+		strings.Replace(siteDir, "%", "%%", -1), systemdQuote(strings.Replace(script, "$", "$$", -1)), watchdog,
+		config.MaxWait+int(stopMargin/time.Second), caps, systemdQuote(siteDir))
+
+	if len(givenSecrets(fs)) > 0 {
+		fmt.Fprintln(os.Stderr, "Secrets are left out of the unit, add them with systemctl edit go-azure-website:")
+		fmt.Fprintln(os.Stderr, "  [Service]")
+		printSecretSettings(fs, "Environment=")
+	}
+	if config.SocketActivation {
+		fmt.Fprintln(os.Stderr, "Generate the socket unit with: go-azure-website init systemd -unit socket -socketActivation -port", config.Port)
+	}
+	return nil
+}
+
+const systemdServiceTemplate = `[Unit]
+Description=go-azure-website
+After=network-online.target
+Wants=network-online.target
+%s
+[Service]
+Type=notify
+WorkingDirectory=%s
+ExecStart=/bin/sh -c %s
+# The server exits after draining for a deployment and relies on being
+# restarted on the new artifact.
+Restart=always
+RestartSec=1
+%sTimeoutStopSec=%d
+KillMode=mixed
+
+NoNewPrivileges=yes
+%sProtectSystem=strict
+ReadWritePaths=%s
+ProtectHome=read-only
+# PrivateTmp is left off so that the CLI subcommands find the admin endpoint.
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectControlGroups=yes
+RestrictNamespaces=yes
+RestrictSUIDSGID=yes
+RestrictRealtime=yes
+LockPersonality=yes
+SystemCallArchitectures=native
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const systemdSocketTemplate = `[Unit]
+Description=go-azure-website listener
+
+[Socket]
+ListenStream=0.0.0.0:%d
+# Connections queue here while a drained process is restarted.
+Backlog=1024
+NoDelay=yes
+
+[Install]
+WantedBy=sockets.target
+`
+
+const webConfigTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<configuration>
+  <system.webServer>
+    <handlers>
+      <add name="httpPlatformHandler" path="*" verb="*" modules="httpPlatformHandler" resourceType="Unspecified" />
+    </handlers>
+    <httpPlatform processPath="%%HOME%%\site\wwwroot\go-azure.bat"
+                  arguments="%s"
+                  startupRetryCount="3"
+                  stdoutLogEnabled="true">
+    </httpPlatform>
+  </system.webServer>
+</configuration>
+`
@@ -0,0 +1,69 @@
+package goazure
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// terminating is set in -k8s mode from SIGTERM until draining starts, while
+// the pod is being removed from the endpoints of its Services, and likewise
+// while -rotationHook takes the instance out of rotation.
+var terminating int32
+
+func isTerminating() bool {
+	return atomic.LoadInt32(&terminating) == 1
+}
+
+// k8sTerminate fails readiness checks and keeps serving for -preStopDelay,
+// so that load balancers stop sending traffic before the listener closes.
+// Kubernetes sends SIGTERM while endpoints are still being updated, which
+// would otherwise refuse the connections of the clients slowest to notice.
+// A preStop hook sleeping for as long does the same, with -preStopDelay 0.
+func k8sTerminate(stop <-chan struct{}) {
+	atomic.StoreInt32(&terminating, 1)
+	if config.PreStopDelay <= 0 {
+		return
+	}
+	log.Printf("Failing readiness, draining in %d seconds", config.PreStopDelay)
+	select {
+	case <-clk.After(time.Duration(config.PreStopDelay) * time.Second):
+	case <-stop:
+	}
+}
+
+// terminationGracePeriod returns the pod's terminationGracePeriodSeconds,
+// which Kubernetes does not expose to containers: the pod spec has to pass it
+// as TERMINATION_GRACE_PERIOD_SECONDS. The pre-stop delay is part of it.
+func terminationGracePeriod() (time.Duration, bool) {
+	v := strings.TrimSpace(os.Getenv("TERMINATION_GRACE_PERIOD_SECONDS"))
+	if v == "" {
+		return 0, false
+	}
+	s, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring unparsable TERMINATION_GRACE_PERIOD_SECONDS %q", v)
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, s > 0
+}
+
+// exitCode returns the exit status after Run returned err. Under -k8s, a
+// drain cut short exits like a process killed by SIGTERM, as Kubernetes
+// reports it.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case !errors.Is(err, ErrDrainTimeout):
+		return 1
+	case config.K8s:
+		return 128 + int(syscall.SIGTERM)
+	}
+	return -1
+}
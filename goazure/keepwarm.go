@@ -0,0 +1,92 @@
+package goazure
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var keepWarmRounds = newCounter("goazure_keepwarm_rounds_total", "Rounds of requests keeping idle routes warm")
+
+// keepWarmer is set up by defineHandlers and started by Run.
+var keepWarmer *keepWarm
+
+// keepWarm requests routes while the server is idle, so that caches, lazily
+// initialized handlers and the connection pools to backends are ready when
+// traffic comes back, as plans without Always-On unload idle sites and
+// backends close idle connections.
+type keepWarm struct {
+	routine WarmupRoutine
+	stop    <-chan struct{}
+	running int32
+	// seen is requestsTotal after the last round, requests of which are
+	// counted too.
+	seen uint64
+}
+
+func newKeepWarm(paths string) *keepWarm {
+	var ps []string
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) == 0 {
+		return nil
+	}
+	return &keepWarm{routine: warmupRoutes(ps)}
+}
+
+// round requests the routes unless a round is running already.
+func (k *keepWarm) round() {
+	if !atomic.CompareAndSwapInt32(&k.running, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&k.running, 0)
+	keepWarmRounds.inc()
+	if err := k.routine(k.stop); err != nil {
+		log.Printf("Keep-warm requests failed: %v", err)
+	}
+	atomic.StoreUint64(&k.seen, requestsTotal.value())
+}
+
+// start runs a round every interval during which no other request came in,
+// until stop is closed.
+func (k *keepWarm) start(interval time.Duration, stop <-chan struct{}) {
+	if k == nil || interval <= 0 {
+		return
+	}
+	k.stop = stop
+	atomic.StoreUint64(&k.seen, requestsTotal.value())
+	goBackground(func() {
+		for {
+			select {
+			case <-clk.After(interval):
+			case <-stop:
+				return
+			}
+			if requestsTotal.value() == atomic.LoadUint64(&k.seen) {
+				k.round()
+			} else {
+				atomic.StoreUint64(&k.seen, requestsTotal.value())
+			}
+		}
+	})
+}
+
+// withKeepWarm starts a round in the background when the Always-On ping of
+// App Service comes in, which keeps the site loaded but only requests the
+// root, so that the routes behind it stay warm as well.
+func withKeepWarm(h http.Handler, k *keepWarm) http.Handler {
+	if k == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.UserAgent(), "AlwaysOn") && r.Header.Get(warmupHeader) == "" {
+			goBackground(k.round)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,265 @@
+package goazure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// instanceID identifies this instance among scaled-out siblings sharing the
+// same content volume.
+var instanceID = func() string {
+	if id := os.Getenv("WEBSITE_INSTANCE_ID"); id != "" {
+		return id
+	}
+	h, _ := os.Hostname()
+	return h
+}()
+
+type leaseInfo struct {
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// restartLease is a file based lease on shared storage that allows only one
+// instance at a time to restart. The lease is held across the restart and
+// released by the replacement process once it is ready, or expires.
+// Instances waiting for the lease queue up in order of arrival.
+type restartLease struct {
+	path     string
+	queueDir string
+	ticket   string
+	duration time.Duration
+}
+
+func newRestartLease(dir string, duration time.Duration) *restartLease {
+	return &restartLease{
+		path:     filepath.Join(dir, "restart.lease"),
+		queueDir: filepath.Join(dir, "restart.queue"),
+		duration: duration,
+	}
+}
+
+// enqueue takes a ticket in the restart queue, reusing one left behind by a
+// previous process of this instance.
+func (l *restartLease) enqueue() error {
+	if err := os.MkdirAll(l.queueDir, 0755); err != nil {
+		return err
+	}
+
+	tickets, err := ioutil.ReadDir(l.queueDir)
+	if err != nil {
+		return err
+	}
+	for _, t := range tickets {
+		if strings.HasSuffix(t.Name(), "-"+instanceID) {
+			l.ticket = filepath.Join(l.queueDir, t.Name())
+			return nil
+		}
+	}
+
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), instanceID)
+	l.ticket = filepath.Join(l.queueDir, name)
+	return ioutil.WriteFile(l.ticket, nil, 0644)
+}
+
+// refresh rewrites our ticket, which shows that we are still waiting, and
+// returns its new modification time. The share stamps it, so this is the
+// share's clock, which the other tickets are compared against rather than
+// our own clock that may be skewed from the other instances'.
+func (l *restartLease) refresh() (time.Time, error) {
+	f, err := os.OpenFile(l.ticket, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = f.WriteString(instanceID)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	fi, err := os.Stat(l.ticket)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// myTurn reports whether this instance holds the oldest live ticket. Waiting
+// instances refresh their ticket on every poll, so tickets of instances that
+// vanished without dequeueing go stale after the lease duration and are
+// removed.
+func (l *restartLease) myTurn() bool {
+	now, err := l.refresh()
+	if os.IsNotExist(err) {
+		// Our ticket vanished; take a new one at the back of the queue.
+		if err := l.enqueue(); err != nil {
+			log.Printf("Could not enqueue for restart: %v", err)
+		}
+		return false
+	}
+	if err != nil {
+		log.Printf("Could not refresh restart ticket: %v", err)
+		return false
+	}
+
+	tickets, err := ioutil.ReadDir(l.queueDir)
+	if err != nil {
+		log.Printf("Could not read restart queue: %v", err)
+		return false
+	}
+
+	// ReadDir sorts by name, which starts with the enqueue time.
+	for _, t := range tickets {
+		p := filepath.Join(l.queueDir, t.Name())
+		if p == l.ticket {
+			return true
+		}
+		if now.Sub(t.ModTime()) > l.duration {
+			log.Printf("Removing stale restart ticket %s", t.Name())
+			os.Remove(p)
+			continue
+		}
+		return false
+	}
+
+	// Our ticket vanished since; take a new one at the back of the queue.
+	if err := l.enqueue(); err != nil {
+		log.Printf("Could not enqueue for restart: %v", err)
+	}
+	return false
+}
+
+func (l *restartLease) dequeue() {
+	if l.ticket != "" {
+		os.Remove(l.ticket)
+		l.ticket = ""
+	}
+}
+
+func (l *restartLease) current() (leaseInfo, []byte, error) {
+	var li leaseInfo
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return li, nil, err
+	}
+	if err := json.Unmarshal(b, &li); err != nil {
+		// A lease just created is empty until written; count it as held
+		// for the lease duration from when it was created.
+		fi, serr := os.Stat(l.path)
+		if serr != nil {
+			return li, nil, serr
+		}
+		li.Expires = fi.ModTime().Add(l.duration)
+	}
+	return li, b, nil
+}
+
+func (l *restartLease) tryAcquire() (bool, error) {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		li, seen, rerr := l.current()
+		if rerr == nil && li.Holder == instanceID {
+			// Left behind by a restart of our own that never released it.
+			return true, l.write()
+		}
+		if rerr == nil && time.Now().Before(li.Expires) {
+			return false, nil
+		}
+		if rerr != nil && !os.IsNotExist(rerr) {
+			return false, rerr
+		}
+		return false, l.breakExpired(li.Holder, seen)
+	}
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	return true, l.write()
+}
+
+// breakExpired removes the expired lease whose contents were seen. Instances
+// breaking it at the same time could otherwise remove the lease one of them
+// has taken since, so it is first renamed aside, which only one can do, and
+// put back if it is not the lease that was seen to expire.
+func (l *restartLease) breakExpired(holder string, seen []byte) error {
+	if seen == nil {
+		return nil
+	}
+	aside := fmt.Sprintf("%s.%s.broken", l.path, instanceID)
+	if err := os.Rename(l.path, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := ioutil.ReadFile(aside)
+	if err == nil && string(b) != string(seen) {
+		log.Printf("Restart lease was taken while breaking it, leaving it in place")
+		return os.Rename(aside, l.path)
+	}
+	log.Printf("Broke expired restart lease held by %s", holder)
+	return os.Remove(aside)
+}
+
+func (l *restartLease) write() error {
+	now := time.Now().UTC()
+	b, _ := json.Marshal(leaseInfo{Holder: instanceID, Acquired: now, Expires: now.Add(l.duration)})
+	return ioutil.WriteFile(l.path, b, 0644)
+}
+
+// acquire blocks until it is this instance's turn and the lease is held, or
+// stop is closed.
+func (l *restartLease) acquire(stop <-chan struct{}) bool {
+	const retry = 5 * time.Second
+
+	if err := l.enqueue(); err != nil {
+		log.Printf("Could not enqueue for restart: %v", err)
+	}
+
+	logged := false
+	for {
+		if l.myTurn() {
+			ok, err := l.tryAcquire()
+			if err != nil {
+				log.Printf("Restart lease error: %v", err)
+			}
+			if ok {
+				log.Printf("Acquired restart lease %s", l.path)
+				l.dequeue()
+				return true
+			}
+		}
+		if !logged {
+			log.Println("Other instances are restarting, waiting for our turn")
+			logged = true
+		}
+
+		select {
+		case <-time.After(retry):
+		case <-stop:
+			l.dequeue()
+			return false
+		}
+	}
+}
+
+// release gives up the lease if it is held by this instance.
+func (l *restartLease) release() {
+	li, _, err := l.current()
+	if err != nil || li.Holder != instanceID {
+		return
+	}
+	if err := os.Remove(l.path); err != nil {
+		log.Printf("Could not release restart lease: %v", err)
+		return
+	}
+	log.Printf("Released restart lease %s", l.path)
+}
@@ -0,0 +1,38 @@
+package goazure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestartQueueStaleTickets(t *testing.T) {
+	l := newRestartLease(t.TempDir(), time.Minute)
+	if err := l.enqueue(); err != nil {
+		t.Fatal(err)
+	}
+	// Our own ticket is old, but we are still polling.
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(l.ticket, old, old)
+
+	ahead := filepath.Join(l.queueDir, "00000000000000000001-other")
+	if err := ioutil.WriteFile(ahead, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l.myTurn() {
+		t.Fatal("got the turn ahead of a live ticket")
+	}
+	if fi, err := os.Stat(l.ticket); err != nil || time.Since(fi.ModTime()) > time.Minute {
+		t.Fatalf("our ticket was not refreshed: %v", err)
+	}
+
+	os.Chtimes(ahead, old, old)
+	if !l.myTurn() {
+		t.Fatal("a stale ticket kept us waiting")
+	}
+	if _, err := os.Stat(ahead); !os.IsNotExist(err) {
+		t.Fatal("stale ticket not removed")
+	}
+}
@@ -0,0 +1,24 @@
+package goazure
+
+import "errors"
+
+// Errors returned by Run and Deploy, possibly wrapped; test for them with
+// errors.Is.
+var (
+	// ErrListenerClosed means the listener stopped accepting connections
+	// other than for a shutdown. Run drains before returning it.
+	ErrListenerClosed = errors.New("listener closed")
+	// ErrDrainTimeout means connections were still open at the end of the
+	// drain and the process should terminate at once.
+	ErrDrainTimeout = errors.New("drain did not complete in time, terminating")
+	// ErrWatcherFailed means deployments could no longer be detected. It is
+	// returned without serving if the watcher cannot be started and after a
+	// drain if it fails later.
+	ErrWatcherFailed = errors.New("watcher failed")
+	// ErrArtifactInvalid means a deployed artifact is missing, empty or not
+	// a regular file. The deployment is skipped and the server keeps running.
+	ErrArtifactInvalid = errors.New("invalid artifact")
+	// ErrAlreadyRunning means Run was called while another Run was serving
+	// in the same process.
+	ErrAlreadyRunning = errors.New("already running")
+)
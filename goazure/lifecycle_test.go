@@ -0,0 +1,55 @@
+package goazure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// lifecycleConfig is the flag defaults, serving on l.
+func lifecycleConfig(t *testing.T, l net.Listener) Config {
+	cfg := DefaultConfig()
+	cfg.WatchDir = t.TempDir()
+	cfg.WatchMode = watchPoll
+	cfg.IMDS = false
+	cfg.Listener = l
+	return cfg
+}
+
+func TestRunWatcherFailed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := lifecycleConfig(t, l)
+	cfg.DeployQueue = "ftp://example.com/deployments"
+	if err := Run(context.Background(), cfg); !errors.Is(err, ErrWatcherFailed) {
+		t.Fatalf("got %v, want ErrWatcherFailed", err)
+	}
+}
+
+func TestRunListenerClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- Run(context.Background(), lifecycleConfig(t, l)) }()
+
+	url := "http://" + l.Addr().String() + "/healthz"
+	if err := waitHealthy(url, 10*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrListenerClosed) {
+			t.Fatalf("got %v, want ErrListenerClosed", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after its listener closed")
+	}
+}
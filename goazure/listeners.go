@@ -0,0 +1,383 @@
+package goazure
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// ListenerGroup holds the listeners of the server, which are drained
+// together: closing the shutdown channel starts the drain once and stops all
+// of them from accepting, including those added later. A listener can be
+// disabled at runtime, refusing the connections it accepts while those open
+// already are served, and enabled again without binding anew. It can also be
+// replaced by one on another address, after which it drains on its own.
+type ListenerGroup struct {
+	mu        sync.Mutex
+	listeners []*groupListener
+	closed    bool
+	// stopped is closed once every listener stopped accepting.
+	stopped chan struct{}
+	serving sync.WaitGroup
+	// conns counts the connections accepted and not yet closed.
+	conns sync.WaitGroup
+}
+
+// listenerGroup is set by Run for the admin API.
+var listenerGroup *ListenerGroup
+
+type groupListener struct {
+	name     string
+	l        *stoppableListener
+	disabled int32
+	active   int64
+	accepted uint64
+	refused  uint64
+}
+
+func (gl *groupListener) opened() {
+	atomic.AddUint64(&gl.accepted, 1)
+	atomic.AddInt64(&gl.active, 1)
+}
+
+func (gl *groupListener) closed() {
+	atomic.AddInt64(&gl.active, -1)
+}
+
+// refuse reports whether a connection just accepted is to be closed, as the
+// listener is disabled.
+func (gl *groupListener) refuse() bool {
+	if atomic.LoadInt32(&gl.disabled) == 0 {
+		return false
+	}
+	atomic.AddUint64(&gl.refused, 1)
+	return true
+}
+
+func newListenerGroup(shutdown <-chan struct{}) *ListenerGroup {
+	g := &ListenerGroup{stopped: make(chan struct{})}
+	go func() {
+		<-shutdown
+		startDraining()
+		log.Println("Stopping listening for new connections")
+		g.mu.Lock()
+		g.closed = true
+		for _, gl := range g.listeners {
+			gl.l.Listener.Close()
+		}
+		g.mu.Unlock()
+		close(g.stopped)
+	}()
+	return g
+}
+
+// serve runs serve on sl in the background, for wait.
+func (g *ListenerGroup) serve(sl *stoppableListener, serve func(*stoppableListener)) {
+	g.serving.Add(1)
+	goBackground(func() {
+		defer g.serving.Done()
+		serve(sl)
+	})
+}
+
+// wait returns once the listeners stopped accepting and those served with
+// serve returned, by when every connection they accepted is counted.
+func (g *ListenerGroup) wait() {
+	<-g.stopped
+	g.serving.Wait()
+}
+
+// add wraps l, named for the admin API and metrics, to be served.
+func (g *ListenerGroup) add(name string, l net.Listener, shutdown <-chan struct{}) *stoppableListener {
+	gl := &groupListener{name: name}
+	gl.l = &stoppableListener{Listener: l, initShutdown: shutdown, group: gl, conns: &g.conns, retired: make(chan struct{})}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.listeners = append(g.listeners, gl)
+	if g.closed {
+		l.Close()
+	}
+	return gl.l
+}
+
+// rebind adds l in place of the listener called name, which stops accepting
+// and drains: its connections are asked to close after their current
+// request and closed while idle, then closed regardless after -maxWait. The
+// caller is to serve the returned listener.
+func (g *ListenerGroup) rebind(name string, l net.Listener, shutdown <-chan struct{}) *stoppableListener {
+	var old *groupListener
+	for _, gl := range g.snapshot() {
+		if gl.name == name && !gl.l.isRetired() {
+			old = gl
+		}
+	}
+	sl := g.add(name, l, shutdown)
+	if old == nil {
+		return sl
+	}
+	close(old.l.retired)
+	old.l.Listener.Close()
+	goBackground(func() {
+		old.drain(time.Duration(config.MaxWait)*time.Second, shutdown)
+		g.mu.Lock()
+		for i, gl := range g.listeners {
+			if gl == old {
+				g.listeners = append(g.listeners[:i:i], g.listeners[i+1:]...)
+				break
+			}
+		}
+		g.mu.Unlock()
+	})
+	return sl
+}
+
+// drain closes the idle HTTP/1 connections of a retired listener until none
+// is left, closing all of them once maxWait passed. HTTP/2 connections get a
+// GOAWAY from the server, see closableIdle. A drain of the whole server
+// takes over when shutdown is closed.
+func (gl *groupListener) drain(maxWait time.Duration, shutdown <-chan struct{}) {
+	deadline := clk.After(maxWait)
+	for atomic.LoadInt64(&gl.active) > 0 {
+		force := false
+		select {
+		case <-clk.After(250 * time.Millisecond):
+		case <-deadline:
+			force = true
+		case <-shutdown:
+			return
+		}
+		liveConns.Range(func(k, _ interface{}) bool {
+			cs := k.(*ConnTracker)
+			if cs.listener == gl && cs.conn != nil && (force || cs.closableIdle()) {
+				cs.conn.Close()
+			}
+			return true
+		})
+		if force {
+			log.Printf("Closed the remaining connections of %s after %v", gl.l.Addr(), maxWait)
+			return
+		}
+	}
+	log.Printf("Drained %s", gl.l.Addr())
+}
+
+// movedPort is the port the "port" setting moved the main listener to, 0
+// until it does.
+var movedPort int32
+
+// listenPort returns the port of the main listener.
+func listenPort() int {
+	if p := atomic.LoadInt32(&movedPort); p != 0 {
+		return int(p)
+	}
+	return config.Port
+}
+
+// watchPortSetting moves the main listener to the port in the "port" dynamic
+// setting whenever it changes, serving it with serve. The process keeps
+// running, unlike for a deployment, and connections to the old port are
+// drained while the new one takes over.
+func watchPortSetting(g *ListenerGroup, serve func(*stoppableListener), shutdown <-chan struct{}) {
+	goBackground(func() {
+		for {
+			select {
+			case <-dynamic.changed:
+			case <-shutdown:
+				return
+			}
+			v := dynamic.get("port")
+			if v == "" {
+				continue
+			}
+			port, err := strconv.Atoi(v)
+			if err != nil || port <= 0 || port > 65535 {
+				log.Printf("Ignoring invalid port setting %q", v)
+				continue
+			}
+			if port == listenPort() {
+				continue
+			}
+			if config.SocketActivation || config.Listener != nil {
+				log.Printf("Not moving to port %d, the listener was passed in", port)
+				continue
+			}
+			l, err := listenTCP(port)
+			if err != nil {
+				log.Printf("Could not move to port %d: %v", port, err)
+				continue
+			}
+			name := "http"
+			if tlsEnabled() {
+				name = "https"
+			}
+			old := listenPort()
+			sl := g.rebind(name, l, shutdown)
+			atomic.StoreInt32(&movedPort, int32(port))
+			publishAdminEndpoint()
+			log.Printf("Listening on port %d, draining port %d", port, old)
+			g.serve(sl, serve)
+		}
+	})
+}
+
+type listenerStatus struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Enabled  bool   `json:"enabled"`
+	Retired  bool   `json:"retired,omitempty"`
+	Active   int64  `json:"active"`
+	Accepted uint64 `json:"accepted"`
+	Refused  uint64 `json:"refused"`
+}
+
+func (gl *groupListener) status() listenerStatus {
+	return listenerStatus{
+		Name:     gl.name,
+		Addr:     gl.l.Addr().String(),
+		Enabled:  atomic.LoadInt32(&gl.disabled) == 0,
+		Retired:  gl.l.isRetired(),
+		Active:   atomic.LoadInt64(&gl.active),
+		Accepted: atomic.LoadUint64(&gl.accepted),
+		Refused:  atomic.LoadUint64(&gl.refused),
+	}
+}
+
+func (g *ListenerGroup) snapshot() []*groupListener {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*groupListener(nil), g.listeners...)
+}
+
+var errLastListener = errors.New("refusing to disable the last enabled listener")
+
+// setEnabled enables or disables the listener called name. The last enabled
+// listener cannot be disabled, which would leave the admin API unreachable.
+func (g *ListenerGroup) setEnabled(name string, enabled bool) (listenerStatus, error) {
+	var target *groupListener
+	others := 0
+	for _, gl := range g.snapshot() {
+		if gl.l.isRetired() {
+			continue
+		}
+		if gl.name == name {
+			target = gl
+		} else if atomic.LoadInt32(&gl.disabled) == 0 {
+			others++
+		}
+	}
+	if target == nil {
+		return listenerStatus{}, fmt.Errorf("no listener %q", name)
+	}
+	if enabled {
+		atomic.StoreInt32(&target.disabled, 0)
+	} else {
+		if others == 0 {
+			return target.status(), errLastListener
+		}
+		atomic.StoreInt32(&target.disabled, 1)
+	}
+	log.Printf("Listener %s on %s %s", name, target.l.Addr(), map[bool]string{true: "enabled", false: "disabled"}[enabled])
+	return target.status(), nil
+}
+
+// listenUnix listens on the unix socket at path, replacing a socket left
+// behind by a previous process.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Leave the file to the next process, which may have replaced it by the
+	// time this one drains.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	return l, nil
+}
+
+// listenersHandler reports the listeners, or enables or disables one:
+//
+//	GET /admin/listeners
+//	POST /admin/listeners?name=unix&enabled=false
+func listenersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		report := []listenerStatus{}
+		for _, gl := range listenerGroup.snapshot() {
+			report = append(report, gl.status())
+		}
+		httpjson.Write(w, http.StatusOK, report)
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			httpjson.Fail(w, r, http.StatusBadRequest, "enabled must be true or false")
+			return
+		}
+		if listenerGroup == nil {
+			httpjson.Fail(w, r, http.StatusNotFound, "no listeners")
+			return
+		}
+		s, err := listenerGroup.setEnabled(r.URL.Query().Get("name"), enabled)
+		switch {
+		case err == errLastListener:
+			httpjson.Fail(w, r, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			httpjson.Fail(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		httpjson.Write(w, http.StatusOK, s)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listenerMetrics writes the connection counts of each listener.
+type listenerMetrics struct{}
+
+func (listenerMetrics) name() string { return "goazure_listener_connections" }
+
+func (listenerMetrics) write(w *metricsWriter) {
+	gls := listenerGroup.snapshot()
+	if len(gls) == 0 {
+		return
+	}
+	w.header("goazure_listener_connections", "Open client connections per listener", "gauge")
+	for _, gl := range gls {
+		w.labeled("goazure_listener_connections", `listener="`+escapeLabel(gl.name)+`"`, float64(atomic.LoadInt64(&gl.active)))
+	}
+	w.header("goazure_listener_accepted_total", "Connections accepted per listener", "counter")
+	for _, gl := range gls {
+		w.labeled("goazure_listener_accepted_total", `listener="`+escapeLabel(gl.name)+`"`, float64(atomic.LoadUint64(&gl.accepted)))
+	}
+	w.header("goazure_listener_refused_total", "Connections refused per listener while disabled", "counter")
+	for _, gl := range gls {
+		w.labeled("goazure_listener_refused_total", `listener="`+escapeLabel(gl.name)+`"`, float64(atomic.LoadUint64(&gl.refused)))
+	}
+	w.header("goazure_listener_enabled", "Whether the listener accepts connections", "gauge")
+	for _, gl := range gls {
+		v := 1.0
+		if atomic.LoadInt32(&gl.disabled) == 1 {
+			v = 0
+		}
+		w.labeled("goazure_listener_enabled", `listener="`+escapeLabel(gl.name)+`"`, v)
+	}
+}
+
+func init() {
+	register(listenerMetrics{})
+}
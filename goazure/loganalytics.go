@@ -0,0 +1,252 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	logRecordsShipped = newCounter("goazure_log_records_shipped_total", "Log records shipped to Log Analytics")
+	logRecordsLost    = newCounter("goazure_log_records_lost_total", "Log records not shipped to Log Analytics because the buffer was full or retries ran out")
+)
+
+const (
+	logShipInterval = 5 * time.Second
+	logShipBuffer   = 10000
+	logShipMaxBatch = 1000
+	logShipMaxBytes = 900 << 10 // the Logs Ingestion API accepts up to 1 MB per call
+	logShipRetries  = 5
+)
+
+// logRecord is a log line as sent to the Logs Ingestion API. The data
+// collection rule's stream needs matching columns.
+type logRecord struct {
+	TimeGenerated time.Time `json:"TimeGenerated"`
+	Stream        string    `json:"Stream"`
+	Instance      string    `json:"Instance"`
+	Site          string    `json:"Site,omitempty"`
+	Region        string    `json:"Region,omitempty"`
+	SKU           string    `json:"SKU,omitempty"`
+	Message       string    `json:"Message"`
+}
+
+// logShipper batches log lines and posts them to a Log Analytics workspace
+// through a data collection rule, authenticating with the managed identity.
+// Logs thus survive the recycling of the instance that wrote them.
+type logShipper struct {
+	url      string
+	identity *managedIdentity
+	client   *http.Client
+	site     string
+	records  chan logRecord
+	flushes  chan chan struct{}
+}
+
+var shipper *logShipper
+
+// newLogShipper takes the Logs Ingestion URL of a stream, such as
+// https://<endpoint>.ingest.monitor.azure.com/dataCollectionRules/<rule id>/streams/Custom-<table>.
+func newLogShipper(ingestURL, clientID string) (*logShipper, error) {
+	u, err := url.Parse(ingestURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || !strings.Contains(u.Path, "/dataCollectionRules/") || !strings.Contains(u.Path, "/streams/") {
+		return nil, errors.New("need an https URL of the form .../dataCollectionRules/<rule id>/streams/<stream>")
+	}
+	q := u.Query()
+	if q.Get("api-version") == "" {
+		q.Set("api-version", "2023-01-01")
+		u.RawQuery = q.Encode()
+	}
+	s := &logShipper{
+		url:      u.String(),
+		identity: newManagedIdentity("https://monitor.azure.com", clientID),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		site:     os.Getenv("WEBSITE_SITE_NAME"),
+		records:  make(chan logRecord, logShipBuffer),
+		flushes:  make(chan chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// writer returns a log output shipping each line as a record of stream.
+func (s *logShipper) writer(stream string) io.Writer {
+	return logStreamWriter{s: s, stream: stream}
+}
+
+type logStreamWriter struct {
+	s      *logShipper
+	stream string
+}
+
+func (w logStreamWriter) Write(p []byte) (int, error) {
+	r := logRecord{
+		TimeGenerated: time.Now().UTC(),
+		Stream:        w.stream,
+		Instance:      instanceID,
+		Site:          w.s.site,
+		Message:       logMessage(p),
+	}
+	if m := metadata; m != nil {
+		r.Region, r.SKU = m.Region, m.SKU
+	}
+	select {
+	case w.s.records <- r:
+	default:
+		logRecordsLost.inc()
+	}
+	return len(p), nil
+}
+
+// logMessage strips the standard logger's date and time prefix, which
+// TimeGenerated replaces, and the trailing newline.
+func logMessage(p []byte) string {
+	const layout = "2006/01/02 15:04:05 "
+	m := strings.TrimSuffix(string(p), "\n")
+	if len(m) >= len(layout) {
+		if _, err := time.Parse(layout, m[:len(layout)]); err == nil {
+			m = m[len(layout):]
+		}
+	}
+	return m
+}
+
+func (s *logShipper) run() {
+	var batch []logRecord
+	tick := time.NewTicker(logShipInterval)
+	for {
+		select {
+		case r := <-s.records:
+			if batch = append(batch, r); len(batch) >= logShipMaxBatch {
+				s.send(batch)
+				batch = nil
+			}
+		case <-tick.C:
+			s.send(batch)
+			batch = nil
+		case done := <-s.flushes:
+			for n := len(s.records); n > 0; n-- {
+				batch = append(batch, <-s.records)
+			}
+			s.send(batch)
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+// flush ships everything logged so far, giving up after timeout.
+func (s *logShipper) flush(timeout time.Duration) {
+	done := make(chan struct{})
+	select {
+	case s.flushes <- done:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		sinkLog.Printf("Gave up waiting for logs to be shipped to Log Analytics after %v", timeout)
+	}
+}
+
+// send posts records in calls within the API's size limit.
+func (s *logShipper) send(records []logRecord) {
+	var body bytes.Buffer
+	n := 0
+	for i, r := range records {
+		b, _ := json.Marshal(r)
+		if n > 0 && body.Len()+len(b)+2 > logShipMaxBytes {
+			body.WriteByte(']')
+			s.post(body.Bytes(), n)
+			body.Reset()
+			n = 0
+		}
+		if n == 0 {
+			body.WriteByte('[')
+		} else {
+			body.WriteByte(',')
+		}
+		body.Write(b)
+		n++
+		if i == len(records)-1 {
+			body.WriteByte(']')
+			s.post(body.Bytes(), n)
+		}
+	}
+}
+
+// post sends a batch, retrying throttled and failed calls with exponential
+// backoff before counting the records as lost.
+func (s *logShipper) post(body []byte, n int) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, retryAfter, err := s.postOnce(body)
+		if err == nil {
+			for i := 0; i < n; i++ {
+				logRecordsShipped.inc()
+			}
+			return
+		}
+		if !retry || attempt == logShipRetries {
+			sinkLog.Printf("Could not ship %d log records to Log Analytics: %v", n, err)
+			for i := 0; i < n; i++ {
+				logRecordsLost.inc()
+			}
+			return
+		}
+		if retryAfter <= 0 {
+			retryAfter = backoff
+		}
+		time.Sleep(retryAfter)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// postOnce makes a single call, reporting whether a failure is worth
+// retrying and after how long if the service said so.
+func (s *logShipper) postOnce(body []byte) (retry bool, retryAfter time.Duration, err error) {
+	token, err := s.identity.get()
+	if err != nil {
+		return true, 0, err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	err = fmt.Errorf("Log Analytics returned %s", resp.Status)
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, 0, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		s.identity.invalidate()
+		return true, 0, err
+	case resp.StatusCode == http.StatusTooManyRequests:
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return true, time.Duration(secs) * time.Second, err
+	}
+	return resp.StatusCode >= 500, 0, err
+}
@@ -0,0 +1,96 @@
+package goazure
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+var logsDropped = newCounter("goazure_log_lines_dropped_total", "Log lines dropped because the log buffer was full")
+
+// connLog carries per-connection and per-request logging, which is moved off
+// the hot path when -logBuffer is set. Lifecycle logging stays on the
+// synchronous standard logger so nothing is lost on log.Fatal.
+var connLog = log.New(os.Stderr, "", log.LstdFlags)
+
+type logItem struct {
+	line    []byte
+	flushed chan struct{}
+}
+
+// asyncWriter hands writes to a dedicated goroutine that writes them out in
+// batches. When its buffer is full it either blocks or drops the write.
+type asyncWriter struct {
+	ch   chan logItem
+	out  io.Writer
+	drop bool
+}
+
+func newAsyncWriter(out io.Writer, size int, drop bool) *asyncWriter {
+	a := &asyncWriter{ch: make(chan logItem, size), out: out, drop: drop}
+	go a.run()
+	return a
+}
+
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	item := logItem{line: append([]byte(nil), p...)}
+	if !a.drop {
+		a.ch <- item
+		return len(p), nil
+	}
+
+	select {
+	case a.ch <- item:
+	default:
+		logsDropped.inc()
+	}
+	return len(p), nil
+}
+
+func (a *asyncWriter) run() {
+	bw := bufio.NewWriterSize(a.out, 64<<10)
+	for item := range a.ch {
+		a.write(bw, item)
+		for n := len(a.ch); n > 0; n-- {
+			a.write(bw, <-a.ch)
+		}
+		bw.Flush()
+	}
+}
+
+func (a *asyncWriter) write(bw *bufio.Writer, item logItem) {
+	if item.flushed != nil {
+		bw.Flush()
+		close(item.flushed)
+		return
+	}
+	bw.Write(item.line)
+}
+
+// flush blocks until everything written so far is out.
+func (a *asyncWriter) flush() {
+	done := make(chan struct{})
+	a.ch <- logItem{flushed: done}
+	<-done
+}
+
+var connLogWriter *asyncWriter
+
+func flushLogs() {
+	if connLogWriter != nil {
+		connLogWriter.flush()
+	}
+	for _, flush := range sinkFlushes {
+		flush(10 * time.Second)
+	}
+}
+
+func setupConnLog() {
+	if config.LogBuffer <= 0 {
+		return
+	}
+	connLogWriter = newAsyncWriter(connLog.Writer(), config.LogBuffer, config.LogDrop)
+	connLog.SetOutput(connLogWriter)
+}
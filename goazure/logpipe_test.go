@@ -0,0 +1,70 @@
+package goazure
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+// BenchmarkConnLog logs connection lines to a file synchronously and through
+// the asynchronous writer, from as many goroutines as connections would.
+func BenchmarkConnLog(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		async bool
+	}{
+		{"Sync", false},
+		{"Async", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			f, err := os.Create(b.TempDir() + "/conn.log")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			l := log.New(f, "", log.LstdFlags)
+			var a *asyncWriter
+			if bc.async {
+				a = newAsyncWriter(f, 4096, false)
+				l.SetOutput(a)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					l.Printf("connection to %s closed", "203.0.113.7:51234")
+				}
+			})
+			if a != nil {
+				a.flush()
+			}
+		})
+	}
+}
+
+type lockedBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.Buffer.Write(p)
+}
+
+func TestAsyncWriterFlush(t *testing.T) {
+	var out lockedBuffer
+	a := newAsyncWriter(&out, 16, false)
+	for i := 0; i < 100; i++ {
+		a.Write([]byte("line\n"))
+	}
+	a.flush()
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if n := bytes.Count(out.Bytes(), []byte("line\n")); n != 100 {
+		t.Fatalf("got %d lines after flush, want 100", n)
+	}
+}
@@ -0,0 +1,134 @@
+package goazure
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// sinkLog reports log sink problems on stderr only, as reporting them
+// through the logs being shipped could feed back into the failing sink.
+var sinkLog = log.New(os.Stderr, "", log.LstdFlags)
+
+// logStreams are the names of the logs that can be sent to sinks: lifecycle
+// is the standard logger and access is connLog.
+var logStreams = []string{"lifecycle", "access"}
+
+// logSink sends a log stream to a destination besides stderr.
+type logSink struct {
+	stream string // lifecycle, access or all
+	target string
+}
+
+// logSinks holds the sinks configured with -logSink, given as comma
+// separated "STREAM=SINK" entries.
+type logSinks []logSink
+
+func (ls *logSinks) String() string {
+	s := make([]string, len(*ls))
+	for i, l := range *ls {
+		s[i] = l.stream + "=" + l.target
+	}
+	return strings.Join(s, ",")
+}
+
+func (ls *logSinks) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return fmt.Errorf("invalid log sink %q, expected STREAM=SINK", spec)
+		}
+		l := logSink{stream: spec[:eq], target: spec[eq+1:]}
+		switch l.stream {
+		case "lifecycle", "access", "all":
+		default:
+			return fmt.Errorf("invalid log stream in %q, expected lifecycle, access or all", spec)
+		}
+		switch {
+		case strings.HasPrefix(l.target, "syslog+udp://"), strings.HasPrefix(l.target, "syslog+tcp://"),
+			strings.HasPrefix(l.target, "syslog+tls://"):
+		case l.target == "eventlog", strings.HasPrefix(l.target, "eventlog:"):
+		case l.target == "loganalytics":
+		default:
+			return fmt.Errorf("invalid sink in %q, expected syslog+udp|tcp|tls://HOST:PORT, eventlog[:SOURCE] or loganalytics", spec)
+		}
+		*ls = append(*ls, l)
+	}
+	return nil
+}
+
+func (l logSink) has(stream string) bool {
+	return l.stream == "all" || l.stream == stream
+}
+
+// open returns a writer sending the lines of stream to the sink.
+func (l logSink) open(stream string) (io.Writer, error) {
+	switch {
+	case strings.HasPrefix(l.target, "syslog+"):
+		scheme := strings.SplitN(strings.TrimPrefix(l.target, "syslog+"), "://", 2)
+		return newSyslogWriter(scheme[0], scheme[1], stream)
+	case strings.HasPrefix(l.target, "eventlog"):
+		source := strings.TrimPrefix(strings.TrimPrefix(l.target, "eventlog"), ":")
+		if source == "" {
+			source = "go-azure-website"
+		}
+		return newEventLogWriter(source)
+	case l.target == "loganalytics":
+		if shipper == nil {
+			return nil, fmt.Errorf("loganalytics sink requires -logAnalytics")
+		}
+		return shipper.writer(stream), nil
+	}
+	return nil, fmt.Errorf("unknown sink %q", l.target)
+}
+
+// sinkFlushes wait for sinks writing asynchronously to send what they have.
+var sinkFlushes []func(timeout time.Duration)
+
+// setupLogSinks tees the log streams to the sinks configured with -logSink.
+// With -logAnalytics and no loganalytics sink, both streams are shipped.
+func setupLogSinks() {
+	sinks := config.LogSinks
+	if config.LogAnalyticsURL != "" {
+		s, err := newLogShipper(config.LogAnalyticsURL, config.IdentityClientID)
+		if err != nil {
+			log.Fatalf("Invalid -logAnalytics: %v", err)
+		}
+		shipper = s
+		sinkFlushes = append(sinkFlushes, s.flush)
+		if !strings.Contains(sinks.String(), "=loganalytics") {
+			sinks = append(sinks, logSink{stream: "all", target: "loganalytics"})
+		}
+	}
+	if len(sinks) == 0 {
+		return
+	}
+
+	outputs := map[string][]io.Writer{
+		"lifecycle": {log.Writer()},
+		"access":    {connLog.Writer()},
+	}
+	for _, l := range sinks {
+		for _, stream := range logStreams {
+			if !l.has(stream) {
+				continue
+			}
+			w, err := l.open(stream)
+			if err != nil {
+				log.Fatalf("Could not open log sink %s: %v", l.target, err)
+			}
+			outputs[stream] = append(outputs[stream], w)
+		}
+	}
+	log.SetOutput(io.MultiWriter(outputs["lifecycle"]...))
+	connLog.SetOutput(io.MultiWriter(outputs["access"]...))
+	log.Printf("Log sinks: %s", sinks.String())
+}
@@ -0,0 +1,1189 @@
+// Package goazure is the go-azure-website server: it serves a site and, when
+// a new build is deployed to the watched directory, drains its clients and
+// exits for the platform to start the new build. Run is the lifecycle for
+// embedding it, and Main the command line built on top.
+package goazure
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hruan/go-azure/goazure/internal/clock"
+)
+
+// Config holds the server configuration. The fields up to WatchDir are set
+// from the command line flags by RegisterFlags, and DefaultConfig returns
+// their defaults.
+type Config struct {
+	Port               int
+	MaxWait            int
+	MinRestartInterval int
+	DeployWindows      windows
+	AdminToken         string
+	HistoryFile        string
+	HistorySize        int
+	LockDir            string
+	LeaseDuration      int
+	DeployQueue        string
+	DeployQueuePoison  string
+	AppConfigPrefix    string
+	AppConfigLabel     string
+	AppConfigInterval  int
+	WatchMode          string
+	PollInterval       int
+	RouteTimeouts      routeTimeouts
+	CacheSize          int
+	CacheTTL           int
+	StaticDir          string
+	SPA                bool
+	RulesFile          string
+	TLSCert            string
+	TLSKey             string
+	HTTPRedirectPort   int
+	ACMEDir            string
+	VhostsFile         string
+	ErrorPagesDir      string
+	HeadersFile        string
+	DefaultStatus      int
+	DefaultContentType string
+	DefaultBody        string
+	DefaultBodyFile    string
+	Upload             bool
+	UploadDir          string
+	UploadMaxSize      int
+	Workers            int
+	QueueDepth         int
+	FDHighWater        int
+	TCPKeepAlive       int
+	TCPNoDelay         bool
+	TCPLinger          int
+	ListenBacklog      int
+	DisableKeepAlives  bool
+	MaxConnRequests    int
+	MaxConnAge         int
+	ProxyBufferSize    int
+	MaxProcs           int
+	MemLimit           int
+	MemLimitPercent    int
+	LogBuffer          int
+	LogDrop            bool
+	WatchdogInterval   int
+	HeartbeatInterval  int
+	StatsdAddr         string
+	LogAnalyticsURL    string
+	IdentityClientID   string
+	LogSinks           logSinks
+	SlowRequestMs      int
+	SLOTarget          float64
+	SLOLatencyMs       int
+	SLOWebhook         string
+	SLOBurnRate        float64
+	Dependencies       dependencies
+	DependencyTimeout  int
+	DependencyCacheTTL int
+	PluginsFile        string
+	ScriptFile         string
+	CertsFile          string
+	CertRefresh        int
+	TicketKeyRotation  int
+	TicketKeyDir       string
+	OCSPStapling       bool
+	K8s                bool
+	PreStopDelay       int
+	HoldRequests       int
+	HoldTimeout        int
+	ProxyMaxConns      int
+	ProxyMaxIdle       int
+	ProxyTryTimeout    int
+	ProxyRetries       int
+	ProxyRetryBudget   int
+	BreakerFailures    int
+	BreakerCooldown    int
+	BackendCheck       int
+	ProxyBufferBody    int
+	WSIdleTimeout      int
+	CDNPurge           string
+	CDNPurgePaths      string
+	RotationHook       string
+	RotationDelay      int
+	WarmupPaths        string
+	WarmupTimeout      int
+	KeepWarm           int
+	KeepWarmPaths      string
+	IMDS               bool
+	UnixSocket         string
+	DrainPolicy        string
+	ShedLatencyMs      int
+	ShedQueue          int
+	ShedGoroutines     int
+	BrownoutFile       string
+	BrownoutAt         int
+	WaitFor            waitTargets
+	WaitForTimeout     int
+	TemplatesDir       string
+	UploadRoutes       string
+	StaticBlob         string
+	StaticBlobCache    string
+	StaticBlobSync     int
+	OutboundTimeout    int
+	OutboundRetries    int
+	LogFormat          string
+	StatsdTags         string
+	StatsdInterval     int
+	ProfileDir         string
+	DrainProfileAfter  int
+	Coalesce           bool
+	DrainStallTimeout  int
+	ArtifactFile       string
+	SocketActivation   bool
+	ChaosFile          string
+	RecordEvents       string
+
+	// WatchDir is the directory watched for deployments, the argument of
+	// serve.
+	WatchDir string
+
+	// Listener, if set, is served instead of listening on Port.
+	Listener net.Listener
+	// Clock, if set, replaces the system clock for drain timeouts and
+	// deployment scheduling.
+	Clock Clock
+}
+
+// config is the configuration in use, set from Config by Run.
+var config = DefaultConfig()
+
+// DefaultConfig returns the configuration serve runs with when no flags are
+// given.
+func DefaultConfig() Config {
+	var c Config
+	RegisterFlags(flag.NewFlagSet("", flag.ContinueOnError), &c)
+	return c
+}
+
+var started = time.Now()
+
+type semConn struct {
+	net.Conn
+	state *ConnTracker
+	conns *sync.WaitGroup
+}
+
+// running is held by Run while it serves.
+var running sync.Mutex
+
+// background tracks goroutines started by Run, which waits for them before
+// returning.
+var background sync.WaitGroup
+
+func goBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+func (c semConn) Close() error {
+	// net/http may close a connection twice, e.g. when it closes idle
+	// connections while the connection is finishing on its own.
+	err := net.ErrClosed
+	c.state.once.Do(func() {
+		lingerOnDrain(c.Conn)
+		err = c.Conn.Close()
+		c.state.closed()
+		connLog.Printf("connection to %s closed", c.Conn.RemoteAddr())
+		c.conns.Done()
+	})
+	return err
+}
+
+type stoppableListener struct {
+	net.Listener
+	initShutdown <-chan struct{}
+	group        *groupListener
+	conns        *sync.WaitGroup
+	// retired is closed when another listener replaces this one, which then
+	// drains on its own.
+	retired chan struct{}
+}
+
+func (l *stoppableListener) isRetired() bool {
+	select {
+	case <-l.retired:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *stoppableListener) Accept() (c net.Conn, err error) {
+	var backoff time.Duration
+	for {
+		waitFDs(l.initShutdown)
+		c, err = l.Listener.Accept()
+		if err == nil && l.group != nil && l.group.refuse() {
+			c.Close()
+			continue
+		}
+		if err == nil {
+			break
+		}
+
+		select {
+		case <-l.initShutdown:
+			return
+		case <-l.retired:
+			return
+		default:
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil, fmt.Errorf("%w: %v", ErrListenerClosed, err)
+		}
+
+		// Keep serving through transient failures such as running out of
+		// file descriptors rather than letting Serve return and shut down.
+		acceptErrors.inc()
+		if backoff == 0 {
+			backoff = 5 * time.Millisecond
+		} else if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+		log.Printf("Accept error: %v; retrying in %v", err, backoff)
+		time.Sleep(backoff)
+	}
+
+	connLog.Printf("new connection from %s", c.RemoteAddr())
+	tuneConn(c)
+	cs := &ConnTracker{start: time.Now(), listener: l.group, conn: c, maxAge: connAgeLimit()}
+	cs.opened()
+	c = semConn{Conn: c, state: cs, conns: l.conns}
+	l.conns.Add(1)
+
+	return
+}
+
+// RegisterFlags defines the command line flags of serve on fs, storing
+// their values in c.
+func RegisterFlags(fs *flag.FlagSet, c *Config) {
+	fs.IntVar(&c.Port, "port", 8000, "HTTP port")
+	fs.IntVar(&c.MaxWait, "maxWait", 30, "Max seconds to wait clients before forcible termination, capped to fit the stop time limit of the platform")
+	fs.IntVar(&c.MinRestartInterval, "minRestartInterval", 0, "Min seconds between process start and a deployment-triggered restart, 0 to restart right away")
+	fs.Var(&c.DeployWindows, "deployWindow", "Comma separated UTC windows (HH:MM-HH:MM) in which deployments are applied, prefix with ! to exclude")
+	fs.StringVar(&c.AdminToken, "adminToken", "", "Bearer token for /admin endpoints and /metrics, which are disabled if empty; also read from GOAZURE_ADMIN_TOKEN")
+	fs.StringVar(&c.HistoryFile, "historyFile", "", "File to persist deployment history in, kept in memory only if empty")
+	fs.IntVar(&c.HistorySize, "historySize", 100, "Max number of deployment history events to keep")
+	fs.StringVar(&c.LockDir, "lockDir", "", "Shared directory used to restart scaled-out instances one at a time, disabled if empty")
+	fs.IntVar(&c.LeaseDuration, "leaseDuration", 180, "Seconds before an unreleased restart lease expires")
+	fs.StringVar(&c.DeployQueue, "deployQueue", "", "Azure Storage Queue URL, including SAS token, to receive restart commands from; also read from GOAZURE_DEPLOY_QUEUE")
+	fs.StringVar(&c.DeployQueuePoison, "deployQueuePoison", "", "Azure Storage Queue URL, including SAS token, to move failing -deployQueue messages to, <queue>-poison with the SAS of -deployQueue if empty; also read from GOAZURE_DEPLOY_QUEUE_POISON")
+	fs.StringVar(&c.AppConfigPrefix, "appConfigPrefix", "go-azure:", "Key prefix of settings read from Azure App Configuration")
+	fs.StringVar(&c.AppConfigLabel, "appConfigLabel", "", "Label of settings read from Azure App Configuration")
+	fs.IntVar(&c.AppConfigInterval, "appConfigInterval", 30, "Seconds between Azure App Configuration refreshes")
+	fs.StringVar(&c.WatchMode, "watchMode", "auto", "How to detect new binaries: notify, poll or auto to pick by storage type")
+	fs.IntVar(&c.PollInterval, "pollInterval", 5, "Seconds between directory listings in poll watch mode")
+	fs.Var(&c.RouteTimeouts, "routeTimeout", "Comma separated per-route handler timeouts as [METHOD ]PATH=SECONDS, paths ending in / match as prefix")
+	fs.IntVar(&c.CacheSize, "cacheSize", 0, "Size in MB of the in-memory GET response cache, disabled if 0")
+	fs.IntVar(&c.CacheTTL, "cacheTTL", 60, "Max seconds to keep a cached response")
+	fs.StringVar(&c.StaticDir, "staticDir", "", "Directory to serve static files from instead of the default response")
+	fs.BoolVar(&c.SPA, "spa", false, "Serve index.html for unknown static paths without a file extension")
+	fs.StringVar(&c.RulesFile, "rules", "", "JSON file with rewrite and redirect rules applied before routing")
+	fs.StringVar(&c.TLSCert, "tlsCert", "", "TLS certificate file, serves HTTPS together with -tlsKey")
+	fs.StringVar(&c.TLSKey, "tlsKey", "", "TLS private key file")
+	fs.IntVar(&c.HTTPRedirectPort, "httpRedirectPort", 0, "Plain HTTP port redirecting to HTTPS when TLS is enabled, disabled if 0")
+	fs.StringVar(&c.ACMEDir, "acmeDir", "", "Directory with ACME HTTP-01 challenge tokens served on the redirect port")
+	fs.StringVar(&c.VhostsFile, "vhosts", "", "JSON file scoping static roots and proxy targets by Host header")
+	fs.StringVar(&c.ErrorPagesDir, "errorPages", "", "Directory with 404, 500 and 503 error pages as <status>.html templates or <status>.json")
+	fs.StringVar(&c.HeadersFile, "headers", "", "JSON file with per-route request and response header rules")
+	fs.IntVar(&c.DefaultStatus, "defaultStatus", http.StatusOK, "Status code of the default response")
+	fs.StringVar(&c.DefaultContentType, "defaultContentType", "application/json", "Content type of the default response")
+	fs.StringVar(&c.DefaultBody, "defaultBody", `{"message": "Hello from Azure Websites!"}`, "Default response body, a text/template with .Instance, .Version, .Host, .Path, .Time and .Uptime")
+	fs.StringVar(&c.DefaultBodyFile, "defaultBodyFile", "", "File to read the default response body template from, overrides -defaultBody")
+	fs.BoolVar(&c.Upload, "upload", false, "Accept resumable artifact uploads on /upload/, requires -adminToken")
+	fs.StringVar(&c.UploadDir, "uploadDir", "", "Directory to store uploads in, the watched directory if empty")
+	fs.IntVar(&c.UploadMaxSize, "uploadMaxSize", 512, "Max upload size in MB")
+	fs.IntVar(&c.Workers, "workers", 0, "Max concurrently handled requests, unbounded if 0")
+	fs.IntVar(&c.QueueDepth, "queueDepth", 100, "Max requests waiting for a worker before new ones are shed with 503")
+	fs.IntVar(&c.FDHighWater, "fdHighWater", 90, "Percentage of the file descriptor limit in use at which accepting connections pauses")
+	fs.IntVar(&c.TCPKeepAlive, "tcpKeepAlive", 0, "TCP keep-alive period in seconds, system default if 0, disabled if negative")
+	fs.BoolVar(&c.TCPNoDelay, "tcpNoDelay", true, "Disable Nagle's algorithm on client connections")
+	fs.IntVar(&c.TCPLinger, "tcpLinger", -1, "SO_LINGER seconds for connections closed while draining, 0 resets them, system default if negative")
+	fs.IntVar(&c.ListenBacklog, "listenBacklog", 0, "Listen backlog (Linux only), system default if 0")
+	fs.BoolVar(&c.DisableKeepAlives, "disableKeepAlives", false, "Close connections after every request")
+	fs.IntVar(&c.MaxConnRequests, "maxConnRequests", 0, "Max requests served per connection, unlimited if 0")
+	fs.IntVar(&c.MaxConnAge, "maxConnAge", 0, "Seconds after which connections are closed after their current request or while idle, give or take 10% so that clients do not reconnect all at once, unlimited if 0")
+	fs.IntVar(&c.ProxyBufferSize, "proxyBufferSize", 32, "Size in KB of pooled reverse proxy copy buffers")
+	fs.IntVar(&c.MaxProcs, "maxProcs", 0, "GOMAXPROCS, derived from the container CPU limit if 0")
+	fs.IntVar(&c.MemLimit, "memLimit", 0, "Soft memory limit in MB, derived from the container memory limit if 0")
+	fs.IntVar(&c.MemLimitPercent, "memLimitPercent", 90, "Percentage of the container memory limit to use as soft memory limit")
+	fs.IntVar(&c.LogBuffer, "logBuffer", 4096, "Connection log lines buffered for asynchronous writing, synchronous if 0")
+	fs.BoolVar(&c.LogDrop, "logDrop", false, "Drop connection log lines when the log buffer is full instead of blocking")
+	fs.IntVar(&c.WatchdogInterval, "watchdogInterval", 60, "Seconds between goroutine and heap leak watchdog samples, disabled if 0")
+	fs.IntVar(&c.HeartbeatInterval, "heartbeatInterval", 0, "Seconds between heartbeat log lines with uptime, connections, request rate and memory, disabled if 0")
+	fs.StringVar(&c.StatsdAddr, "statsd", "", "host:port of a statsd or DogStatsD agent to push metrics to over UDP, disabled if empty")
+	fs.StringVar(&c.StatsdTags, "statsdTags", "", "Comma separated DogStatsD tags as name:value added to pushed metrics")
+	fs.IntVar(&c.StatsdInterval, "statsdInterval", 10, "Seconds between metric pushes to statsd")
+	fs.StringVar(&c.LogAnalyticsURL, "logAnalytics", "", "Logs Ingestion API stream URL of a data collection rule to ship logs to a Log Analytics workspace, disabled if empty")
+	fs.StringVar(&c.IdentityClientID, "identityClientID", "", "Client ID of the user-assigned managed identity to authenticate to Azure with, system-assigned if empty")
+	fs.Var(&c.LogSinks, "logSink", "Comma separated STREAM=SINK entries sending the lifecycle, access or all logs to syslog+udp|tcp|tls://HOST:PORT, eventlog[:SOURCE] or loganalytics")
+	fs.IntVar(&c.SlowRequestMs, "slowRequestMs", 0, "Log and count requests taking longer than this many milliseconds, disabled if 0")
+	fs.Float64Var(&c.SLOTarget, "sloTarget", 0, "Percentage of requests that must succeed, and be faster than -sloLatencyMs if set, to track an SLO on /admin/slo, disabled if 0")
+	fs.IntVar(&c.SLOLatencyMs, "sloLatencyMs", 0, "Latency objective in milliseconds counted against -sloTarget, none if 0")
+	fs.StringVar(&c.SLOWebhook, "sloWebhook", "", "URL to POST a JSON alert to when the error budget burns fast; also read from GOAZURE_SLO_WEBHOOK")
+	fs.Float64Var(&c.SLOBurnRate, "sloBurnRate", 14.4, "Error budget burn rate over the last hour, confirmed over the last 5 minutes, that triggers -sloWebhook")
+	fs.Var(&c.Dependencies, "dependency", "Comma separated NAME=URL dependency checks reported on /readyz, URL being tcp://HOST:PORT or http(s)://..., NAME? for optional ones")
+	fs.IntVar(&c.DependencyTimeout, "dependencyTimeout", 2, "Seconds a dependency check may take")
+	fs.IntVar(&c.DependencyCacheTTL, "dependencyCacheTTL", 5, "Seconds dependency check results are reused for")
+	fs.StringVar(&c.PluginsFile, "plugins", "", "JSON file with plugin programs serving routes or acting as middleware over a Unix socket")
+	fs.StringVar(&c.ScriptFile, "script", "", "Request script rewriting requests and responses before routing, reloaded when it changes")
+	fs.StringVar(&c.CertsFile, "certs", "", "JSON file with certificates selected by SNI, from PEM files or Key Vault secrets, serves HTTPS")
+	fs.IntVar(&c.CertRefresh, "certRefresh", 60, "Minutes between checks for new versions of Key Vault certificates")
+	fs.IntVar(&c.TicketKeyRotation, "ticketKeyRotation", 0, "Minutes between TLS session ticket key rotations, rotated by the TLS library if 0")
+	fs.StringVar(&c.TicketKeyDir, "ticketKeyDir", "", "Shared directory holding TLS session ticket keys so that scaled-out instances resume each other's sessions, requires -ticketKeyRotation")
+	fs.BoolVar(&c.OCSPStapling, "ocspStapling", false, "Staple OCSP responses fetched from the responders of the served certificates")
+	fs.BoolVar(&c.K8s, "k8s", false, "Follow the Kubernetes pod lifecycle: fail readiness on SIGTERM, wait -preStopDelay before draining and fit -maxWait to TERMINATION_GRACE_PERIOD_SECONDS")
+	fs.IntVar(&c.PreStopDelay, "preStopDelay", 5, "Seconds to keep serving after SIGTERM under -k8s while endpoints are updated, 0 if a preStop hook waits instead")
+	fs.IntVar(&c.HoldRequests, "holdRequests", 0, "Max idempotent requests parked while draining and replayed against the next process once it records its endpoint and is ready, disabled if 0")
+	fs.IntVar(&c.HoldTimeout, "holdTimeout", 5, "Seconds a parked request waits for the next process before being served by the draining one")
+	fs.IntVar(&c.ProxyMaxConns, "proxyMaxConns", 0, "Max connections to each proxy target, unlimited if 0")
+	fs.IntVar(&c.ProxyMaxIdle, "proxyMaxIdle", 0, "Max idle connections kept to each proxy target, the Go default if 0")
+	fs.IntVar(&c.ProxyTryTimeout, "proxyTryTimeout", 0, "Milliseconds a proxy target has to send response headers on each try, no limit if 0")
+	fs.IntVar(&c.ProxyRetries, "proxyRetries", 2, "Times idempotent proxied requests are retried after a failure or 503")
+	fs.IntVar(&c.ProxyRetryBudget, "proxyRetryBudget", 20, "Retries allowed as a percentage of proxied requests, besides 3 per 10 seconds")
+	fs.IntVar(&c.BreakerFailures, "proxyBreakerFailures", 5, "Consecutive failures opening the circuit breaker of a proxy target, disabled if 0")
+	fs.IntVar(&c.BreakerCooldown, "proxyBreakerCooldown", 10, "Seconds an open circuit breaker fails requests before probing the proxy target again")
+	fs.IntVar(&c.BackendCheck, "backendCheckInterval", 5, "Seconds between active health checks of virtual host backends")
+	fs.IntVar(&c.ProxyBufferBody, "proxyBufferBody", 0, "Max KB of request bodies buffered before proxying so that requests can be retried while a backend restarts, disabled if 0")
+	fs.IntVar(&c.WSIdleTimeout, "wsIdleTimeout", 300, "Seconds without a frame after which proxied WebSocket connections are closed, disabled if 0")
+	fs.StringVar(&c.CDNPurge, "cdnPurge", "", "Resource ID of a Front Door or CDN endpoint to purge once a new release is healthy, requires -historyFile, disabled if empty")
+	fs.StringVar(&c.CDNPurgePaths, "cdnPurgePaths", "/*", "Comma separated paths purged by -cdnPurge")
+	fs.StringVar(&c.RotationHook, "rotationHook", "", "URL to POST register and deregister actions for this instance to, before draining and after startup; also read from GOAZURE_ROTATION_HOOK")
+	fs.IntVar(&c.RotationDelay, "rotationDelay", 10, "Seconds to keep serving after -rotationHook took the instance out of rotation")
+	fs.StringVar(&c.WarmupPaths, "warmupPaths", "", "Comma separated /PATH or HOST/PATH requested at startup and on slot swaps before reporting ready")
+	fs.IntVar(&c.WarmupTimeout, "warmupTimeout", 60, "Seconds each warm-up routine may take")
+	fs.IntVar(&c.KeepWarm, "keepWarm", 0, "Seconds without requests after which -keepWarmPaths are requested to keep them warm, disabled if 0")
+	fs.StringVar(&c.KeepWarmPaths, "keepWarmPaths", "", "Comma separated /PATH or HOST/PATH kept warm while idle and on Always-On pings, -warmupPaths if empty")
+	fs.BoolVar(&c.IMDS, "imds", false, "Ask the Azure Instance Metadata Service for the region and size of virtual machines and AKS nodes at startup")
+	fs.StringVar(&c.UnixSocket, "unixSocket", "", "Path of a unix socket also serving the site, for a reverse proxy on the same host")
+	fs.StringVar(&c.DrainPolicy, "drainPolicy", "", "Comma separated TAG=SECONDS closing connections tagged TAG, such as websocket or admin, that long into a drain rather than after -maxWait")
+	fs.IntVar(&c.ShedLatencyMs, "shedLatencyMs", 0, "p99 latency in milliseconds over the last 10 seconds beyond which a share of requests is rejected with 503, disabled if 0")
+	fs.IntVar(&c.ShedQueue, "shedQueue", 0, "Requests waiting for a worker, or in flight without -workers, beyond which a share of requests is rejected with 503, disabled if 0")
+	fs.IntVar(&c.ShedGoroutines, "shedGoroutines", 0, "Goroutines beyond which a share of requests is rejected with 503, disabled if 0")
+	fs.StringVar(&c.BrownoutFile, "brownout", "", "JSON file with per-route rules degrading requests in brownout mode")
+	fs.IntVar(&c.BrownoutAt, "brownoutAt", 80, "Percentage of the load shedding thresholds at which brownout mode starts, only entered manually if 0")
+	fs.Var(&c.WaitFor, "waitFor", "Comma separated HOST:PORT, tcp://HOST:PORT or http(s)://... addresses to reach before reporting ready on /readyz")
+	fs.IntVar(&c.WaitForTimeout, "waitForTimeout", 120, "Seconds to wait for the -waitFor addresses before reporting ready regardless")
+	fs.StringVar(&c.TemplatesDir, "templates", "", "Directory of html/template pages served for their path, with layouts/ and partials/, reloaded on change")
+	fs.StringVar(&c.UploadRoutes, "uploadRoutes", "", "JSON file of routes accepting multipart form uploads into a directory or Blob Storage container")
+	fs.StringVar(&c.StaticBlob, "staticBlob", "", "Blob Storage container URL to serve static files from, with a SAS token or else the managed identity; also read from GOAZURE_STATIC_BLOB")
+	fs.StringVar(&c.StaticBlobCache, "staticBlobCache", filepath.Join(os.TempDir(), "go-azure-static"), "Local directory -staticBlob is mirrored into")
+	fs.IntVar(&c.StaticBlobSync, "staticBlobSync", 60, "Seconds between syncs of -staticBlob")
+	fs.IntVar(&c.OutboundTimeout, "outboundTimeout", 30, "Seconds outbound requests made with the client handlers get from ClientFromContext may take")
+	fs.IntVar(&c.OutboundRetries, "outboundRetries", 2, "Times the outbound client retries requests that got no response")
+	fs.StringVar(&c.LogFormat, "logFormat", "auto", "Console log format: plain, dev for colored and aligned lines, json for one object per line, or auto for dev when stdout is a terminal and json otherwise")
+	fs.StringVar(&c.ProfileDir, "profileDir", "", "Directory to write profiles to, LogFiles on App Service if empty")
+	fs.IntVar(&c.DrainProfileAfter, "drainProfileAfter", 20, "Seconds into a drain after which profiles are captured, disabled if 0")
+	fs.BoolVar(&c.Coalesce, "coalesce", false, "Share one upstream call among concurrent identical GETs to proxy targets")
+	fs.IntVar(&c.DrainStallTimeout, "drainStallTimeout", 0, "Terminate a drain early once no connection has closed for this many seconds, disabled if 0")
+	fs.StringVar(&c.ChaosFile, "chaos", "", "JSON file with chaos rules injecting latency, connection resets and errors for resilience testing")
+	fs.StringVar(&c.RecordEvents, "recordEvents", "", "File to append raw file watcher events to as JSON lines, for replay-events")
+	fs.BoolVar(&c.SocketActivation, "socketActivation", false, "Serve on the socket passed by systemd socket activation instead of -port")
+	fs.StringVar(&c.ArtifactFile, "artifactFile", "", "File naming the artifact the startup script runs, _artifact.txt next to the watched directory if empty")
+}
+
+// Main runs the go-azure-website command line with args, the command line
+// arguments without the program name.
+func Main(args []string) {
+	RegisterFlags(flag.CommandLine, &config)
+	if len(args) > 0 {
+		if c := findCommand(args[0]); c != nil {
+			c.run(args[1:])
+			return
+		}
+	}
+	runServe(args)
+}
+
+// runServe implements the "serve" subcommand, which is also what runs when
+// no subcommand is given.
+func runServe(args []string) {
+	flag.CommandLine.Parse(args)
+	if flag.NArg() < 1 {
+		printUsage()
+	}
+	if err := setSecretsFromEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	config.WatchDir = flag.Arg(0)
+
+	setupLogFormat()
+	setupConnLog()
+	setupLogSinks()
+	fitShutdownBudget()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := Run(ctx, config)
+	if err != nil {
+		log.Println(err)
+	}
+	flushLogs()
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// Run serves until ctx is cancelled or a deployment triggers a restart, then
+// drains existing clients for up to cfg.MaxWait. All goroutines it started
+// have finished by the time it returns. The configuration and clock in use
+// before are restored then, so that runs in one process do not see each
+// other's. Runs take turns: the handlers, metrics and admin API are the
+// process's, so Run fails with ErrAlreadyRunning while another is serving.
+func Run(ctx context.Context, cfg Config) error {
+	if !running.TryLock() {
+		return ErrAlreadyRunning
+	}
+	defer running.Unlock()
+	prevConfig, prevClock := config, clk
+	defer func() { config, clk = prevConfig, prevClock }()
+	config = cfg
+	atomic.StoreInt32(&draining, 0)
+	clk = clock.Real{}
+	if cfg.Clock != nil {
+		clk = cfg.Clock
+	}
+
+	autoTune()
+
+	var err error
+	if drainPolicies, err = parseDrainPolicies(config.DrainPolicy); err != nil {
+		return err
+	}
+
+	deployments.load(config.HistoryFile, config.HistorySize)
+
+	if h, err := executableHash(); err != nil {
+		log.Printf("Could not hash running binary: %v", err)
+	} else {
+		runningHash = h
+	}
+
+	shutdown := make(chan struct{})
+	var shutdownOnce sync.Once
+	initShutdown := func() { shutdownOnce.Do(func() { close(shutdown) }) }
+	defer background.Wait()
+	defer initShutdown()
+
+	startFDMonitor(config.FDHighWater, shutdown)
+
+	atomic.StoreInt32(&movedPort, 0)
+	var l net.Listener
+	if config.Listener != nil {
+		l = config.Listener
+	} else if config.SocketActivation {
+		l, err = activatedListener()
+		if tcp, ok := l.(*net.TCPListener); ok {
+			config.Port = tcp.Addr().(*net.TCPAddr).Port
+		}
+	} else {
+		l, err = listenTCP(config.Port)
+	}
+	if err != nil {
+		return fmt.Errorf("could not create listener: %v", err)
+	}
+	if config.Listener == nil {
+		defer publishAdminEndpoint()()
+	}
+
+	notifyDone := make(chan struct{})
+	defer close(notifyDone)
+	startNotifyWatchdog(notifyDone)
+	// Keeps beating while draining, as a stuck drain is worth noticing too.
+	startHeartbeat(time.Duration(config.HeartbeatInterval)*time.Second, notifyDone)
+	metadata = loadInstanceMetadata(config.IMDS)
+	var statsdTags []string
+	if config.StatsdTags != "" {
+		statsdTags = strings.Split(config.StatsdTags, ",")
+	}
+	statsdTags = append(statsdTags, metadata.tags()...)
+	if err := startStatsd(config.StatsdAddr, statsdTags, time.Duration(config.StatsdInterval)*time.Second, notifyDone); err != nil {
+		l.Close()
+		return fmt.Errorf("could not start statsd exporter: %v", err)
+	}
+
+	var lease *restartLease
+	if config.LockDir != "" {
+		lease = newRestartLease(config.LockDir, time.Duration(config.LeaseDuration)*time.Second)
+	}
+
+	var rotation *rotationHook
+	if config.RotationHook != "" {
+		if rotation, err = newRotationHook(config.RotationHook); err != nil {
+			l.Close()
+			return err
+		}
+		rotation.register(shutdown)
+	}
+
+	sync, err := startWatcher(lease)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	// Keep watching while draining so that deployments landing meanwhile are
+	// recorded and handed over to the next process.
+	defer close(sync.stopWatcher)
+
+	failure := make(chan error, 1)
+	goBackground(func() {
+		select {
+		case <-sync.newBinary:
+		case err := <-sync.failed:
+			log.Printf("Draining after watcher failure: %v", err)
+			failure <- err
+		case <-ctx.Done():
+			log.Println("Shutdown requested")
+			if config.K8s {
+				k8sTerminate(shutdown)
+			}
+		case <-drainRequests:
+			log.Println("Drain requested through the admin API")
+		case <-shutdown:
+		}
+		if rotation != nil {
+			rotation.deregister(time.Duration(config.RotationDelay)*time.Second, shutdown)
+		}
+		initShutdown()
+	})
+
+	listenerGroup = newListenerGroup(shutdown)
+	name := "http"
+	if tlsEnabled() {
+		name = "https"
+	}
+	sl := listenerGroup.add(name, l, shutdown)
+
+	startWatchdog(time.Duration(config.WatchdogInterval)*time.Second, shutdown)
+
+	if cs := os.Getenv("AZURE_APPCONFIG_CONNECTION_STRING"); cs != "" {
+		ac, err := newAppConfig(cs, config.AppConfigPrefix, config.AppConfigLabel)
+		if err != nil {
+			return fmt.Errorf("could not configure App Configuration: %v", err)
+		}
+		log.Println("Polling App Configuration for dynamic settings")
+		goBackground(func() {
+			ac.poll(dynamic, time.Duration(config.AppConfigInterval)*time.Second, shutdown)
+		})
+	}
+
+	handler, err := defineHandlers()
+	if err != nil {
+		return err
+	}
+	if err := startPlugins(); err != nil {
+		return err
+	}
+	// Runs once drained, so that requests in flight to plugins complete.
+	defer stopPlugins()
+	startReaper(spawnsChildren)
+	startSLOAlerts(slo, config.SLOWebhook, config.SLOBurnRate, shutdown)
+	requestScript.watch(2*time.Second, shutdown)
+	templates.watch(shutdown)
+	blobStatic.start(time.Duration(config.StaticBlobSync)*time.Second, shutdown)
+	startUpstreamChecks(time.Duration(config.BackendCheck)*time.Second, shutdown)
+	enforceConnAge(shutdown)
+	if prev, ok := slotSwapped(); ok {
+		slot := os.Getenv("WEBSITE_SLOT_NAME")
+		log.Printf("Slot swap detected, previously running in %s, now in %s", prev, slot)
+		deployments.record(deployEvent{Kind: eventSlotSwap, Hash: runningHash, Slot: slot, Outcome: "detected"})
+	}
+	startDependencyWait(config.WaitFor, time.Duration(config.WaitForTimeout)*time.Second, shutdown)
+	setWarmupPaths(config.WarmupPaths)
+	startWarmup(time.Duration(config.WarmupTimeout)*time.Second, shutdown)
+	keepWarmer.start(time.Duration(config.KeepWarm)*time.Second, shutdown)
+	shedder.start(shutdown)
+	brownout.start(shutdown)
+	if config.CDNPurge != "" {
+		if config.HistoryFile == "" {
+			return errors.New("-cdnPurge requires -historyFile")
+		}
+		p, err := newCDNPurger(config.CDNPurge, config.CDNPurgePaths, config.IdentityClientID)
+		if err != nil {
+			return err
+		}
+		purgeAfterSwitchover(p, shutdown)
+	}
+	s := http.Server{
+		Handler:        handler,
+		ConnContext:    connContext,
+		ConnState:      connState,
+		BaseContext:    func(net.Listener) context.Context { return withMetadata(context.Background()) },
+		ReadTimeout:    15 * time.Second,
+		WriteTimeout:   15 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	s.SetKeepAlivesEnabled(!config.DisableKeepAlives)
+
+	if tlsEnabled() {
+		s.TLSConfig = &tls.Config{}
+	}
+	if config.CertsFile != "" {
+		certs, err := newCertStore(config.CertsFile, config.TLSCert != "" && config.TLSKey != "")
+		if err != nil {
+			return fmt.Errorf("could not load certificates: %v", err)
+		}
+		certs.watch(30*time.Second, time.Duration(config.CertRefresh)*time.Minute, shutdown)
+		s.TLSConfig.GetCertificate = certs.getCertificate
+	}
+	if tlsEnabled() && config.OCSPStapling {
+		var fallback *tls.Certificate
+		if config.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+			if err != nil {
+				return fmt.Errorf("could not load TLS certificate: %v", err)
+			}
+			fallback = &cert
+		}
+		stapler := newOCSPStapler()
+		stapler.start(shutdown)
+		s.TLSConfig.GetCertificate = stapler.wrap(s.TLSConfig.GetCertificate, fallback)
+	}
+	if tlsEnabled() && config.TicketKeyRotation > 0 {
+		tk, err := newTicketKeys(config.TicketKeyDir, time.Duration(config.TicketKeyRotation)*time.Minute)
+		if err == nil {
+			err = tk.start(s.TLSConfig, shutdown)
+		}
+		if err != nil {
+			return fmt.Errorf("could not set up TLS session ticket keys: %v", err)
+		}
+	}
+
+	if config.HTTPRedirectPort > 0 {
+		if !tlsEnabled() {
+			return errors.New("-httpRedirectPort requires -tlsCert and -tlsKey or -certs")
+		}
+		if err := startRedirectServer(shutdown); err != nil {
+			return err
+		}
+	}
+	if config.UnixSocket != "" {
+		ul, err := listenUnix(config.UnixSocket)
+		if err != nil {
+			return fmt.Errorf("could not create unix socket listener: %v", err)
+		}
+		usl := listenerGroup.add("unix", ul, shutdown)
+		// The same server, so that it stops keep-alives on both when draining.
+		goBackground(func() { s.Serve(usl) })
+	}
+
+	logStartupReport()
+	if lease != nil {
+		goBackground(func() {
+			// Ready rather than alive: warm-up and -waitFor are done, so the
+			// next instance may take its turn.
+			err := waitHealthy(selfURL("/readyz"), time.Duration(config.LeaseDuration)*time.Second, shutdown)
+			if err != nil {
+				log.Printf("Readiness check failed, leaving restart lease to expire: %v", err)
+				return
+			}
+			lease.release()
+		})
+	}
+	// serve serves the main listener, or one replacing it on another port,
+	// and shuts down when it stops unexpectedly.
+	serve := func(sl *stoppableListener) {
+		var err error
+		if tlsEnabled() {
+			err = s.ServeTLS(sl, config.TLSCert, config.TLSKey)
+		} else {
+			err = s.Serve(sl)
+		}
+		if sl.isRetired() {
+			return
+		}
+		log.Printf("Server stopped: %v", err)
+		if errors.Is(err, ErrListenerClosed) {
+			select {
+			case failure <- err:
+			default:
+			}
+		}
+		initShutdown()
+	}
+	sdNotify("READY=1")
+	listenerGroup.serve(sl, serve)
+	watchPortSetting(listenerGroup, serve, shutdown)
+	listenerGroup.wait()
+	sdNotify("STOPPING=1\nSTATUS=Draining connections")
+
+	// Closes idle connections now and the rest after their current request.
+	s.SetKeepAlivesEnabled(false)
+
+	log.Printf("Waiting for existing clients for upto %d seconds", config.MaxWait)
+	drainStart := clk.Now()
+	drained := make(chan struct{})
+	profileOnSlowDrain(time.Duration(config.DrainProfileAfter)*time.Second, drained)
+	analysis := analyzeDrain(drained)
+	err = waitClients(&listenerGroup.conns, time.Duration(config.MaxWait)*time.Second, analysis)
+	close(drained)
+	if err != nil {
+		abandonConns(&listenerGroup.conns)
+		return err
+	}
+
+	report := analysis.report(false)
+	logDrainReport(report)
+	deployments.record(deployEvent{
+		Kind:     eventRestart,
+		Hash:     runningHash,
+		Slot:     os.Getenv("WEBSITE_SLOT_NAME"),
+		Duration: clk.Now().Sub(drainStart).String(),
+		Outcome:  "drained",
+		Drain:    report,
+	})
+	select {
+	case err := <-failure:
+		return err
+	default:
+		return nil
+	}
+}
+
+// waitClients waits for conns to close, for up to maxWait.
+func waitClients(conns *sync.WaitGroup, maxWait time.Duration, analysis *drainAnalysis) error {
+	start := clk.Now()
+	timeout := clk.After(maxWait)
+	allClosed := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(allClosed)
+	}()
+
+	var stallCheck <-chan time.Time
+	stall := time.Duration(config.DrainStallTimeout) * time.Second
+	if stall > 0 {
+		stallCheck = clk.After(time.Second)
+	}
+
+	for {
+		select {
+		case <-timeout:
+			log.Println("Maximum wait time exceeding. Terminating.")
+			return forceTerminate(clk.Now().Sub(start), "timeout", analysis)
+		case <-stallCheck:
+			if drainStalled(start, stall) {
+				log.Printf("No connection closed for %v, %d remaining. Terminating.", stall, atomic.LoadInt64(&activeConns))
+				return forceTerminate(clk.Now().Sub(start), "stalled", analysis)
+			}
+			stallCheck = clk.After(time.Second)
+		case <-allClosed:
+			log.Println("All connection closed. Shutting down.")
+			return nil
+		}
+	}
+}
+
+// forceTerminate records that the drain was cut short, along with what held
+// it up. The caller is expected to exit, abandoning the remaining
+// connections.
+func forceTerminate(waited time.Duration, outcome string, analysis *drainAnalysis) error {
+	analysis.sample()
+	report := analysis.report(true)
+	logDrainReport(report)
+	deployments.record(deployEvent{
+		Kind:     eventForcedTermination,
+		Hash:     runningHash,
+		Duration: waited.String(),
+		Outcome:  outcome,
+		Drain:    report,
+	})
+	return fmt.Errorf("%w after %v (%s)", ErrDrainTimeout, waited.Round(time.Millisecond), outcome)
+}
+
+// abandonConns closes the connections a drain left open and waits a little
+// for the server to let go of them, so that they do not outlive Run and see
+// the state of the next run. Handlers that do not notice are left behind.
+func abandonConns(conns *sync.WaitGroup) {
+	liveConns.Range(func(k, _ interface{}) bool {
+		if cs := k.(*ConnTracker); cs.conn != nil {
+			cs.conn.Close()
+		}
+		return true
+	})
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+func printUsage() {
+	fmt.Println("Usage: go-azure-website [flags] <dir_to_watch>")
+	for _, c := range commands {
+		fmt.Println(strings.TrimRight("       go-azure-website "+c.name+" "+c.args, " "))
+	}
+	os.Exit(0)
+}
+
+type synchronization struct {
+	stopWatcher chan<- struct{}
+	newBinary   <-chan struct{}
+	failed      <-chan error
+}
+
+func startWatcher(lease *restartLease) (synchronization, error) {
+	storage := storageMode(config.WatchDir)
+	mode := watchModeFor(config.WatchMode, storage)
+	setWatchStatus(storage, mode)
+	if storage == storageLocalCache {
+		log.Println("Local cache is enabled, deployments to shared storage are not visible until the site restarts; consider -deployQueue")
+	}
+
+	var src deploymentSource
+	var err error
+	switch mode {
+	case watchNotify:
+		var rec *eventRecorder
+		if config.RecordEvents != "" {
+			if rec, err = newEventRecorder(config.RecordEvents); err != nil {
+				return synchronization{}, fmt.Errorf("%w: could not record watcher events: %v", ErrWatcherFailed, err)
+			}
+			log.Printf("Recording watcher events to %s", config.RecordEvents)
+		}
+		src, err = newFSSource(config.WatchDir, rec)
+	case watchPoll:
+		src, err = newPollSource(config.WatchDir, time.Duration(config.PollInterval)*time.Second)
+	default:
+		err = fmt.Errorf("unknown watch mode %q", mode)
+	}
+	if err != nil {
+		return synchronization{}, fmt.Errorf("%w: could not create watcher: %v", ErrWatcherFailed, err)
+	}
+	sources := []deploymentSource{src, simulatedSource{}}
+
+	if config.DeployQueue != "" {
+		q, err := newQueueSource(config.DeployQueue, config.DeployQueuePoison)
+		if err != nil {
+			return synchronization{}, fmt.Errorf("%w: could not create deployment queue source: %v", ErrWatcherFailed, err)
+		}
+		sources = append(sources, q)
+	}
+
+	stop := make(chan struct{})
+	newBin := make(chan struct{})
+	d := newDebouncer(restartSchedule(), func() {
+		if lease != nil && !lease.acquire(stop) {
+			return
+		}
+		log.Printf("Preparing to shutdown.")
+		close(newBin)
+	})
+
+	deploy := make(chan deployment)
+	failed := make(chan error, len(sources))
+	for _, src := range sources {
+		src := src
+		goBackground(func() {
+			if err := watchRecovered(src, deploy, stop); err != nil {
+				failed <- err
+			}
+		})
+	}
+
+	goBackground(func() {
+		for {
+			select {
+			case dep := <-deploy:
+				goBackground(func() { acceptDeployment(dep, d, stop) })
+			case <-stop:
+				d.stop()
+				return
+			}
+		}
+	})
+
+	return synchronization{newBinary: newBin, stopWatcher: stop, failed: failed}, nil
+}
+
+// restartSchedule returns when a restart may happen at the earliest for a
+// deployment detected at a given time, honoring the minimum restart interval
+// and the deployment windows.
+func restartSchedule() func(time.Time) time.Time {
+	earliest := clk.Now().Add(time.Duration(config.MinRestartInterval) * time.Second)
+	return func(t time.Time) time.Time {
+		if t.Before(earliest) {
+			t = earliest
+		}
+		return config.DeployWindows.next(t)
+	}
+}
+
+func acceptDeployment(dep deployment, d *debouncer, stop <-chan struct{}) {
+	defer func() {
+		if p := recover(); p != nil {
+			recoverPanic("accepting deployment of "+dep.artifact, p)
+		}
+	}()
+	e := deployEvent{Kind: eventDeployment, Artifact: dep.artifact, Trigger: dep.trigger}
+	if dep.artifact != "" {
+		changed, h, err := artifactChanged(dep.artifact, stop)
+		e.Hash = h
+		var reason string
+		if e.Outcome, reason = deploymentSkipped(dep.artifact, changed, h, err); e.Outcome != "" {
+			log.Printf("Skipping deployment: %s", reason)
+			deployments.record(e)
+			return
+		}
+	}
+	if cache != nil {
+		cache.purge()
+	}
+	e.Outcome = d.trigger(dep.artifact)
+	deployments.record(e)
+}
+
+// deploymentSkipped returns the outcome recorded for a deployment of
+// artifact that does not go ahead after checking it, and why, or an empty
+// outcome if it goes ahead.
+func deploymentSkipped(artifact string, changed bool, hash string, err error) (outcome, reason string) {
+	switch {
+	case err != nil:
+		return "invalid", err.Error()
+	case !changed:
+		return "skipped", fmt.Sprintf("%s is identical to running binary (%s)", artifact, hash)
+	}
+	return "", ""
+}
+
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	var body bytes.Buffer
+	if err := defaultResponse.Execute(&body, newResponseData(r)); err != nil {
+		log.Printf("Could not render default response: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Add("Content-Type", config.DefaultContentType)
+
+	w.WriteHeader(config.DefaultStatus)
+
+	w.Write(body.Bytes())
+}
+
+// spawnsChildren is set by defineHandlers when plugins or CGI programs run
+// as child processes that the server waits for itself.
+var spawnsChildren bool
+
+func defineHandlers() (http.Handler, error) {
+	mux := http.NewServeMux()
+	var root http.Handler
+	blobStatic = nil
+	if config.StaticDir != "" {
+		root = newStaticHandler(config.StaticDir, config.SPA)
+	} else if config.StaticBlob != "" {
+		var err error
+		if blobStatic, err = newBlobSite(config.StaticBlob, config.StaticBlobCache, config.IdentityClientID); err != nil {
+			return nil, fmt.Errorf("could not set up -staticBlob: %v", err)
+		}
+		blobWarmup.Do(func() {
+			RegisterWarmup("static-blob", func(stop <-chan struct{}) error {
+				if blobStatic == nil {
+					return nil
+				}
+				return blobStatic.warmup(stop)
+			})
+		})
+		sh := newStaticHandler(blobStatic.content(), config.SPA)
+		sh.etag = blobStatic.etag
+		root = sh
+	} else {
+		if err := loadDefaultResponse(); err != nil {
+			return nil, fmt.Errorf("could not load default response: %v", err)
+		}
+		root = http.HandlerFunc(rootHandler)
+	}
+	templates = nil
+	if config.TemplatesDir != "" {
+		var err error
+		if templates, err = loadTemplates(config.TemplatesDir); err != nil {
+			return nil, fmt.Errorf("could not load templates: %v", err)
+		}
+	}
+	mux.Handle("/", withTemplates(root, templates))
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	mux.HandleFunc("/admin/status", adminOnly(statusHandler))
+	mux.HandleFunc("/admin/deployments", adminOnly(deploymentsHandler))
+	mux.HandleFunc("/admin/profile", adminOnly(profileHandler))
+	mux.HandleFunc("/admin/drain", adminOnly(drainHandler))
+	mux.HandleFunc("/admin/rollback", adminOnly(rollbackHandler))
+	mux.HandleFunc("/admin/simulate", adminOnly(simulateHandler))
+	mux.HandleFunc("/admin/top", adminOnly(topHandler))
+	mux.HandleFunc("/admin/slo", adminOnly(sloHandler))
+	mux.HandleFunc("/admin/config", adminOnly(configHandler))
+	mux.HandleFunc("/admin/backends", adminOnly(backendsHandler))
+	mux.HandleFunc("/admin/dependencies", adminOnly(dependenciesHandler))
+	mux.HandleFunc("/admin/listeners", adminOnly(listenersHandler))
+	mux.HandleFunc("/admin/brownout", adminOnly(brownoutHandler))
+	mux.HandleFunc("/admin/uploads", adminOnly(uploadsHandler))
+	mux.HandleFunc("/admin/capture", adminOnly(captureHandler))
+	mux.HandleFunc("/admin/capture.har", adminOnly(captureHARHandler))
+	mux.HandleFunc("/admin/openapi.json", adminOnly(openAPIHandler))
+	mux.HandleFunc("/metrics", adminOnly(metricsHandler))
+	if config.Upload {
+		if config.AdminToken == "" {
+			return nil, errors.New("-upload requires -adminToken")
+		}
+		if config.UploadDir == "" {
+			config.UploadDir = config.WatchDir
+		}
+		mux.HandleFunc("/upload/", adminOnly(uploadHandler))
+	}
+	if config.UploadRoutes != "" {
+		routes, err := loadUploadRoutes(config.UploadRoutes)
+		if err != nil {
+			return nil, fmt.Errorf("could not load upload routes: %v", err)
+		}
+		for _, ur := range routes {
+			mux.Handle(ur.Path, ur)
+		}
+	}
+	if config.CacheSize > 0 {
+		cache = newResponseCache(config.CacheSize<<20, time.Duration(config.CacheTTL)*time.Second)
+	}
+
+	var rules []*rule
+	if config.RulesFile != "" {
+		var err error
+		if rules, err = loadRules(config.RulesFile); err != nil {
+			return nil, fmt.Errorf("could not load rules: %v", err)
+		}
+	}
+
+	requestScript = nil
+	if config.ScriptFile != "" {
+		var err error
+		if requestScript, err = loadScriptFile(config.ScriptFile); err != nil {
+			return nil, fmt.Errorf("could not load request script: %v", err)
+		}
+	}
+
+	proxyBuffers = newBufferPool(config.ProxyBufferSize << 10)
+	backend = newBackendTransport()
+	if err := setupPlugins(mux); err != nil {
+		return nil, err
+	}
+
+	var vhosts []*vhost
+	upstreamPools = nil
+	if config.VhostsFile != "" {
+		var err error
+		if vhosts, err = loadVhosts(config.VhostsFile); err != nil {
+			return nil, fmt.Errorf("could not load virtual hosts: %v", err)
+		}
+	}
+	spawnsChildren = len(plugins) > 0
+	for _, v := range vhosts {
+		if v.CGI != "" {
+			spawnsChildren = true
+		}
+	}
+
+	var headerRules []*headerRule
+	if config.HeadersFile != "" {
+		var err error
+		if headerRules, err = loadHeaderRules(config.HeadersFile); err != nil {
+			return nil, fmt.Errorf("could not load header rules: %v", err)
+		}
+	}
+
+	outbound = newOutboundClient(time.Duration(config.OutboundTimeout)*time.Second, config.OutboundRetries)
+	h := withVhosts(mux, vhosts)
+	h = withOutboundClient(h, outbound)
+	h = withHeaders(h, headerRules)
+	h = withTimeouts(h, config.RouteTimeouts)
+	if config.Workers > 0 {
+		pool = newWorkerPool(config.Workers, config.QueueDepth)
+	}
+	h = withWorkerPool(h, pool)
+	h = withCache(h, cache)
+	h = withPlugins(h)
+	brownout.rules = nil
+	if config.BrownoutFile != "" {
+		var err error
+		if brownout.rules, err = loadBrownoutRules(config.BrownoutFile); err != nil {
+			return nil, fmt.Errorf("could not load brownout rules: %v", err)
+		}
+	}
+	h = withBrownout(h, brownout)
+	h = withRules(h, rules)
+	h = withScript(h, requestScript)
+	h = withSettings(h)
+	var hold *holdQueue
+	if config.HoldRequests > 0 {
+		hold = newHoldQueue(config.HoldRequests, time.Duration(config.HoldTimeout)*time.Second)
+	}
+	h = withHoldReplay(h, hold)
+	h = withDrainGuard(h)
+	h = withWarmup(h, time.Duration(config.WarmupTimeout)*time.Second, 5*time.Minute)
+	keepWarmPaths := config.KeepWarmPaths
+	if keepWarmPaths == "" {
+		keepWarmPaths = config.WarmupPaths
+	}
+	keepWarmer = newKeepWarm(keepWarmPaths)
+	h = withKeepWarm(h, keepWarmer)
+	shedder = newLoadShedder(config.ShedLatencyMs, config.ShedQueue, config.ShedGoroutines)
+	h = withPriorityLane(withLoadShed(h, shedder), h)
+	h = withKeepAlivePolicy(h)
+
+	if config.ChaosFile != "" {
+		chaos, err := loadChaosRules(config.ChaosFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load chaos rules: %v", err)
+		}
+		log.Printf("Chaos rules loaded from %s, injecting faults", config.ChaosFile)
+		h = withChaos(h, chaos)
+	}
+	h = withRouteStats(h)
+	slo = nil
+	if config.SLOTarget > 0 {
+		var err error
+		if slo, err = newSLOTracker(config.SLOTarget, time.Duration(config.SLOLatencyMs)*time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+	h = withSLO(h, slo)
+	h = withSlowLog(h, time.Duration(config.SlowRequestMs)*time.Millisecond)
+	h = withRecovery(h)
+
+	var pages *errorPages
+	if config.ErrorPagesDir != "" {
+		var err error
+		if pages, err = loadErrorPages(config.ErrorPagesDir); err != nil {
+			return nil, fmt.Errorf("could not load error pages: %v", err)
+		}
+	}
+	return withCapture(withErrorPages(h, pages)), nil
+}
@@ -0,0 +1,175 @@
+package goazure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// InstanceMetadata describes where the server runs, from the environment of
+// App Service, Container Apps or Kubernetes, or the Azure Instance Metadata
+// Service on virtual machines and AKS nodes.
+type InstanceMetadata struct {
+	Provider      string `json:"provider"` // appservice, containerapps, aks, kubernetes, vm or local
+	Region        string `json:"region,omitempty"`
+	Instance      string `json:"instance"`
+	SKU           string `json:"sku,omitempty"`
+	Site          string `json:"site,omitempty"`
+	Slot          string `json:"slot,omitempty"`
+	Zone          string `json:"zone,omitempty"`
+	ResourceGroup string `json:"resourceGroup,omitempty"`
+	Subscription  string `json:"subscription,omitempty"`
+}
+
+// metadata is loaded by Run.
+var metadata *InstanceMetadata
+
+type metadataKey struct{}
+
+// MetadataFromContext returns the metadata of the instance serving a
+// request, nil outside of one.
+func MetadataFromContext(ctx context.Context) *InstanceMetadata {
+	m, _ := ctx.Value(metadataKey{}).(*InstanceMetadata)
+	return m
+}
+
+func withMetadata(ctx context.Context) context.Context {
+	if metadata == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// loadInstanceMetadata reads the metadata of the instance, asking the
+// Instance Metadata Service only when the environment is not one of App
+// Service or Container Apps and imds is set. A Kubernetes pod whose node
+// answers it runs on AKS.
+func loadInstanceMetadata(imds bool) *InstanceMetadata {
+	m := &InstanceMetadata{Provider: "local", Instance: instanceID}
+	switch {
+	case os.Getenv("WEBSITE_SITE_NAME") != "":
+		m.Provider = "appservice"
+		m.Site = os.Getenv("WEBSITE_SITE_NAME")
+		m.Region = os.Getenv("REGION_NAME")
+		m.SKU = os.Getenv("WEBSITE_SKU")
+		m.Slot = os.Getenv("WEBSITE_SLOT_NAME")
+		m.ResourceGroup = os.Getenv("WEBSITE_RESOURCE_GROUP")
+		// WEBSITE_OWNER_NAME is SUBSCRIPTION+RESOURCEGROUP-REGIONwebspace.
+		if owner := os.Getenv("WEBSITE_OWNER_NAME"); strings.Contains(owner, "+") {
+			m.Subscription = owner[:strings.Index(owner, "+")]
+		}
+	case os.Getenv("CONTAINER_APP_NAME") != "":
+		m.Provider = "containerapps"
+		m.Site = os.Getenv("CONTAINER_APP_NAME")
+		m.Slot = os.Getenv("CONTAINER_APP_REVISION")
+		if r := os.Getenv("CONTAINER_APP_REPLICA_NAME"); r != "" {
+			m.Instance = r
+		}
+	case os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+		m.Provider = "kubernetes"
+		m.Site = os.Getenv("POD_NAMESPACE")
+		if imds && m.queryIMDS() == nil {
+			// Keep the pod rather than the node as the instance.
+			m.Provider, m.Instance, m.Site = "aks", instanceID, os.Getenv("POD_NAMESPACE")
+		}
+	case imds:
+		if err := m.queryIMDS(); err != nil {
+			log.Printf("No instance metadata: %v", err)
+		}
+	}
+	return m
+}
+
+// queryIMDS fills m from the compute metadata of the virtual machine. The
+// service is link-local, so it answers at once or not at all.
+func (m *InstanceMetadata) queryIMDS() error {
+	client := &http.Client{
+		Timeout:   time.Second,
+		Transport: &http.Transport{Proxy: nil, DialContext: (&net.Dialer{Timeout: 500 * time.Millisecond}).DialContext},
+	}
+	req, err := http.NewRequest("GET", "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("instance metadata service returned %s", resp.Status)
+	}
+	var c struct {
+		Location          string `json:"location"`
+		Name              string `json:"name"`
+		VMSize            string `json:"vmSize"`
+		Zone              string `json:"zone"`
+		ResourceGroupName string `json:"resourceGroupName"`
+		SubscriptionID    string `json:"subscriptionId"`
+		VMScaleSetName    string `json:"vmScaleSetName"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return err
+	}
+	m.Provider, m.Region, m.SKU, m.Zone = "vm", c.Location, c.VMSize, c.Zone
+	m.ResourceGroup, m.Subscription = c.ResourceGroupName, c.SubscriptionID
+	m.Instance, m.Site = c.Name, c.VMScaleSetName
+	return nil
+}
+
+func (m *InstanceMetadata) String() string {
+	s := fmt.Sprintf("%s instance %s", m.Provider, m.Instance)
+	if m.Site != "" {
+		s += " of " + m.Site
+	}
+	if m.Region != "" {
+		s += " in " + m.Region
+	}
+	if m.SKU != "" {
+		s += ", " + m.SKU
+	}
+	return s
+}
+
+// tags returns statsd tags for the region, instance and SKU. The region is
+// written as an ARM location, as App Service names it "West Europe".
+func (m *InstanceMetadata) tags() []string {
+	var tags []string
+	region := strings.ToLower(strings.Replace(m.Region, " ", "", -1))
+	for _, t := range [][2]string{{"region", region}, {"instance", m.Instance}, {"sku", m.SKU}} {
+		if t[1] != "" {
+			tags = append(tags, t[0]+":"+t[1])
+		}
+	}
+	return tags
+}
+
+// instanceInfo is the goazure_instance_info metric, always 1, whose labels
+// describe the instance so that other series can be joined on it.
+type instanceInfo struct{}
+
+func (instanceInfo) name() string { return "goazure_instance_info" }
+
+func (instanceInfo) write(w *metricsWriter) {
+	m := metadata
+	if m == nil {
+		return
+	}
+	w.header("goazure_instance_info", "Instance metadata as labels", "gauge")
+	var labels []string
+	for _, l := range [][2]string{{"provider", m.Provider}, {"region", m.Region}, {"instance", m.Instance}, {"sku", m.SKU}, {"site", m.Site}, {"slot", m.Slot}, {"zone", m.Zone}} {
+		labels = append(labels, l[0]+`="`+escapeLabel(l[1])+`"`)
+	}
+	w.labeled("goazure_instance_info", strings.Join(labels, ","), 1)
+}
+
+func init() {
+	register(instanceInfo{})
+}
@@ -0,0 +1,192 @@
+package goazure
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can write itself in the Prometheus text format.
+type metric interface {
+	name() string
+	write(w *metricsWriter)
+}
+
+// metricsWriter writes metrics in the Prometheus text format, or hands
+// their samples to collect if set.
+type metricsWriter struct {
+	w       io.Writer
+	collect func(metricSample)
+	kind    string
+}
+
+// metricSample is one value of a metric, with the type of the metric family
+// it belongs to and its labels in the Prometheus text format.
+type metricSample struct {
+	name   string
+	labels string
+	kind   string
+	value  float64
+}
+
+func (mw *metricsWriter) header(name, help, kind string) {
+	mw.kind = kind
+	if mw.collect == nil {
+		fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+}
+
+func (mw *metricsWriter) sample(name string, v float64) {
+	mw.labeled(name, "", v)
+}
+
+func (mw *metricsWriter) labeled(name, labels string, v float64) {
+	switch {
+	case mw.collect != nil:
+		mw.collect(metricSample{name: name, labels: labels, kind: mw.kind, value: v})
+	case labels == "":
+		fmt.Fprintf(mw.w, "%s %s\n", name, formatFloat(v))
+	default:
+		fmt.Fprintf(mw.w, "%s{%s} %s\n", name, labels, formatFloat(v))
+	}
+}
+
+// samples lists the current values of m.
+func samples(m metric) []metricSample {
+	var ss []metricSample
+	m.write(&metricsWriter{collect: func(s metricSample) { ss = append(ss, s) }})
+	return ss
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		return fmt.Sprintf("%d", int64(v))
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics []metric
+}{}
+
+func register(m metric) {
+	registry.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.Unlock()
+}
+
+type counter struct {
+	n, help string
+	v       uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{n: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *counter) inc()          { atomic.AddUint64(&c.v, 1) }
+func (c *counter) add(n uint64)  { atomic.AddUint64(&c.v, n) }
+func (c *counter) value() uint64 { return atomic.LoadUint64(&c.v) }
+func (c *counter) name() string  { return c.n }
+
+func (c *counter) write(w *metricsWriter) {
+	w.header(c.n, c.help, "counter")
+	w.sample(c.n, float64(c.value()))
+}
+
+type gaugeFunc struct {
+	n, help string
+	fn      func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	register(&gaugeFunc{n: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) name() string { return g.n }
+
+func (g *gaugeFunc) write(w *metricsWriter) {
+	w.header(g.n, g.help, "gauge")
+	w.sample(g.n, g.fn())
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	n, help string
+	mu      sync.Mutex
+	bounds  []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	h := &histogram{n: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+	register(h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *histogram) name() string { return h.n }
+
+func (h *histogram) write(w *metricsWriter) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	w.header(h.n, h.help, "histogram")
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += counts[i]
+		w.labeled(h.n+"_bucket", `le="`+formatFloat(b)+`"`, float64(cum))
+	}
+	w.labeled(h.n+"_bucket", `le="+Inf"`, float64(count))
+	w.sample(h.n+"_sum", sum)
+	w.sample(h.n+"_count", float64(count))
+}
+
+// exponentialBuckets returns n bucket bounds starting at start, each factor
+// times the previous.
+func exponentialBuckets(start, factor float64, n int) []float64 {
+	b := make([]float64, n)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	registry.Lock()
+	ms := append([]metric(nil), registry.metrics...)
+	registry.Unlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := &metricsWriter{w: w}
+	for _, m := range ms {
+		m.write(mw)
+	}
+}
@@ -0,0 +1,77 @@
+package goazure
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify reports state to systemd when running as a Type=notify service,
+// and does nothing otherwise.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	c, err := net.Dial("unixgram", addr)
+	if err != nil {
+		log.Printf("Could not notify systemd: %v", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		log.Printf("Could not notify systemd: %v", err)
+	}
+}
+
+// startNotifyWatchdog pings the systemd watchdog at half its timeout until
+// done is closed. While serving, a ping is only sent once the server has
+// answered a request of its own, so that systemd restarts a process whose
+// serve loop is stuck rather than one that merely runs. While draining, the
+// listener is closed and pings continue, so that a slow drain is not
+// mistaken for a hung process.
+func startNotifyWatchdog(done <-chan struct{}) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	client := loopbackClient(interval / 2)
+	goBackground(func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := serveAlive(client); err != nil {
+					log.Printf("Withholding systemd watchdog ping, the server did not answer: %v", err)
+					continue
+				}
+				sdNotify("WATCHDOG=1")
+			case <-done:
+				return
+			}
+		}
+	})
+}
+
+// serveAlive checks that the main listener answers requests. Any response
+// will do, as /healthz fails on purpose at times, such as in maintenance.
+func serveAlive(client *http.Client) error {
+	if isDraining() {
+		return nil
+	}
+	resp, err := client.Get(selfURL("/healthz"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,359 @@
+package goazure
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ocspFailures = newCounter("goazure_ocsp_fetch_failures_total", "Failed OCSP response fetches for stapling")
+
+// The OCSP messages of RFC 6960, as far as stapling needs them.
+
+var oidSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			Cert ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Raw            asn1.RawContent
+		Version        int `asn1:"optional,default:0,explicit,tag:0"`
+		RawResponderID asn1.RawValue
+		ProducedAt     time.Time `asn1:"generalized"`
+		Responses      []ocspSingleResponse
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag     `asn1:"tag:0,optional"`
+	Revoked asn1.RawValue `asn1:"tag:1,optional"`
+	Unknown asn1.Flag     `asn1:"tag:2,optional"`
+	// ThisUpdate and NextUpdate bound the validity of the response.
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// ocspCertificateID identifies leaf to the OCSP responder of its issuer.
+func ocspCertificateID(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  leaf.SerialNumber,
+	}, nil
+}
+
+// ocspSignatureAlgorithms maps the signature algorithms responders use to
+// their x509 equivalents.
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+// verify checks that the response is signed by issuer, or by a responder
+// certificate issuer delegated OCSP signing to.
+func (basic *ocspBasicResponse) verify(issuer *x509.Certificate) error {
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		cert, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return fmt.Errorf("invalid OCSP responder certificate: %v", err)
+		}
+		if !bytes.Equal(cert.Raw, issuer.Raw) {
+			if err := cert.CheckSignatureFrom(issuer); err != nil {
+				return fmt.Errorf("OCSP responder certificate is not issued by the issuer: %v", err)
+			}
+			delegated := false
+			for _, u := range cert.ExtKeyUsage {
+				if u == x509.ExtKeyUsageOCSPSigning {
+					delegated = true
+				}
+			}
+			if !delegated {
+				return errors.New("OCSP responder certificate is not authorized to sign responses")
+			}
+		}
+		signer = cert
+	}
+	alg, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported OCSP signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(alg, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return fmt.Errorf("bad OCSP response signature: %v", err)
+	}
+	return nil
+}
+
+// fetchOCSP asks the responder of leaf for its status, returning the raw
+// response to staple and the single response about leaf. Responses not
+// signed on behalf of issuer are rejected, as clients would.
+func fetchOCSP(client *http.Client, leaf, issuer *x509.Certificate) ([]byte, *ocspSingleResponse, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("certificate names no OCSP responder")
+	}
+	id, err := ocspCertificateID(leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	var req ocspRequest
+	req.TBSRequest.RequestList = append(req.TBSRequest.RequestList, struct{ Cert ocspCertID }{id})
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var r ocspResponse
+	if _, err := asn1.Unmarshal(raw, &r); err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	if r.Status != 0 {
+		return nil, nil, fmt.Errorf("OCSP responder answered with status %d", r.Status)
+	}
+	if !r.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, nil, fmt.Errorf("unsupported OCSP response type %v", r.Response.ResponseType)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(r.Response.Response, &basic); err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	if err := basic.verify(issuer); err != nil {
+		return nil, nil, err
+	}
+	for i, s := range basic.TBSResponseData.Responses {
+		if s.CertID.SerialNumber != nil && s.CertID.SerialNumber.Cmp(leaf.SerialNumber) == 0 &&
+			bytes.Equal(s.CertID.NameHash, id.NameHash) && bytes.Equal(s.CertID.IssuerKeyHash, id.IssuerKeyHash) {
+			return raw, &basic.TBSResponseData.Responses[i], nil
+		}
+	}
+	return nil, nil, errors.New("OCSP response does not cover the certificate")
+}
+
+// staple is the OCSP state of one certificate.
+type staple struct {
+	cert     *tls.Certificate
+	stapled  *tls.Certificate // cert with a current response, nil if none
+	leaf     *x509.Certificate
+	issuer   *x509.Certificate
+	expires  time.Time // NextUpdate of the stapled response
+	next     time.Time // when to fetch again
+	failures int
+	lastUsed time.Time
+}
+
+// ocspStapler staples OCSP responses to the certificates served. Responses
+// are fetched in the background, the first handshakes with a certificate
+// going without, and refreshed halfway through their validity. When the
+// responder is unreachable, the last response is stapled until it expires
+// and retries back off up to an hour.
+type ocspStapler struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	staples map[*tls.Certificate]*staple
+	wake    chan struct{}
+}
+
+func newOCSPStapler() *ocspStapler {
+	return &ocspStapler{
+		client:  &http.Client{Timeout: 15 * time.Second},
+		staples: make(map[*tls.Certificate]*staple),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// wrap returns a GetCertificate function stapling responses to the
+// certificates chosen by get, or to fallback when get chooses none.
+func (o *ocspStapler) wrap(get func(*tls.ClientHelloInfo) (*tls.Certificate, error), fallback *tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := fallback
+		if get != nil {
+			c, err := get(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				cert = c
+			}
+		}
+		if cert == nil {
+			return nil, nil
+		}
+		return o.staple(cert), nil
+	}
+}
+
+func (o *ocspStapler) staple(cert *tls.Certificate) *tls.Certificate {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s, ok := o.staples[cert]
+	if !ok {
+		s = &staple{cert: cert}
+		if err := s.parse(); err != nil {
+			log.Printf("Not stapling OCSP responses: %v", err)
+		} else {
+			select {
+			case o.wake <- struct{}{}:
+			default:
+			}
+		}
+		o.staples[cert] = s
+	}
+	s.lastUsed = time.Now()
+	if s.stapled != nil && time.Now().Before(s.expires) {
+		return s.stapled
+	}
+	return cert
+}
+
+func (s *staple) parse() error {
+	if len(s.cert.Certificate) < 2 {
+		return errors.New("certificate chain lacks the issuer")
+	}
+	var err error
+	if s.leaf, err = x509.ParseCertificate(s.cert.Certificate[0]); err != nil {
+		return err
+	}
+	if s.issuer, err = x509.ParseCertificate(s.cert.Certificate[1]); err != nil {
+		return err
+	}
+	if len(s.leaf.OCSPServer) == 0 {
+		name := s.leaf.Subject.CommonName
+		s.leaf = nil
+		return fmt.Errorf("certificate for %s names no OCSP responder", name)
+	}
+	return nil
+}
+
+// refresh fetches the responses that are due, and forgets certificates not
+// served for an hour, such as those replaced by a reload.
+func (o *ocspStapler) refresh() {
+	o.mu.Lock()
+	var due []*staple
+	for c, s := range o.staples {
+		if time.Since(s.lastUsed) > time.Hour {
+			delete(o.staples, c)
+			continue
+		}
+		if s.leaf != nil && !time.Now().Before(s.next) {
+			due = append(due, s)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, s := range due {
+		raw, single, err := fetchOCSP(o.client, s.leaf, s.issuer)
+		if err == nil && len(single.Revoked.FullBytes) > 0 {
+			err = errors.New("certificate is revoked")
+		} else if err == nil && !single.Good {
+			err = errors.New("certificate status is unknown")
+		}
+
+		o.mu.Lock()
+		if err != nil {
+			ocspFailures.inc()
+			s.failures++
+			backoff := time.Hour
+			if s.failures < 6 {
+				backoff = time.Duration(1<<uint(s.failures)) * time.Minute
+			}
+			s.next = time.Now().Add(backoff)
+			log.Printf("Could not fetch OCSP response for %s, retrying in %v: %v", s.leaf.Subject.CommonName, backoff, err)
+		} else {
+			stapled := *s.cert
+			stapled.OCSPStaple = raw
+			s.stapled, s.failures = &stapled, 0
+			s.expires = single.NextUpdate
+			if s.expires.IsZero() {
+				s.expires = time.Now().Add(24 * time.Hour)
+			}
+			s.next = single.ThisUpdate.Add(s.expires.Sub(single.ThisUpdate) / 2)
+			if s.next.Before(time.Now().Add(time.Minute)) {
+				s.next = time.Now().Add(time.Minute)
+			}
+		}
+		o.mu.Unlock()
+	}
+}
+
+// start refreshes responses until stop is closed.
+func (o *ocspStapler) start(stop <-chan struct{}) {
+	goBackground(func() {
+		for {
+			select {
+			case <-o.wake:
+			case <-time.After(time.Minute):
+			case <-stop:
+				return
+			}
+			o.refresh()
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package goazure
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate from tmpl, signed by parent or, without
+// one, by itself.
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// ocspTestResponse builds a good response about leaf, signed by signer and
+// carrying signer's certificate if embed is set.
+func ocspTestResponse(t *testing.T, leaf, issuer, signer *testCert, embed bool) []byte {
+	t.Helper()
+	id, err := ocspCertificateID(leaf.cert, issuer.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var basic ocspBasicResponse
+	keyHash := sha256.Sum256(signer.cert.RawSubjectPublicKeyInfo)
+	hash, _ := asn1.Marshal(keyHash[:])
+	basic.TBSResponseData.RawResponderID = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: hash}
+	basic.TBSResponseData.ProducedAt = time.Now().UTC().Truncate(time.Second)
+	basic.TBSResponseData.Responses = []ocspSingleResponse{{
+		CertID:     id,
+		Good:       true,
+		ThisUpdate: time.Now().UTC().Truncate(time.Second),
+		NextUpdate: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}}
+	tbs, err := asn1.Marshal(basic.TBSResponseData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbs)
+	sig, err := signer.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic.TBSResponseData.Raw = tbs
+	basic.SignatureAlgorithm.Algorithm = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	basic.Signature = asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}
+	if embed {
+		basic.Certificates = []asn1.RawValue{{FullBytes: signer.cert.Raw}}
+	}
+	b, err := asn1.Marshal(basic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ocspResponse
+	resp.Response.ResponseType = oidOCSPBasic
+	resp.Response.Response = b
+	raw, err := asn1.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestFetchOCSPVerifies(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	stranger := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Other CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	delegate := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "Test OCSP"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, ca)
+	server := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "Test server"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	strangerDelegate := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(5),
+		Subject:      pkix.Name{CommonName: "Other OCSP"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, stranger)
+	leaf := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+	}, ca)
+
+	for _, tc := range []struct {
+		name   string
+		signer *testCert
+		embed  bool
+		err    string
+	}{
+		{"issuer", ca, false, ""},
+		{"issuer embedded", ca, true, ""},
+		{"delegated responder", delegate, true, ""},
+		{"other issuer", stranger, false, "bad OCSP response signature"},
+		{"responder of another issuer", strangerDelegate, true, "not issued by the issuer"},
+		{"responder without OCSP signing", server, true, "not authorized"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := ocspTestResponse(t, leaf, ca, tc.signer, tc.embed)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(raw)
+			}))
+			defer srv.Close()
+			leaf.cert.OCSPServer = []string{srv.URL}
+
+			got, single, err := fetchOCSP(srv.Client(), leaf.cert, ca.cert)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(raw) || !single.Good {
+					t.Fatal("got a different response than the responder sent")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package goazure
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+type apiParam struct {
+	name, description string
+	schema            string
+}
+
+// apiOperation describes an endpoint of the admin API. The schema of a JSON
+// response is derived from the type of response.
+type apiOperation struct {
+	method, path, summary string
+	params                []apiParam
+	status                int
+	response              interface{}
+	contentType           string // of a non-JSON response
+	public                bool   // not behind adminOnly
+}
+
+var adminAPI = []apiOperation{
+	{method: "get", path: "/healthz", summary: "Liveness check", status: 200, contentType: "text/plain", public: true},
+	{method: "get", path: "/readyz", summary: "Readiness including dependency checks, 503 when not ready, draining, warming up or waiting for -waitFor", status: 200, response: readyReport{}, public: true},
+	{method: "get", path: "/admin/status", summary: "Server status", status: 200, response: serverStatus{}},
+	{method: "get", path: "/admin/deployments", summary: "Deployment history, oldest first", status: 200, response: []deployEvent{}},
+	{method: "get", path: "/admin/config", summary: "Resolved configuration with secrets redacted", status: 200, response: map[string]interface{}{}},
+	{method: "post", path: "/admin/drain", summary: "Drain and exit so the platform restarts the process", status: 202, response: drainResult{}},
+	{method: "post", path: "/admin/rollback", summary: "Point the startup script at an earlier artifact and drain", status: 202, response: deployEvent{},
+		params: []apiParam{{"to", "Hash prefix of the deployment to roll back to, the previous one if empty", "string"}}},
+	{method: "post", path: "/admin/simulate", summary: "Run a deployment of the running binary", status: 202, response: simulateResult{}},
+	{method: "post", path: "/admin/profile", summary: "Capture profiles to the profile directory", status: 200, response: profileResult{},
+		params: []apiParam{
+			{"profiles", "Comma separated profiles among heap, goroutine, cpu and others of runtime/pprof", "string"},
+			{"seconds", "Duration of the CPU profile, 10 by default, at most 60", "integer"},
+		}},
+	{method: "get", path: "/admin/top", summary: "Slowest and most failing routes over a rolling window", status: 200, response: topReport{},
+		params: []apiParam{
+			{"window", "Window in minutes, 5 by default, at most 60", "integer"},
+			{"n", "Number of routes per list, 10 by default", "integer"},
+		}},
+	{method: "get", path: "/admin/dependencies", summary: "Outcome of the -dependency checks, with their errors", status: 200, response: map[string]dependencyStatus{}},
+	{method: "get", path: "/admin/backends", summary: "Health and outlier ejection state of virtual host backends", status: 200, response: map[string][]backendStatus{}},
+	{method: "get", path: "/admin/listeners", summary: "Listeners with their connection counts", status: 200, response: []listenerStatus{}},
+	{method: "post", path: "/admin/listeners", summary: "Enable or disable a listener, refusing its new connections while disabled", status: 200, response: listenerStatus{},
+		params: []apiParam{
+			{"name", "Name of the listener: http, https, http-redirect or unix", "string"},
+			{"enabled", "Whether the listener accepts connections", "boolean"},
+		}},
+	{method: "get", path: "/admin/brownout", summary: "Brownout mode and why it is active", status: 200, response: brownoutStatus{}},
+	{method: "post", path: "/admin/brownout", summary: "Enter or leave brownout mode, left only once no other reason remains", status: 200, response: brownoutStatus{},
+		params: []apiParam{{"enabled", "Whether to be in brownout mode", "boolean"}}},
+	{method: "get", path: "/admin/uploads", summary: "Progress of the uploads being received on -uploadRoutes", status: 200, response: []uploadProgress{}},
+	{method: "get", path: "/admin/capture", summary: "Request capture state", status: 200, response: captureStatus{}},
+	{method: "post", path: "/admin/capture", summary: "Start or stop capturing requests and responses, starting discards the previous capture", status: 200, response: captureStatus{},
+		params: []apiParam{
+			{"enabled", "Whether to capture", "boolean"},
+			{"limit", "Number of requests to capture, 100 by default", "integer"},
+			{"path", "Only capture requests whose path starts with this", "string"},
+			{"bodyBytes", "Bytes of each body to keep, 65536 by default", "integer"},
+		}},
+	{method: "get", path: "/admin/capture.har", summary: "Captured requests and responses as a HAR file, with credentials redacted", status: 200, response: harLog{}},
+	{method: "get", path: "/admin/slo", summary: "SLO compliance and remaining error budget", status: 200, response: sloReport{}},
+	{method: "get", path: "/admin/openapi.json", summary: "This document", status: 200, response: map[string]interface{}{}},
+	{method: "get", path: "/metrics", summary: "Metrics in the Prometheus text format", status: 200, contentType: "text/plain"},
+}
+
+// openAPISpec returns an OpenAPI 3 document describing the admin API.
+func openAPISpec() map[string]interface{} {
+	paths := make(map[string]interface{})
+	errorContent := map[string]interface{}{"application/json": map[string]interface{}{
+		"schema": typeSchema(reflect.TypeOf(struct {
+			Error httpjson.Error `json:"error"`
+		}{})),
+	}}
+	for _, op := range adminAPI {
+		content := map[string]interface{}{}
+		if op.contentType != "" {
+			content[op.contentType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+		} else {
+			content["application/json"] = map[string]interface{}{"schema": typeSchema(reflect.TypeOf(op.response))}
+		}
+		responses := map[string]interface{}{
+			strconv.Itoa(op.status): map[string]interface{}{"description": "OK", "content": content},
+		}
+		o := map[string]interface{}{
+			"summary":     op.summary,
+			"operationId": operationID(op),
+			"responses":   responses,
+		}
+		if op.public {
+			o["security"] = []interface{}{}
+		} else {
+			responses["403"] = map[string]interface{}{"description": "Missing or wrong bearer token", "content": errorContent}
+			responses["404"] = map[string]interface{}{"description": "Admin endpoints disabled, -adminToken is not set", "content": errorContent}
+		}
+		if op.method == "post" {
+			responses["405"] = map[string]interface{}{"description": "Method not allowed", "content": errorContent}
+		}
+		var params []interface{}
+		for _, p := range op.params {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          "query",
+				"description": p.description,
+				"schema":      map[string]interface{}{"type": p.schema},
+			})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+
+		item, _ := paths[op.path].(map[string]interface{})
+		if item == nil {
+			item = make(map[string]interface{})
+			paths[op.path] = item
+		}
+		item[op.method] = o
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "go-azure-website admin API",
+			"version":     version,
+			"description": "Control and status endpoints of the go-azure-website server.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "The -adminToken, without which these endpoints answer 404"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"adminToken": []interface{}{}}},
+	}
+}
+
+// operationID derives an identifier such as postAdminDrain from an
+// operation's method and path.
+func operationID(op apiOperation) string {
+	id := op.method
+	for _, part := range strings.FieldsFunc(op.path, func(r rune) bool { return r == '/' || r == '.' }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// openAPIHandler serves the admin API description for client generators:
+//
+//	GET /admin/openapi.json
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	httpjson.Write(w, http.StatusOK, openAPISpec())
+}
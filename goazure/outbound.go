@@ -0,0 +1,150 @@
+package goazure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+var (
+	outboundRequests = newCounter("goazure_outbound_requests_total", "Requests sent with the outbound client")
+	outboundErrors   = newCounter("goazure_outbound_errors_total", "Outbound requests that got no response")
+	outboundRetries  = newCounter("goazure_outbound_retries_total", "Outbound requests retried")
+	outboundDuration = newHistogram("goazure_outbound_duration_seconds", "Time to the response headers of outbound requests",
+		exponentialBuckets(0.005, 2, 12))
+)
+
+// outbound is the shared outbound client, set up by defineHandlers.
+var outbound *http.Client
+
+// newOutboundClient returns the client handlers call other services with.
+// It pools connections across requests, honors HTTPS_PROXY and NO_PROXY,
+// bounds dialing, TLS handshakes and whole requests, retries requests that
+// failed to get a response like the proxy does, and propagates the trace
+// context and request ID of the request being handled.
+func newOutboundClient(timeout time.Duration, retries int) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = 10 * time.Second
+	t.MaxIdleConnsPerHost = 32
+	return &http.Client{
+		Transport: &outboundTransport{transport: t, maxTries: 1 + retries, budget: newRetryBudget(0.1)},
+		Timeout:   timeout,
+	}
+}
+
+type outboundKey struct{}
+
+// outboundContext is what the outbound client carries over from the request
+// being handled.
+type outboundContext struct {
+	client      *http.Client
+	traceparent string
+	tracestate  string
+	requestID   string
+}
+
+// ClientFromContext returns the shared outbound client. Requests made with
+// the context of the request being handled, such as with
+// http.NewRequestWithContext(r.Context(), ...), carry on its trace context
+// and request ID.
+func ClientFromContext(ctx context.Context) *http.Client {
+	if oc, ok := ctx.Value(outboundKey{}).(*outboundContext); ok {
+		return oc.client
+	}
+	if outbound != nil {
+		return outbound
+	}
+	return http.DefaultClient
+}
+
+// withOutboundClient makes the outbound client available to handlers with
+// ClientFromContext.
+func withOutboundClient(h http.Handler, client *http.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oc := &outboundContext{
+			client:      client,
+			traceparent: r.Header.Get("Traceparent"),
+			tracestate:  r.Header.Get("Tracestate"),
+			requestID:   httpjson.RequestID(r),
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), outboundKey{}, oc)))
+	})
+}
+
+// childTraceparent returns a W3C traceparent for a call made while handling
+// a request with traceparent: the same trace with a new parent ID. It
+// returns "" if traceparent is not valid.
+func childTraceparent(traceparent string) string {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ""
+	}
+	if parts[0] == "ff" || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "00-" + parts[1] + "-" + hex.EncodeToString(id) + "-" + parts[3]
+}
+
+type outboundTransport struct {
+	transport *http.Transport
+	maxTries  int
+	budget    *retryBudget
+}
+
+func (t *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if oc, ok := req.Context().Value(outboundKey{}).(*outboundContext); ok {
+		req = req.Clone(req.Context())
+		if tp := childTraceparent(oc.traceparent); tp != "" && req.Header.Get("Traceparent") == "" {
+			req.Header.Set("Traceparent", tp)
+			if oc.tracestate != "" {
+				req.Header.Set("Tracestate", oc.tracestate)
+			}
+		}
+		if oc.requestID != "" && req.Header.Get("X-Request-Id") == "" {
+			req.Header.Set("X-Request-Id", oc.requestID)
+		}
+	}
+	t.budget.request()
+
+	for try := 1; ; try++ {
+		outboundRequests.inc()
+		start := time.Now()
+		resp, err := t.transport.RoundTrip(req)
+		outboundDuration.observe(time.Since(start).Seconds())
+		if err == nil {
+			return resp, nil
+		}
+		outboundErrors.inc()
+		if try >= t.maxTries || !retryable(req, err) || req.Context().Err() != nil || !t.budget.retry() {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		outboundRetries.inc()
+		// Back off exponentially with full jitter, up to 100ms before the
+		// second try.
+		backoff := time.Duration(mrand.Int63n(int64(100*time.Millisecond) << uint(try-1)))
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package goazure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	pluginStartTimeout = 10 * time.Second
+	pluginStopTimeout  = 5 * time.Second
+	// pluginSetPrefix marks middleware response headers to set on the request.
+	pluginSetPrefix = "X-Goazure-Set-Request-"
+)
+
+// plugin is an external program extending the server without a fork. It is
+// started with GOAZURE_PLUGIN_SOCKET naming a Unix socket it must serve
+// HTTP on. Requests to its routes are proxied to it unchanged. As
+// middleware it is first sent every request without a body, marked with
+// X-Goazure-Phase: middleware, and answers either 204 to let the request
+// through, setting request headers with X-Goazure-Set-Request-<Name>
+// response headers, or with a response for the client. Plugins are
+// restarted if they exit and stopped once the server has drained.
+type plugin struct {
+	Name       string            `json:"name"`
+	Command    []string          `json:"command"`
+	Env        map[string]string `json:"env,omitempty"`
+	Routes     []string          `json:"routes,omitempty"`
+	Middleware bool              `json:"middleware,omitempty"`
+
+	socket  string
+	client  *http.Client
+	proxy   *httputil.ReverseProxy
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	stopped chan struct{}
+}
+
+func (p *plugin) validate() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, `/\`) {
+		return errors.New("plugin needs a name without slashes")
+	}
+	if len(p.Command) == 0 {
+		return errors.New("plugin needs a command")
+	}
+	if len(p.Routes) == 0 && !p.Middleware {
+		return errors.New("plugin needs routes or middleware")
+	}
+	for _, r := range p.Routes {
+		if !strings.HasPrefix(r, "/") {
+			return fmt.Errorf("invalid route %q", r)
+		}
+	}
+	return nil
+}
+
+func loadPlugins(file string) ([]*plugin, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var plugins []*plugin
+	if err := json.Unmarshal(b, &plugins); err != nil {
+		return nil, err
+	}
+	for i, p := range plugins {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("plugin %d: %v", i, err)
+		}
+	}
+	return plugins, nil
+}
+
+// setup builds the transport to the plugin's socket, which start creates.
+func (p *plugin) setup() {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", p.socket)
+		},
+		MaxIdleConnsPerHost: 64,
+	}
+	p.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme, r.URL.Host = "http", "plugin"
+		},
+		Transport:  transport,
+		BufferPool: proxyBuffers,
+	}
+}
+
+// start runs the plugin and supervises it until stop is called.
+func (p *plugin) start(dir string) error {
+	p.socket = filepath.Join(dir, p.Name+".sock")
+	p.stopped = make(chan struct{})
+	if err := p.run(); err != nil {
+		return err
+	}
+	goBackground(p.supervise)
+	return nil
+}
+
+func (p *plugin) run() error {
+	os.Remove(p.socket)
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Env = append(os.Environ(), "GOAZURE_PLUGIN_SOCKET="+p.socket, "GOAZURE_PLUGIN_NAME="+p.Name)
+	for k, v := range p.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start plugin %s: %v", p.Name, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	p.mu.Lock()
+	p.cmd, p.exited = cmd, exited
+	p.mu.Unlock()
+
+	for deadline := time.Now().Add(pluginStartTimeout); ; {
+		if c, err := net.Dial("unix", p.socket); err == nil {
+			c.Close()
+			log.Printf("Plugin %s started (pid %d)", p.Name, cmd.Process.Pid)
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("plugin %s exited during startup: %v", p.Name, cmd.ProcessState)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			return fmt.Errorf("plugin %s did not listen on its socket within %v", p.Name, pluginStartTimeout)
+		}
+	}
+}
+
+// supervise restarts the plugin whenever it exits, backing off while it
+// keeps failing.
+func (p *plugin) supervise() {
+	backoff := time.Second
+	for {
+		p.mu.Lock()
+		exited := p.exited
+		p.mu.Unlock()
+		select {
+		case <-exited:
+		case <-p.stopped:
+			return
+		}
+
+		log.Printf("Plugin %s exited, restarting in %v", p.Name, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-p.stopped:
+			return
+		}
+		if err := p.run(); err != nil {
+			log.Print(err)
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// stop asks the plugin to exit with SIGTERM, killing it if it does not.
+func (p *plugin) stop() {
+	close(p.stopped)
+	p.mu.Lock()
+	cmd, exited := p.cmd, p.exited
+	p.mu.Unlock()
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+	case <-time.After(pluginStopTimeout):
+		log.Printf("Plugin %s did not exit within %v, killing it", p.Name, pluginStopTimeout)
+		cmd.Process.Kill()
+		<-exited
+	}
+	os.Remove(p.socket)
+}
+
+// intercept runs the plugin as middleware, reporting whether it answered
+// the request itself.
+func (p *plugin) intercept(w http.ResponseWriter, r *http.Request) bool {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://plugin"+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set("X-Goazure-Phase", "middleware")
+	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	req.Host = r.Host
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("Plugin %s middleware failed: %v", p.Name, err)
+		http.Error(w, "plugin unavailable", http.StatusBadGateway)
+		return true
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		for k, vs := range resp.Header {
+			if strings.HasPrefix(k, pluginSetPrefix) {
+				r.Header[strings.TrimPrefix(k, pluginSetPrefix)] = vs
+			}
+		}
+		return false
+	}
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	readFrom(w, resp.Body)
+	return true
+}
+
+var plugins []*plugin
+
+// setupPlugins loads the plugins configured with -plugins and routes their
+// paths on mux. Nothing runs until startPlugins.
+func setupPlugins(mux *http.ServeMux) error {
+	plugins = nil
+	if config.PluginsFile == "" {
+		return nil
+	}
+	ps, err := loadPlugins(config.PluginsFile)
+	if err != nil {
+		return fmt.Errorf("could not load plugins: %v", err)
+	}
+	for _, p := range ps {
+		p.setup()
+		for _, route := range p.Routes {
+			mux.Handle(route, p.proxy)
+		}
+	}
+	plugins = ps
+	return nil
+}
+
+// startPlugins runs the plugins set up by defineHandlers.
+func startPlugins() error {
+	if len(plugins) == 0 {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "go-azure-plugins")
+	if err != nil {
+		return err
+	}
+	for i, p := range plugins {
+		if err := p.start(dir); err != nil {
+			plugins = plugins[:i]
+			stopPlugins()
+			os.Remove(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// stopPlugins stops the plugins once no request can reach them anymore.
+func stopPlugins() {
+	var wg sync.WaitGroup
+	for _, p := range plugins {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.stop()
+		}()
+	}
+	wg.Wait()
+	if len(plugins) > 0 {
+		os.Remove(filepath.Dir(plugins[0].socket))
+	}
+	plugins = nil
+}
+
+// withPlugins runs middleware plugins in configuration order.
+func withPlugins(h http.Handler) http.Handler {
+	var mw []*plugin
+	for _, p := range plugins {
+		if p.Middleware {
+			mw = append(mw, p)
+		}
+	}
+	if len(mw) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if br := brownoutRuleFrom(r.Context()); br != nil && br.SkipPlugins {
+			h.ServeHTTP(w, r)
+			return
+		}
+		for _, p := range mw {
+			if p.intercept(w, r) {
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
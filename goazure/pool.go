@@ -0,0 +1,69 @@
+package goazure
+
+import (
+	"net/http"
+)
+
+// workerPool bounds the number of requests handled concurrently. Requests
+// beyond that wait in a queue of bounded depth; when the queue is full they
+// are shed with 503 straight away.
+type workerPool struct {
+	workers chan struct{}
+	queue   chan struct{}
+}
+
+var pool *workerPool
+
+func newWorkerPool(workers, depth int) *workerPool {
+	return &workerPool{
+		workers: make(chan struct{}, workers),
+		queue:   make(chan struct{}, workers+depth),
+	}
+}
+
+func (p *workerPool) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case p.queue <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server busy", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-p.queue }()
+
+		select {
+		case p.workers <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-p.workers }()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// inFlight returns the number of requests being handled and waiting.
+func (p *workerPool) inFlight() (active, queued int) {
+	active = len(p.workers)
+	queued = len(p.queue) - active
+	if queued < 0 {
+		queued = 0
+	}
+	return
+}
+
+func withWorkerPool(h http.Handler, p *workerPool) http.Handler {
+	if p == nil {
+		return h
+	}
+	queued := p.wrap(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Priority requests skip the queue, see withPriorityLane.
+		if isPriorityRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		queued.ServeHTTP(w, r)
+	})
+}
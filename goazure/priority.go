@@ -0,0 +1,32 @@
+package goazure
+
+import (
+	"net/http"
+	"strings"
+)
+
+var priorityRequests = newCounter("goazure_priority_requests_total", "Health check and admin requests served on the priority lane")
+
+// isPriorityRequest reports whether r is a health check or goes to the admin
+// API, which virtual hosts never proxy.
+func isPriorityRequest(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/admin/")
+}
+
+// withPriorityLane sends priority requests straight to lane, past the load
+// shedding in h, and withWorkerPool lets them skip its queue. They still go
+// through every other layer, such as virtual hosts, rules and the drain
+// guard. An instance that is overloaded but alive keeps answering its health
+// checks, rather than being marked dead by the platform and restarted, which
+// would move its load onto the other instances, and stays reachable for
+// operators to act on it.
+func withPriorityLane(h, lane http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPriorityRequest(r) {
+			priorityRequests.inc()
+			lane.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,154 @@
+package goazure
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// profileDir returns where profiles are written: -profileDir, or the
+// LogFiles directory on App Service so they can be fetched through Kudu.
+func profileDir() string {
+	if config.ProfileDir != "" {
+		return config.ProfileDir
+	}
+	if home := os.Getenv("HOME"); home != "" && os.Getenv("WEBSITE_SITE_NAME") != "" {
+		return filepath.Join(home, "LogFiles", "go-azure")
+	}
+	return ""
+}
+
+// captureProfiles writes the named profiles to dir, tagging the file names
+// with reason and the current time. A "cpu" profile is recorded for cpuFor.
+func captureProfiles(dir, reason string, cpuFor time.Duration, profiles ...string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	var paths []string
+	for _, name := range profiles {
+		ext, debug := "pprof", 0
+		if name == "goroutine" {
+			// Full stacks are what explains a drain that does not finish.
+			ext, debug = "txt", 2
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%s-%s-%s.%s", reason, name, stamp, ext))
+
+		var err error
+		if name == "cpu" {
+			err = writeCPUProfile(path, cpuFor)
+		} else {
+			err = writeProfile(path, name, debug)
+		}
+		if err != nil {
+			return paths, err
+		}
+		log.Printf("Wrote %s profile to %s", name, path)
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func writeProfile(path, name string, debug int) error {
+	p := pprof.Lookup(name)
+	if p == nil {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.WriteTo(f, debug)
+}
+
+func writeCPUProfile(path string, d time.Duration) error {
+	if d <= 0 {
+		return errors.New("cpu profile needs a duration")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := pprof.StartCPUProfile(f); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	pprof.StopCPUProfile()
+	return nil
+}
+
+// profileOnSlowDrain captures goroutine and heap profiles if the drain is
+// still going after threshold. Closing done cancels it.
+func profileOnSlowDrain(threshold time.Duration, done <-chan struct{}) {
+	dir := profileDir()
+	if threshold <= 0 || dir == "" {
+		return
+	}
+
+	goBackground(func() {
+		select {
+		case <-time.After(threshold):
+		case <-done:
+			return
+		}
+		log.Printf("Drain still running after %v, capturing profiles", threshold)
+		if _, err := captureProfiles(dir, "drain", 0, "goroutine", "heap"); err != nil {
+			log.Printf("Could not capture drain profiles: %v", err)
+		}
+	})
+}
+
+type profileResult struct {
+	Files []string `json:"files"`
+}
+
+// profileHandler captures profiles on demand:
+//
+//	POST /admin/profile?profiles=heap,goroutine,cpu&seconds=10
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	dir := profileDir()
+	if dir == "" {
+		httpjson.Fail(w, r, http.StatusConflict, "no profile directory configured, set -profileDir")
+		return
+	}
+
+	profiles := []string{"heap", "goroutine"}
+	if p := r.URL.Query().Get("profiles"); p != "" {
+		profiles = strings.Split(p, ",")
+	}
+	seconds, _ := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if seconds <= 0 {
+		seconds = 10
+	}
+	if seconds > 60 {
+		seconds = 60
+	}
+
+	d := time.Duration(seconds) * time.Second
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + 30*time.Second))
+
+	paths, err := captureProfiles(dir, "admin", d, profiles...)
+	if err != nil {
+		httpjson.Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpjson.Write(w, http.StatusOK, profileResult{paths})
+}
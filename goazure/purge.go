@@ -0,0 +1,161 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cdnPurger purges the cache of an Azure Front Door or CDN endpoint through
+// Azure Resource Manager, authenticating with the managed identity, which
+// needs the CDN Endpoint Contributor role or one allowing purge.
+type cdnPurger struct {
+	endpoint string // resource ID of the endpoint
+	paths    []string
+	identity *managedIdentity
+	client   *http.Client
+}
+
+func newCDNPurger(endpoint, paths, clientID string) (*cdnPurger, error) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasPrefix(endpoint, "/subscriptions/") || !strings.Contains(strings.ToLower(endpoint), "/providers/microsoft.cdn/profiles/") {
+		return nil, fmt.Errorf("%q is not the resource ID of a Front Door or CDN endpoint", endpoint)
+	}
+	p := &cdnPurger{
+		endpoint: endpoint,
+		identity: newManagedIdentity("https://management.azure.com/", clientID),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, s := range strings.Split(paths, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			p.paths = append(p.paths, s)
+		}
+	}
+	if len(p.paths) == 0 {
+		p.paths = []string{"/*"}
+	}
+	return p, nil
+}
+
+// purge asks for the paths to be purged. The purge completes asynchronously
+// within minutes; it is not waited for.
+func (p *cdnPurger) purge() error {
+	token, err := p.identity.get()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string][]string{"contentPaths": p.paths})
+	req, err := http.NewRequest("POST", "https://management.azure.com"+p.endpoint+"/purge?api-version=2023-05-01", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		p.identity.invalidate()
+		fallthrough
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("purge returned %s", resp.Status)
+	}
+	return nil
+}
+
+// newRelease reports whether the running binary differs from the one that
+// last restarted according to the deployment history. Without a hash
+// recorded for that restart, as without -historyFile, it cannot tell and
+// reports false.
+func newRelease() bool {
+	if runningHash == "" {
+		return false
+	}
+	events := deployments.snapshot()
+	for i := len(events) - 1; i >= 0; i-- {
+		if e := events[i]; e.Kind == eventRestart || e.Kind == eventForcedTermination {
+			return e.Hash != "" && e.Hash != runningHash
+		}
+	}
+	return false
+}
+
+// claimPurge reports whether this instance purges for the running release.
+// With -lockDir the instances share, the first to create the release's
+// marker there does, so that a release rolling over many instances purges
+// once. The markers of earlier releases are removed.
+func claimPurge(dir string) bool {
+	if dir == "" {
+		return true
+	}
+	marker := filepath.Join(dir, "cdn-purge-"+runningHash)
+	f, err := os.OpenFile(marker, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if !os.IsExist(err) {
+			log.Printf("Not purging CDN, could not claim the purge: %v", err)
+		}
+		return false
+	}
+	fmt.Fprintln(f, instanceID)
+	f.Close()
+	old, _ := filepath.Glob(filepath.Join(dir, "cdn-purge-*"))
+	for _, o := range old {
+		if o != marker {
+			os.Remove(o)
+		}
+	}
+	return true
+}
+
+// purgeAfterSwitchover purges the CDN once this instance of a new release
+// passes its health check, so that cached assets of the previous release do
+// not outlive it. Plain restarts of the same binary purge nothing.
+func purgeAfterSwitchover(p *cdnPurger, stop <-chan struct{}) {
+	if p == nil || !newRelease() {
+		return
+	}
+	goBackground(func() {
+		if err := waitHealthy(selfURL("/healthz"), time.Duration(config.MaxWait)*time.Second, stop); err != nil {
+			log.Printf("Not purging CDN, health check failed: %v", err)
+			return
+		}
+		if !claimPurge(config.LockDir) {
+			return
+		}
+		e := deployEvent{Kind: eventCDNPurge, Hash: runningHash}
+		var err error
+		for try := 0; try < 3; try++ {
+			if try > 0 {
+				select {
+				case <-time.After(time.Duration(10<<uint(try)) * time.Second):
+				case <-stop:
+					return
+				}
+			}
+			if err = p.purge(); err == nil {
+				break
+			}
+			log.Printf("Could not purge CDN: %v", err)
+		}
+		if err != nil {
+			e.Outcome = "failed"
+			// Leave the release to the next instance to try.
+			if config.LockDir != "" {
+				os.Remove(filepath.Join(config.LockDir, "cdn-purge-"+runningHash))
+			}
+		} else {
+			log.Printf("Purging %s from CDN endpoint %s", strings.Join(p.paths, ", "), p.endpoint)
+			e.Outcome = "accepted"
+		}
+		deployments.record(e)
+	})
+}
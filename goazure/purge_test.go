@@ -0,0 +1,58 @@
+package goazure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewRelease(t *testing.T) {
+	defer func(h string, events []deployEvent) {
+		runningHash = h
+		deployments.mu.Lock()
+		deployments.events = events
+		deployments.mu.Unlock()
+	}(runningHash, deployments.snapshot())
+	runningHash = "new"
+
+	for _, tc := range []struct {
+		name   string
+		events []deployEvent
+		want   bool
+	}{
+		{"no history", nil, false},
+		{"no hash recorded", []deployEvent{{Kind: eventRestart}}, false},
+		{"same binary", []deployEvent{{Kind: eventRestart, Hash: "new"}}, false},
+		{"new binary", []deployEvent{{Kind: eventRestart, Hash: "old"}}, true},
+		{"new binary after forced termination", []deployEvent{{Kind: eventForcedTermination, Hash: "old"}}, true},
+		{"latest restart counts", []deployEvent{{Kind: eventRestart, Hash: "old"}, {Kind: eventRestart, Hash: "new"}}, false},
+	} {
+		deployments.mu.Lock()
+		deployments.events = tc.events
+		deployments.mu.Unlock()
+		if got := newRelease(); got != tc.want {
+			t.Errorf("%s: newRelease() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestClaimPurgeOnce(t *testing.T) {
+	defer func(h string) { runningHash = h }(runningHash)
+	dir := t.TempDir()
+
+	runningHash = "v1"
+	if !claimPurge(dir) {
+		t.Fatal("first instance of v1 did not claim the purge")
+	}
+	if claimPurge(dir) {
+		t.Fatal("second instance of v1 claimed the purge too")
+	}
+
+	runningHash = "v2"
+	if !claimPurge(dir) {
+		t.Fatal("first instance of v2 did not claim the purge")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cdn-purge-v1")); !os.IsNotExist(err) {
+		t.Fatal("marker of the previous release left behind")
+	}
+}
@@ -0,0 +1,224 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	queuePollInterval = 10 * time.Second
+	queueMaxDequeue   = 5
+)
+
+// queueCommand is the JSON payload of a deployment queue message.
+type queueCommand struct {
+	Command  string `json:"command"`            // "restart" or "deploy"
+	Artifact string `json:"artifact,omitempty"` // path of the new artifact
+	Instance string `json:"instance,omitempty"` // target instance, any if empty
+}
+
+type queueMessage struct {
+	MessageID    string `xml:"MessageId"`
+	PopReceipt   string `xml:"PopReceipt"`
+	DequeueCount int    `xml:"DequeueCount"`
+	MessageText  string `xml:"MessageText"`
+}
+
+// queueSource receives restart and deploy commands from an Azure Storage
+// Queue. Messages are deleted only once handed over to the restart scheduler
+// and are moved to the poison queue after repeated failures: the one given
+// with -deployQueuePoison, or else the "-poison" sibling queue, which the
+// SAS token of the queue must then be allowed to add messages to, as an
+// account-level one is.
+type queueSource struct {
+	u      *url.URL // queue URL, authorized with a SAS token in the query
+	poison *url.URL
+	client *http.Client
+}
+
+func newQueueSource(queueURL, poisonURL string) (*queueSource, error) {
+	u, err := parseQueueURL(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	poison := &url.URL{}
+	*poison = *u
+	poison.Path += "-poison"
+	if poisonURL != "" {
+		if poison, err = parseQueueURL(poisonURL); err != nil {
+			return nil, err
+		}
+	}
+	return &queueSource{u: u, poison: poison, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func parseQueueURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, withoutSAS(err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid queue URL %q", redactURL(s))
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// withoutSAS leaves the query, which holds the SAS token, out of the URL in
+// errors of the client and url.Parse, so that logging them does not leak it.
+func withoutSAS(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		if i := strings.IndexByte(ue.URL, '?'); i >= 0 {
+			ue.URL = ue.URL[:i]
+		}
+	}
+	return err
+}
+
+func (q *queueSource) endpoint(queue *url.URL, suffix string, params url.Values) string {
+	u := *queue
+	u.Path = queue.Path + suffix
+	v := u.Query()
+	for k, vs := range params {
+		v[k] = vs
+	}
+	u.RawQuery = v.Encode()
+	return u.String()
+}
+
+func (q *queueSource) watch(deploy chan<- deployment, stop <-chan struct{}) error {
+	for {
+		msgs, err := q.receive()
+		if err != nil {
+			log.Printf("Deployment queue error: %v", err)
+		}
+		for _, m := range msgs {
+			if !q.handle(m, deploy, stop) {
+				return nil
+			}
+		}
+
+		select {
+		case <-time.After(queuePollInterval):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// handle processes a single message, returning false if stop was closed.
+func (q *queueSource) handle(m queueMessage, deploy chan<- deployment, stop <-chan struct{}) bool {
+	cmd, err := parseQueueCommand(m.MessageText)
+	if err != nil {
+		log.Printf("Invalid deployment queue message %s: %v", m.MessageID, err)
+		if m.DequeueCount >= queueMaxDequeue {
+			q.deadLetter(m)
+		}
+		return true
+	}
+
+	if cmd.Instance != "" && cmd.Instance != instanceID {
+		// Left for the target instance once the visibility timeout lapses.
+		return true
+	}
+
+	switch cmd.Command {
+	case "restart", "deploy":
+	default:
+		log.Printf("Unknown deployment queue command %q", cmd.Command)
+		q.deadLetter(m)
+		return true
+	}
+
+	log.Printf("Deployment queue requested %s", cmd.Command)
+	select {
+	case deploy <- deployment{artifact: cmd.Artifact, trigger: "queue"}:
+	case <-stop:
+		return false
+	}
+
+	if err := q.delete(m); err != nil {
+		log.Printf("Could not delete deployment queue message %s: %v", m.MessageID, err)
+	}
+	return true
+}
+
+func parseQueueCommand(text string) (queueCommand, error) {
+	var cmd queueCommand
+	b := []byte(text)
+	if d, err := base64.StdEncoding.DecodeString(text); err == nil {
+		b = d
+	}
+	err := json.Unmarshal(b, &cmd)
+	return cmd, err
+}
+
+func (q *queueSource) receive() ([]queueMessage, error) {
+	params := url.Values{"numofmessages": {"8"}, "visibilitytimeout": {"60"}}
+	resp, err := q.client.Get(q.endpoint(q.u, "/messages", params))
+	if err != nil {
+		return nil, withoutSAS(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("receive returned %s", resp.Status)
+	}
+
+	var list struct {
+		Messages []queueMessage `xml:"QueueMessage"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&list)
+	return list.Messages, err
+}
+
+func (q *queueSource) delete(m queueMessage) error {
+	params := url.Values{"popreceipt": {m.PopReceipt}}
+	req, err := http.NewRequest("DELETE", q.endpoint(q.u, "/messages/"+m.MessageID, params), nil)
+	if err != nil {
+		return withoutSAS(err)
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return withoutSAS(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("delete returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (q *queueSource) deadLetter(m queueMessage) {
+	var body bytes.Buffer
+	body.WriteString("<QueueMessage><MessageText>")
+	xml.EscapeText(&body, []byte(m.MessageText))
+	body.WriteString("</MessageText></QueueMessage>")
+
+	resp, err := q.client.Post(q.endpoint(q.poison, "/messages", nil), "application/xml", &body)
+	err = withoutSAS(err)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			err = fmt.Errorf("enqueue returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not dead-letter deployment queue message %s: %v", m.MessageID, err)
+		return
+	}
+
+	log.Printf("Moved deployment queue message %s to poison queue", m.MessageID)
+	if err := q.delete(m); err != nil {
+		log.Printf("Could not delete deployment queue message %s: %v", m.MessageID, err)
+	}
+}
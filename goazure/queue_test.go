@@ -0,0 +1,31 @@
+package goazure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueueErrorsLeaveOutSAS(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	q, err := newQueueSource(srv.URL+"/deploy?sv=2022&sig=s3cret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.receive(); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Fatalf("got %v, want an error without the SAS token", err)
+	}
+}
+
+func TestQueuePoison(t *testing.T) {
+	q, _ := newQueueSource("https://acct.queue.core.windows.net/deploy?sig=a", "")
+	if got := q.endpoint(q.poison, "/messages", nil); got != "https://acct.queue.core.windows.net/deploy-poison/messages?sig=a" {
+		t.Fatalf("got poison queue %s", got)
+	}
+	q, _ = newQueueSource("https://acct.queue.core.windows.net/deploy?sig=a", "https://acct.queue.core.windows.net/failed?sig=b")
+	if got := q.endpoint(q.poison, "/messages", nil); got != "https://acct.queue.core.windows.net/failed/messages?sig=b" {
+		t.Fatalf("got poison queue %s", got)
+	}
+}
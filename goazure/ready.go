@@ -0,0 +1,235 @@
+package goazure
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// DependencyCheck reports whether a downstream dependency is usable,
+// returning promptly once ctx is done.
+type DependencyCheck func(ctx context.Context) error
+
+type dependency struct {
+	name     string
+	target   string // URL it was configured with, empty for custom checks
+	optional bool
+	check    DependencyCheck
+}
+
+// dependencies holds the checks configured with -dependency, given as comma
+// separated "NAME=URL" entries where URL is tcp://HOST:PORT or an http(s)
+// URL. A name ending in ? marks an optional dependency, which is reported
+// without affecting readiness.
+type dependencies []dependency
+
+func (ds *dependencies) String() string {
+	s := make([]string, len(*ds))
+	for i, d := range *ds {
+		s[i] = d.name + "=" + d.target
+		if d.optional {
+			s[i] = d.name + "?=" + d.target
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (ds *dependencies) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		eq := strings.Index(spec, "=")
+		if eq <= 0 {
+			return fmt.Errorf("invalid dependency %q, expected NAME=URL", spec)
+		}
+		d := dependency{name: spec[:eq], target: spec[eq+1:]}
+		if strings.HasSuffix(d.name, "?") {
+			d.name, d.optional = strings.TrimSuffix(d.name, "?"), true
+		}
+		u, err := url.Parse(d.target)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid URL in %q", spec)
+		}
+		switch u.Scheme {
+		case "tcp":
+			d.check = tcpCheck(u.Host)
+		case "http", "https":
+			d.check = httpCheck(d.target)
+		default:
+			return fmt.Errorf("invalid dependency scheme in %q, expected tcp, http or https", spec)
+		}
+		*ds = append(*ds, d)
+	}
+	return nil
+}
+
+// tcpCheck succeeds if a connection to addr can be established.
+func tcpCheck(addr string) DependencyCheck {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+var dependencyClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// httpCheck succeeds if a GET of url answers with a 2xx or 3xx status.
+func httpCheck(url string) DependencyCheck {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := dependencyClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("returned %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+var registered struct {
+	sync.Mutex
+	deps []dependency
+}
+
+// RegisterDependency adds a check to /readyz. Unless optional, the server
+// is reported not ready while the check fails.
+func RegisterDependency(name string, optional bool, check DependencyCheck) {
+	registered.Lock()
+	registered.deps = append(registered.deps, dependency{name: name, optional: optional, check: check})
+	registered.Unlock()
+}
+
+// dependencyState is what /readyz, which anyone can ask, tells of a
+// dependency. The errors, which may name hosts and URLs, are left to
+// /admin/dependencies.
+type dependencyState struct {
+	OK       bool `json:"ok"`
+	Optional bool `json:"optional,omitempty"`
+}
+
+type dependencyStatus struct {
+	OK        bool      `json:"ok"`
+	Optional  bool      `json:"optional,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs int64     `json:"latencyMs"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// readiness caches the outcome of the dependency checks, so that frequent
+// probes from several load balancers do not hammer the dependencies.
+type readiness struct {
+	mu      sync.Mutex
+	results map[string]dependencyStatus
+	checked time.Time
+}
+
+var ready readiness
+
+// check runs all checks concurrently, each bounded by timeout, unless the
+// previous results are younger than ttl.
+func (rd *readiness) check(ttl, timeout time.Duration) map[string]dependencyStatus {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.results != nil && time.Since(rd.checked) < ttl {
+		return rd.results
+	}
+
+	registered.Lock()
+	deps := append(append([]dependency(nil), config.Dependencies...), registered.deps...)
+	registered.Unlock()
+
+	results := make(map[string]dependencyStatus, len(deps))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, d := range deps {
+		d := d
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			err := d.check(ctx)
+			s := dependencyStatus{OK: err == nil, Optional: d.optional, LatencyMs: time.Since(start).Milliseconds(), CheckedAt: start.UTC()}
+			if err != nil {
+				s.Error = err.Error()
+			}
+			mu.Lock()
+			results[d.name] = s
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	rd.results, rd.checked = results, time.Now()
+	return results
+}
+
+type readyReport struct {
+	Ready        bool                       `json:"ready"`
+	Draining     bool                       `json:"draining"`
+	Warming      bool                       `json:"warming,omitempty"`
+	WaitingFor   []string                   `json:"waitingFor,omitempty"`
+	Dependencies map[string]dependencyState `json:"dependencies,omitempty"`
+}
+
+// readyHandler answers 200 when the server takes traffic and all required
+// dependencies are healthy, and 503 otherwise, with the state of each
+// dependency.
+// Unlike /healthz it fails while draining, so load balancers move traffic
+// away before connections are closed, while warming up and while waiting
+// for the -waitFor dependencies.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	deps := ready.check(time.Duration(config.DependencyCacheTTL)*time.Second, time.Duration(config.DependencyTimeout)*time.Second)
+	warming := isWarming()
+	pending := waitingFor()
+	ok := !isDraining() && !isTerminating() && !warming && len(pending) == 0
+	states := make(map[string]dependencyState, len(deps))
+	for name, s := range deps {
+		if !s.OK && !s.Optional {
+			ok = false
+		}
+		states[name] = dependencyState{s.OK, s.Optional}
+	}
+
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(pidHeader, strconv.Itoa(os.Getpid()))
+	httpjson.Write(w, status, readyReport{ok, isDraining(), warming, pending, states})
+}
+
+// dependenciesHandler details the outcome of each dependency check,
+// including why it failed:
+//
+//	GET /admin/dependencies
+func dependenciesHandler(w http.ResponseWriter, r *http.Request) {
+	deps := ready.check(time.Duration(config.DependencyCacheTTL)*time.Second, time.Duration(config.DependencyTimeout)*time.Second)
+	httpjson.Write(w, http.StatusOK, deps)
+}
@@ -0,0 +1,38 @@
+package goazure
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startReaper reaps orphaned processes when running as PID 1 in a
+// container, where nothing else would and they would linger as zombies.
+// Reaping waits for any child, which would take the exit status of plugins
+// and CGI programs from the server waiting for them, so with those
+// configured orphans are left to an init such as docker run --init.
+func startReaper(spawnsChildren bool) {
+	if os.Getpid() != 1 {
+		return
+	}
+	if spawnsChildren {
+		log.Println("Running as PID 1 with plugins or CGI, not reaping orphaned processes")
+		return
+	}
+	log.Println("Running as PID 1, reaping orphaned processes")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	go func() {
+		for range sigs {
+			for {
+				var ws syscall.WaitStatus
+				pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+				if pid <= 0 || err != nil {
+					break
+				}
+			}
+		}
+	}()
+}
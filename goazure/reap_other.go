@@ -0,0 +1,5 @@
+//go:build !linux
+
+package goazure
+
+func startReaper(bool) {}
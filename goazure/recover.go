@@ -0,0 +1,79 @@
+package goazure
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+var panicsRecovered = newCounter("goazure_panics_recovered_total", "Panics recovered in handlers and the watcher")
+
+// recoverPanic logs a recovered panic with its stack trace and counts it.
+func recoverPanic(context string, p interface{}) {
+	panicsRecovered.inc()
+	log.Printf("Panic %s: %v\n%s", context, p, debug.Stack())
+}
+
+// recoveryWriter notes whether the response has been started, which decides
+// how a panic can be reported to the client.
+type recoveryWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (rw *recoveryWriter) WriteHeader(status int) {
+	rw.written = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recoveryWriter) Write(b []byte) (int, error) {
+	rw.written = true
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recoveryWriter) ReadFrom(r io.Reader) (int64, error) {
+	rw.written = true
+	return readFrom(rw.ResponseWriter, r)
+}
+
+func (rw *recoveryWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// withRecovery turns a panic in a handler into a 500, or aborts the
+// response if it had already started, instead of leaving net/http to drop
+// the connection with nothing but a log line.
+func withRecovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoveryWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			recoverPanic(fmt.Sprintf("serving %s %s%s for %s (request %s)", r.Method, r.Host, r.RequestURI, r.RemoteAddr, requestID(r)), p)
+			if rw.written {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// watchRecovered runs a deployment source, turning a panic into
+// ErrWatcherFailed so that the server drains rather than crashes.
+func watchRecovered(src deploymentSource, deploy chan<- deployment, stop <-chan struct{}) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			recoverPanic("in deployment source", p)
+			err = fmt.Errorf("%w: panic: %v", ErrWatcherFailed, p)
+		}
+	}()
+	return src.watch(deploy, stop)
+}
@@ -0,0 +1,59 @@
+package goazure
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+func tlsEnabled() bool {
+	return config.TLSCert != "" && config.TLSKey != "" || config.CertsFile != ""
+}
+
+// httpsRedirectHandler sends plain HTTP clients to the HTTPS listener, except
+// for ACME HTTP-01 challenges which are served from config.ACMEDir.
+func httpsRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	if config.ACMEDir != "" && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+		if token == "" || strings.ContainsAny(token, `/\`) || strings.Contains(token, "..") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeFile(w, r, filepath.Join(config.ACMEDir, token))
+		return
+	}
+
+	host := requestHost(r)
+	if port := listenPort(); port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// startRedirectServer serves httpsRedirectHandler on config.HTTPRedirectPort
+// until shutdown is closed. Its connections are drained along with those of
+// the main listener.
+func startRedirectServer(shutdown <-chan struct{}) error {
+	l, err := listenTCP(config.HTTPRedirectPort)
+	if err != nil {
+		return fmt.Errorf("could not create redirect listener: %v", err)
+	}
+
+	sl := listenerGroup.add("http-redirect", l, shutdown)
+
+	s := http.Server{
+		Handler:        http.HandlerFunc(httpsRedirectHandler),
+		ReadTimeout:    15 * time.Second,
+		WriteTimeout:   15 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	goBackground(func() { s.Serve(sl) })
+	return nil
+}
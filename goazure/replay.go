@@ -0,0 +1,422 @@
+package goazure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayRequest is a request read from a recording. status is the status
+// the recording saw, zero if unknown.
+type replayRequest struct {
+	method    string
+	uri       string
+	header    http.Header
+	body      []byte
+	truncated bool
+	status    int
+}
+
+// replayResult is what replaying one request gave.
+type replayResult struct {
+	req     *replayRequest
+	status  int
+	elapsed time.Duration
+	err     error
+}
+
+// replayDropped are headers of recorded requests that are not replayed: those
+// describing the original connection, and those the App Service front end
+// adds and would add again.
+var replayDropped = map[string]bool{
+	"Host":                   true,
+	"Content-Length":         true,
+	"Connection":             true,
+	"Keep-Alive":             true,
+	"Transfer-Encoding":      true,
+	"Upgrade":                true,
+	"Te":                     true,
+	"Max-Forwards":           true,
+	"X-Forwarded-For":        true,
+	"X-Forwarded-Proto":      true,
+	"X-Forwarded-Tlsversion": true,
+	"X-Original-Url":         true,
+	"X-Arr-Log-Id":           true,
+	"X-Arr-Ssl":              true,
+	"X-Client-Ip":            true,
+	"X-Client-Port":          true,
+	"X-Site-Deployment-Id":   true,
+	"X-Waws-Unencoded-Url":   true,
+	"Disguised-Host":         true,
+	"Was-Default-Hostname":   true,
+	"Client-Ip":              true,
+}
+
+// headerList is a flag.Value collecting repeated "Name: value" flags.
+type headerList http.Header
+
+func (h headerList) String() string {
+	var s []string
+	for k, vs := range h {
+		for _, v := range vs {
+			s = append(s, k+": "+v)
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+func (h headerList) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return fmt.Errorf("header %q is not Name: value", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+	return nil
+}
+
+// runReplay implements the "replay" subcommand, which sends the requests of
+// a HAR file downloaded from /admin/capture.har, or of an access log, to
+// another deployment such as a staging slot, and reports how it answered
+// compared to the recording.
+func runReplay(args []string) {
+	fs := commandFlags("replay")
+	target := fs.String("target", "", "Base URL to send the requests to, such as https://app-staging.azurewebsites.net")
+	concurrency := fs.Int("concurrency", 8, "Number of requests in flight")
+	rate := fs.Float64("rate", 0, "Requests per second to send at most, 0 for as fast as the concurrency allows")
+	host := fs.String("host", "", "Host header to send, the host of -target if empty")
+	methods := fs.String("methods", "GET,HEAD", "Comma-separated methods to replay, * for all")
+	timeout := fs.Int("timeout", 30, "Seconds to wait for each response")
+	verbose := fs.Bool("v", false, "Print every request")
+	header := headerList{}
+	fs.Var(header, "header", "Header to add to every request as \"Name: value\", can be repeated")
+	fs.Parse(args)
+	if fs.NArg() < 1 || *target == "" {
+		printUsage()
+	}
+	base, err := url.Parse(*target)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		log.Fatalf("Invalid -target %q", *target)
+	}
+	if *concurrency < 1 {
+		log.Fatal("-concurrency must be positive")
+	}
+
+	reqs, format, err := readReplay(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	allowed := map[string]bool{}
+	for _, m := range strings.Split(*methods, ",") {
+		allowed[strings.ToUpper(strings.TrimSpace(m))] = true
+	}
+	var selected []*replayRequest
+	truncated := 0
+	for _, r := range reqs {
+		if !allowed["*"] && !allowed[r.method] {
+			continue
+		}
+		if r.truncated {
+			truncated++
+		}
+		selected = append(selected, r)
+	}
+	fmt.Printf("Replaying %d of %d requests from %s (%s) against %s\n", len(selected), len(reqs), fs.Arg(0), format, base)
+	if truncated > 0 {
+		fmt.Printf("%d request bodies were truncated when recorded and are sent as recorded\n", truncated)
+	}
+	if len(selected) == 0 {
+		return
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = *concurrency
+	client := &http.Client{
+		Transport: t,
+		Timeout:   time.Duration(*timeout) * time.Second,
+		// Compare redirects as answered rather than where they lead.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	work := make(chan *replayRequest)
+	results := make(chan replayResult)
+	go func() {
+		var tick <-chan time.Time
+		if *rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for _, r := range selected {
+			if tick != nil {
+				<-tick
+			}
+			work <- r
+		}
+		close(work)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				results <- replayOne(client, base, *host, http.Header(header), r)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	var s replaySummary
+	for res := range results {
+		s.add(res)
+		if *verbose {
+			if res.err != nil {
+				fmt.Printf("%s %s: %v\n", res.req.method, res.req.uri, res.err)
+			} else {
+				fmt.Printf("%s %s: %d in %v\n", res.req.method, res.req.uri, res.status, res.elapsed.Round(time.Millisecond))
+			}
+		}
+	}
+	s.print(os.Stdout, time.Since(start))
+	if s.errors > 0 || len(s.mismatches) > 0 {
+		os.Exit(1)
+	}
+}
+
+func replayOne(client *http.Client, base *url.URL, host string, extra http.Header, r *replayRequest) replayResult {
+	res := replayResult{req: r}
+	req, err := http.NewRequest(r.method, strings.TrimSuffix(base.String(), "/")+r.uri, bytes.NewReader(r.body))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	for k, vs := range r.header {
+		req.Header[k] = vs
+	}
+	for k, vs := range extra {
+		req.Header[k] = vs
+	}
+	if host != "" {
+		req.Host = host
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	res.status, res.elapsed = resp.StatusCode, time.Since(start)
+	return res
+}
+
+// replaySummary tallies the results of a replay.
+type replaySummary struct {
+	statuses   map[int]int
+	latencies  []time.Duration
+	errors     int
+	firstError error
+	mismatches []replayResult
+}
+
+func (s *replaySummary) add(res replayResult) {
+	if res.err != nil {
+		if s.errors == 0 {
+			s.firstError = res.err
+		}
+		s.errors++
+		return
+	}
+	if s.statuses == nil {
+		s.statuses = map[int]int{}
+	}
+	s.statuses[res.status]++
+	s.latencies = append(s.latencies, res.elapsed)
+	if res.req.status != 0 && res.req.status != res.status {
+		s.mismatches = append(s.mismatches, res)
+	}
+}
+
+func (s *replaySummary) print(w io.Writer, elapsed time.Duration) {
+	n := len(s.latencies) + s.errors
+	fmt.Fprintf(w, "Sent %d requests in %v, %.1f/s\n", n, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+	var codes []int
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d  %d\n", code, s.statuses[code])
+	}
+	if s.errors > 0 {
+		fmt.Fprintf(w, "  %d requests failed, such as: %v\n", s.errors, s.firstError)
+	}
+	if len(s.latencies) > 0 {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		q := func(p float64) time.Duration {
+			return s.latencies[int(p*float64(len(s.latencies)-1))].Round(100 * time.Microsecond)
+		}
+		fmt.Fprintf(w, "Latency p50 %v, p90 %v, p99 %v, max %v\n", q(0.5), q(0.9), q(0.99), q(1))
+	}
+	if len(s.mismatches) > 0 {
+		fmt.Fprintf(w, "%d responses differ from the recorded status:\n", len(s.mismatches))
+		for i, m := range s.mismatches {
+			if i == 10 {
+				fmt.Fprintf(w, "  and %d more\n", len(s.mismatches)-i)
+				break
+			}
+			fmt.Fprintf(w, "  %s %s: %d, recorded %d\n", m.req.method, m.req.uri, m.status, m.req.status)
+		}
+	}
+}
+
+// readReplay reads the requests recorded in a HAR file, a W3C extended log
+// such as App Service HTTP logs, or a common or combined log format access
+// log, "-" reading from stdin. It returns the format found.
+func readReplay(name string) ([]*replayRequest, string, error) {
+	var b []byte
+	var err error
+	if name == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		reqs, err := readHAR(trimmed)
+		return reqs, "har", err
+	}
+	return readAccessLog(b)
+}
+
+func readHAR(b []byte) ([]*replayRequest, error) {
+	var har harLog
+	if err := json.Unmarshal(b, &har); err != nil {
+		return nil, fmt.Errorf("could not parse HAR: %v", err)
+	}
+	var reqs []*replayRequest
+	for i, e := range har.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		r := &replayRequest{method: e.Request.Method, uri: u.RequestURI(), header: http.Header{}, status: e.Response.Status}
+		for _, h := range e.Request.Headers {
+			name := http.CanonicalHeaderKey(h.Name)
+			// Captures leave out credentials, which are better missing than wrong.
+			if replayDropped[name] || h.Value == "REDACTED" && captureRedacted[name] {
+				continue
+			}
+			r.header.Add(name, h.Value)
+		}
+		if pd := e.Request.PostData; pd != nil {
+			if pd.Encoding == "base64" {
+				if r.body, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+					return nil, fmt.Errorf("entry %d: %v", i, err)
+				}
+			} else {
+				r.body = []byte(pd.Text)
+			}
+			r.truncated = int64(len(r.body)) < pd.Size
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// clfLine matches the common log format, optionally followed by the referer
+// and user agent of the combined log format.
+var clfLine = regexp.MustCompile(`^\S+ \S+ \S+ \[[^\]]+\] "(\S+) (\S+)[^"]*" (\d{3}) \S+(?: "([^"]*)" "([^"]*)")?`)
+
+func readAccessLog(b []byte) ([]*replayRequest, string, error) {
+	var reqs []*replayRequest
+	var fields map[string]int
+	format := "clf"
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "#") {
+			if strings.HasPrefix(text, "#Fields:") {
+				fields, format = map[string]int{}, "w3c"
+				for i, f := range strings.Fields(strings.TrimPrefix(text, "#Fields:")) {
+					fields[f] = i
+				}
+			}
+			continue
+		}
+		var r *replayRequest
+		if fields != nil {
+			r = w3cRequest(fields, strings.Fields(text))
+		} else if m := clfLine.FindStringSubmatch(text); m != nil {
+			r = &replayRequest{method: m[1], uri: m[2], header: http.Header{}}
+			r.status, _ = strconv.Atoi(m[3])
+			if m[4] != "" && m[4] != "-" {
+				r.header.Set("Referer", m[4])
+			}
+			if m[5] != "" && m[5] != "-" {
+				r.header.Set("User-Agent", m[5])
+			}
+		}
+		if r == nil || !strings.HasPrefix(r.uri, "/") {
+			return nil, "", fmt.Errorf("line %d is not a %s access log line", line, format)
+		}
+		reqs = append(reqs, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, "", err
+	}
+	return reqs, format, nil
+}
+
+// w3cRequest returns the request of a W3C extended log line, nil if the
+// fields do not describe one.
+func w3cRequest(fields map[string]int, values []string) *replayRequest {
+	get := func(name string) string {
+		if i, ok := fields[name]; ok && i < len(values) && values[i] != "-" {
+			return values[i]
+		}
+		return ""
+	}
+	r := &replayRequest{method: get("cs-method"), uri: get("cs-uri-stem"), header: http.Header{}}
+	if r.method == "" || r.uri == "" {
+		return nil
+	}
+	if q := get("cs-uri-query"); q != "" {
+		r.uri += "?" + q
+	}
+	r.status, _ = strconv.Atoi(get("sc-status"))
+	// Spaces in the user agent and referer are logged as +.
+	if ua := get("cs(User-Agent)"); ua != "" {
+		r.header.Set("User-Agent", strings.Replace(ua, "+", " ", -1))
+	}
+	if ref := get("cs(Referer)"); ref != "" {
+		r.header.Set("Referer", ref)
+	}
+	return r
+}
@@ -0,0 +1,96 @@
+package goazure
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+var requestsBuffered = newCounter("goazure_proxy_requests_buffered_total", "Proxied request bodies buffered so that the request can be retried")
+
+// memoryBodyLimit is the size up to which request bodies are buffered in
+// memory rather than in a temporary file.
+const memoryBodyLimit = 64 << 10
+
+// withRequestBuffer reads request bodies of up to limit bytes before they are
+// proxied, so that the backend transport can send them again when a backend
+// is restarting. Larger bodies are streamed as they arrive and cannot be
+// retried.
+func withRequestBuffer(h http.Handler, limit int64) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength > limit {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		memLimit := int64(memoryBodyLimit)
+		if limit < memLimit {
+			memLimit = limit
+		}
+		var mem bytes.Buffer
+		n, err := io.CopyN(&mem, r.Body, memLimit+1)
+		if err != nil && err != io.EOF {
+			http.Error(w, "could not read request body", http.StatusBadRequest)
+			return
+		}
+		if n <= memLimit {
+			b := mem.Bytes()
+			setBufferedBody(r, func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			}, int64(len(b)))
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var f *os.File
+		if n <= limit {
+			f, err = ioutil.TempFile("", "go-azure-body")
+		}
+		if f == nil {
+			// Over the limit, or proxy it unbuffered rather than fail the
+			// request.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(&mem, r.Body), r.Body}
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		n, err = io.Copy(f, io.MultiReader(&mem, io.LimitReader(r.Body, limit-n+1)))
+		if err != nil {
+			http.Error(w, "could not read request body", http.StatusBadRequest)
+			return
+		}
+		if n > limit {
+			// Too large after all: send what was read followed by the rest.
+			f.Seek(0, io.SeekStart)
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(f, r.Body), r.Body}
+			h.ServeHTTP(w, r)
+			return
+		}
+		setBufferedBody(r, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.NewSectionReader(f, 0, n)), nil
+		}, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func setBufferedBody(r *http.Request, getBody func() (io.ReadCloser, error), n int64) {
+	requestsBuffered.inc()
+	r.Body, _ = getBody()
+	r.GetBody = getBody
+	r.ContentLength = n
+	r.TransferEncoding = nil
+}
@@ -0,0 +1,53 @@
+package goazure
+
+import (
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var defaultResponse *template.Template
+
+type responseData struct {
+	Instance string
+	Version  string
+	Host     string
+	Path     string
+	Time     time.Time
+	Uptime   time.Duration
+}
+
+func newResponseData(r *http.Request) responseData {
+	return responseData{
+		Instance: instanceID,
+		Version:  version,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Time:     time.Now().UTC(),
+		Uptime:   time.Since(started),
+	}
+}
+
+// loadDefaultResponse parses the default route's body, read from
+// -defaultBodyFile if set, as a text/template.
+func loadDefaultResponse() error {
+	body := config.DefaultBody
+	if config.DefaultBodyFile != "" {
+		b, err := ioutil.ReadFile(config.DefaultBodyFile)
+		if err != nil {
+			return err
+		}
+		body = string(b)
+	}
+
+	t, err := template.New("default").Parse(body)
+	if err != nil {
+		return err
+	}
+	defaultResponse = t
+	return nil
+}
@@ -0,0 +1,85 @@
+package goazure
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// debouncer coalesces deployment notifications into a single restart that
+// fires at the first instant allowed by next. Deployments arriving once the
+// restart has begun are handed over to the next process.
+type debouncer struct {
+	mu      sync.Mutex
+	next    func(time.Time) time.Time
+	timer   ClockTimer
+	at      time.Time
+	fired   bool
+	stopped bool
+	fire    func()
+}
+
+func newDebouncer(next func(time.Time) time.Time, fire func()) *debouncer {
+	return &debouncer{next: next, fire: fire}
+}
+
+// trigger schedules a restart for artifact and returns the outcome to record
+// for the deployment.
+func (d *debouncer) trigger(artifact string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case d.stopped:
+		return "ignored"
+	case d.fired || isDraining():
+		log.Printf("Restart already in progress, %s will be picked up by the next process", artifact)
+		setPendingDeployment(&pendingDeployment{Artifact: artifact, DetectedAt: clk.Now(), Handover: true})
+		return "handover"
+	case d.timer != nil:
+		log.Println("Restart already pending, coalescing deployment")
+		at := d.at
+		setPendingDeployment(&pendingDeployment{Artifact: artifact, DetectedAt: clk.Now(), ScheduledAt: &at})
+		return "coalesced"
+	}
+
+	now := clk.Now()
+	at := d.next(now)
+	if at.IsZero() {
+		log.Println("No deployment window ever allows a restart, deployment staged indefinitely")
+		setPendingDeployment(&pendingDeployment{Artifact: artifact, DetectedAt: now})
+		return "staged"
+	}
+
+	wait := at.Sub(now)
+	if wait <= 0 {
+		d.fired = true
+		go d.fire()
+		return "accepted"
+	}
+
+	log.Printf("Deferring restart until %v", at.UTC())
+	d.at = at
+	setPendingDeployment(&pendingDeployment{Artifact: artifact, DetectedAt: now, ScheduledAt: &at})
+	d.timer = clk.AfterFunc(wait, func() {
+		d.mu.Lock()
+		if d.stopped {
+			d.mu.Unlock()
+			return
+		}
+		d.fired = true
+		d.mu.Unlock()
+		d.fire()
+	})
+	return "deferred"
+}
+
+func (d *debouncer) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
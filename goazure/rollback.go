@@ -0,0 +1,97 @@
+package goazure
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// artifactFile returns the file the startup script reads the artifact to run
+// from, or "" if there is none.
+func artifactFile() string {
+	if config.ArtifactFile != "" {
+		return config.ArtifactFile
+	}
+	f := filepath.Join(filepath.Dir(filepath.Clean(config.WatchDir)), "_artifact.txt")
+	if _, err := os.Stat(f); err != nil {
+		return ""
+	}
+	return f
+}
+
+// rollbackTarget picks the most recent deployment preceding the running one
+// whose artifact is still on disk unchanged. A non-empty hash prefix selects
+// a specific deployment instead.
+func rollbackTarget(events []deployEvent, prefix string) (deployEvent, error) {
+	end := len(events)
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Kind == eventDeployment && events[i].Hash == runningHash {
+			end = i
+			break
+		}
+	}
+
+	for i := end - 1; i >= 0; i-- {
+		e := events[i]
+		if e.Kind != eventDeployment || e.Artifact == "" || e.Hash == "" || e.Hash == runningHash {
+			continue
+		}
+		if e.Outcome == "skipped" || e.Outcome == "ignored" || e.Outcome == "invalid" {
+			continue
+		}
+		if prefix != "" && !strings.HasPrefix(e.Hash, prefix) {
+			continue
+		}
+		if h, err := fileHash(e.Artifact); err != nil || h != e.Hash {
+			continue
+		}
+		return e, nil
+	}
+	return deployEvent{}, errors.New("no earlier artifact available to roll back to")
+}
+
+// rollbackHandler points the startup script at a previously deployed
+// artifact and drains, so that the platform restarts the site on it:
+//
+//	POST /admin/rollback?to=<hash prefix>
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	f := artifactFile()
+	if f == "" {
+		httpjson.Fail(w, r, http.StatusConflict, "no artifact file to roll back, set -artifactFile")
+		return
+	}
+	target, err := rollbackTarget(deployments.snapshot(), r.FormValue("to"))
+	if err != nil {
+		httpjson.Fail(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	tmp := f + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(target.Artifact+"\n"), 0644); err != nil {
+		httpjson.Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := os.Rename(tmp, f); err != nil {
+		os.Remove(tmp)
+		httpjson.Fail(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	target = deployEvent{Time: time.Now().UTC(), Kind: eventRollback, Artifact: target.Artifact, Hash: target.Hash, Trigger: "admin", Outcome: "accepted"}
+	deployments.record(target)
+	requestDrain()
+
+	httpjson.Write(w, http.StatusAccepted, target)
+}
@@ -0,0 +1,89 @@
+package goazure
+
+import (
+	"sort"
+	"time"
+)
+
+// rollingHistogram counts observations in a ring of fixed-width time slots
+// to summarize the recent past, such as the latencies behind the load
+// shedder's p99, the routes on /admin/top or SLO compliance. Its owner
+// locks it.
+type rollingHistogram struct {
+	width   int64 // seconds per slot
+	buckets bool  // whether to count observations per routeBuckets
+	slots   []rollingSlot
+}
+
+// rollingSlot aggregates the observations of one slot, or of several once
+// summed by total.
+type rollingSlot struct {
+	at     int64 // slot number, in widths since the epoch
+	count  uint64
+	errors uint64
+	sum    float64
+	counts []uint64 // per routeBuckets, if kept
+}
+
+func newRollingHistogram(width time.Duration, slots int, buckets bool) *rollingHistogram {
+	return &rollingHistogram{width: int64(width / time.Second), buckets: buckets, slots: make([]rollingSlot, slots)}
+}
+
+func (h *rollingHistogram) slot(t time.Time) int64 {
+	return t.Unix() / h.width
+}
+
+// observe adds v, counted as an error if failed, to the slot of t.
+func (h *rollingHistogram) observe(t time.Time, v float64, failed bool) {
+	at := h.slot(t)
+	s := &h.slots[at%int64(len(h.slots))]
+	if s.at != at {
+		counts := s.counts
+		for i := range counts {
+			counts[i] = 0
+		}
+		if h.buckets && counts == nil {
+			counts = make([]uint64, len(routeBuckets))
+		}
+		*s = rollingSlot{at: at, counts: counts}
+	}
+	s.count++
+	if failed {
+		s.errors++
+	}
+	s.sum += v
+	if h.buckets {
+		if i := sort.SearchFloat64s(routeBuckets, v); i < len(s.counts) {
+			s.counts[i]++
+		}
+	}
+}
+
+// total sums the last n slots up to the one of t.
+func (h *rollingHistogram) total(t time.Time, n int) rollingSlot {
+	at := h.slot(t)
+	sum := rollingSlot{at: at}
+	if h.buckets {
+		sum.counts = make([]uint64, len(routeBuckets))
+	}
+	for _, s := range h.slots {
+		if s.count == 0 || at-s.at >= int64(n) {
+			continue
+		}
+		sum.count += s.count
+		sum.errors += s.errors
+		sum.sum += s.sum
+		for i, c := range s.counts {
+			sum.counts[i] += c
+		}
+	}
+	return sum
+}
+
+// quantile estimates the q quantile of the observations, see bucketQuantile.
+func (s rollingSlot) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return bucketQuantile(q, s.counts, s.count)
+}
@@ -0,0 +1,33 @@
+package goazure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollingHistogram(t *testing.T) {
+	h := newRollingHistogram(time.Second, 10, true)
+	start := time.Unix(1000, 0)
+	h.observe(start, 0.001, false)
+	h.observe(start, 1, true)
+	h.observe(start.Add(5*time.Second), 0.3, false)
+
+	if got := h.total(start.Add(5*time.Second), 10); got.count != 3 || got.errors != 1 || got.sum != 1.301 {
+		t.Fatalf("got %d observations, %d errors, sum %v", got.count, got.errors, got.sum)
+	}
+	if got := h.total(start.Add(5*time.Second), 5); got.count != 1 {
+		t.Fatalf("got %d observations in the last 5 slots, want 1", got.count)
+	}
+	if got := h.total(start.Add(5*time.Second), 10).quantile(0.99); got != 1.28 {
+		t.Fatalf("got p99 %v, want 1.28", got)
+	}
+
+	// A slot reused a ring later starts over.
+	h.observe(start.Add(10*time.Second), 0.001, false)
+	if got := h.total(start.Add(10*time.Second), 10); got.count != 2 || got.errors != 0 {
+		t.Fatalf("got %d observations, %d errors after wrapping, want 2 and 0", got.count, got.errors)
+	}
+	if got := h.total(start.Add(time.Minute), 10); got.count != 0 || got.quantile(0.5) != 0 {
+		t.Fatalf("got %d stale observations", got.count)
+	}
+}
@@ -0,0 +1,115 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+var rotationHookFailures = newCounter("goazure_rotation_hook_failures_total", "Failed calls to remove the instance from or add it to rotation")
+
+// rotationHook takes the instance out of an external load balancer before
+// it drains, and puts it back once a new process is healthy, rather than
+// waiting for the balancer's health probes to notice either. It is a URL
+// receiving a JSON POST with the action and the instance ID, so that the
+// receiver removes only this instance. Targets shared by all instances,
+// such as a Traffic Manager endpoint for the whole app, would take every
+// instance out of rotation at once and are not supported.
+type rotationHook struct {
+	webhook string
+	client  *http.Client
+}
+
+func newRotationHook(spec string) (*rotationHook, error) {
+	u, err := url.Parse(spec)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("rotation hook %q is not an http or https URL", spec)
+	}
+	return &rotationHook{webhook: spec, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// call runs the hook for action, "register" or "deregister".
+func (h *rotationHook) call(action string) error {
+	body, _ := json.Marshal(map[string]string{"action": action, "instance": instanceID, "hash": runningHash})
+	req, err := http.NewRequest("POST", h.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", action, resp.Status)
+	}
+	return nil
+}
+
+// deregisterRetry is how long deregister waits before its one retry.
+const deregisterRetry = time.Second
+
+// deregister takes the instance out of rotation before draining, failing
+// readiness checks too, and keeps serving for delay while the balancer
+// catches up. A failing hook delays the drain by a retry at most.
+func (h *rotationHook) deregister(delay time.Duration, stop <-chan struct{}) {
+	atomic.StoreInt32(&terminating, 1)
+	err := h.call("deregister")
+	if err != nil {
+		rotationHookFailures.inc()
+		log.Printf("Could not take instance out of rotation, retrying in %v: %v", deregisterRetry, err)
+		select {
+		case <-clk.After(deregisterRetry):
+		case <-stop:
+			return
+		}
+		if err = h.call("deregister"); err != nil {
+			rotationHookFailures.inc()
+			log.Printf("Could not take instance out of rotation: %v", err)
+			return
+		}
+	}
+	if delay <= 0 {
+		return
+	}
+	log.Printf("Out of rotation, draining in %v", delay)
+	select {
+	case <-clk.After(delay):
+	case <-stop:
+	}
+}
+
+// register puts the instance back in rotation once it passes its health
+// check, retrying with backoff until it succeeds or stop is closed.
+func (h *rotationHook) register(stop <-chan struct{}) {
+	goBackground(func() {
+		if err := waitHealthy(selfURL("/healthz"), time.Duration(config.MaxWait)*time.Second, stop); err != nil {
+			log.Printf("Not adding instance to rotation, health check failed: %v", err)
+			return
+		}
+		backoff := time.Second
+		for {
+			err := h.call("register")
+			if err == nil {
+				log.Println("Instance added to rotation")
+				return
+			}
+			rotationHookFailures.inc()
+			log.Printf("Could not add instance to rotation: %v", err)
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+		}
+	})
+}
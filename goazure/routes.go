@@ -0,0 +1,291 @@
+package goazure
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+const (
+	routeMaxDepth  = 4   // path segments kept in a route, deeper ones become *
+	routeMaxRoutes = 500 // distinct routes tracked, later ones count as "other" until idle ones are evicted
+	routeSlots     = 60  // one-minute slots kept for /admin/top
+)
+
+var routeBuckets = exponentialBuckets(0.005, 2, 12)
+
+// normalizeRoute turns a request path into a route pattern by replacing
+// segments that look like identifiers with :id and truncating deep paths,
+// so that routes can label metrics without exploding their number.
+func normalizeRoute(path string) string {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segs) > routeMaxDepth {
+		segs = append(segs[:routeMaxDepth], "*")
+	}
+	for i, s := range segs {
+		if looksLikeID(s) {
+			segs[i] = ":id"
+		}
+	}
+	return "/" + strings.Join(segs, "/")
+}
+
+// looksLikeID reports whether a path segment is a number, a UUID, a hash or
+// a similar generated token rather than a fixed name.
+func looksLikeID(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := 0
+	for _, c := range s {
+		if unicode.IsDigit(c) {
+			digits++
+		}
+	}
+	return digits == len(s) || len(s) > 32 || (digits > 0 && len(s) >= 8)
+}
+
+// routeStat holds the totals of a route for /metrics and its recent
+// minutes for /admin/top.
+type routeStat struct {
+	method, route string
+	codes         map[string]uint64
+	counts        []uint64
+	sum           float64
+	count         uint64
+	last          int64 // minute of the latest request
+	recent        *rollingHistogram
+}
+
+// routeStats tracks request counts, errors and latencies per route.
+type routeStats struct {
+	mu      sync.Mutex
+	routes  map[string]*routeStat
+	evicted int64 // minute of the latest search for idle routes
+}
+
+var routes = &routeStats{routes: make(map[string]*routeStat)}
+
+func init() {
+	register(routes)
+}
+
+func (rs *routeStats) observe(method, path string, status int, d time.Duration) {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+	default:
+		method = "OTHER"
+	}
+	// Paths that match nothing are whatever clients and scanners make up,
+	// so they share a route rather than filling the table.
+	route := "unmatched"
+	if status != http.StatusNotFound {
+		route = normalizeRoute(path)
+	}
+	key := method + " " + route
+	t := time.Now()
+	now := t.Unix() / 60
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(routeBuckets, secs)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s := rs.routes[key]
+	if s == nil {
+		if len(rs.routes) >= routeMaxRoutes && !rs.evictIdle(now) {
+			key, route = method+" other", "other"
+			s = rs.routes[key]
+		}
+		if s == nil {
+			s = &routeStat{
+				method: method,
+				route:  route,
+				codes:  make(map[string]uint64),
+				counts: make([]uint64, len(routeBuckets)),
+				recent: newRollingHistogram(time.Minute, routeSlots, true),
+			}
+			rs.routes[key] = s
+		}
+	}
+
+	s.codes[strconv.Itoa(status/100)+"xx"]++
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += secs
+	s.count++
+	s.last = now
+	s.recent.observe(t, secs, status >= 500)
+}
+
+func (rs *routeStats) name() string { return "goazure_route_requests_total" }
+
+func (rs *routeStats) write(w *metricsWriter) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	keys := make([]string, 0, len(rs.routes))
+	for k := range rs.routes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.header("goazure_route_requests_total", "Requests by method, route pattern and status class", "counter")
+	for _, k := range keys {
+		s := rs.routes[k]
+		codes := make([]string, 0, len(s.codes))
+		for c := range s.codes {
+			codes = append(codes, c)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			w.labeled("goazure_route_requests_total", s.labels()+`,code="`+code+`"`, float64(s.codes[code]))
+		}
+	}
+
+	const d = "goazure_route_request_duration_seconds"
+	w.header(d, "Request handling time by method and route pattern", "histogram")
+	for _, k := range keys {
+		s := rs.routes[k]
+		var cum uint64
+		for i, b := range routeBuckets {
+			cum += s.counts[i]
+			w.labeled(d+"_bucket", s.labels()+`,le="`+formatFloat(b)+`"`, float64(cum))
+		}
+		w.labeled(d+"_bucket", s.labels()+`,le="+Inf"`, float64(s.count))
+		w.labeled(d+"_sum", s.labels(), s.sum)
+		w.labeled(d+"_count", s.labels(), float64(s.count))
+	}
+}
+
+func (s *routeStat) labels() string {
+	return `method="` + escapeLabel(s.method) + `",route="` + escapeLabel(s.route) + `"`
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// routeSummary is a route's activity over the window asked of /admin/top.
+type routeSummary struct {
+	Route     string  `json:"route"`
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	AvgMs     float64 `json:"avgMs"`
+	P95Ms     float64 `json:"p95Ms"`
+}
+
+// evictIdle drops the routes that saw no request in the minutes /admin/top
+// looks back on, reporting whether that made room. The routes are searched
+// at most once a minute.
+func (rs *routeStats) evictIdle(now int64) bool {
+	if rs.evicted == now {
+		return false
+	}
+	rs.evicted = now
+	for k, s := range rs.routes {
+		if now-s.last >= routeSlots {
+			delete(rs.routes, k)
+		}
+	}
+	return len(rs.routes) < routeMaxRoutes
+}
+
+// summarize aggregates the slots of the last window minutes of each route.
+func (rs *routeStats) summarize(window int) []routeSummary {
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var out []routeSummary
+	for key, s := range rs.routes {
+		total := s.recent.total(now, window)
+		if total.count == 0 {
+			continue
+		}
+		out = append(out, routeSummary{
+			Route:     key,
+			Requests:  total.count,
+			Errors:    total.errors,
+			ErrorRate: float64(total.errors) / float64(total.count),
+			AvgMs:     total.sum / float64(total.count) * 1000,
+			P95Ms:     total.quantile(0.95) * 1000,
+		})
+	}
+	return out
+}
+
+// bucketQuantile estimates a quantile as the upper bound of the bucket it
+// falls in, or the largest bound for observations beyond all buckets.
+func bucketQuantile(q float64, counts []uint64, total uint64) float64 {
+	rank := uint64(q * float64(total))
+	var cum uint64
+	for i, c := range counts {
+		if cum += c; cum > rank {
+			return routeBuckets[i]
+		}
+	}
+	return routeBuckets[len(routeBuckets)-1]
+}
+
+type topReport struct {
+	WindowMinutes int            `json:"windowMinutes"`
+	Slowest       []routeSummary `json:"slowest"`
+	Errors        []routeSummary `json:"errors"`
+}
+
+// topHandler reports the slowest and most error-prone routes over a rolling
+// window:
+//
+//	GET /admin/top?window=<minutes, default 5>&n=<routes, default 10>
+func topHandler(w http.ResponseWriter, r *http.Request) {
+	window, n := 5, 10
+	if v, err := strconv.Atoi(r.FormValue("window")); err == nil && v > 0 && v <= routeSlots {
+		window = v
+	}
+	if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 {
+		n = v
+	}
+
+	all := routes.summarize(window)
+	slowest := append([]routeSummary{}, all...)
+	sort.Slice(slowest, func(i, j int) bool {
+		if slowest[i].P95Ms != slowest[j].P95Ms {
+			return slowest[i].P95Ms > slowest[j].P95Ms
+		}
+		return slowest[i].AvgMs > slowest[j].AvgMs
+	})
+	failing := []routeSummary{}
+	for _, s := range all {
+		if s.Errors > 0 {
+			failing = append(failing, s)
+		}
+	}
+	sort.Slice(failing, func(i, j int) bool {
+		if failing[i].Errors != failing[j].Errors {
+			return failing[i].Errors > failing[j].Errors
+		}
+		return failing[i].ErrorRate > failing[j].ErrorRate
+	})
+	if len(slowest) > n {
+		slowest = slowest[:n]
+	}
+	if len(failing) > n {
+		failing = failing[:n]
+	}
+
+	httpjson.Write(w, http.StatusOK, topReport{window, slowest, failing})
+}
+
+// withRouteStats records the status and handling time of requests by route.
+func withRouteStats(h http.Handler) http.Handler {
+	return withTiming(h, func(r *http.Request, status int, d time.Duration) {
+		routes.observe(r.Method, r.URL.Path, status, d)
+	})
+}
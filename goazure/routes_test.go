@@ -0,0 +1,55 @@
+package goazure
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNormalizeRoute(t *testing.T) {
+	for path, want := range map[string]string{
+		"/":                               "/",
+		"/api/users/12345":                "/api/users/:id",
+		"/api/orders/3f2a9c1e-7b4d/items": "/api/orders/:id/items",
+		"/a/b/c/d/e/f":                    "/a/b/c/d/*",
+		"/static/app.css":                 "/static/app.css",
+	} {
+		if got := normalizeRoute(path); got != want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRouteStatsUnmatched(t *testing.T) {
+	rs := &routeStats{routes: make(map[string]*routeStat)}
+	for i := 0; i < 2*routeMaxRoutes; i++ {
+		rs.observe("GET", fmt.Sprintf("/probe-%d/x", i), http.StatusNotFound, time.Millisecond)
+	}
+	if len(rs.routes) != 1 || rs.routes["GET unmatched"] == nil {
+		t.Fatalf("got routes %v, want only GET unmatched", keys(rs.routes))
+	}
+}
+
+func TestRouteStatsEvictsIdle(t *testing.T) {
+	rs := &routeStats{routes: make(map[string]*routeStat)}
+	now := time.Now().Unix() / 60
+	for i := 0; i < routeMaxRoutes; i++ {
+		rs.routes[fmt.Sprintf("GET /page-%d", i)] = &routeStat{last: now - routeSlots}
+	}
+	rs.observe("GET", "/fresh", http.StatusOK, time.Millisecond)
+	if rs.routes["GET /fresh"] == nil {
+		t.Fatalf("new route counted as other after idle routes expired: %d routes", len(rs.routes))
+	}
+	if len(rs.routes) != 1 {
+		t.Fatalf("got %d routes after eviction, want 1", len(rs.routes))
+	}
+}
+
+func keys(m map[string]*routeStat) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
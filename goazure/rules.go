@@ -0,0 +1,135 @@
+package goazure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// rule rewrites or redirects requests matching a path prefix or regular
+// expression, optionally restricted to a host. Regex rules expand $1 style
+// submatches in their target; prefix rules replace the matched prefix.
+type rule struct {
+	Host     string `json:"host,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+	Rewrite  string `json:"rewrite,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	Status   int    `json:"status,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (rl *rule) compile() error {
+	if (rl.Prefix == "") == (rl.Regex == "") {
+		return errors.New("rule needs exactly one of prefix or regex")
+	}
+	if (rl.Rewrite == "") == (rl.Redirect == "") {
+		return errors.New("rule needs exactly one of rewrite or redirect")
+	}
+	if rl.Redirect != "" {
+		if rl.Status == 0 {
+			rl.Status = http.StatusMovedPermanently
+		}
+		if rl.Status < 300 || rl.Status > 399 {
+			return fmt.Errorf("invalid redirect status %d", rl.Status)
+		}
+	}
+	if rl.Regex != "" {
+		re, err := regexp.Compile(rl.Regex)
+		if err != nil {
+			return err
+		}
+		rl.re = re
+	}
+	return nil
+}
+
+// apply returns the target for p, or false if the rule does not match.
+func (rl *rule) apply(host, p string) (string, bool) {
+	if rl.Host != "" && !strings.EqualFold(rl.Host, host) {
+		return "", false
+	}
+
+	target := rl.Rewrite + rl.Redirect
+	if rl.re != nil {
+		m := rl.re.FindStringSubmatchIndex(p)
+		if m == nil {
+			return "", false
+		}
+		return string(rl.re.ExpandString(nil, target, p, m)), true
+	}
+
+	if !strings.HasPrefix(p, rl.Prefix) {
+		return "", false
+	}
+	return target + p[len(rl.Prefix):], true
+}
+
+func loadRules(file string) ([]*rule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for i, rl := range rules {
+		if err := rl.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return rules, nil
+}
+
+func requestHost(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		return h
+	}
+	return r.Host
+}
+
+// withRules applies the first matching rule before the request is routed.
+func withRules(h http.Handler, rules []*rule) http.Handler {
+	if len(rules) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+		for _, rl := range rules {
+			target, ok := rl.apply(host, r.URL.Path)
+			if !ok {
+				continue
+			}
+
+			if rl.Redirect != "" {
+				if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, rl.Status)
+				return
+			}
+
+			if i := strings.Index(target, "?"); i >= 0 {
+				r.URL.RawQuery = target[i+1:]
+				target = target[:i]
+			}
+			clean := path.Clean("/" + target)
+			if strings.HasSuffix(target, "/") && clean != "/" {
+				clean += "/"
+			}
+			r.URL.Path = clean
+			r.URL.RawPath = ""
+			break
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,630 @@
+package goazure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// A request script is a small sandboxed program run on every request to
+// adjust it before routing, without recompiling the server. It has no loops,
+// no I/O and no state across requests, so it always terminates quickly:
+//
+//	# Comments run to the end of the line.
+//	if host == "old.example.com" {
+//		redirect(301, "https://new.example.com" + uri)
+//	}
+//	if method == "GET" && path =~ "^/api/v1/(.*)" {
+//		set_path("/api/v2/" + $1)
+//		set_header("X-Api-Version", "2")
+//	} else if header("X-Debug") != "" {
+//		respond(200, "text/plain", "debug " + instance)
+//	}
+//	set_response_header("X-Served-By", instance)
+//
+// Values are strings; comparisons and && || ! yield booleans, and an empty
+// string is false. =~ and !~ take a regular expression literal, whose
+// submatches are available as $0 to $9 afterwards.
+//
+// Variables: method, host, path, uri, query_string, remote_addr, scheme,
+// instance. Functions: header(name), query(name), cookie(name),
+// feature(name), true if the feature flag is enabled, lower(s), upper(s),
+// has_prefix(s, p), has_suffix(s, p), contains(s, sub).
+// Actions: set_path(p), set_header(name, value), del_header(name),
+// set_response_header(name, value), redirect(status, url),
+// respond(status, content_type, body) and stop(), which ends the script.
+
+type scriptEnv struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	captures []string
+	done     bool // the script answered the request or called stop
+	answered bool
+}
+
+type scriptExpr func(e *scriptEnv) interface{}
+
+type scriptStmt func(e *scriptEnv)
+
+type script struct {
+	stmts []scriptStmt
+}
+
+func (s *script) run(w http.ResponseWriter, r *http.Request) bool {
+	e := &scriptEnv{w: w, r: r}
+	for _, st := range s.stmts {
+		if st(e); e.done {
+			break
+		}
+	}
+	return e.answered
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return false
+}
+
+func str(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+type scriptToken struct {
+	kind string // ident, string, number, op or eof
+	text string
+	line int
+}
+
+func lexScript(src string) ([]scriptToken, error) {
+	var toks []scriptToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == ';':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				if j < len(src) && src[j] == '\n' {
+					return nil, fmt.Errorf("line %d: unterminated string", line)
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid string %s", line, src[i:j+1])
+			}
+			toks = append(toks, scriptToken{"string", s, line})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			toks = append(toks, scriptToken{"number", src[i:j], line})
+			i = j
+		case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, scriptToken{"ident", src[i:j], line})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "=~", "!~", "&&", "||", "!", "+", "(", ")", "{", "}", ","} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("line %d: unexpected %q", line, c)
+			}
+			toks = append(toks, scriptToken{"op", op, line})
+			i += len(op)
+		}
+	}
+	return append(toks, scriptToken{"eof", "", line}), nil
+}
+
+type scriptParser struct {
+	toks []scriptToken
+	pos  int
+}
+
+func (p *scriptParser) peek() scriptToken { return p.toks[p.pos] }
+
+func (p *scriptParser) next() scriptToken {
+	t := p.toks[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *scriptParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.peek().line, fmt.Sprintf(format, args...))
+}
+
+func (p *scriptParser) accept(op string) bool {
+	if t := p.peek(); t.kind == "op" && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(op string) error {
+	if !p.accept(op) {
+		return p.errorf("expected %q, found %q", op, p.peek().text)
+	}
+	return nil
+}
+
+// parseScript compiles a request script.
+func parseScript(src string) (*script, error) {
+	toks, err := lexScript(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{toks: toks}
+	var stmts []scriptStmt
+	for p.peek().kind != "eof" {
+		st, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, st)
+	}
+	return &script{stmts: stmts}, nil
+}
+
+func (p *scriptParser) block() ([]scriptStmt, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var stmts []scriptStmt
+	for !p.accept("}") {
+		if p.peek().kind == "eof" {
+			return nil, p.errorf("missing }")
+		}
+		st, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, st)
+	}
+	return stmts, nil
+}
+
+func runBlock(e *scriptEnv, stmts []scriptStmt) {
+	for _, st := range stmts {
+		if st(e); e.done {
+			return
+		}
+	}
+}
+
+func (p *scriptParser) stmt() (scriptStmt, error) {
+	t := p.next()
+	if t.kind != "ident" {
+		return nil, fmt.Errorf("line %d: expected a statement, found %q", t.line, t.text)
+	}
+	if t.text == "if" {
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		then, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		var els []scriptStmt
+		if p.peek().kind == "ident" && p.peek().text == "else" {
+			p.next()
+			if p.peek().kind == "ident" && p.peek().text == "if" {
+				st, err := p.stmt()
+				if err != nil {
+					return nil, err
+				}
+				els = []scriptStmt{st}
+			} else if els, err = p.block(); err != nil {
+				return nil, err
+			}
+		}
+		return func(e *scriptEnv) {
+			if truthy(cond(e)) {
+				runBlock(e, then)
+			} else {
+				runBlock(e, els)
+			}
+		}, nil
+	}
+
+	args, err := p.args()
+	if err != nil {
+		return nil, err
+	}
+	return scriptAction(t, args)
+}
+
+func (p *scriptParser) args() ([]scriptExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []scriptExpr
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		a, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	return args, nil
+}
+
+var scriptArity = map[string]int{
+	"set_path": 1, "set_header": 2, "del_header": 1, "set_response_header": 2,
+	"redirect": 2, "respond": 3, "stop": 0,
+}
+
+func scriptAction(t scriptToken, args []scriptExpr) (scriptStmt, error) {
+	n, ok := scriptArity[t.text]
+	if !ok {
+		return nil, fmt.Errorf("line %d: unknown action %s", t.line, t.text)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("line %d: %s takes %d arguments", t.line, t.text, n)
+	}
+
+	switch t.text {
+	case "set_path":
+		return func(e *scriptEnv) {
+			target := str(args[0](e))
+			if i := strings.Index(target, "?"); i >= 0 {
+				e.r.URL.RawQuery = target[i+1:]
+				target = target[:i]
+			}
+			clean := path.Clean("/" + target)
+			if strings.HasSuffix(target, "/") && clean != "/" {
+				clean += "/"
+			}
+			e.r.URL.Path, e.r.URL.RawPath = clean, ""
+		}, nil
+	case "set_header":
+		return func(e *scriptEnv) { e.r.Header.Set(str(args[0](e)), str(args[1](e))) }, nil
+	case "del_header":
+		return func(e *scriptEnv) { e.r.Header.Del(str(args[0](e))) }, nil
+	case "set_response_header":
+		return func(e *scriptEnv) { e.w.Header().Set(str(args[0](e)), str(args[1](e))) }, nil
+	case "redirect":
+		return func(e *scriptEnv) {
+			status, err := strconv.Atoi(str(args[0](e)))
+			if err != nil || status < 300 || status > 399 {
+				status = http.StatusFound
+			}
+			http.Redirect(e.w, e.r, str(args[1](e)), status)
+			e.done, e.answered = true, true
+		}, nil
+	case "respond":
+		return func(e *scriptEnv) {
+			status, err := strconv.Atoi(str(args[0](e)))
+			if err != nil || status < 100 || status > 599 {
+				status = http.StatusOK
+			}
+			e.w.Header().Set("Content-Type", str(args[1](e)))
+			e.w.WriteHeader(status)
+			fmt.Fprint(e.w, str(args[2](e)))
+			e.done, e.answered = true, true
+		}, nil
+	}
+	return func(e *scriptEnv) { e.done = true }, nil
+}
+
+func (p *scriptParser) expr() (scriptExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		l, right := left, scriptExpr(nil)
+		if right, err = p.and(); err != nil {
+			return nil, err
+		}
+		left = func(e *scriptEnv) interface{} { return truthy(l(e)) || truthy(right(e)) }
+	}
+	return left, nil
+}
+
+func (p *scriptParser) and() (scriptExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		l, right := left, scriptExpr(nil)
+		if right, err = p.not(); err != nil {
+			return nil, err
+		}
+		left = func(e *scriptEnv) interface{} { return truthy(l(e)) && truthy(right(e)) }
+	}
+	return left, nil
+}
+
+func (p *scriptParser) not() (scriptExpr, error) {
+	if p.accept("!") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(e *scriptEnv) interface{} { return !truthy(x(e)) }, nil
+	}
+	return p.cmp()
+}
+
+func (p *scriptParser) cmp() (scriptExpr, error) {
+	left, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != "op" {
+		return left, nil
+	}
+	switch t.text {
+	case "==", "!=":
+		p.next()
+		right, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		eq := t.text == "=="
+		return func(e *scriptEnv) interface{} { return (str(left(e)) == str(right(e))) == eq }, nil
+	case "=~", "!~":
+		p.next()
+		lit := p.next()
+		if lit.kind != "string" {
+			return nil, fmt.Errorf("line %d: %s needs a regular expression literal", lit.line, t.text)
+		}
+		re, err := regexp.Compile(lit.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lit.line, err)
+		}
+		match := t.text == "=~"
+		return func(e *scriptEnv) interface{} {
+			m := re.FindStringSubmatch(str(left(e)))
+			if m != nil {
+				e.captures = m
+			}
+			return (m != nil) == match
+		}, nil
+	}
+	return left, nil
+}
+
+func (p *scriptParser) sum() (scriptExpr, error) {
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("+") {
+		l, right := left, scriptExpr(nil)
+		if right, err = p.primary(); err != nil {
+			return nil, err
+		}
+		left = func(e *scriptEnv) interface{} { return str(l(e)) + str(right(e)) }
+	}
+	return left, nil
+}
+
+func (p *scriptParser) primary() (scriptExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case "string", "number":
+		v := t.text
+		return func(*scriptEnv) interface{} { return v }, nil
+	case "eof":
+		return nil, fmt.Errorf("line %d: unexpected end of script", t.line)
+	case "op":
+		if t.text == "(" {
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	case "ident":
+		if p.peek().kind == "op" && p.peek().text == "(" {
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			return scriptFunc(t, args)
+		}
+		return scriptVar(t)
+	}
+	return nil, fmt.Errorf("line %d: unexpected %q", t.line, t.text)
+}
+
+func scriptVar(t scriptToken) (scriptExpr, error) {
+	if len(t.text) == 2 && t.text[0] == '$' && t.text[1] >= '0' && t.text[1] <= '9' {
+		i := int(t.text[1] - '0')
+		return func(e *scriptEnv) interface{} {
+			if i < len(e.captures) {
+				return e.captures[i]
+			}
+			return ""
+		}, nil
+	}
+	vars := map[string]func(r *http.Request) string{
+		"method":       func(r *http.Request) string { return r.Method },
+		"host":         requestHost,
+		"path":         func(r *http.Request) string { return r.URL.Path },
+		"uri":          func(r *http.Request) string { return r.URL.RequestURI() },
+		"query_string": func(r *http.Request) string { return r.URL.RawQuery },
+		"remote_addr":  func(r *http.Request) string { return r.RemoteAddr },
+		"scheme": func(r *http.Request) string {
+			if r.TLS != nil {
+				return "https"
+			}
+			return "http"
+		},
+		"instance": func(*http.Request) string { return instanceID },
+	}
+	v, ok := vars[t.text]
+	if !ok {
+		return nil, fmt.Errorf("line %d: unknown variable %s", t.line, t.text)
+	}
+	return func(e *scriptEnv) interface{} { return v(e.r) }, nil
+}
+
+func scriptFunc(t scriptToken, args []scriptExpr) (scriptExpr, error) {
+	one := map[string]func(e *scriptEnv, a string) interface{}{
+		"header": func(e *scriptEnv, a string) interface{} { return e.r.Header.Get(a) },
+		"query":  func(e *scriptEnv, a string) interface{} { return e.r.URL.Query().Get(a) },
+		"cookie": func(e *scriptEnv, a string) interface{} {
+			if c, err := e.r.Cookie(a); err == nil {
+				return c.Value
+			}
+			return ""
+		},
+		"feature": func(e *scriptEnv, a string) interface{} { return dynamic.feature(a) },
+		"lower":   func(e *scriptEnv, a string) interface{} { return strings.ToLower(a) },
+		"upper":   func(e *scriptEnv, a string) interface{} { return strings.ToUpper(a) },
+	}
+	two := map[string]func(a, b string) bool{
+		"has_prefix": strings.HasPrefix,
+		"has_suffix": strings.HasSuffix,
+		"contains":   strings.Contains,
+	}
+	if f, ok := one[t.text]; ok {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("line %d: %s takes 1 argument", t.line, t.text)
+		}
+		return func(e *scriptEnv) interface{} { return f(e, str(args[0](e))) }, nil
+	}
+	if f, ok := two[t.text]; ok {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("line %d: %s takes 2 arguments", t.line, t.text)
+		}
+		return func(e *scriptEnv) interface{} { return f(str(args[0](e)), str(args[1](e))) }, nil
+	}
+	return nil, fmt.Errorf("line %d: unknown function %s", t.line, t.text)
+}
+
+// scriptFile holds the compiled request script, recompiled whenever the
+// file changes. A script that fails to compile is logged and the previous
+// one kept.
+type scriptFile struct {
+	path    string
+	current atomic.Value // *script
+	modTime time.Time
+}
+
+// requestScript is the script loaded from -script, nil if none.
+var requestScript *scriptFile
+
+func loadScriptFile(file string) (*scriptFile, error) {
+	sf := &scriptFile{path: file}
+	if err := sf.reload(); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+func (sf *scriptFile) reload() error {
+	fi, err := os.Stat(sf.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(sf.path)
+	if err != nil {
+		return err
+	}
+	// Remembered even if the script is broken, to report it only once.
+	sf.modTime = fi.ModTime()
+	s, err := parseScript(string(b))
+	if err != nil {
+		return fmt.Errorf("%s: %v", sf.path, err)
+	}
+	sf.current.Store(s)
+	return nil
+}
+
+// watch recompiles the script when its modification time changes.
+func (sf *scriptFile) watch(interval time.Duration, stop <-chan struct{}) {
+	if sf == nil {
+		return
+	}
+	goBackground(func() {
+		for {
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+			fi, err := os.Stat(sf.path)
+			if err != nil || fi.ModTime().Equal(sf.modTime) {
+				continue
+			}
+			if err := sf.reload(); err != nil {
+				log.Printf("Keeping previous request script: %v", err)
+				continue
+			}
+			log.Printf("Reloaded request script %s", sf.path)
+		}
+	})
+}
+
+func withScript(h http.Handler, sf *scriptFile) http.Handler {
+	if sf == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sf.current.Load().(*script).run(w, r) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
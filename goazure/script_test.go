@@ -0,0 +1,238 @@
+package goazure
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runScript compiles src and runs it on a request for target, returning the
+// recorded response, the request as the script left it and whether the
+// script answered it.
+func runScript(t *testing.T, src, target string, header http.Header) (*httptest.ResponseRecorder, *http.Request, bool) {
+	t.Helper()
+	s, err := parseScript(src)
+	if err != nil {
+		t.Fatalf("parseScript: %v", err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	answered := s.run(w, r)
+	return w, r, answered
+}
+
+func TestScriptParseErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		`set_path("/a`:                          `line 1: unterminated string`,
+		"set_path(\"/a\nb\")":                   `line 1: unterminated string`,
+		`set_path("/a") @`:                      `line 1: unexpected '@'`,
+		"\n\nfrobnicate()":                      `line 3: unknown action frobnicate`,
+		`set_header("X-A")`:                     `line 1: set_header takes 2 arguments`,
+		`if path == "/" { stop()`:               `line 1: missing }`,
+		`if path == "/" stop()`:                 `line 1: expected "{", found "stop"`,
+		`if nope == "" { stop() }`:              `line 1: unknown variable nope`,
+		`if lower() == "" { stop() }`:           `line 1: lower takes 1 argument`,
+		`if contains(path) { stop() }`:          `line 1: contains takes 2 arguments`,
+		`if getenv("HOME") { stop() }`:          `line 1: unknown function getenv`,
+		`if path =~ path { stop() }`:            `line 1: =~ needs a regular expression literal`,
+		`if path =~ "(" { stop() }`:             "line 1: error parsing regexp",
+		`if path == { stop() }`:                 `line 1: unexpected "{"`,
+		`if path ==`:                            `line 1: unexpected end of script`,
+		`"/a"`:                                  `line 1: expected a statement, found "/a"`,
+		`if (path == "/" { stop() }`:            `line 1: expected ")", found "{"`,
+		`set_path("/a" "/b")`:                   `line 1: expected ",", found "/b"`,
+		`while path != "/" { set_path("/") }`:   `line 1: expected "(", found "path"`,
+		`if path == "/" { } else set_path("/")`: `line 1: expected "{", found "set_path"`,
+	} {
+		_, err := parseScript(src)
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("parseScript(%q) = %v, want %s", src, err, want)
+		}
+	}
+}
+
+func TestScriptRewrite(t *testing.T) {
+	src := `
+		# Move v1 to v2.
+		if method == "GET" && path =~ "^/api/v1/(.*)" {
+			set_path("/api/v2/" + $1)
+			set_header("X-Api-Version", "2")
+		} else if header("X-Debug") != "" {
+			respond(200, "text/plain", "debug " + lower(header("X-Debug")))
+		}
+		del_header("X-Remove")
+		set_response_header("X-Query", query("q") + "|" + query_string)
+	`
+	w, r, answered := runScript(t, src, "/api/v1/users?q=1", http.Header{"X-Remove": {"x"}})
+	if answered {
+		t.Fatal("rewrite answered the request")
+	}
+	if r.URL.Path != "/api/v2/users" || r.Header.Get("X-Api-Version") != "2" {
+		t.Fatalf("got path %q, version %q", r.URL.Path, r.Header.Get("X-Api-Version"))
+	}
+	if r.Header.Get("X-Remove") != "" {
+		t.Fatal("header not deleted")
+	}
+	if got := w.Header().Get("X-Query"); got != "1|q=1" {
+		t.Fatalf("got X-Query %q", got)
+	}
+
+	w, _, answered = runScript(t, src, "/other", http.Header{"X-Debug": {"ON"}})
+	if !answered || w.Code != 200 || w.Body.String() != "debug on" {
+		t.Fatalf("got answered %v, %d %q", answered, w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Query") != "" {
+		t.Fatal("script went on after respond")
+	}
+}
+
+func TestScriptOperators(t *testing.T) {
+	for cond, want := range map[string]bool{
+		`""`:                                     false,
+		`"x"`:                                    true,
+		`!""`:                                    true,
+		`path == "/a/b" && method != "POST"`:     true,
+		`path == "/x" || has_prefix(path, "/a")`: true,
+		`!(path == "/a/b")`:                      false,
+		`path !~ "^/a"`:                          false,
+		`has_suffix(path, "/b") == "true"`:       true,
+		`upper(method) + 1 == "GET1"`:            true,
+		`contains(uri, "?k=v")`:                  true,
+		`cookie("session") == "abc"`:             true,
+		`cookie("missing") == ""`:                true,
+		`scheme == "http" && instance != ""`:     true,
+	} {
+		src := `if ` + cond + ` { respond(200, "text/plain", "yes") }`
+		_, _, answered := runScript(t, src, "/a/b?k=v", http.Header{"Cookie": {"session=abc"}})
+		if answered != want {
+			t.Errorf("%s: got %v, want %v", cond, answered, want)
+		}
+	}
+}
+
+// TestScriptSandbox checks that a script cannot step outside of the
+// request it is run on.
+func TestScriptSandbox(t *testing.T) {
+	t.Run("path stays rooted", func(t *testing.T) {
+		for target, want := range map[string]string{
+			"../../etc/passwd":   "/etc/passwd",
+			"/a/../../b/":        "/b/",
+			"a//b/./c":           "/a/b/c",
+			"/x?debug=1&y=../..": "/x",
+		} {
+			_, r, _ := runScript(t, `set_path("`+target+`")`, "/start", nil)
+			if r.URL.Path != want || r.URL.RawPath != "" {
+				t.Errorf("set_path(%q) left path %q, want %q", target, r.URL.Path, want)
+			}
+		}
+	})
+
+	t.Run("statuses are clamped", func(t *testing.T) {
+		w, _, _ := runScript(t, `redirect(200, "/elsewhere")`, "/", nil)
+		if w.Code != http.StatusFound {
+			t.Errorf("redirect with 200 sent %d, want 302", w.Code)
+		}
+		w, _, _ = runScript(t, `respond(999, "text/plain", "x")`, "/", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("respond with 999 sent %d, want 200", w.Code)
+		}
+		w, _, _ = runScript(t, `respond("nope", "text/plain", "x")`, "/", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("respond with nope sent %d, want 200", w.Code)
+		}
+	})
+
+	t.Run("stop ends the script", func(t *testing.T) {
+		w, _, answered := runScript(t, `if path == "/" { stop() } set_response_header("X-After", "1")`, "/", nil)
+		if answered || w.Header().Get("X-After") != "" {
+			t.Errorf("script went on after stop, answered %v", answered)
+		}
+	})
+
+	t.Run("no state across requests", func(t *testing.T) {
+		s, err := parseScript(`
+			if path =~ "^/u/(.*)" { set_header("X-Matched", "1") }
+			set_response_header("X-User", $1)
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.run(w, httptest.NewRequest("GET", "/u/alice", nil))
+		if got := w.Header().Get("X-User"); got != "alice" {
+			t.Fatalf("got X-User %q, want alice", got)
+		}
+		w = httptest.NewRecorder()
+		s.run(w, httptest.NewRequest("GET", "/other", nil))
+		if got := w.Header().Get("X-User"); got != "" {
+			t.Fatalf("capture leaked into the next request: X-User %q", got)
+		}
+	})
+}
+
+func TestScriptReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "request.script")
+	write := func(src string, mod time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(file, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(h http.Handler) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Body.String()
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("next")) })
+
+	base := time.Now().Add(-time.Hour)
+	write(`respond(200, "text/plain", "one")`, base)
+	if _, err := loadScriptFile(file + ".missing"); err == nil {
+		t.Fatal("loaded a missing script")
+	}
+	sf, err := loadScriptFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withScript(next, sf)
+	if got := get(h); got != "one" {
+		t.Fatalf("got %q, want one", got)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	sf.watch(10*time.Millisecond, stop)
+	waitFor := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); get(h) != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("still serving %q, want %q", get(h), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	write(`stop()`, base.Add(time.Minute))
+	waitFor("next")
+
+	// A broken script keeps the previous one.
+	write(`respond(200, "text/plain", "three"`, base.Add(2*time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	if got := get(h); got != "next" {
+		t.Fatalf("got %q after a broken reload, want the previous script", got)
+	}
+
+	write(`respond(200, "text/plain", "four")`, base.Add(3*time.Minute))
+	waitFor("four")
+}
@@ -0,0 +1,136 @@
+package goazure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runSelftest implements the "selftest" subcommand. It serves the
+// configuration given by the flags on an ephemeral port and a temporary
+// watch directory, then deploys a dummy artifact and checks that the server
+// drains and stops. The exit code is non-zero if any step fails.
+func runSelftest(args []string) {
+	fs := commandFlags("selftest")
+	verbose := fs.Bool("v", false, "Show server logs")
+	fs.Parse(args)
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+		connLog.SetOutput(ioutil.Discard)
+	}
+	if err := selftest(); err != nil {
+		fmt.Printf("FAIL  %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+func selftest() error {
+	dir, err := ioutil.TempDir("", "go-azure-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	cfg := config
+	cfg.Port = port
+	cfg.WatchDir = dir
+	cfg.MinRestartInterval = 0
+	cfg.DeployWindows = nil
+	cfg.HistoryFile = ""
+	cfg.LockDir = ""
+	cfg.DeployQueue = ""
+	cfg.HTTPRedirectPort = 0
+	cfg.SocketActivation = false
+	config = cfg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	var runErr error
+	go func() {
+		runErr = Run(ctx, cfg)
+		close(stopped)
+	}()
+
+	step := func(name string, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Printf("ok    %s\n", name)
+		return nil
+	}
+
+	err = waitHealthy(selfURL("/healthz"), 10*time.Second, stopped)
+	select {
+	case <-stopped:
+		err = fmt.Errorf("server stopped: %v", runErr)
+	default:
+	}
+	if err := step("server became healthy", err); err != nil {
+		return err
+	}
+
+	// Keep the connection open afterwards so that the drain has to close it.
+	c := loopbackClient(10 * time.Second)
+	err = func() error {
+		resp, err := c.Get(selfURL("/"))
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("got %s", resp.Status)
+		}
+		return nil
+	}()
+	if err := step("served a request", err); err != nil {
+		return err
+	}
+
+	artifact := filepath.Join(dir, "selftest-artifact")
+	err = ioutil.WriteFile(artifact, []byte(time.Now().String()), 0644)
+	if err := step("deployed "+artifact, err); err != nil {
+		return err
+	}
+
+	// Allow for the artifact stability check before the drain starts.
+	timeout := time.Duration(cfg.MaxWait)*time.Second + 30*time.Second
+	select {
+	case <-stopped:
+		err = runErr
+	case <-time.After(timeout):
+		err = fmt.Errorf("server still running after %v", timeout)
+	}
+	if err := step("drained and stopped", err); err != nil {
+		return err
+	}
+
+	for _, e := range deployments.snapshot() {
+		if e.Kind == eventRestart && e.Outcome == "drained" {
+			return step("recorded the restart", nil)
+		}
+	}
+	return step("recorded the restart", fmt.Errorf("no restart in deployment history"))
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,183 @@
+package goazure
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// settings holds values that can change at runtime without a restart, such
+// as those pulled from Azure App Configuration.
+type settings struct {
+	mu       sync.RWMutex
+	values   map[string]string
+	features map[string]bool
+	enabled  string // names of the enabled features, sorted and comma separated
+	limiter  *rateLimiter
+	// changed is signalled when replace changed anything.
+	changed chan struct{}
+}
+
+var dynamic = &settings{values: map[string]string{}, features: map[string]bool{}, changed: make(chan struct{}, 1)}
+
+func (s *settings) get(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[key]
+}
+
+func (s *settings) feature(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.features[name]
+}
+
+func (s *settings) maintenance() bool {
+	b, _ := strconv.ParseBool(s.get("maintenance"))
+	return b
+}
+
+// replace swaps in a complete set of values and feature flags, returning
+// whether anything changed.
+func (s *settings) replace(values map[string]string, features map[string]bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if equalStrings(s.values, values) && equalBools(s.features, features) {
+		return false
+	}
+	s.values, s.features = values, features
+	var enabled []string
+	for name, on := range features {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	s.enabled = strings.Join(enabled, ",")
+
+	rate, _ := strconv.ParseFloat(values["rateLimit"], 64)
+	if rate > 0 {
+		s.limiter = newRateLimiter(rate)
+	} else {
+		s.limiter = nil
+	}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *settings) snapshot() (map[string]string, map[string]bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		values[k] = v
+	}
+	features := make(map[string]bool, len(s.features))
+	for k, v := range s.features {
+		features[k] = v
+	}
+	return values, features
+}
+
+// featureHeader carries the enabled feature flags to handlers and backends.
+const featureHeader = "X-Goazure-Features"
+
+// withSettings applies maintenance mode and rate limiting, and passes the
+// enabled feature flags on in featureHeader, replacing any sent by the
+// client. Health and admin endpoints stay reachable in maintenance mode.
+func withSettings(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(featureHeader)
+		dynamic.mu.RLock()
+		enabled := dynamic.enabled
+		dynamic.mu.RUnlock()
+		if enabled != "" {
+			r.Header.Set(featureHeader, enabled)
+		}
+
+		operational := r.URL.Path == "/healthz" || strings.HasPrefix(r.URL.Path, "/admin/")
+		if !operational && dynamic.maintenance() {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "service under maintenance", http.StatusServiceUnavailable)
+			return
+		}
+
+		dynamic.mu.RLock()
+		l := dynamic.limiter
+		dynamic.mu.RUnlock()
+		if l != nil && !l.allow() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter is a token bucket allowing rate requests per second with bursts
+// of up to one second's worth, or of one request for rates below one per
+// second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(rate, 1)
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func equalStrings(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func equalBools(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package goazure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBelowOnePerSecond(t *testing.T) {
+	l := newRateLimiter(0.5)
+	if !l.allow() {
+		t.Fatal("first request rejected")
+	}
+	if l.allow() {
+		t.Fatal("second request within two seconds allowed")
+	}
+	l.last = l.last.Add(-2 * time.Second)
+	if !l.allow() {
+		t.Fatal("request after two seconds rejected")
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	defer dynamic.replace(dynamic.snapshot())
+	dynamic.replace(map[string]string{}, map[string]bool{"beta": true, "old-ui": false, "alpha": true})
+
+	var got string
+	h := withSettings(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(featureHeader)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(featureHeader, "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "alpha,beta" {
+		t.Fatalf("handler got features %q, want alpha,beta", got)
+	}
+
+	for cond, want := range map[string]bool{`feature("beta")`: true, `feature("old-ui")`: false, `feature("none")`: false} {
+		_, _, answered := runScript(t, `if `+cond+` { respond(200, "text/plain", "on") }`, "/", nil)
+		if answered != want {
+			t.Errorf("%s: got %v, want %v", cond, answered, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package goazure
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const shedSlots = 10 // one-second slots of latencies behind the p99
+
+var shedRequests = newCounter("goazure_shed_requests_total", "Requests rejected by load shedding")
+
+// shedder is set up by defineHandlers and started by Run.
+var shedder *loadShedder
+
+// loadShedder rejects a fraction of requests while the instance is
+// overloaded, as measured by the p99 latency over the last seconds, the
+// requests queued for a worker (or in flight without -workers) and the
+// number of goroutines, each against its threshold. The fraction follows the
+// worst ratio to its threshold, rejecting 1-1/ratio of requests so that what
+// gets through stays within it, rising at once and falling by 5% a second,
+// so that it neither lets a spike through nor flaps once it subsides.
+type loadShedder struct {
+	latency    time.Duration
+	queue      int
+	goroutines int
+
+	mu        sync.Mutex
+	latencies *rollingHistogram
+	fraction  uint64 // math.Float64bits of the fraction rejected
+	ratio     uint64 // math.Float64bits of the last overload ratio
+}
+
+func newLoadShedder(latencyMs, queue, goroutines int) *loadShedder {
+	if latencyMs <= 0 && queue <= 0 && goroutines <= 0 {
+		return nil
+	}
+	return &loadShedder{
+		latency:    time.Duration(latencyMs) * time.Millisecond,
+		queue:      queue,
+		goroutines: goroutines,
+		latencies:  newRollingHistogram(time.Second, shedSlots, true),
+	}
+}
+
+func init() {
+	newGaugeFunc("goazure_shed_fraction", "Fraction of requests being rejected by load shedding", func() float64 {
+		return shedder.shedFraction()
+	})
+}
+
+func (s *loadShedder) shedFraction() float64 {
+	if s == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&s.fraction))
+}
+
+// pressure returns the last largest ratio of a signal to its threshold,
+// above 1 when overloaded.
+func (s *loadShedder) pressure() float64 {
+	if s == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&s.ratio))
+}
+
+func (s *loadShedder) observe(d time.Duration) {
+	s.mu.Lock()
+	s.latencies.observe(time.Now(), d.Seconds(), false)
+	s.mu.Unlock()
+}
+
+// p99 returns the 99th percentile latency over the last shedSlots seconds.
+func (s *loadShedder) p99() time.Duration {
+	s.mu.Lock()
+	total := s.latencies.total(time.Now(), shedSlots)
+	s.mu.Unlock()
+	return time.Duration(total.quantile(0.99) * float64(time.Second))
+}
+
+// overload returns the largest ratio of a signal to its threshold.
+func (s *loadShedder) overload() float64 {
+	ratio := 0.0
+	if s.latency > 0 {
+		ratio = math.Max(ratio, float64(s.p99())/float64(s.latency))
+	}
+	if s.queue > 0 {
+		queued := int(atomic.LoadInt64(&activeRequests))
+		if pool != nil {
+			_, queued = pool.inFlight()
+		}
+		ratio = math.Max(ratio, float64(queued)/float64(s.queue))
+	}
+	if s.goroutines > 0 {
+		ratio = math.Max(ratio, float64(runtime.NumGoroutine())/float64(s.goroutines))
+	}
+	return ratio
+}
+
+// start adjusts the fraction every second until stop is closed.
+func (s *loadShedder) start(stop <-chan struct{}) {
+	if s == nil {
+		return
+	}
+	goBackground(func() {
+		for {
+			select {
+			case <-clk.After(time.Second):
+			case <-stop:
+				return
+			}
+			target := 0.0
+			r := s.overload()
+			atomic.StoreUint64(&s.ratio, math.Float64bits(r))
+			if r > 1 {
+				// Let some requests through to keep measuring latency.
+				target = math.Min(1-1/r, 0.95)
+			}
+			current := s.shedFraction()
+			if target < current {
+				target = math.Max(target, current-0.05)
+			}
+			atomic.StoreUint64(&s.fraction, math.Float64bits(target))
+		}
+	})
+}
+
+// withLoadShed rejects requests with 503 at the current fraction. Health
+// checks and the admin API take the priority lane around it.
+func withLoadShed(h http.Handler, s *loadShedder) http.Handler {
+	if s == nil {
+		return h
+	}
+	timed := withTiming(h, func(r *http.Request, status int, d time.Duration) {
+		s.observe(d)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f := s.shedFraction(); f > 0 && rand.Float64() < f {
+			shedRequests.inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		timed.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package goazure
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+// simulatedDeployments carries deployments requested through the admin API
+// and Deploy. Those from the admin API have no artifact, so they go through
+// the deployment windows, restart lease, drain and restart like a real
+// deployment but bring back the same binary, which makes them safe for
+// rehearsing a deployment in production.
+var simulatedDeployments = make(chan deployment)
+
+// Deploy feeds a deployment of artifact to the running server as if a
+// watcher had found it, recording trigger as its origin. An empty artifact
+// deploys the running binary; an artifact that cannot be run fails with
+// ErrArtifactInvalid. It gives up once ctx is done.
+func Deploy(ctx context.Context, artifact, trigger string) error {
+	if artifact != "" {
+		if err := validateArtifact(artifact); err != nil {
+			return err
+		}
+	}
+	select {
+	case simulatedDeployments <- deployment{artifact: artifact, trigger: trigger}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type simulatedSource struct{}
+
+func (simulatedSource) watch(deploy chan<- deployment, stop <-chan struct{}) error {
+	for {
+		select {
+		case dep := <-simulatedDeployments:
+			select {
+			case deploy <- dep:
+			case <-stop:
+				return nil
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+type simulateResult struct {
+	Trigger string `json:"trigger"`
+}
+
+// simulateHandler starts a simulated deployment on POST. Its outcome and the
+// duration of the resulting drain show up in /admin/deployments.
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	select {
+	case simulatedDeployments <- deployment{trigger: "simulated"}:
+	case <-time.After(5 * time.Second):
+		httpjson.Fail(w, r, http.StatusServiceUnavailable, "deployment pipeline is not accepting deployments")
+		return
+	}
+
+	httpjson.Write(w, http.StatusAccepted, simulateResult{"simulated"})
+}
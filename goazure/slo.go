@@ -0,0 +1,175 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+const sloSlots = 24 * 60 // one-minute slots, covering the longest window
+
+// sloWindows are the rolling windows compliance is reported over.
+var sloWindows = []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+var sloAlerts = newCounter("goazure_slo_alerts_total", "Fast error budget burn alerts sent")
+
+// sloTracker counts requests that met and missed the service level
+// objective: a request is good if it did not fail with a 5xx status and,
+// with a latency objective, completed within it.
+type sloTracker struct {
+	target  float64 // fraction of good requests, such as 0.999
+	latency time.Duration
+
+	mu     sync.Mutex
+	recent *rollingHistogram // bad requests counted as errors
+}
+
+var slo *sloTracker
+
+func newSLOTracker(targetPercent float64, latency time.Duration) (*sloTracker, error) {
+	if targetPercent <= 0 || targetPercent >= 100 {
+		return nil, fmt.Errorf("SLO target must be between 0 and 100, got %v", targetPercent)
+	}
+	return &sloTracker{target: targetPercent / 100, latency: latency, recent: newRollingHistogram(time.Minute, sloSlots, false)}, nil
+}
+
+func (s *sloTracker) observe(status int, d time.Duration) {
+	bad := status >= 500 || (s.latency > 0 && d > s.latency)
+	s.mu.Lock()
+	s.recent.observe(time.Now(), 0, bad)
+	s.mu.Unlock()
+}
+
+// sloWindow is the compliance over a rolling window. BudgetRemaining is the
+// share of the error budget left, negative once it is overspent, and
+// BurnRate how fast it is being spent relative to exhausting it exactly at
+// the end of the window.
+type sloWindow struct {
+	Window          string  `json:"window"`
+	Requests        uint64  `json:"requests"`
+	Bad             uint64  `json:"bad"`
+	Compliance      float64 `json:"compliance"`
+	BudgetRemaining float64 `json:"budgetRemaining"`
+	BurnRate        float64 `json:"burnRate"`
+}
+
+func (s *sloTracker) window(d time.Duration) sloWindow {
+	w := sloWindow{Window: strings.TrimSuffix(strings.TrimSuffix(d.String(), "0s"), "0m"), Compliance: 1, BudgetRemaining: 1}
+
+	s.mu.Lock()
+	total := s.recent.total(time.Now(), int(d/time.Minute))
+	s.mu.Unlock()
+	w.Requests, w.Bad = total.count, total.errors
+
+	if w.Requests > 0 {
+		badRatio := float64(w.Bad) / float64(w.Requests)
+		w.Compliance = 1 - badRatio
+		w.BurnRate = badRatio / (1 - s.target)
+		w.BudgetRemaining = 1 - w.BurnRate
+	}
+	return w
+}
+
+type sloReport struct {
+	Target    float64     `json:"target"`
+	LatencyMs int64       `json:"latencyMs,omitempty"`
+	Windows   []sloWindow `json:"windows"`
+}
+
+func (s *sloTracker) report() sloReport {
+	r := sloReport{Target: s.target, LatencyMs: s.latency.Milliseconds()}
+	for _, d := range sloWindows {
+		r.Windows = append(r.Windows, s.window(d))
+	}
+	return r
+}
+
+// sloHandler reports compliance and the remaining error budget:
+//
+//	GET /admin/slo
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	if slo == nil {
+		httpjson.Fail(w, r, http.StatusNotFound, "no SLO configured, set -sloTarget")
+		return
+	}
+	httpjson.Write(w, http.StatusOK, slo.report())
+}
+
+// withSLO counts requests against the objective, leaving out health and
+// readiness checks and the admin API.
+func withSLO(h http.Handler, s *sloTracker) http.Handler {
+	if s == nil {
+		return h
+	}
+
+	timed := withTiming(h, func(r *http.Request, status int, d time.Duration) {
+		s.observe(status, d)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPriorityRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		timed.ServeHTTP(w, r)
+	})
+}
+
+// startSLOAlerts posts to webhook when the error budget burns at least
+// burnRate times too fast over both the last hour and the last five
+// minutes, the latter confirming that the burn is still going on. Alerts
+// are repeated at most hourly.
+func startSLOAlerts(s *sloTracker, webhook string, burnRate float64, stop <-chan struct{}) {
+	if s == nil || webhook == "" {
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	goBackground(func() {
+		var last time.Time
+		for {
+			select {
+			case <-time.After(time.Minute):
+			case <-stop:
+				return
+			}
+
+			long, short := s.window(time.Hour), s.window(5*time.Minute)
+			if long.BurnRate < burnRate || short.BurnRate < burnRate || time.Since(last) < time.Hour {
+				continue
+			}
+			last = time.Now()
+			sloAlerts.inc()
+
+			site := os.Getenv("WEBSITE_SITE_NAME")
+			if site == "" {
+				site = instanceID
+			}
+			text := fmt.Sprintf("%s (instance %s) is burning its error budget %.1fx too fast: %.3f%% compliance over the last hour for a %.3f%% objective",
+				site, instanceID, long.BurnRate, long.Compliance*100, s.target*100)
+			log.Printf("SLO alert: %s", text)
+			b, _ := json.Marshal(struct {
+				Text     string    `json:"text"`
+				Instance string    `json:"instance"`
+				Window   sloWindow `json:"window"`
+				Report   sloReport `json:"report"`
+			}{text, instanceID, long, s.report()})
+			resp, err := client.Post(webhook, "application/json", bytes.NewReader(b))
+			if err != nil {
+				log.Printf("Could not send SLO alert: %v", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Printf("SLO alert webhook returned %s", resp.Status)
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package goazure
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+var slowRequests = newCounter("goazure_slow_requests_total", "Requests taking longer than -slowRequestMs")
+
+// requestID returns the ID a request was given by the client or the App
+// Service front end, or "-".
+func requestID(r *http.Request) string {
+	if id := httpjson.RequestID(r); id != "" {
+		return id
+	}
+	return "-"
+}
+
+// timedBody accumulates the time spent reading the request body.
+type timedBody struct {
+	io.ReadCloser
+	d time.Duration
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := b.ReadCloser.Read(p)
+	b.d += time.Since(start)
+	return n, err
+}
+
+// timedWriter accumulates the time spent writing the response and keeps its
+// status.
+type timedWriter struct {
+	http.ResponseWriter
+	status int
+	d      time.Duration
+}
+
+func (tw *timedWriter) WriteHeader(status int) {
+	if tw.status == 0 {
+		tw.status = status
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timedWriter) Write(b []byte) (int, error) {
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	start := time.Now()
+	n, err := tw.ResponseWriter.Write(b)
+	tw.d += time.Since(start)
+	return n, err
+}
+
+func (tw *timedWriter) ReadFrom(r io.Reader) (int64, error) {
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	start := time.Now()
+	n, err := readFrom(tw.ResponseWriter, r)
+	tw.d += time.Since(start)
+	return n, err
+}
+
+func (tw *timedWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// withTiming calls observe with the status and handling time of each
+// request.
+func withTiming(h http.Handler, observe func(r *http.Request, status int, d time.Duration)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tw := &timedWriter{ResponseWriter: w}
+		h.ServeHTTP(tw, r)
+		if tw.status == 0 {
+			tw.status = http.StatusOK
+		}
+		observe(r, tw.status, time.Since(start))
+	})
+}
+
+// withSlowLog logs requests taking longer than threshold with the time spent
+// reading the body, handling and writing the response, to find the routes
+// that will not finish within the drain budget.
+func withSlowLog(h http.Handler, threshold time.Duration) http.Handler {
+	if threshold <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tb := &timedBody{ReadCloser: r.Body}
+		r.Body = tb
+		tw := &timedWriter{ResponseWriter: w}
+		h.ServeHTTP(tw, r)
+
+		total := time.Since(start)
+		if total < threshold {
+			return
+		}
+		slowRequests.inc()
+		connLog.Printf("slow request %s %s%s status=%d total=%v read=%v handle=%v write=%v request=%s client=%s",
+			r.Method, r.Host, r.RequestURI, tw.status, total.Round(time.Millisecond),
+			tb.d.Round(time.Millisecond), (total - tb.d - tw.d).Round(time.Millisecond), tw.d.Round(time.Millisecond),
+			requestID(r), r.RemoteAddr)
+	})
+}
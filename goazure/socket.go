@@ -0,0 +1,72 @@
+package goazure
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listenTCP opens the IPv4 listener for port, with a custom accept backlog
+// where the platform supports it.
+func listenTCP(port int) (net.Listener, error) {
+	if config.ListenBacklog > 0 {
+		l, err := listenBacklog(port, config.ListenBacklog)
+		if err == nil {
+			return l, nil
+		}
+		log.Printf("Could not set listen backlog, using system default: %v", err)
+	}
+	return net.Listen("tcp4", ":"+strconv.Itoa(port))
+}
+
+// activatedListener returns the first socket passed in by systemd socket
+// activation. The socket outlives the process, so connections arriving while
+// a drained process restarts queue up instead of being refused.
+func activatedListener() (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, errors.New("no socket passed by systemd")
+	}
+	if n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS")); n < 1 {
+		return nil, errors.New("no socket passed by systemd")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// Passed descriptors start at 3, after stdin, stdout and stderr.
+	f := os.NewFile(3, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// tuneConn applies the TCP socket options from the configuration to an
+// accepted connection.
+func tuneConn(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	switch {
+	case config.TCPKeepAlive < 0:
+		tc.SetKeepAlive(false)
+	case config.TCPKeepAlive > 0:
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(time.Duration(config.TCPKeepAlive) * time.Second)
+	}
+	tc.SetNoDelay(config.TCPNoDelay)
+}
+
+// lingerOnDrain sets the linger behavior for connections closed while
+// draining; zero resets them instead of waiting for unsent data.
+func lingerOnDrain(c net.Conn) {
+	if config.TCPLinger < 0 || !isDraining() {
+		return
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(config.TCPLinger)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package goazure
+
+import (
+	"errors"
+	"net"
+)
+
+func listenBacklog(port, backlog int) (net.Listener, error) {
+	return nil, errors.New("listen backlog is not supported on this platform")
+}
@@ -0,0 +1,61 @@
+package goazure
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+// deployment is a request to restart onto a new artifact.
+type deployment struct {
+	artifact string // path of the new artifact, empty if unknown
+	trigger  string
+}
+
+// deploymentSource produces deployments until stop is closed. watch returns
+// an error if the source fails and can no longer produce deployments.
+type deploymentSource interface {
+	watch(deploy chan<- deployment, stop <-chan struct{}) error
+}
+
+// fsSource reports binaries created in a directory.
+type fsSource struct {
+	w   *fsnotify.Watcher
+	rec *eventRecorder
+}
+
+func newFSSource(dir string, rec *eventRecorder) (*fsSource, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &fsSource{w: w, rec: rec}, nil
+}
+
+func (s *fsSource) watch(deploy chan<- deployment, stop <-chan struct{}) error {
+	defer s.w.Close()
+	defer s.rec.close()
+	for {
+		select {
+		case evt := <-s.w.Events:
+			s.rec.record(evt.Op, evt.Name)
+			if dep, reason := watcherDeployment(evt.Op, evt.Name); reason == "" {
+				log.Printf("New binary found: %s", evt.Name)
+				select {
+				case deploy <- dep:
+				case <-stop:
+					return nil
+				}
+			}
+		case err := <-s.w.Errors:
+			return fmt.Errorf("%w: file watcher error: %v", ErrWatcherFailed, err)
+		case <-stop:
+			return nil
+		}
+	}
+}
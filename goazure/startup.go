@@ -0,0 +1,114 @@
+package goazure
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// startupReport is logged as a single JSON record once the server is set up
+// to serve, describing what it resolved its configuration to and where it
+// runs, so that one line of a log answers how an instance was started.
+type startupReport struct {
+	Version   string                 `json:"version"`
+	Go        string                 `json:"go"`
+	OS        string                 `json:"os"`
+	PID       int                    `json:"pid"`
+	Hash      string                 `json:"hash,omitempty"`
+	Instance  *InstanceMetadata      `json:"instance"`
+	Listeners []startupListener      `json:"listeners"`
+	TLS       startupTLS             `json:"tls"`
+	Watch     startupWatch           `json:"watch"`
+	Runtime   startupRuntime         `json:"runtime"`
+	Config    map[string]interface{} `json:"config"`
+}
+
+type startupListener struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+type startupTLS struct {
+	Enabled      bool   `json:"enabled"`
+	Certificates string `json:"certificates,omitempty"` // files, sni or both
+	OCSPStapling bool   `json:"ocspStapling,omitempty"`
+	TicketKeys   string `json:"ticketKeys,omitempty"`
+	RedirectPort int    `json:"redirectPort,omitempty"`
+}
+
+type startupWatch struct {
+	Dir     string `json:"dir"`
+	Storage string `json:"storage"`
+	Mode    string `json:"mode"`
+}
+
+type startupRuntime struct {
+	GOMAXPROCS    int   `json:"gomaxprocs"`
+	CPUs          int   `json:"cpus"`
+	MemoryLimitMB int64 `json:"memoryLimitMB,omitempty"`
+}
+
+// logStartupReport logs the startup report. Flags left at their defaults are
+// left out of the configuration, which is redacted as in "config dump".
+func logStartupReport() {
+	r := startupReport{
+		Version:  version,
+		Go:       runtime.Version(),
+		OS:       runtime.GOOS + "/" + runtime.GOARCH,
+		PID:      os.Getpid(),
+		Hash:     runningHash,
+		Instance: metadata,
+		Config:   make(map[string]interface{}),
+	}
+	for _, gl := range listenerGroup.snapshot() {
+		r.Listeners = append(r.Listeners, startupListener{gl.name, gl.l.Addr().String()})
+	}
+
+	if tlsEnabled() {
+		r.TLS.Enabled = true
+		switch {
+		case config.TLSCert != "" && config.CertsFile != "":
+			r.TLS.Certificates = "both"
+		case config.CertsFile != "":
+			r.TLS.Certificates = "sni"
+		default:
+			r.TLS.Certificates = "files"
+		}
+		r.TLS.OCSPStapling = config.OCSPStapling
+		switch {
+		case config.TicketKeyRotation > 0 && config.TicketKeyDir != "":
+			r.TLS.TicketKeys = "shared"
+		case config.TicketKeyRotation > 0:
+			r.TLS.TicketKeys = "rotated"
+		}
+		r.TLS.RedirectPort = config.HTTPRedirectPort
+	}
+
+	status.Lock()
+	r.Watch = startupWatch{config.WatchDir, status.storage, status.watchMode}
+	status.Unlock()
+
+	r.Runtime = startupRuntime{GOMAXPROCS: runtime.GOMAXPROCS(0), CPUs: runtime.NumCPU()}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		r.Runtime.MemoryLimitMB = limit >> 20
+	}
+
+	// Flags resolved at startup, such as -maxWait fitted to the platform,
+	// differ from their defaults too.
+	flag.VisitAll(func(f *flag.Flag) {
+		if v := f.Value.String(); v != f.DefValue {
+			r.Config[f.Name] = redactFlag(f.Name, flagValue(f.Value))
+		}
+	})
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Could not encode startup report: %v", err)
+		return
+	}
+	log.Printf("Starting server: %s", b)
+}
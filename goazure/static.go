@@ -0,0 +1,135 @@
+package goazure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type etagKey struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// etagCache remembers content hashes so files are hashed once per change.
+var etagCache = struct {
+	sync.Mutex
+	m map[etagKey]string
+}{m: map[etagKey]string{}}
+
+func strongETag(f http.File, name string, fi os.FileInfo) (string, error) {
+	k := etagKey{name: name, size: fi.Size(), modTime: fi.ModTime()}
+
+	etagCache.Lock()
+	tag, ok := etagCache.m[k]
+	etagCache.Unlock()
+	if ok {
+		return tag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	tag = `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+
+	etagCache.Lock()
+	etagCache.m[k] = tag
+	etagCache.Unlock()
+	return tag, nil
+}
+
+// staticHandler serves files from root with strong ETags, or those etag
+// returns for files it knows. Conditional and Range requests are handled by
+// http.ServeContent. In SPA mode, unknown paths without a file extension are
+// served the root index.html so that client side routes resolve.
+type staticHandler struct {
+	root http.FileSystem
+	spa  bool
+	etag func(name string) string
+}
+
+func newStaticHandler(dir string, spa bool) *staticHandler {
+	return &staticHandler{root: http.Dir(dir), spa: spa}
+}
+
+func (s *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	f, fi, err := s.open(name)
+	if os.IsNotExist(err) && s.spa && path.Ext(name) == "" {
+		name = "/index.html"
+		f, fi, err = s.open(name)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	s.serveFile(w, r, f, name, fi)
+}
+
+// open opens name, resolving directories to their index.html.
+func (s *staticHandler) open(name string) (http.File, os.FileInfo, error) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !fi.IsDir() {
+		return f, fi, nil
+	}
+
+	f.Close()
+	if strings.HasSuffix(name, "/index.html") {
+		return nil, nil, os.ErrNotExist
+	}
+	return s.open(path.Join(name, "index.html"))
+}
+
+func (s *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, f http.File, name string, fi os.FileInfo) {
+	if s.serveCompressed(w, r, f, name, fi) {
+		return
+	}
+
+	tag, err := s.etagFor(f, name, fi)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", tag)
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+func (s *staticHandler) etagFor(f http.File, name string, fi os.FileInfo) (string, error) {
+	if s.etag != nil {
+		if tag := s.etag(name); tag != "" {
+			return tag, nil
+		}
+	}
+	return strongETag(f, name, fi)
+}
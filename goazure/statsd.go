@@ -0,0 +1,155 @@
+package goazure
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps packets within a typical MTU so they are not
+// fragmented.
+const statsdMaxPacket = 1432
+
+// statsdExporter pushes the registered metrics to a statsd or DogStatsD
+// agent, for environments where nothing can scrape /metrics. Counters are
+// sent as the increase since the previous push, gauges as their current
+// value and histograms as the increase of their count and sum.
+type statsdExporter struct {
+	conn net.Conn
+	tags string
+	last map[string]float64
+	buf  bytes.Buffer
+}
+
+func newStatsdExporter(addr string, tags []string) (*statsdExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tags = append([]string{"instance:" + instanceID}, tags...)
+	if site := os.Getenv("WEBSITE_SITE_NAME"); site != "" {
+		tags = append(tags, "site:"+site)
+	}
+	return &statsdExporter{conn: conn, tags: strings.Join(tags, ","), last: make(map[string]float64)}, nil
+}
+
+// startStatsd pushes metrics every interval and once more when stop is
+// closed, so that the final drain is reported too.
+func startStatsd(addr string, tags []string, interval time.Duration, stop <-chan struct{}) error {
+	if addr == "" {
+		return nil
+	}
+	e, err := newStatsdExporter(addr, tags)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pushing metrics to statsd at %s every %v", addr, interval)
+
+	goBackground(func() {
+		defer e.conn.Close()
+		for {
+			select {
+			case <-time.After(interval):
+				e.push()
+			case <-stop:
+				e.push()
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (e *statsdExporter) push() {
+	registry.Lock()
+	ms := append([]metric(nil), registry.metrics...)
+	registry.Unlock()
+
+	for _, m := range ms {
+		for _, s := range samples(m) {
+			tags := statsdTags(s.labels)
+			switch {
+			case s.kind == "gauge":
+				e.line(s.name, tags, s.value, "g")
+			case s.kind == "counter":
+				e.delta(s.name, tags, s.value)
+			case strings.HasSuffix(s.name, "_count"):
+				e.delta(strings.TrimSuffix(s.name, "_count")+".count", tags, s.value)
+			case strings.HasSuffix(s.name, "_sum"):
+				e.delta(strings.TrimSuffix(s.name, "_sum")+".sum", tags, s.value)
+			}
+			// Histogram buckets are left out, as statsd has no counterpart.
+		}
+	}
+	e.flush()
+}
+
+// statsdTags turns Prometheus labels into DogStatsD tags.
+func statsdTags(labels string) string {
+	var tags []string
+	for labels != "" {
+		i := strings.Index(labels, `="`)
+		if i < 0 {
+			break
+		}
+		name, rest := labels[:i], labels[i+2:]
+		var v strings.Builder
+		j := 0
+		for ; j < len(rest) && rest[j] != '"'; j++ {
+			if rest[j] == '\\' && j+1 < len(rest) {
+				j++
+			}
+			v.WriteByte(rest[j])
+		}
+		if v.Len() > 0 {
+			tags = append(tags, name+":"+statsdTagValue.Replace(v.String()))
+		}
+		labels = strings.TrimPrefix(rest[min(j+1, len(rest)):], ",")
+	}
+	return strings.Join(tags, ",")
+}
+
+var statsdTagValue = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// delta sends the increase of a cumulative value as a counter.
+func (e *statsdExporter) delta(name, tags string, v float64) {
+	key := name + "|" + tags
+	d := v - e.last[key]
+	e.last[key] = v
+	if d > 0 {
+		e.line(name, tags, d, "c")
+	}
+}
+
+func (e *statsdExporter) line(name, tags string, v float64, kind string) {
+	l := fmt.Sprintf("%s:%s|%s", name, formatFloat(v), kind)
+	if e.tags != "" && tags != "" {
+		tags = e.tags + "," + tags
+	} else if tags == "" {
+		tags = e.tags
+	}
+	if tags != "" {
+		l += "|#" + tags
+	}
+	if e.buf.Len() > 0 && e.buf.Len()+1+len(l) > statsdMaxPacket {
+		e.flush()
+	}
+	if e.buf.Len() > 0 {
+		e.buf.WriteByte('\n')
+	}
+	e.buf.WriteString(l)
+}
+
+func (e *statsdExporter) flush() {
+	if e.buf.Len() == 0 {
+		return
+	}
+	if _, err := e.conn.Write(e.buf.Bytes()); err != nil {
+		log.Printf("Could not push metrics to statsd: %v", err)
+	}
+	e.buf.Reset()
+}
@@ -0,0 +1,70 @@
+package goazure
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdTags(t *testing.T) {
+	for labels, want := range map[string]string{
+		``:                                     ``,
+		`listener="http"`:                      `listener:http`,
+		`method="GET",route="/a,b",code="2xx"`: `method:GET,route:/a_b,code:2xx`,
+		`route="/say \"hi\"",le="+Inf"`:        `route:/say "hi",le:+Inf`,
+		`site="a|b",slot="c\\d"`:               `site:a_b,slot:c\d`,
+		`region="",sku="B1"`:                   `sku:B1`,
+	} {
+		if got := statsdTags(labels); got != want {
+			t.Errorf("statsdTags(%q) = %q, want %q", labels, got, want)
+		}
+	}
+}
+
+func TestStatsdPush(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	e, err := newStatsdExporter(pc.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.conn.Close()
+
+	routes.observe("GET", "/statsd-test", 200, 20*time.Millisecond)
+	e.push()
+	routes.observe("GET", "/statsd-test", 503, 20*time.Millisecond)
+	e.push()
+
+	var lines []string
+	buf := make([]byte, 64<<10)
+	pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	all := strings.Join(lines, "\n")
+
+	for _, want := range []string{
+		"goazure_route_requests_total:1|c|#instance:" + instanceID + ",method:GET,route:/statsd-test,code:2xx",
+		"goazure_route_requests_total:1|c|#instance:" + instanceID + ",method:GET,route:/statsd-test,code:5xx",
+		"goazure_route_request_duration_seconds.count:1|c|#instance:" + instanceID + ",method:GET,route:/statsd-test",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("no %q pushed in:\n%s", want, all)
+		}
+	}
+	if strings.Contains(all, "_bucket") {
+		t.Errorf("histogram buckets pushed:\n%s", all)
+	}
+	// The 2xx count did not change, so the second push leaves it out.
+	if n := strings.Count(all, "route:/statsd-test,code:2xx"); n != 1 {
+		t.Errorf("2xx count pushed %d times, want once:\n%s", n, all)
+	}
+}
@@ -0,0 +1,103 @@
+package goazure
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+type pendingDeployment struct {
+	Artifact    string     `json:"artifact"`
+	DetectedAt  time.Time  `json:"detectedAt"`
+	ScheduledAt *time.Time `json:"scheduledAt,omitempty"`
+	// Handover is set when the deployment arrived after the restart began
+	// and will be picked up by the next process rather than this one.
+	Handover bool `json:"handover,omitempty"`
+}
+
+type poolStatus struct {
+	Size   int `json:"size"`
+	Active int `json:"active"`
+	Queued int `json:"queued"`
+}
+
+var status struct {
+	sync.Mutex
+	pending   *pendingDeployment
+	storage   string
+	watchMode string
+}
+
+func setWatchStatus(storage, mode string) {
+	status.Lock()
+	status.storage, status.watchMode = storage, mode
+	status.Unlock()
+}
+
+func setPendingDeployment(p *pendingDeployment) {
+	status.Lock()
+	status.pending = p
+	status.Unlock()
+}
+
+// serverStatus is the document served by /admin/status.
+type serverStatus struct {
+	Instance          string             `json:"instance"`
+	Metadata          *InstanceMetadata  `json:"metadata,omitempty"`
+	Version           string             `json:"version"`
+	Started           time.Time          `json:"started"`
+	Uptime            string             `json:"uptime"`
+	ArtifactHash      string             `json:"artifactHash,omitempty"`
+	StorageMode       string             `json:"storageMode"`
+	WatchMode         string             `json:"watchMode"`
+	DeployWindows     string             `json:"deployWindows,omitempty"`
+	PendingDeployment *pendingDeployment `json:"pendingDeployment,omitempty"`
+	Draining          bool               `json:"draining"`
+	Connections       int64              `json:"connections"`
+	ConnectionTags    map[string]int64   `json:"connectionTags,omitempty"`
+	Requests          int64              `json:"requests"`
+	RequestsTotal     uint64             `json:"requestsTotal"`
+	Maintenance       bool               `json:"maintenance"`
+	Brownout          bool               `json:"brownout"`
+	Settings          map[string]string  `json:"settings,omitempty"`
+	Features          map[string]bool    `json:"features,omitempty"`
+	Workers           *poolStatus        `json:"workers,omitempty"`
+}
+
+func currentStatus() serverStatus {
+	status.Lock()
+	s := serverStatus{
+		Instance:          instanceID,
+		Metadata:          metadata,
+		Version:           version,
+		Started:           started,
+		Uptime:            time.Since(started).String(),
+		ArtifactHash:      runningHash,
+		StorageMode:       status.storage,
+		WatchMode:         status.watchMode,
+		DeployWindows:     config.DeployWindows.String(),
+		PendingDeployment: status.pending,
+		Draining:          isDraining(),
+		Connections:       atomic.LoadInt64(&activeConns),
+		ConnectionTags:    connTagCounts(),
+		Requests:          atomic.LoadInt64(&activeRequests),
+		RequestsTotal:     requestsTotal.value(),
+		Maintenance:       dynamic.maintenance(),
+		Brownout:          brownout.isActive(),
+	}
+	status.Unlock()
+	s.Settings, s.Features = dynamic.snapshot()
+	if pool != nil {
+		ps := poolStatus{Size: cap(pool.workers)}
+		ps.Active, ps.Queued = pool.inFlight()
+		s.Workers = &ps
+	}
+	return s
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	httpjson.Write(w, http.StatusOK, currentStatus())
+}
@@ -0,0 +1,113 @@
+package goazure
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	storageLocal      = "local"
+	storageShared     = "shared"
+	storageLocalCache = "local-cache"
+
+	watchNotify = "notify"
+	watchPoll   = "poll"
+)
+
+// storageMode reports where dir lives on App Service. Content under HOME is
+// an SMB share unless local cache is enabled, in which case HOME is a local
+// copy taken at startup.
+func storageMode(dir string) string {
+	if os.Getenv("WEBSITE_SITE_NAME") == "" {
+		return storageLocal
+	}
+	if strings.EqualFold(os.Getenv("WEBSITE_LOCAL_CACHE_OPTION"), "Always") {
+		return storageLocalCache
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return storageShared
+	}
+	for _, root := range []string{os.Getenv("HOME"), os.Getenv("WEBROOT_PATH")} {
+		if root != "" && strings.HasPrefix(strings.ToLower(abs), strings.ToLower(filepath.Clean(root))) {
+			return storageShared
+		}
+	}
+	return storageLocal
+}
+
+// watchModeFor resolves -watchMode auto: file system notifications are not
+// reliably delivered for SMB shares, so those are polled instead.
+func watchModeFor(mode, storage string) string {
+	if mode != "auto" {
+		return mode
+	}
+	if storage == storageShared {
+		return watchPoll
+	}
+	return watchNotify
+}
+
+// pollSource reports files appearing in a directory by listing it
+// periodically.
+type pollSource struct {
+	dir      string
+	interval time.Duration
+	seen     map[string]bool
+}
+
+func newPollSource(dir string, interval time.Duration) (*pollSource, error) {
+	p := &pollSource{dir: dir, interval: interval}
+	seen, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	p.seen = seen
+	return p, nil
+}
+
+func (p *pollSource) list() (map[string]bool, error) {
+	fis, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(fis))
+	for _, fi := range fis {
+		names[fi.Name()] = true
+	}
+	return names, nil
+}
+
+func (p *pollSource) watch(deploy chan<- deployment, stop <-chan struct{}) error {
+	for {
+		select {
+		case <-time.After(p.interval):
+		case <-stop:
+			return nil
+		}
+
+		names, err := p.list()
+		if err != nil {
+			log.Printf("Could not poll %s: %v", p.dir, err)
+			continue
+		}
+		for name := range names {
+			if p.seen[name] || hiddenFile(name) {
+				continue
+			}
+			path := filepath.Join(p.dir, name)
+			log.Printf("New binary found: %s", path)
+			select {
+			case deploy <- deployment{artifact: path, trigger: "poll"}:
+			case <-stop:
+				return nil
+			}
+		}
+		p.seen = names
+	}
+}
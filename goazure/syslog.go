@@ -0,0 +1,134 @@
+package goazure
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	syslogFacility = 16 // local0
+	syslogSeverity = 6  // informational
+	syslogBuffer   = 4096
+)
+
+type syslogItem struct {
+	msg     []byte
+	flushed chan struct{}
+}
+
+// syslogWriter sends each log line as an RFC 5424 message over UDP, or TCP
+// or TLS with octet-counting framing (RFC 6587). Messages are sent from a
+// dedicated goroutine, dropping them when its buffer is full so that a slow
+// collector never blocks logging, and the connection is re-established
+// after failures.
+type syslogWriter struct {
+	network string
+	addr    string
+	header  string
+	ch      chan syslogItem
+	conn    net.Conn
+}
+
+func newSyslogWriter(network, addr, msgID string) (*syslogWriter, error) {
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown syslog transport %q", network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "-"
+	}
+	app := os.Getenv("WEBSITE_SITE_NAME")
+	if app == "" {
+		app = "go-azure-website"
+	}
+	w := &syslogWriter{
+		network: network,
+		addr:    addr,
+		header:  fmt.Sprintf("%s %s %d %s -", host, app, os.Getpid(), msgID),
+		ch:      make(chan syslogItem, syslogBuffer),
+	}
+	go w.run()
+	sinkFlushes = append(sinkFlushes, w.flush)
+	return w, nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := fmt.Sprintf("<%d>1 %s %s %s", syslogFacility*8+syslogSeverity,
+		time.Now().UTC().Format(time.RFC3339Nano), w.header, logMessage(p))
+	select {
+	case w.ch <- syslogItem{msg: []byte(msg)}:
+	default:
+		logsDropped.inc()
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) run() {
+	for item := range w.ch {
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+		// One retry on a fresh connection covers a collector restart.
+		for attempt := 0; attempt < 2; attempt++ {
+			if err := w.send(item.msg); err != nil {
+				if attempt == 1 {
+					sinkLog.Printf("Could not send to syslog at %s: %v", w.addr, err)
+					logsDropped.inc()
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (w *syslogWriter) send(msg []byte) error {
+	if w.conn == nil {
+		var err error
+		d := &net.Dialer{Timeout: 5 * time.Second}
+		if w.network == "tls" {
+			w.conn, err = tls.DialWithDialer(d, "tcp", w.addr, nil)
+		} else {
+			w.conn, err = d.Dial(w.network, w.addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	var err error
+	if w.network == "udp" {
+		_, err = w.conn.Write(msg)
+	} else {
+		_, err = fmt.Fprintf(w.conn, "%d %s", len(msg), msg)
+	}
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// flush waits until the messages written so far have been sent.
+func (w *syslogWriter) flush(timeout time.Duration) {
+	done := make(chan struct{})
+	select {
+	case w.ch <- syslogItem{flushed: done}:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
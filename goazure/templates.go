@@ -0,0 +1,248 @@
+package goazure
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+var templateRenders = newCounter("goazure_template_renders_total", "Pages rendered from -templates")
+
+// pageData is what pages are rendered with: the fields of the default
+// response, plus the request ID and query.
+type pageData struct {
+	responseData
+	Page      string
+	RequestID string
+	Query     url.Values
+}
+
+// templateSet renders pages from a directory of html/template files. Each
+// *.html file outside of layouts/ and partials/ is a page served for its
+// path without the extension, index.html for its directory. Layouts and
+// partials are parsed along with every page under their file name, so that a
+// page uses a layout with {{template "base.html" .}} and overrides the
+// layout's {{block}}s with {{define}}, and includes a partial with
+// {{template "nav.html" .}}.
+type templateSet struct {
+	dir     string
+	current atomic.Value // map[string]*template.Template by page
+}
+
+// templates is set up by defineHandlers and watched by Run.
+var templates *templateSet
+
+func loadTemplates(dir string) (*templateSet, error) {
+	ts := &templateSet{dir: dir}
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// reload parses the directory again, keeping the previous pages on error.
+func (ts *templateSet) reload() error {
+	base := template.New("")
+	var pages []string
+	err := filepath.Walk(ts.dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || filepath.Ext(name) != ".html" || hiddenFile(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(ts.dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !strings.HasPrefix(rel, "layouts/") && !strings.HasPrefix(rel, "partials/") {
+			pages = append(pages, rel)
+			return nil
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := base.New(filepath.Base(name)).Parse(string(b)); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]*template.Template, len(pages))
+	for _, rel := range pages {
+		b, err := ioutil.ReadFile(filepath.Join(ts.dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		t, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if t, err = t.New(rel).Parse(string(b)); err != nil {
+			return err
+		}
+		set[strings.TrimSuffix(rel, ".html")] = t
+	}
+	ts.current.Store(set)
+	return nil
+}
+
+// lookup returns the page for a request path.
+func (ts *templateSet) lookup(p string) (string, *template.Template) {
+	set := ts.current.Load().(map[string]*template.Template)
+	p = strings.TrimPrefix(path.Clean(p), "/")
+	candidates := []string{path.Join(p, "index")}
+	if p != "" && !strings.HasSuffix(p, "/index") {
+		candidates = []string{p, path.Join(p, "index")}
+	}
+	for _, name := range candidates {
+		if strings.HasPrefix(name, "layouts/") || strings.HasPrefix(name, "partials/") {
+			continue
+		}
+		if t, ok := set[name]; ok {
+			return name, t
+		}
+	}
+	return "", nil
+}
+
+// watch reloads the templates when a file in the directory changes, with the
+// same notify or poll mode the deployment watcher picks for its storage, so
+// that pages are edited without restarting.
+func (ts *templateSet) watch(stop <-chan struct{}) {
+	if ts == nil {
+		return
+	}
+	reload := func() {
+		if err := ts.reload(); err != nil {
+			log.Printf("Keeping previous templates: %v", err)
+			return
+		}
+		log.Printf("Reloaded templates from %s", ts.dir)
+	}
+
+	if watchModeFor(config.WatchMode, storageMode(ts.dir)) == watchPoll {
+		goBackground(func() {
+			last := ts.modTime()
+			for {
+				select {
+				case <-time.After(time.Duration(config.PollInterval) * time.Second):
+				case <-stop:
+					return
+				}
+				if t := ts.modTime(); !t.Equal(last) {
+					last = t
+					reload()
+				}
+			}
+		})
+		return
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = ts.addDirs(w)
+	}
+	if err != nil {
+		log.Printf("Not reloading templates, could not watch %s: %v", ts.dir, err)
+		if w != nil {
+			w.Close()
+		}
+		return
+	}
+	goBackground(func() {
+		defer w.Close()
+		// Editors and deployments write several files in a row.
+		var settle <-chan time.Time
+		for {
+			select {
+			case evt := <-w.Events:
+				if evt.Op&fsnotify.Create != 0 {
+					if fi, err := os.Stat(evt.Name); err == nil && fi.IsDir() {
+						w.Add(evt.Name)
+					}
+				}
+				settle = time.After(200 * time.Millisecond)
+			case <-settle:
+				settle = nil
+				reload()
+			case err := <-w.Errors:
+				log.Printf("Template watcher error: %v", err)
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+func (ts *templateSet) addDirs(w *fsnotify.Watcher) error {
+	return filepath.Walk(ts.dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		return w.Add(name)
+	})
+}
+
+// modTime returns the latest modification time in the directory.
+func (ts *templateSet) modTime() time.Time {
+	var latest time.Time
+	filepath.Walk(ts.dir, func(name string, fi os.FileInfo, err error) error {
+		if err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+// withTemplates renders the page matching GET and HEAD requests, passing
+// other requests on to h.
+func withTemplates(h http.Handler, ts *templateSet) http.Handler {
+	if ts == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name, t := ts.lookup(r.URL.Path)
+		if t == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var body bytes.Buffer
+		data := pageData{responseData: newResponseData(r), Page: name, RequestID: requestID(r), Query: r.URL.Query()}
+		if err := t.ExecuteTemplate(&body, name+".html", data); err != nil {
+			log.Printf("Could not render page %s: %v", name, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		templateRenders.inc()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", fmt.Sprint(body.Len()))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(body.Bytes())
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package goazure
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ticketKeys rotates the keys protecting TLS session tickets. Time is cut
+// into periods of the rotation interval, each with its own key: tickets are
+// issued with the key of the current period and accepted for the previous
+// one too, so a ticket lives for one to two periods.
+//
+// With a directory on shared storage, the instances behind a load balancer
+// use the same keys, and a client resumes its session whichever instance it
+// reaches. The first instance needing a period's key creates it; the key of
+// the next period is created ahead of time and accepted as well, so that
+// instances with slightly skewed clocks agree.
+type ticketKeys struct {
+	dir      string
+	interval time.Duration
+	keys     map[int64][32]byte
+}
+
+func newTicketKeys(dir string, interval time.Duration) (*ticketKeys, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &ticketKeys{dir: dir, interval: interval, keys: make(map[int64][32]byte)}, nil
+}
+
+func (t *ticketKeys) period(at time.Time) int64 {
+	return at.UnixNano() / int64(t.interval)
+}
+
+// key returns the key of a period, creating it if needed.
+func (t *ticketKeys) key(period int64) ([32]byte, error) {
+	if k, ok := t.keys[period]; ok {
+		return k, nil
+	}
+	var k [32]byte
+	if t.dir == "" {
+		_, err := rand.Read(k[:])
+		return k, err
+	}
+
+	path := filepath.Join(t.dir, fmt.Sprintf("ticket-%d.key", period))
+	b, err := ioutil.ReadFile(path)
+	if err == nil && len(b) == len(k) {
+		copy(k[:], b)
+		return k, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return k, err
+	}
+	// The key is absent, or cut short by an instance that crashed writing
+	// it. It is renamed into place once written, so that no instance reads
+	// it partially.
+	if _, err := rand.Read(k[:]); err != nil {
+		return k, err
+	}
+	f, err := ioutil.TempFile(t.dir, ".ticket-*.tmp")
+	if err != nil {
+		return k, err
+	}
+	_, err = f.Write(k[:])
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return k, err
+	}
+	// Of instances creating the key at the same time the last rename wins,
+	// so use whichever key ended up in place.
+	if b, err := ioutil.ReadFile(path); err == nil && len(b) == len(k) {
+		copy(k[:], b)
+	}
+	return k, nil
+}
+
+// rotate installs the keys of the current, previous and next periods in
+// cfg, and removes keys older than these from the directory.
+func (t *ticketKeys) rotate(cfg *tls.Config) error {
+	now := t.period(clk.Now())
+	keys := make(map[int64][32]byte)
+	var list [][32]byte
+	for _, p := range []int64{now, now - 1, now + 1} {
+		k, err := t.key(p)
+		if err != nil {
+			return err
+		}
+		keys[p] = k
+		list = append(list, k)
+	}
+	t.keys = keys
+	cfg.SetSessionTicketKeys(list)
+
+	if t.dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".ticket-") && clk.Now().Sub(f.ModTime()) > t.interval {
+			// Left behind by an instance that crashed creating a key.
+			os.Remove(filepath.Join(t.dir, name))
+			continue
+		}
+		if !strings.HasPrefix(name, "ticket-") || !strings.HasSuffix(name, ".key") {
+			continue
+		}
+		p, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "ticket-"), ".key"), 10, 64)
+		if err == nil && p < now-1 {
+			os.Remove(filepath.Join(t.dir, name))
+		}
+	}
+	return nil
+}
+
+// start installs the current keys in cfg and rotates them at the start of
+// every period until stop is closed. A failed rotation is retried a minute
+// later, the previous keys staying in use meanwhile.
+func (t *ticketKeys) start(cfg *tls.Config, stop <-chan struct{}) error {
+	if err := t.rotate(cfg); err != nil {
+		return err
+	}
+	goBackground(func() {
+		for {
+			next := time.Unix(0, (t.period(clk.Now())+1)*int64(t.interval))
+			select {
+			case <-clk.After(next.Sub(clk.Now())):
+			case <-stop:
+				return
+			}
+			for {
+				err := t.rotate(cfg)
+				if err == nil {
+					break
+				}
+				log.Printf("Could not rotate TLS session ticket keys, retrying in a minute: %v", err)
+				select {
+				case <-clk.After(time.Minute):
+				case <-stop:
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
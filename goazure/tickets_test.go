@@ -0,0 +1,51 @@
+package goazure
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTicketKeysShared(t *testing.T) {
+	dir := t.TempDir()
+	a, err := newTicketKeys(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newTicketKeys(dir, time.Hour)
+
+	ka, err := a.key(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := b.key(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ka != kb {
+		t.Fatal("instances sharing a directory use different keys")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, ".ticket-*"))
+	if len(files) != 0 {
+		t.Fatalf("temporary files left behind: %v", files)
+	}
+}
+
+func TestTicketKeysShortFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ticket-7.key")
+	if err := ioutil.WriteFile(path, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tk, _ := newTicketKeys(dir, time.Hour)
+	k, err := tk.key(7)
+	if err != nil {
+		t.Fatalf("a short key file was not replaced: %v", err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(b, k[:]) {
+		t.Fatalf("key file holds %d bytes, not the key in use", len(b))
+	}
+}
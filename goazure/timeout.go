@@ -0,0 +1,97 @@
+package goazure
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type routeTimeout struct {
+	method  string // any method if empty
+	path    string // prefix if it ends in a slash, exact match otherwise
+	timeout time.Duration
+}
+
+func (rt routeTimeout) matches(r *http.Request) bool {
+	if rt.method != "" && rt.method != r.Method {
+		return false
+	}
+	if strings.HasSuffix(rt.path, "/") {
+		return strings.HasPrefix(r.URL.Path, rt.path)
+	}
+	return r.URL.Path == rt.path
+}
+
+// routeTimeouts holds the per-route timeouts configured with -routeTimeout,
+// given as comma separated "[METHOD ]PATH=SECONDS" entries.
+type routeTimeouts []routeTimeout
+
+func (rts *routeTimeouts) String() string {
+	s := make([]string, len(*rts))
+	for i, rt := range *rts {
+		s[i] = strings.TrimSpace(rt.method+" "+rt.path) + "=" + strconv.Itoa(int(rt.timeout/time.Second))
+	}
+	return strings.Join(s, ",")
+}
+
+func (rts *routeTimeouts) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		eq := strings.LastIndex(spec, "=")
+		if eq < 0 {
+			return fmt.Errorf("invalid route timeout %q, expected [METHOD ]PATH=SECONDS", spec)
+		}
+		secs, err := strconv.Atoi(spec[eq+1:])
+		if err != nil || secs <= 0 {
+			return fmt.Errorf("invalid timeout in %q", spec)
+		}
+
+		rt := routeTimeout{path: strings.TrimSpace(spec[:eq]), timeout: time.Duration(secs) * time.Second}
+		if i := strings.Index(rt.path, " "); i >= 0 {
+			rt.method = strings.ToUpper(rt.path[:i])
+			rt.path = strings.TrimSpace(rt.path[i+1:])
+		}
+		if !strings.HasPrefix(rt.path, "/") {
+			return fmt.Errorf("invalid path in %q", spec)
+		}
+		*rts = append(*rts, rt)
+	}
+	return nil
+}
+
+// withTimeouts bounds the handling time of routes with a configured timeout.
+// The most specific matching route wins.
+func withTimeouts(h http.Handler, rts routeTimeouts) http.Handler {
+	if len(rts) == 0 {
+		return h
+	}
+
+	handlers := make([]http.Handler, len(rts))
+	for i, rt := range rts {
+		handlers[i] = http.TimeoutHandler(h, rt.timeout, "request timed out")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		best := -1
+		for i, rt := range rts {
+			if !rt.matches(r) {
+				continue
+			}
+			if best < 0 || len(rt.path) > len(rts[best].path) ||
+				len(rt.path) == len(rts[best].path) && rt.method != "" {
+				best = i
+			}
+		}
+		if best < 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		handlers[best].ServeHTTP(w, r)
+	})
+}
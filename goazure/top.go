@@ -0,0 +1,149 @@
+package goazure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// runTop implements the "top" subcommand, a live view of the local server
+// refreshed until interrupted. It keeps polling through restarts, so a
+// deployment can be followed from drain to the next process coming up.
+func runTop(args []string) {
+	fs := commandFlags("top")
+	interval := fs.Int("interval", 2, "Seconds between refreshes")
+	events := fs.Int("events", 5, "Number of recent deployment events to show")
+	fs.Parse(args)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	// Hide the cursor while drawing and restore it on the way out.
+	fmt.Print("\x1b[?25l")
+	defer fmt.Print("\x1b[?25h")
+
+	var v topView
+	for {
+		locateAdmin(fs)
+		v.refresh(*events)
+
+		var buf bytes.Buffer
+		buf.WriteString("\x1b[H\x1b[2J")
+		v.render(&buf)
+		os.Stdout.Write(buf.Bytes())
+
+		select {
+		case <-time.After(time.Duration(*interval) * time.Second):
+		case <-sig:
+			fmt.Println()
+			return
+		}
+	}
+}
+
+// topView holds what top shows, along with the previous sample needed to
+// derive the request rate.
+type topView struct {
+	at     time.Time
+	status serverStatus
+	events []deployEvent
+	rate   float64
+	err    error
+}
+
+func (v *topView) refresh(n int) {
+	prev, prevAt := v.status, v.at
+	v.at = time.Now()
+
+	b, err := adminRequest(http.MethodGet, "/admin/status")
+	if err == nil {
+		var s serverStatus
+		if err = json.Unmarshal(b, &s); err == nil {
+			v.status = s
+		}
+	}
+	v.err = err
+	if err != nil {
+		return
+	}
+
+	// Leave out our own two requests per refresh.
+	const own = 2
+	v.rate = 0
+	if !prevAt.IsZero() && prev.Instance == v.status.Instance && prev.Started.Equal(v.status.Started) &&
+		v.status.RequestsTotal >= prev.RequestsTotal+own {
+		v.rate = float64(v.status.RequestsTotal-prev.RequestsTotal-own) / v.at.Sub(prevAt).Seconds()
+	}
+
+	if b, err := adminRequest(http.MethodGet, "/admin/deployments"); err == nil {
+		var events []deployEvent
+		if json.Unmarshal(b, &events) == nil {
+			if len(events) > n {
+				events = events[len(events)-n:]
+			}
+			v.events = events
+		}
+	}
+}
+
+func (v *topView) render(w io.Writer) {
+	s := v.status
+	fmt.Fprintf(w, "go-azure-website top - %s  (Ctrl-C to quit)\n\n", v.at.Format("15:04:05"))
+	if v.err != nil {
+		fmt.Fprintf(w, "Server not reachable on port %d: %v\n", config.Port, v.err)
+		if s.Instance == "" {
+			return
+		}
+		fmt.Fprintln(w, "Last known state:")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Instance\t%s\tVersion\t%s\n", s.Instance, s.Version)
+	fmt.Fprintf(tw, "Uptime\t%s\tArtifact\t%.12s\n", roundDuration(s.Uptime), s.ArtifactHash)
+	fmt.Fprintf(tw, "Requests/s\t%.1f\tIn flight\t%d\n", v.rate, s.Requests)
+	fmt.Fprintf(tw, "Connections\t%d\tState\t%s\n", s.Connections, topState(s))
+	if s.Workers != nil {
+		fmt.Fprintf(tw, "Workers\t%d/%d busy\tQueued\t%d\n", s.Workers.Active, s.Workers.Size, s.Workers.Queued)
+	}
+	if p := s.PendingDeployment; p != nil {
+		fmt.Fprintf(tw, "Pending\t%s\t\t\n", p.Artifact)
+	}
+	tw.Flush()
+
+	if len(v.events) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nRecent deployment events:")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i := len(v.events) - 1; i >= 0; i-- {
+		e := v.events[i]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.12s\t%s\n", e.Time.Local().Format("Jan 02 15:04:05"), e.Kind, e.Outcome, e.Hash, e.Duration)
+	}
+	tw.Flush()
+}
+
+func topState(s serverStatus) string {
+	switch {
+	case s.Draining:
+		return "draining"
+	case s.Maintenance:
+		return "maintenance"
+	}
+	return "serving"
+}
+
+// roundDuration shortens a Go duration string to whole seconds.
+func roundDuration(d string) string {
+	pd, err := time.ParseDuration(d)
+	if err != nil {
+		return d
+	}
+	return pd.Round(time.Second).String()
+}
@@ -0,0 +1,36 @@
+package goazure
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// autoTune sizes GOMAXPROCS and the soft memory limit to the container's
+// limits, so the runtime neither gets CPU throttled nor grows past what the
+// plan allows. Explicit flags win over detection, and GOMAXPROCS/GOMEMLIMIT
+// in the environment win over both.
+func autoTune() {
+	cpus, mem := containerLimits()
+
+	if os.Getenv("GOMAXPROCS") == "" {
+		procs := config.MaxProcs
+		if procs == 0 && cpus > 0 {
+			procs = int(math.Ceil(cpus))
+		}
+		if procs > 0 && procs != runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(procs)
+		}
+	}
+
+	if os.Getenv("GOMEMLIMIT") == "" {
+		limit := int64(config.MemLimit) << 20
+		if limit == 0 && mem > 0 {
+			limit = mem * int64(config.MemLimitPercent) / 100
+		}
+		if limit > 0 {
+			debug.SetMemoryLimit(limit)
+		}
+	}
+}
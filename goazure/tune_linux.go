@@ -0,0 +1,49 @@
+package goazure
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// containerLimits reads the CPU and memory limits of the process's cgroup,
+// trying cgroup v2 before v1. Zero means unlimited or unknown.
+func containerLimits() (cpus float64, mem int64) {
+	if f := readCgroup("/sys/fs/cgroup/cpu.max"); len(f) == 2 && f[0] != "max" {
+		quota, _ := strconv.ParseFloat(f[0], 64)
+		period, _ := strconv.ParseFloat(f[1], 64)
+		if period > 0 {
+			cpus = quota / period
+		}
+	} else {
+		q := readCgroup("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+		p := readCgroup("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+		if len(q) == 1 && len(p) == 1 {
+			quota, _ := strconv.ParseFloat(q[0], 64)
+			period, _ := strconv.ParseFloat(p[0], 64)
+			if quota > 0 && period > 0 {
+				cpus = quota / period
+			}
+		}
+	}
+
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		if f := readCgroup(path); len(f) == 1 && f[0] != "max" {
+			n, _ := strconv.ParseInt(f[0], 10, 64)
+			// cgroup v1 reports a huge number when unlimited.
+			if n > 0 && n < 1<<62 {
+				mem = n
+			}
+			break
+		}
+	}
+	return
+}
+
+func readCgroup(path string) []string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(b))
+}
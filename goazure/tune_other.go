@@ -0,0 +1,17 @@
+//go:build !linux
+
+package goazure
+
+import (
+	"os"
+	"strconv"
+)
+
+// containerLimits falls back to the memory limit App Service advertises
+// through WEBSITE_MEMORY_LIMIT_MB, as there are no cgroups to read.
+func containerLimits() (cpus float64, mem int64) {
+	if mb, err := strconv.ParseInt(os.Getenv("WEBSITE_MEMORY_LIMIT_MB"), 10, 64); err == nil && mb > 0 {
+		mem = mb << 20
+	}
+	return
+}
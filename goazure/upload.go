@@ -0,0 +1,185 @@
+package goazure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const uploadTimeout = 10 * time.Minute
+
+// uploadHandler accepts artifacts straight into config.UploadDir.
+//
+//	POST  /upload/          multipart/form-data, every file part is stored
+//	HEAD  /upload/<name>    reports the size of a partial upload in Upload-Offset
+//	PATCH /upload/<name>    appends the body at Upload-Offset; with
+//	                        Upload-Complete: true the upload is finalized,
+//	                        verified against X-Content-SHA256 if given
+//
+// Partial uploads are kept as hidden files next to their destination, which
+// deployment sources ignore, and renamed into place once complete.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/upload/")
+	maxSize := int64(config.UploadMaxSize) << 20
+
+	// Uploads outlast the server wide timeouts meant for regular requests.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(uploadTimeout))
+	rc.SetWriteDeadline(time.Now().Add(uploadTimeout))
+
+	switch r.Method {
+	case "POST":
+		if name != "" {
+			http.Error(w, "POST to /upload/ without a name", http.StatusBadRequest)
+			return
+		}
+		uploadMultipart(w, r, maxSize)
+		return
+	case "HEAD", "PATCH":
+	default:
+		w.Header().Set("Allow", "POST, HEAD, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !validUploadName(name) {
+		http.Error(w, "invalid upload name", http.StatusBadRequest)
+		return
+	}
+	partial := partialPath(name)
+
+	fi, err := os.Stat(partial)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var offset int64
+	if err == nil {
+		offset = fi.Size()
+	}
+
+	if r.Method == "HEAD" {
+		if fi == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	want, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || want != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Upload-Offset does not match received size", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Could not open partial upload %s: %v", partial, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, maxSize-offset))
+	f.Close()
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		log.Printf("Upload of %s interrupted at %d bytes: %v", name, offset, err)
+		http.Error(w, "upload interrupted, resume from Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Upload-Complete") != "true" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if sum := r.Header.Get("X-Content-SHA256"); sum != "" {
+		h, err := fileHash(partial)
+		if err != nil || !strings.EqualFold(h, sum) {
+			os.Remove(partial)
+			http.Error(w, "checksum mismatch, upload discarded", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if err := os.Rename(partial, filepath.Join(config.UploadDir, name)); err != nil {
+		log.Printf("Could not finalize upload %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Received upload %s (%d bytes)", name, offset)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func uploadMultipart(w http.ResponseWriter, r *http.Request, maxSize int64) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "malformed multipart body", uploadReadStatus(err))
+			return
+		}
+
+		name := part.FileName()
+		if name == "" {
+			continue
+		}
+		if !validUploadName(name) {
+			http.Error(w, "invalid upload name", http.StatusBadRequest)
+			return
+		}
+
+		partial := partialPath(name)
+		f, err := os.Create(partial)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), part)
+		f.Close()
+		if err != nil {
+			os.Remove(partial)
+			http.Error(w, "upload interrupted", uploadReadStatus(err))
+			return
+		}
+		if err := os.Rename(partial, filepath.Join(config.UploadDir, name)); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Received upload %s (%d bytes, sha256 %s)", name, n, hex.EncodeToString(h.Sum(nil)))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func validUploadName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\:`) && filepath.Base(name) == name
+}
+
+func partialPath(name string) string {
+	return filepath.Join(config.UploadDir, "."+name+".partial")
+}
+
+// hiddenFile reports whether name is a dot file, such as a partial upload,
+// that deployment sources should not treat as an artifact.
+func hiddenFile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
@@ -0,0 +1,81 @@
+package goazure
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func multipartUpload(t *testing.T, name string, size int) *http.Request {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte("x"), size))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload/", &b)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadMultipart(t *testing.T) {
+	config.UploadDir = t.TempDir()
+	config.UploadMaxSize = 1
+
+	w := httptest.NewRecorder()
+	uploadHandler(w, multipartUpload(t, "site.zip", 1000))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if fi, err := os.Stat(filepath.Join(config.UploadDir, "site.zip")); err != nil || fi.Size() != 1000 {
+		t.Fatalf("upload not stored: %v", err)
+	}
+}
+
+func TestUploadMultipartTooLarge(t *testing.T) {
+	config.UploadDir = t.TempDir()
+	config.UploadMaxSize = 1
+
+	w := httptest.NewRecorder()
+	uploadHandler(w, multipartUpload(t, "site.zip", 2<<20))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if _, err := os.Stat(filepath.Join(config.UploadDir, "site.zip")); !os.IsNotExist(err) {
+		t.Fatalf("oversized upload stored: %v", err)
+	}
+	if _, err := os.Stat(partialPath("site.zip")); !os.IsNotExist(err) {
+		t.Fatalf("partial upload left behind: %v", err)
+	}
+}
+
+func TestLoadUploadRoutesMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "uploads.json")
+	load := func(routes string) ([]*uploadRoute, error) {
+		t.Helper()
+		if err := ioutil.WriteFile(file, []byte(routes), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return loadUploadRoutes(file)
+	}
+
+	routes, err := load(`[{"path": "/a/", "dir": "` + dir + `"}, {"path": "/b/", "dir": "` + dir + `", "maxSizeMB": 5}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes[0].MaxSizeMB != uploadDefaultMaxMB || routes[1].MaxSizeMB != 5 {
+		t.Fatalf("got limits %d and %d MB, want %d and 5", routes[0].MaxSizeMB, routes[1].MaxSizeMB, uploadDefaultMaxMB)
+	}
+	if _, err := load(`[{"path": "/a/", "dir": "` + dir + `", "maxSizeMB": -1}]`); err == nil {
+		t.Fatal("loaded a negative limit")
+	}
+}
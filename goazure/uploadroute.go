@@ -0,0 +1,362 @@
+package goazure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+const (
+	uploadFieldMax      = 64 << 10 // total size of the non-file form fields
+	uploadDefaultMaxMB  = 32       // MaxSizeMB of routes that set none
+	uploadProgressEvery = 8 << 20
+)
+
+var (
+	uploadSubmissions = newCounter("goazure_upload_submissions_total", "Forms accepted by upload routes")
+	uploadBytes       = newCounter("goazure_upload_bytes_total", "Bytes of files stored by upload routes")
+)
+
+// uploadRoute accepts multipart/form-data POSTs on Path, as a prefix if it
+// ends in a slash, storing each file part in Dir or in the Blob Storage
+// Container, named after the submission ID and the file name, along with a
+// <id>.json holding the other form fields and the files stored. Submissions
+// over MaxSizeMB, uploadDefaultMaxMB if unset, or with a file whose sniffed
+// type does not match one of Types, such as "image/*", are rejected whole. Browsers posting a form are
+// sent to Redirect when set; other clients get the submission as JSON.
+type uploadRoute struct {
+	Path      string   `json:"path"`
+	MaxSizeMB int      `json:"maxSizeMB,omitempty"`
+	Types     []string `json:"types,omitempty"`
+	Dir       string   `json:"dir,omitempty"`
+	Container string   `json:"container,omitempty"`
+	Redirect  string   `json:"redirect,omitempty"`
+
+	blobs *blobContainer
+}
+
+type uploadSubmission struct {
+	ID     string              `json:"id"`
+	Route  string              `json:"route"`
+	Time   time.Time           `json:"time"`
+	Fields map[string][]string `json:"fields,omitempty"`
+	Files  []uploadedFile      `json:"files"`
+}
+
+type uploadedFile struct {
+	Field       string `json:"field"`
+	Name        string `json:"name"`
+	Stored      string `json:"stored"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+}
+
+func loadUploadRoutes(file string) ([]*uploadRoute, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*uploadRoute
+	if err := json.Unmarshal(b, &routes); err != nil {
+		return nil, err
+	}
+	for i, ur := range routes {
+		if !strings.HasPrefix(ur.Path, "/") {
+			return nil, fmt.Errorf("upload route %d: invalid path %q", i, ur.Path)
+		}
+		if ur.MaxSizeMB < 0 {
+			return nil, fmt.Errorf("upload route %s: invalid maxSizeMB %d", ur.Path, ur.MaxSizeMB)
+		}
+		if ur.MaxSizeMB == 0 {
+			ur.MaxSizeMB = uploadDefaultMaxMB
+		}
+		if (ur.Dir == "") == (ur.Container == "") {
+			return nil, fmt.Errorf("upload route %s: set either dir or container", ur.Path)
+		}
+		if ur.Container != "" {
+			if ur.blobs, err = newBlobContainer(ur.Container, config.IdentityClientID); err != nil {
+				return nil, fmt.Errorf("upload route %s: %v", ur.Path, err)
+			}
+		} else if fi, err := os.Stat(ur.Dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("upload route %s: %s is not a directory", ur.Path, ur.Dir)
+		}
+		for _, t := range ur.Types {
+			if !strings.Contains(t, "/") {
+				return nil, fmt.Errorf("upload route %s: invalid content type %q", ur.Path, t)
+			}
+		}
+	}
+	return routes, nil
+}
+
+func (ur *uploadRoute) allows(contentType string) bool {
+	if len(ur.Types) == 0 {
+		return true
+	}
+	for _, t := range ur.Types {
+		if t == contentType || strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadsInProgress holds the progress of the submissions being received,
+// reported on /admin/uploads.
+var uploadsInProgress sync.Map
+
+type uploadProgress struct {
+	ID       string    `json:"id"`
+	Route    string    `json:"route"`
+	Started  time.Time `json:"started"`
+	Received int64     `json:"received"`
+	Total    int64     `json:"total,omitempty"` // Content-Length, 0 if unknown
+}
+
+// progressReader counts bytes read into p, logging every
+// uploadProgressEvery bytes.
+type progressReader struct {
+	io.ReadCloser
+	p      *uploadProgress
+	logged int64
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(b)
+	received := atomic.AddInt64(&pr.p.Received, int64(n))
+	if received-pr.logged >= uploadProgressEvery {
+		pr.logged = received
+		if pr.p.Total > 0 {
+			log.Printf("Upload %s on %s: %d of %d bytes received", pr.p.ID, pr.p.Route, received, pr.p.Total)
+		} else {
+			log.Printf("Upload %s on %s: %d bytes received", pr.p.ID, pr.p.Route, received)
+		}
+	}
+	return n, err
+}
+
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	report := []uploadProgress{}
+	uploadsInProgress.Range(func(_, v interface{}) bool {
+		p := *v.(*uploadProgress)
+		p.Received = atomic.LoadInt64(&v.(*uploadProgress).Received)
+		report = append(report, p)
+		return true
+	})
+	httpjson.Write(w, http.StatusOK, report)
+}
+
+func newSubmissionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// sanitizeUploadName keeps the base name of a file name sent by a browser,
+// replacing characters that are not safe in file and blob names.
+func sanitizeUploadName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "file"
+	}
+	return name
+}
+
+// store writes one file, returning how it was stored.
+func (ur *uploadRoute) store(name, contentType string, body io.Reader) (int64, error) {
+	if ur.blobs != nil {
+		bw := ur.blobs.create(name, contentType)
+		n, err := io.Copy(bw, body)
+		if err != nil {
+			return n, err
+		}
+		return n, bw.Close()
+	}
+
+	partial := filepath.Join(ur.Dir, "."+name+".partial")
+	f, err := os.Create(partial)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(partial, filepath.Join(ur.Dir, name))
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return n, err
+}
+
+// remove deletes files stored for a rejected submission. Blobs are left to
+// lifecycle management, as deleting them needs more than write access.
+func (ur *uploadRoute) remove(files []uploadedFile) {
+	if ur.blobs != nil {
+		return
+	}
+	for _, f := range files {
+		os.Remove(filepath.Join(ur.Dir, f.Stored))
+	}
+}
+
+var errUploadType = errors.New("file type not allowed")
+
+func (ur *uploadRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpjson.Fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "multipart/form-data" {
+		httpjson.Fail(w, r, http.StatusUnsupportedMediaType, "expected multipart/form-data")
+		return
+	}
+
+	// Uploads outlast the server wide timeouts meant for regular requests.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(uploadTimeout))
+	rc.SetWriteDeadline(time.Now().Add(uploadTimeout))
+
+	sub := uploadSubmission{ID: newSubmissionID(), Route: ur.Path, Time: time.Now().UTC(), Fields: map[string][]string{}, Files: []uploadedFile{}}
+	progress := &uploadProgress{ID: sub.ID, Route: ur.Path, Started: sub.Time}
+	if r.ContentLength > 0 {
+		progress.Total = r.ContentLength
+	}
+	uploadsInProgress.Store(sub.ID, progress)
+	defer uploadsInProgress.Delete(sub.ID)
+	r.Body = http.MaxBytesReader(w, &progressReader{ReadCloser: r.Body, p: progress}, int64(ur.MaxSizeMB)<<20+uploadFieldMax)
+
+	status, err := ur.receive(r, &sub)
+	if err != nil {
+		ur.remove(sub.Files)
+		log.Printf("Rejected upload %s on %s: %v", sub.ID, ur.Path, err)
+		httpjson.Fail(w, r, status, err.Error())
+		return
+	}
+	var total int64
+	for _, f := range sub.Files {
+		total += f.Size
+	}
+	uploadSubmissions.inc()
+	uploadBytes.add(uint64(total))
+	log.Printf("Received upload %s on %s: %d files, %d bytes", sub.ID, ur.Path, len(sub.Files), total)
+
+	if ur.Redirect != "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, ur.Redirect, http.StatusSeeOther)
+		return
+	}
+	httpjson.Write(w, http.StatusCreated, sub)
+}
+
+// receive stores the parts of the form, returning the status to answer
+// with on error.
+func (ur *uploadRoute) receive(r *http.Request, sub *uploadSubmission) (int, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return http.StatusBadRequest, errors.New("expected multipart/form-data")
+	}
+	fieldBytes := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploadReadStatus(err), errors.New("malformed multipart body")
+		}
+
+		if part.FileName() == "" {
+			b, err := ioutil.ReadAll(io.LimitReader(part, int64(uploadFieldMax-fieldBytes+1)))
+			if err != nil {
+				return uploadReadStatus(err), errors.New("upload interrupted")
+			}
+			if fieldBytes += len(b); fieldBytes > uploadFieldMax {
+				return http.StatusRequestEntityTooLarge, errors.New("form fields too large")
+			}
+			sub.Fields[part.FormName()] = append(sub.Fields[part.FormName()], string(b))
+			continue
+		}
+
+		// Check the type sniffed from the content, not the one the client
+		// declares, falling back to the latter for types the sniffer does
+		// not tell apart.
+		head := make([]byte, 512)
+		n, err := io.ReadFull(part, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return uploadReadStatus(err), errors.New("upload interrupted")
+		}
+		head = head[:n]
+		ct := http.DetectContentType(head)
+		if declared := part.Header.Get("Content-Type"); declared != "" && (ct == "application/octet-stream" || strings.HasPrefix(ct, "text/plain")) {
+			ct = declared
+		}
+		if mt, _, err := mime.ParseMediaType(ct); err == nil {
+			ct = mt
+		}
+		if !ur.allows(ct) {
+			return http.StatusUnsupportedMediaType, fmt.Errorf("%s: %v: %s", part.FileName(), errUploadType, ct)
+		}
+
+		f := uploadedFile{Field: part.FormName(), Name: part.FileName(), ContentType: ct}
+		f.Stored = sub.ID + "-" + sanitizeUploadName(f.Name)
+		f.Size, err = ur.store(f.Stored, ct, io.MultiReader(bytes.NewReader(head), part))
+		if err != nil {
+			// Remove what was stored before the error too.
+			sub.Files = append(sub.Files, f)
+			if status := uploadReadStatus(err); status == http.StatusRequestEntityTooLarge {
+				return status, fmt.Errorf("upload larger than %d MB", ur.MaxSizeMB)
+			}
+			log.Printf("Could not store upload %s on %s: %v", f.Stored, ur.Path, err)
+			return http.StatusInternalServerError, errors.New("could not store upload")
+		}
+		sub.Files = append(sub.Files, f)
+	}
+	if len(sub.Files) == 0 {
+		return http.StatusBadRequest, errors.New("no files in the form")
+	}
+
+	meta, _ := json.MarshalIndent(sub, "", "  ")
+	if _, err := ur.store(sub.ID+".json", "application/json", strings.NewReader(string(meta))); err != nil {
+		log.Printf("Could not store upload %s on %s: %v", sub.ID, ur.Path, err)
+		return http.StatusInternalServerError, errors.New("could not store upload")
+	}
+	return 0, nil
+}
+
+// uploadReadStatus tells a body exceeding the route's limit from other
+// failures.
+func uploadReadStatus(err error) int {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
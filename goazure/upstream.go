@@ -0,0 +1,296 @@
+package goazure
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hruan/go-azure/httpjson"
+)
+
+var backendEjections = newCounter("goazure_backend_ejections_total", "Backends ejected from rotation by outlier detection")
+
+// upstreamPools lists the pools of the virtual hosts, whose health checks
+// Run starts.
+var upstreamPools []*upstreamPool
+
+// upstream is one backend of a pool.
+type upstream struct {
+	URL *url.URL
+	// id names the backend in affinity cookies.
+	id string
+
+	mu           sync.Mutex
+	healthy      bool // last active check passed, or no checks
+	failures     int  // consecutive failed requests
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+// upstreamPool balances requests round robin over backends, such as the
+// ports of the old and new binary during a canary. Backends are taken out of
+// rotation when an active health check fails, and ejected for a while by
+// passive outlier detection after consecutive failed requests, longer each
+// time it happens again. At most half of the pool is ejected, and when no
+// backend is left in rotation, requests go to all of them rather than none.
+type upstreamPool struct {
+	name        string
+	backends    []*upstream
+	healthCheck string
+	ejectAfter  int
+	next        uint32
+
+	// affinity is how requests of a session are tied to a backend:
+	// "cookie" sets a cookie naming the backend, while "header" and
+	// "hash-cookie" hash an existing header or cookie, such as the
+	// ARRAffinity cookie of App Service, over the backends in rotation.
+	affinity     string
+	affinityName string
+}
+
+const defaultAffinityCookie = "GoAzureAffinity"
+
+// setAffinity parses a vhost affinity setting: "cookie[:NAME]",
+// "header:NAME" or "hash-cookie:NAME".
+func (p *upstreamPool) setAffinity(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	kind, name := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, name = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "cookie":
+		if name == "" {
+			name = defaultAffinityCookie
+		}
+	case "header", "hash-cookie":
+		if name == "" {
+			return fmt.Errorf("affinity %s needs a name", kind)
+		}
+	default:
+		return fmt.Errorf("unknown affinity %q", spec)
+	}
+	p.affinity, p.affinityName = kind, name
+	return nil
+}
+
+const (
+	baseEjection = 30 * time.Second
+	maxEjection  = 5 * time.Minute
+)
+
+func newUpstreamPool(name string, urls []string, healthCheck string, ejectAfter int) (*upstreamPool, error) {
+	p := &upstreamPool{name: name, healthCheck: healthCheck, ejectAfter: ejectAfter}
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("invalid backend URL " + s)
+		}
+		sum := sha1.Sum([]byte(u.String()))
+		p.backends = append(p.backends, &upstream{URL: u, id: hex.EncodeToString(sum[:4]), healthy: true})
+	}
+	if len(p.backends) == 0 {
+		return nil, errors.New("pool needs backends")
+	}
+	if p.ejectAfter == 0 {
+		p.ejectAfter = 5
+	}
+	return p, nil
+}
+
+// pick chooses the backend for a request, reporting whether the client
+// should be told with an affinity cookie. A session sticks to its backend
+// while that one is in rotation; hashing moves only the sessions of a
+// backend leaving the rotation.
+func (p *upstreamPool) pick(r *http.Request) (*upstream, bool) {
+	now := time.Now()
+	var candidates []*upstream
+	for _, u := range p.backends {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.backends
+	}
+
+	var key string
+	switch p.affinity {
+	case "cookie":
+		if c, err := r.Cookie(p.affinityName); err == nil {
+			for _, u := range candidates {
+				if u.id == c.Value {
+					return u, false
+				}
+			}
+		}
+	case "header":
+		key = r.Header.Get(p.affinityName)
+	case "hash-cookie":
+		if c, err := r.Cookie(p.affinityName); err == nil {
+			key = c.Value
+		}
+	}
+	if key != "" {
+		// Rendezvous hashing: the backend scoring highest for the key.
+		var best *upstream
+		var bestScore uint64
+		for _, u := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(u.id + key))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = u, score
+			}
+		}
+		return best, false
+	}
+
+	n := atomic.AddUint32(&p.next, 1)
+	return candidates[int(n)%len(candidates)], p.affinity == "cookie"
+}
+
+// record notes the outcome of a request to u, ejecting it once it failed
+// too many times in a row.
+func (p *upstreamPool) record(u *upstream, ok bool) {
+	u.mu.Lock()
+	if ok {
+		u.failures = 0
+		u.mu.Unlock()
+		return
+	}
+	u.failures++
+	eject := u.failures >= p.ejectAfter
+	u.mu.Unlock()
+	if !eject {
+		return
+	}
+
+	now := time.Now()
+	ejected := 0
+	for _, b := range p.backends {
+		b.mu.Lock()
+		if now.Before(b.ejectedUntil) {
+			ejected++
+		}
+		b.mu.Unlock()
+	}
+	if (ejected+1)*2 > len(p.backends) {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if now.Before(u.ejectedUntil) {
+		return
+	}
+	u.ejections++
+	d := time.Duration(u.ejections) * baseEjection
+	if d > maxEjection {
+		d = maxEjection
+	}
+	u.ejectedUntil, u.failures = now.Add(d), 0
+	backendEjections.inc()
+	log.Printf("Ejecting backend %s of %s for %v after %d consecutive failures", u.URL.Host, p.name, d, p.ejectAfter)
+}
+
+// check runs the active health check of every backend once. A backend that
+// passes a check after having been ejected gets its ejection count reset.
+func (p *upstreamPool) check(client *http.Client) {
+	for _, u := range p.backends {
+		ok := false
+		resp, err := client.Get(u.URL.ResolveReference(&url.URL{Path: p.healthCheck}).String())
+		if err == nil {
+			resp.Body.Close()
+			ok = resp.StatusCode < 500
+		}
+		u.mu.Lock()
+		if ok != u.healthy {
+			state := "failing"
+			if ok {
+				state = "passing"
+			}
+			log.Printf("Backend %s of %s is %s health checks", u.URL.Host, p.name, state)
+		}
+		u.healthy = ok
+		if ok && !time.Now().Before(u.ejectedUntil) {
+			u.ejections = 0
+		}
+		u.mu.Unlock()
+	}
+}
+
+// startUpstreamChecks runs the active health checks of the pools that have
+// one every interval until stop is closed.
+func startUpstreamChecks(interval time.Duration, stop <-chan struct{}) {
+	var pools []*upstreamPool
+	for _, p := range upstreamPools {
+		if p.healthCheck != "" {
+			pools = append(pools, p)
+		}
+	}
+	if len(pools) == 0 {
+		return
+	}
+	client := &http.Client{Timeout: interval}
+	goBackground(func() {
+		for {
+			for _, p := range pools {
+				p.check(client)
+			}
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+type backendStatus struct {
+	URL          string     `json:"url"`
+	Healthy      bool       `json:"healthy"`
+	Failures     int        `json:"failures"`
+	Ejections    int        `json:"ejections"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// backendsHandler reports the state of the backends of every pool:
+//
+//	GET /admin/backends
+func backendsHandler(w http.ResponseWriter, r *http.Request) {
+	report := make(map[string][]backendStatus)
+	now := time.Now()
+	for _, p := range upstreamPools {
+		for _, u := range p.backends {
+			u.mu.Lock()
+			s := backendStatus{URL: u.URL.String(), Healthy: u.healthy, Failures: u.failures, Ejections: u.ejections}
+			if now.Before(u.ejectedUntil) {
+				t := u.ejectedUntil
+				s.EjectedUntil = &t
+			}
+			u.mu.Unlock()
+			report[p.name] = append(report[p.name], s)
+		}
+	}
+	httpjson.Write(w, http.StatusOK, report)
+}
@@ -0,0 +1,211 @@
+package goazure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// vhost scopes a static root or proxy target to a Host header pattern and
+// path prefix. Patterns are either exact host names or "*.domain", which
+// matches any subdomain of domain.
+type vhost struct {
+	Host   string `json:"host"`
+	Path   string `json:"path,omitempty"`
+	Static string `json:"static,omitempty"`
+	SPA    bool   `json:"spa,omitempty"`
+	Proxy  string `json:"proxy,omitempty"`
+	// Backends balances requests over several proxy targets, which are
+	// checked on HealthCheck if set and ejected after EjectAfter
+	// consecutive failures, 5 by default.
+	Backends    []string `json:"backends,omitempty"`
+	HealthCheck string   `json:"healthCheck,omitempty"`
+	EjectAfter  int      `json:"ejectAfter,omitempty"`
+	// Affinity keeps sessions on one backend: "cookie[:NAME]" sets a
+	// cookie naming it, "header:NAME" and "hash-cookie:NAME" hash the
+	// value of an existing header or cookie such as ARRAffinity.
+	Affinity string `json:"affinity,omitempty"`
+	// FastCGI serves the host through a FastCGI application at
+	// tcp://HOST:PORT or unix:///PATH, running scripts under Root, and CGI
+	// through a CGI program run in Root. MaxConns bounds the connections or
+	// processes used at a time.
+	FastCGI  string `json:"fastcgi,omitempty"`
+	CGI      string `json:"cgi,omitempty"`
+	Root     string `json:"root,omitempty"`
+	Index    string `json:"index,omitempty"`
+	MaxConns int    `json:"maxConns,omitempty"`
+	// GRPC exposes a gRPC backend at grpc://HOST:PORT, or grpcs:// with
+	// TLS, to gRPC-Web and JSON clients as well, browsers being allowed
+	// from GRPCOrigins, "*" for any.
+	GRPC        string   `json:"grpc,omitempty"`
+	GRPCOrigins []string `json:"grpcOrigins,omitempty"`
+
+	handler http.Handler
+}
+
+func (v *vhost) init() error {
+	v.Host = strings.ToLower(v.Host)
+	if v.Host == "" {
+		return errors.New("vhost needs a host")
+	}
+	if v.Path == "" {
+		v.Path = "/"
+	}
+	if !strings.HasPrefix(v.Path, "/") {
+		return fmt.Errorf("invalid path %q", v.Path)
+	}
+	if !strings.HasSuffix(v.Path, "/") {
+		v.Path += "/"
+	}
+
+	targets := 0
+	for _, set := range []bool{v.Static != "", v.Proxy != "", len(v.Backends) > 0, v.FastCGI != "", v.CGI != "", v.GRPC != ""} {
+		if set {
+			targets++
+		}
+	}
+	switch {
+	case v.Affinity != "" && len(v.Backends) == 0:
+		return errors.New("affinity requires backends")
+	case targets != 1:
+		return errors.New("vhost needs exactly one of static, proxy, backends, fastcgi, cgi or grpc")
+	case v.Static != "":
+		v.handler = newStaticHandler(v.Static, v.SPA)
+	case v.FastCGI != "":
+		if v.Root == "" {
+			return errors.New("fastcgi needs a root")
+		}
+		h, err := newFastCGIHandler(v.FastCGI, v.Root, v.Path, v.Index, v.MaxConns)
+		if err != nil {
+			return err
+		}
+		v.handler = h
+	case v.CGI != "":
+		h, err := newCGIHandler(v.CGI, v.Root, v.MaxConns)
+		if err != nil {
+			return err
+		}
+		v.handler = h
+	case v.GRPC != "":
+		h, err := newGRPCHandler(v.GRPC, v.GRPCOrigins)
+		if err != nil {
+			return err
+		}
+		v.handler = h
+	case len(v.Backends) > 0:
+		pool, err := newUpstreamPool(v.Host+v.Path, v.Backends, v.HealthCheck, v.EjectAfter)
+		if err != nil {
+			return err
+		}
+		if err := pool.setAffinity(v.Affinity); err != nil {
+			return err
+		}
+		upstreamPools = append(upstreamPools, pool)
+		rp := httputil.NewSingleHostReverseProxy(pool.backends[0].URL)
+		rp.BufferPool = proxyBuffers
+		rp.Transport = &poolTransport{b: backend, pool: pool}
+		rp.ErrorHandler = proxyErrorHandler
+		v.handler = withRequestBuffer(rp, int64(config.ProxyBufferBody)<<10)
+		v.handler = withWebSocket(v.handler, func(r *http.Request) *url.URL {
+			u, _ := pool.pick(r)
+			return u.URL
+		}, time.Duration(config.WSIdleTimeout)*time.Second)
+		if config.Coalesce {
+			v.handler = newCoalescer().wrap(v.handler)
+		}
+	default:
+		u, err := url.Parse(v.Proxy)
+		if err != nil {
+			return err
+		}
+		rp := httputil.NewSingleHostReverseProxy(u)
+		rp.BufferPool = proxyBuffers
+		if backend != nil {
+			rp.Transport = backend
+		}
+		rp.ErrorHandler = proxyErrorHandler
+		v.handler = withRequestBuffer(rp, int64(config.ProxyBufferBody)<<10)
+		v.handler = withWebSocket(v.handler, func(*http.Request) *url.URL {
+			return u
+		}, time.Duration(config.WSIdleTimeout)*time.Second)
+		if config.Coalesce {
+			v.handler = newCoalescer().wrap(v.handler)
+		}
+	}
+
+	if v.Path != "/" {
+		v.handler = http.StripPrefix(strings.TrimSuffix(v.Path, "/"), v.handler)
+	}
+	return nil
+}
+
+func (v *vhost) wildcard() bool {
+	return strings.HasPrefix(v.Host, "*.")
+}
+
+func (v *vhost) matches(host, p string) bool {
+	if v.wildcard() {
+		if !strings.HasSuffix(host, v.Host[1:]) {
+			return false
+		}
+	} else if host != v.Host {
+		return false
+	}
+	return strings.HasPrefix(p, v.Path) || p == v.Path[:len(v.Path)-1]
+}
+
+func loadVhosts(file string) ([]*vhost, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var vhosts []*vhost
+	if err := json.Unmarshal(b, &vhosts); err != nil {
+		return nil, err
+	}
+	for i, v := range vhosts {
+		if err := v.init(); err != nil {
+			return nil, fmt.Errorf("vhost %d: %v", i, err)
+		}
+	}
+
+	// Exact hosts before wildcards, then longest path first.
+	sort.SliceStable(vhosts, func(i, j int) bool {
+		if vhosts[i].wildcard() != vhosts[j].wildcard() {
+			return !vhosts[i].wildcard()
+		}
+		return len(vhosts[i].Path) > len(vhosts[j].Path)
+	})
+	return vhosts, nil
+}
+
+// withVhosts routes requests to the first matching virtual host, falling
+// back to h. Health and admin endpoints are never scoped by host.
+func withVhosts(h http.Handler, vhosts []*vhost) http.Handler {
+	if len(vhosts) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		host := strings.ToLower(requestHost(r))
+		for _, v := range vhosts {
+			if v.matches(host, r.URL.Path) {
+				v.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
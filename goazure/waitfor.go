@@ -0,0 +1,147 @@
+package goazure
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// waitTargets holds the dependencies given with -waitFor as comma separated
+// tcp://HOST:PORT, HOST:PORT or http(s) URLs.
+type waitTargets []dependency
+
+func (ts *waitTargets) String() string {
+	s := make([]string, len(*ts))
+	for i, t := range *ts {
+		s[i] = t.target
+	}
+	return strings.Join(s, ",")
+}
+
+func (ts *waitTargets) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		t := dependency{name: spec, target: spec}
+		if !strings.Contains(spec, "://") {
+			spec = "tcp://" + spec
+		}
+		u, err := url.Parse(spec)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid address %q, expected HOST:PORT or a URL", t.target)
+		}
+		switch u.Scheme {
+		case "tcp":
+			t.name, t.check = u.Host, tcpCheck(u.Host)
+		case "http", "https":
+			// The name shows on /readyz, so it leaves out credentials,
+			// paths and queries of the URL.
+			t.name, t.check = u.Scheme+"://"+u.Host, httpCheck(spec)
+		default:
+			return fmt.Errorf("invalid scheme in %q, expected tcp, http or https", t.target)
+		}
+		*ts = append(*ts, t)
+	}
+	return nil
+}
+
+var waiting struct {
+	sync.Mutex
+	pending []string
+	done    chan struct{}
+}
+
+// waitingFor returns the -waitFor targets not reachable yet.
+func waitingFor() []string {
+	waiting.Lock()
+	defer waiting.Unlock()
+	return append([]string(nil), waiting.pending...)
+}
+
+// dependenciesReached returns a channel closed once the -waitFor targets
+// were reached or given up on.
+func dependenciesReached() <-chan struct{} {
+	waiting.Lock()
+	defer waiting.Unlock()
+	if waiting.done == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return waiting.done
+}
+
+// startDependencyWait polls targets until each was reached once, for at most
+// timeout, logging progress every few seconds. The server is not ready
+// meanwhile, so that a cold start after a deployment does not take traffic
+// it would answer with errors while its database or the backend it proxies
+// to is still starting. Past timeout, the targets are given up on and only
+// the -dependency checks keep the server from being ready.
+func startDependencyWait(targets waitTargets, timeout time.Duration, stop <-chan struct{}) {
+	done := make(chan struct{})
+	waiting.Lock()
+	waiting.pending, waiting.done = nil, done
+	for _, t := range targets {
+		waiting.pending = append(waiting.pending, t.name)
+	}
+	waiting.Unlock()
+	if len(targets) == 0 {
+		close(done)
+		return
+	}
+
+	goBackground(func() {
+		defer close(done)
+		start := time.Now()
+		deadline := clk.After(timeout)
+		lastLog := start
+		pending := targets
+		for {
+			var failed waitTargets
+			var errs []string
+			for _, t := range pending {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				err := t.check(ctx)
+				cancel()
+				if err != nil {
+					failed = append(failed, t)
+					errs = append(errs, fmt.Sprintf("%s: %v", t.name, err))
+				} else {
+					log.Printf("Reached %s after %v", t.name, time.Since(start).Round(time.Millisecond))
+				}
+			}
+			pending = failed
+			waiting.Lock()
+			waiting.pending = nil
+			for _, t := range pending {
+				waiting.pending = append(waiting.pending, t.name)
+			}
+			waiting.Unlock()
+			if len(pending) == 0 {
+				return
+			}
+			if time.Since(lastLog) >= 5*time.Second {
+				lastLog = time.Now()
+				log.Printf("Waiting for %d dependencies for %v: %s", len(pending), time.Since(start).Round(time.Second), strings.Join(errs, "; "))
+			}
+
+			select {
+			case <-clk.After(500 * time.Millisecond):
+			case <-deadline:
+				log.Printf("Giving up waiting for %s after %v", strings.Join(waitingFor(), ", "), timeout)
+				waiting.Lock()
+				waiting.pending = nil
+				waiting.Unlock()
+				return
+			case <-stop:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package goazure
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmupRoutine prepares the server for traffic, such as by filling caches or
+// opening connections, returning promptly once stop is closed.
+type WarmupRoutine func(stop <-chan struct{}) error
+
+type warmupRoutine struct {
+	name string
+	run  WarmupRoutine
+}
+
+var warmups struct {
+	sync.Mutex
+	routines []warmupRoutine
+	// paths are requested by a routes routine, from -warmupPaths.
+	paths   []string
+	running bool
+	done    chan struct{} // closed when the current run completes
+	last    time.Time
+	stop    <-chan struct{}
+}
+
+// RegisterWarmup adds a routine run at startup and after a slot swap. The
+// server reports "warming" on /readyz until all routines completed.
+func RegisterWarmup(name string, run WarmupRoutine) {
+	warmups.Lock()
+	warmups.routines = append(warmups.routines, warmupRoutine{name, run})
+	warmups.Unlock()
+}
+
+// warmupHeader marks the requests of the routes routine, which are not to be
+// held like warm-up requests of the platform.
+const warmupHeader = "X-Goazure-Warmup"
+
+func init() {
+	newGaugeFunc("goazure_warming", "1 while warm-up routines run", func() float64 {
+		if isWarming() {
+			return 1
+		}
+		return 0
+	})
+}
+
+func isWarming() bool {
+	warmups.Lock()
+	defer warmups.Unlock()
+	return warmups.running
+}
+
+// startWarmup runs the registered routines concurrently once the server is
+// healthy, each for at most timeout, unless they are already running. It
+// returns a channel closed when they completed. A nil stop keeps the one of
+// the previous run.
+func startWarmup(timeout time.Duration, stop <-chan struct{}) <-chan struct{} {
+	warmups.Lock()
+	defer warmups.Unlock()
+	if warmups.running {
+		return warmups.done
+	}
+	if stop == nil {
+		stop = warmups.stop
+	}
+	warmups.stop = stop
+	done := make(chan struct{})
+	routines := append([]warmupRoutine(nil), warmups.routines...)
+	if len(warmups.paths) > 0 {
+		routines = append(routines, warmupRoutine{"routes", warmupRoutes(warmups.paths)})
+	}
+	if len(routines) == 0 {
+		close(done)
+		return done
+	}
+	warmups.running, warmups.done = true, done
+
+	goBackground(func() {
+		defer func() {
+			warmups.Lock()
+			warmups.running, warmups.last = false, time.Now()
+			warmups.Unlock()
+			close(done)
+		}()
+		if err := waitHealthy(selfURL("/healthz"), timeout, stop); err != nil {
+			log.Printf("Skipping warm-up: %v", err)
+			return
+		}
+		// Warming up routes before the backend they proxy to is up would
+		// only warm up errors.
+		select {
+		case <-dependenciesReached():
+		case <-stop:
+			return
+		}
+		start := time.Now()
+		var wg sync.WaitGroup
+		for _, w := range routines {
+			w := w
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				routineStop := make(chan struct{})
+				finished := make(chan error, 1)
+				go func() { finished <- w.run(routineStop) }()
+				select {
+				case err := <-finished:
+					if err != nil {
+						log.Printf("Warm-up %s failed: %v", w.name, err)
+					}
+				case <-time.After(timeout):
+					log.Printf("Warm-up %s did not complete within %v", w.name, timeout)
+				case <-stop:
+				}
+				close(routineStop)
+			}()
+		}
+		wg.Wait()
+		log.Printf("Warmed up in %v", time.Since(start).Round(time.Millisecond))
+	})
+	return done
+}
+
+// warmupRoutes returns a routine requesting each of paths, given as /PATH
+// or HOST/PATH for virtual hosts, and failing on server errors.
+func warmupRoutes(paths []string) WarmupRoutine {
+	return func(stop <-chan struct{}) error {
+		client := loopbackClient(30 * time.Second)
+		var failed []string
+		for _, p := range paths {
+			host := ""
+			if !strings.HasPrefix(p, "/") {
+				host = p
+				if i := strings.Index(p, "/"); i >= 0 {
+					host, p = p[:i], p[i:]
+				} else {
+					p = "/"
+				}
+			}
+			req, err := http.NewRequest("GET", selfURL(p), nil)
+			if err != nil {
+				return err
+			}
+			req.Host = host
+			req.Header.Set(warmupHeader, "1")
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 500 {
+					err = fmt.Errorf("status %s", resp.Status)
+				}
+			}
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s%s: %v", host, p, err))
+			}
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("%s", strings.Join(failed, "; "))
+		}
+		return nil
+	}
+}
+
+// withWarmup holds requests while the warm-up routines run if they are the
+// warm-up requests App Service sends to a slot before swapping it into
+// production, with a SiteWarmup user agent, or go to the path set by
+// WEBSITE_SWAP_WARMUP_PING_PATH. The swap proceeds once these are answered,
+// whatever their status by default, so holding them is what keeps it from
+// reaching a cold instance. A swap does not always restart the process: a
+// warm-up request arriving when the last run is older than rerun starts the
+// routines again.
+func withWarmup(h http.Handler, timeout, rerun time.Duration) http.Handler {
+	pingPath := os.Getenv("WEBSITE_SWAP_WARMUP_PING_PATH")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		swap := strings.Contains(r.UserAgent(), "SiteWarmup")
+		if r.Header.Get(warmupHeader) != "" || !swap && (pingPath == "" || r.URL.Path != pingPath) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		warmups.Lock()
+		rerunNow := swap && !warmups.running && time.Since(warmups.last) > rerun
+		running := warmups.running
+		warmups.Unlock()
+		if rerunNow {
+			log.Println("Swap warm-up request, warming up again")
+		}
+		if rerunNow || running {
+			select {
+			case <-startWarmup(timeout, nil):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// setWarmupPaths sets the paths requested when warming up.
+func setWarmupPaths(paths string) {
+	warmups.Lock()
+	defer warmups.Unlock()
+	warmups.paths = nil
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			warmups.paths = append(warmups.paths, p)
+		}
+	}
+}
+
+// slotSwapped reports whether the deployment history shows the last process
+// running in another slot, along with that slot.
+func slotSwapped() (string, bool) {
+	slot := os.Getenv("WEBSITE_SLOT_NAME")
+	events := deployments.snapshot()
+	for i := len(events) - 1; i >= 0; i-- {
+		if e := events[i]; e.Kind == eventRestart {
+			return e.Slot, slot != "" && e.Slot != "" && e.Slot != slot
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,113 @@
+package goazure
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+)
+
+const (
+	watchdogWindow     = 30
+	watchdogGrowth     = 2.0
+	watchdogMinCapture = time.Hour
+)
+
+var watchdogAlerts = newCounter("goazure_watchdog_alerts_total", "Times goroutine or heap growth looked like a leak")
+
+func init() {
+	newGaugeFunc("goazure_goroutines", "Number of goroutines", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+}
+
+type watchdogSample struct {
+	goroutines int
+	heap       uint64
+}
+
+// watchdog samples goroutine count and heap usage, alerting when either has
+// grown steadily across the whole sample window or doubled from the window's
+// minimum. It optionally captures profiles for post-mortem analysis.
+type watchdog struct {
+	samples     []watchdogSample
+	lastCapture time.Time
+}
+
+func startWatchdog(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	wd := &watchdog{}
+	goBackground(func() {
+		for {
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+			wd.sample()
+		}
+	})
+}
+
+func (wd *watchdog) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s := watchdogSample{goroutines: runtime.NumGoroutine(), heap: ms.HeapAlloc}
+
+	wd.samples = append(wd.samples, s)
+	if len(wd.samples) > watchdogWindow {
+		wd.samples = wd.samples[1:]
+	}
+	if len(wd.samples) < watchdogWindow {
+		return
+	}
+
+	var reasons []string
+	if r := wd.check("goroutines", func(s watchdogSample) float64 { return float64(s.goroutines) }); r != "" {
+		reasons = append(reasons, r)
+	}
+	if r := wd.check("heap bytes", func(s watchdogSample) float64 { return float64(s.heap) }); r != "" {
+		reasons = append(reasons, r)
+	}
+	if len(reasons) == 0 {
+		return
+	}
+
+	watchdogAlerts.inc()
+	log.Printf("Watchdog: possible leak: %v", reasons)
+	if dir := profileDir(); dir != "" && time.Since(wd.lastCapture) >= watchdogMinCapture {
+		wd.lastCapture = time.Now()
+		if _, err := captureProfiles(dir, "watchdog", 0, "heap", "goroutine"); err != nil {
+			log.Printf("Watchdog: could not capture profiles: %v", err)
+		}
+	}
+	// Start a fresh window so a single trend alerts once.
+	wd.samples = wd.samples[:0]
+}
+
+func (wd *watchdog) check(what string, value func(watchdogSample) float64) string {
+	first := value(wd.samples[0])
+	min, last := first, first
+	monotonic := true
+	for _, s := range wd.samples[1:] {
+		v := value(s)
+		if v < last {
+			monotonic = false
+		}
+		if v < min {
+			min = v
+		}
+		last = v
+	}
+
+	switch {
+	case monotonic && last > first:
+		return fmt.Sprintf("%s grew steadily from %.0f to %.0f", what, first, last)
+	case min > 0 && last >= min*watchdogGrowth:
+		return fmt.Sprintf("%s grew from %.0f to %.0f", what, min, last)
+	}
+	return ""
+}
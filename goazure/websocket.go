@@ -0,0 +1,384 @@
+package goazure
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocket close codes of RFC 6455.
+const (
+	wsGoingAway = 1001
+	wsOpClose   = 0x8
+)
+
+// wsGrace is how long peers have to answer a close frame before their
+// connections are closed.
+const wsGrace = 5 * time.Second
+
+var webSocketSessions = &wsRegistry{sessions: make(map[*wsSession]struct{})}
+
+func init() {
+	newGaugeFunc("goazure_websocket_connections", "Proxied WebSocket connections", func() float64 {
+		webSocketSessions.mu.Lock()
+		defer webSocketSessions.mu.Unlock()
+		return float64(len(webSocketSessions.sessions))
+	})
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// withWebSocket proxies WebSocket upgrades to the backend chosen by target,
+// passing other requests to h. The proxy copies whole frames, so that it can
+// close a connection cleanly: after idle seconds without a frame in either
+// direction, or when a drain begins, both peers get a close frame with code
+// 1001 and a few seconds to answer it.
+func withWebSocket(h http.Handler, target func(r *http.Request) *url.URL, idle time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocket(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if isDraining() {
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "server is restarting", http.StatusServiceUnavailable)
+			return
+		}
+		proxyWebSocket(w, r, target(r), idle)
+	})
+}
+
+func proxyWebSocket(w http.ResponseWriter, r *http.Request, u *url.URL, idle time.Duration) {
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	var backendConn net.Conn
+	var err error
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if u.Scheme == "https" {
+		backendConn, err = tls.DialWithDialer(d, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		backendConn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		proxyErrorHandler(w, r, err)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.URL = &url.URL{Path: singleJoiningSlash(u.Path, r.URL.Path), RawQuery: r.URL.RawQuery}
+	out.RequestURI = ""
+	if _, ok := out.Header["User-Agent"]; !ok {
+		out.Header.Set("User-Agent", "")
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	if err := out.Write(backendConn); err != nil {
+		backendConn.Close()
+		proxyErrorHandler(w, r, err)
+		return
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, out)
+	if err != nil {
+		backendConn.Close()
+		proxyErrorHandler(w, r, err)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Refused, the answer goes back as it is.
+		defer backendConn.Close()
+		defer resp.Body.Close()
+		for k, vs := range resp.Header {
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	if cs := ConnFromContext(r.Context()); cs != nil {
+		cs.Tag("websocket")
+	}
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		backendConn.Close()
+		log.Printf("Could not take over WebSocket connection: %v", err)
+		return
+	}
+	// Lift the read and write timeouts of the HTTP server.
+	clientConn.SetDeadline(time.Time{})
+	if err := resp.Write(clientConn); err != nil {
+		clientConn.Close()
+		backendConn.Close()
+		return
+	}
+
+	s := &wsSession{
+		client:  &wsPeer{Conn: clientConn},
+		backend: &wsPeer{Conn: backendConn},
+		closing: make(chan struct{}),
+	}
+	s.touch()
+	webSocketSessions.add(s)
+	defer webSocketSessions.remove(s)
+	s.run(clientBuf.Reader, backendReader, idle)
+}
+
+// singleJoiningSlash joins paths as httputil.NewSingleHostReverseProxy does.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// wsSession is a proxied WebSocket connection.
+type wsSession struct {
+	client, backend *wsPeer
+	last            int64 // UnixNano of the last frame
+	closed          int32 // set once the proxy sent close frames
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+// wsPeer is one end of a session. Frames are forwarded to it piece by piece
+// as they arrive, mu being held only while writing, so that a slow sender
+// does not hold up close frames to the other end. A close frame due while a
+// frame is partly forwarded waits for the rest of that frame.
+type wsPeer struct {
+	net.Conn
+	mu      sync.Mutex
+	partial bool   // a forwarded frame is partly written
+	held    []byte // close frame to write once the partial frame is done
+}
+
+// send writes a close frame now, or once the frame in progress is done.
+func (p *wsPeer) send(frame []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.SetWriteDeadline(time.Now().Add(wsGrace))
+	if p.partial {
+		p.held = frame
+		return
+	}
+	p.Write(frame)
+}
+
+func (s *wsSession) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+// run copies frames both ways until both directions ended with a close
+// frame, either peer is gone, or the peers did not answer close frames in
+// time.
+func (s *wsSession) run(clientReader, backendReader io.Reader, idle time.Duration) {
+	defer s.client.Close()
+	defer s.backend.Close()
+
+	done := make(chan bool, 2)
+	// Client frames are masked and stay so; backend frames are not.
+	go func() { done <- s.copyFrames(s.backend, clientReader) }()
+	go func() { done <- s.copyFrames(s.client, backendReader) }()
+
+	var idleCheck <-chan time.Time
+	if idle > 0 {
+		ticker := time.NewTicker(idle / 4)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+	closing := s.closing
+	var grace <-chan time.Time
+	for finished := 0; finished < 2; {
+		select {
+		case clean := <-done:
+			finished++
+			if !clean {
+				return
+			}
+			if grace == nil {
+				// Give the other peer time to answer the close frame.
+				grace = time.After(wsGrace)
+			}
+		case <-idleCheck:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.last))) >= idle {
+				s.goAway("idle timeout")
+			}
+		case <-closing:
+			closing = nil
+			if grace == nil {
+				grace = time.After(wsGrace)
+			}
+		case <-grace:
+			return
+		}
+	}
+}
+
+// copyFrames copies frames from r to p, reporting whether it stopped after a
+// close frame rather than on an error. Once the proxy sent close frames of
+// its own, further frames are read but no longer forwarded.
+func (s *wsSession) copyFrames(p *wsPeer, r io.Reader) bool {
+	buf := proxyBuffers.Get()
+	defer proxyBuffers.Put(buf)
+	var hdr [14]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+			return false
+		}
+		n := 2
+		length := uint64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			n += 2
+		case 127:
+			n += 8
+		}
+		if hdr[1]&0x80 != 0 {
+			n += 4
+		}
+		if _, err := io.ReadFull(r, hdr[2:n]); err != nil {
+			return false
+		}
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+		case 127:
+			length = binary.BigEndian.Uint64(hdr[2:10])
+		}
+
+		var err error
+		p.mu.Lock()
+		forward := atomic.LoadInt32(&s.closed) == 0
+		if forward {
+			p.partial = true
+			_, err = p.Write(hdr[:n])
+		}
+		p.mu.Unlock()
+		for left := length; err == nil && left > 0; {
+			chunk := buf
+			if uint64(len(chunk)) > left {
+				chunk = chunk[:left]
+			}
+			if _, err = io.ReadFull(r, chunk); err != nil {
+				break
+			}
+			left -= uint64(len(chunk))
+			if forward {
+				p.mu.Lock()
+				_, err = p.Write(chunk)
+				p.mu.Unlock()
+			}
+		}
+		if forward {
+			p.mu.Lock()
+			p.partial = false
+			if p.held != nil && err == nil {
+				_, err = p.Write(p.held)
+			}
+			p.held = nil
+			p.mu.Unlock()
+		}
+		if err != nil {
+			return false
+		}
+		s.touch()
+		if hdr[0]&0x0f == wsOpClose {
+			return true
+		}
+	}
+}
+
+// goAway sends both peers a close frame, once.
+func (s *wsSession) goAway(reason string) {
+	s.closeOnce.Do(func() {
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, wsGoingAway)
+		payload = append(payload, reason...)
+
+		// Frames read from now on are dropped, so nothing follows these.
+		atomic.StoreInt32(&s.closed, 1)
+		s.client.send(wsFrame(wsOpClose, payload, false))
+		s.backend.send(wsFrame(wsOpClose, payload, true))
+		close(s.closing)
+	})
+}
+
+// wsFrame encodes a short control frame, masked as clients send them.
+func wsFrame(opcode byte, payload []byte, masked bool) []byte {
+	f := []byte{0x80 | opcode, byte(len(payload))}
+	if !masked {
+		return append(f, payload...)
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	f[1] |= 0x80
+	f = append(f, key[:]...)
+	for i, b := range payload {
+		f = append(f, b^key[i%4])
+	}
+	return f
+}
+
+// wsRegistry tracks the sessions to close when a drain begins.
+type wsRegistry struct {
+	mu       sync.Mutex
+	sessions map[*wsSession]struct{}
+}
+
+func (reg *wsRegistry) add(s *wsSession) {
+	reg.mu.Lock()
+	reg.sessions[s] = struct{}{}
+	reg.mu.Unlock()
+	if isDraining() {
+		s.goAway("server is restarting")
+	}
+}
+
+func (reg *wsRegistry) remove(s *wsSession) {
+	reg.mu.Lock()
+	delete(reg.sessions, s)
+	reg.mu.Unlock()
+}
+
+// goAway closes every session, as the connections would otherwise keep the
+// drain waiting until it times out.
+func (reg *wsRegistry) goAway(reason string) {
+	reg.mu.Lock()
+	var sessions []*wsSession
+	for s := range reg.sessions {
+		sessions = append(sessions, s)
+	}
+	reg.mu.Unlock()
+	if len(sessions) > 0 {
+		log.Printf("Closing %d WebSocket connections", len(sessions))
+	}
+	for _, s := range sessions {
+		go s.goAway(reason)
+	}
+}
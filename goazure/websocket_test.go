@@ -0,0 +1,85 @@
+package goazure
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWebSocketGoAwayMidFrame closes a session while a frame from the
+// backend is half received: the backend gets its close frame right away,
+// and the client once the frame is complete.
+func TestWebSocketGoAwayMidFrame(t *testing.T) {
+	if proxyBuffers == nil {
+		proxyBuffers = newBufferPool(32 << 10)
+	}
+	client, clientProxy := net.Pipe()
+	backend, backendProxy := net.Pipe()
+	s := &wsSession{
+		client:  &wsPeer{Conn: clientProxy},
+		backend: &wsPeer{Conn: backendProxy},
+		closing: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		s.run(clientProxy, backendProxy, 0)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		backend.Close()
+		<-done
+	}()
+
+	payload := bytes.Repeat([]byte("x"), 100)
+	frame := append([]byte{0x82, byte(len(payload))}, payload...)
+	received := make(chan []byte, 1)
+	// The data frame, then an unmasked close frame with code and reason.
+	go func() {
+		b := make([]byte, len(frame)+2+2+len("test"))
+		io.ReadFull(client, b)
+		received <- b
+	}()
+	if _, err := backend.Write(frame[:12]); err != nil {
+		t.Fatal(err)
+	}
+
+	goneAway := make(chan struct{})
+	go func() {
+		s.goAway("test")
+		close(goneAway)
+	}()
+	// A masked close frame with code and reason.
+	hdr := make([]byte, 2+4+2+len("test"))
+	backend.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(backend, hdr); err != nil {
+		t.Fatalf("backend got no close frame while the client's frame was incomplete: %v", err)
+	}
+	if hdr[0] != 0x80|wsOpClose {
+		t.Fatalf("backend got frame %x, want a close frame", hdr[0])
+	}
+	select {
+	case <-goneAway:
+	case <-time.After(time.Second):
+		t.Fatal("goAway blocked on the frame in progress")
+	}
+
+	go io.Copy(ioutil.Discard, backend)
+	if _, err := backend.Write(frame[12:]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-received:
+		if !bytes.Equal(b[:len(frame)], frame) {
+			t.Fatal("client got a corrupted frame")
+		}
+		if b[len(frame)] != 0x80|wsOpClose {
+			t.Fatalf("client got frame %x after the data, want a close frame", b[len(frame)])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client got no close frame after the data frame")
+	}
+}
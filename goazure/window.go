@@ -0,0 +1,143 @@
+package goazure
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// window is a daily UTC time range, expressed as offsets from midnight. A
+// window whose start is after its end wraps around midnight.
+type window struct {
+	start, end time.Duration
+	deny       bool
+}
+
+func (w window) contains(t time.Time) bool {
+	t = t.UTC()
+	off := t.Sub(midnight(t))
+	if w.start <= w.end {
+		return off >= w.start && off < w.end
+	}
+	return off >= w.start || off < w.end
+}
+
+func (w window) String() string {
+	s := fmt.Sprintf("%s-%s", clockTime(w.start), clockTime(w.end))
+	if w.deny {
+		s = "!" + s
+	}
+	return s
+}
+
+// windows holds the deployment windows configured with -deployWindow.
+// Deployments are allowed inside any allow window (or anywhere, if none are
+// configured) unless a deny window also matches.
+type windows []window
+
+func (ws *windows) String() string {
+	s := make([]string, len(*ws))
+	for i, w := range *ws {
+		s[i] = w.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (ws *windows) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		var w window
+		if strings.HasPrefix(spec, "!") {
+			w.deny = true
+			spec = spec[1:]
+		}
+
+		parts := strings.SplitN(spec, "-", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", spec)
+		}
+
+		var err error
+		if w.start, err = parseClock(parts[0]); err != nil {
+			return err
+		}
+		if w.end, err = parseClock(parts[1]); err != nil {
+			return err
+		}
+		*ws = append(*ws, w)
+	}
+	return nil
+}
+
+func (ws windows) allowed(t time.Time) bool {
+	hasAllow, inAllow := false, false
+	for _, w := range ws {
+		if w.deny {
+			if w.contains(t) {
+				return false
+			}
+			continue
+		}
+		hasAllow = true
+		inAllow = inAllow || w.contains(t)
+	}
+	return !hasAllow || inAllow
+}
+
+// next returns the first instant at or after t when deployments are allowed.
+func (ws windows) next(t time.Time) time.Time {
+	if ws.allowed(t) {
+		return t
+	}
+
+	var candidates []time.Time
+	day := midnight(t)
+	for i := 0; i < 3; i++ {
+		for _, w := range ws {
+			if w.deny {
+				candidates = append(candidates, day.Add(w.end))
+			} else {
+				candidates = append(candidates, day.Add(w.start))
+			}
+		}
+		day = day.Add(24 * time.Hour)
+	}
+
+	sort.Sort(byTime(candidates))
+	for _, c := range candidates {
+		if c.After(t) && ws.allowed(c) {
+			return c
+		}
+	}
+
+	// Windows exclude every point of the day; never deploy.
+	return time.Time{}
+}
+
+type byTime []time.Time
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Less(i, j int) bool { return s[i].Before(s[j]) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func midnight(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func clockTime(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
@@ -0,0 +1,132 @@
+// Package httpjson holds the helpers the server's JSON endpoints are written
+// with: decoding and validating request bodies, writing responses, and
+// reporting errors in one envelope carrying the request ID, so that clients
+// handle errors from every endpoint the same way.
+//
+// An error is written as
+//
+//	{"error": {"status": 404, "error": "Not Found", "message": "...", "requestId": "..."}}
+package httpjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// MaxBodyBytes bounds the request bodies Decode reads.
+var MaxBodyBytes int64 = 1 << 20
+
+// RequestID returns the ID of a request put in error envelopes: the
+// X-Request-Id header set by the client or a proxy, or the X-ARR-LOG-ID App
+// Service's front ends set, empty if neither is.
+var RequestID = func(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return r.Header.Get("X-ARR-LOG-ID")
+}
+
+// Error is an error with the status to answer it with.
+type Error struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.StatusText
+	}
+	return e.Message
+}
+
+// Errorf returns an Error with status and a formatted message.
+func Errorf(status int, format string, args ...interface{}) *Error {
+	return &Error{Status: status, StatusText: http.StatusText(status), Message: fmt.Sprintf(format, args...)}
+}
+
+// Validator is implemented by request types checking their fields once
+// decoded. Errors it returns other than *Error are answered with 422.
+type Validator interface {
+	Validate() error
+}
+
+// Decode reads the JSON request body into v, rejecting other content types,
+// unknown fields, trailing data and bodies over MaxBodyBytes, then validates
+// v if it is a Validator. Errors are *Error, ready for WriteError.
+func Decode(r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+			return Errorf(http.StatusUnsupportedMediaType, "expected application/json, got %s", ct)
+		}
+	}
+	body := &io.LimitedReader{R: r.Body, N: MaxBodyBytes + 1}
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if body.N == 0 {
+			return Errorf(http.StatusRequestEntityTooLarge, "body larger than %d bytes", MaxBodyBytes)
+		}
+		if err == io.EOF {
+			return Errorf(http.StatusBadRequest, "empty body")
+		}
+		return Errorf(http.StatusBadRequest, "invalid JSON body: %v", err)
+	}
+	if body.N == 0 {
+		return Errorf(http.StatusRequestEntityTooLarge, "body larger than %d bytes", MaxBodyBytes)
+	}
+	if dec.More() {
+		return Errorf(http.StatusBadRequest, "invalid JSON body: unexpected data after the value")
+	}
+	if val, ok := v.(Validator); ok {
+		if err := val.Validate(); err != nil {
+			var e *Error
+			if errors.As(err, &e) {
+				return e
+			}
+			return Errorf(http.StatusUnprocessableEntity, "%v", err)
+		}
+	}
+	return nil
+}
+
+// Write answers with status and v encoded as JSON.
+func Write(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// WriteError answers with err in the error envelope, with its status if it
+// is an *Error. Other errors are logged and answered with 500 and a generic
+// message, as their text may reveal internals to clients.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		e = &Error{Status: http.StatusInternalServerError, Message: "internal server error"}
+	}
+	body := *e
+	if body.StatusText == "" {
+		body.StatusText = http.StatusText(body.Status)
+	}
+	if body.RequestID == "" {
+		body.RequestID = RequestID(r)
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	Write(w, body.Status, struct {
+		Error Error `json:"error"`
+	}{body})
+}
+
+// Fail answers with status and message in the error envelope.
+func Fail(w http.ResponseWriter, r *http.Request, status int, message string) {
+	WriteError(w, r, &Error{Status: status, Message: message})
+}
@@ -0,0 +1,126 @@
+package httpjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type request struct {
+	Name string `json:"name"`
+}
+
+func (r *request) Validate() error {
+	switch r.Name {
+	case "":
+		return errors.New("name is required")
+	case "taken":
+		return Errorf(http.StatusConflict, "name %s is taken", r.Name)
+	}
+	return nil
+}
+
+func TestDecode(t *testing.T) {
+	defer func(n int64) { MaxBodyBytes = n }(MaxBodyBytes)
+	MaxBodyBytes = 32
+
+	for _, tc := range []struct {
+		name, contentType, body string
+		status                  int
+	}{
+		{"valid", "application/json", `{"name": "a"}`, 0},
+		{"no content type", "", `{"name": "a"}`, 0},
+		{"content type parameters", "application/json; charset=utf-8", `{"name": "a"}`, 0},
+		{"other content type", "text/plain", `{"name": "a"}`, http.StatusUnsupportedMediaType},
+		{"empty", "application/json", ``, http.StatusBadRequest},
+		{"malformed", "application/json", `{"name": `, http.StatusBadRequest},
+		{"unknown field", "application/json", `{"name": "a", "admin": true}`, http.StatusBadRequest},
+		{"trailing data", "application/json", `{"name": "a"} {}`, http.StatusBadRequest},
+		{"too large", "application/json", `{"name": "` + strings.Repeat("a", 40) + `"}`, http.StatusRequestEntityTooLarge},
+		{"invalid", "application/json", `{"name": ""}`, http.StatusUnprocessableEntity},
+		{"invalid with status", "application/json", `{"name": "taken"}`, http.StatusConflict},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			var v request
+			err := Decode(r, &v)
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v.Name != "a" {
+					t.Fatalf("decoded name %q, want a", v.Name)
+				}
+				return
+			}
+			var e *Error
+			if !errors.As(err, &e) || e.Status != tc.status {
+				t.Fatalf("got %v, want an *Error with status %d", err, tc.status)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := Write(w, http.StatusCreated, map[string]int{"id": 7}); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d with content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != `{"id":7}` {
+		t.Fatalf("got body %s", got)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want Error
+	}{
+		{"error", Errorf(http.StatusNotFound, "no such thing"),
+			Error{Status: 404, StatusText: "Not Found", Message: "no such thing", RequestID: "req-1"}},
+		{"wrapped error", fmt.Errorf("looking it up: %w", Errorf(http.StatusConflict, "taken")),
+			Error{Status: 409, StatusText: "Conflict", Message: "taken", RequestID: "req-1"}},
+		{"other error", errors.New("open /etc/secret.key: permission denied"),
+			Error{Status: 500, StatusText: "Internal Server Error", Message: "internal server error", RequestID: "req-1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-Request-Id", "req-1")
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Length", "12")
+			WriteError(w, r, tc.err)
+
+			if w.Code != tc.want.Status {
+				t.Fatalf("got status %d, want %d", w.Code, tc.want.Status)
+			}
+			if w.Header().Get("Content-Length") != "" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Fatalf("got headers %v", w.Header())
+			}
+			var body struct {
+				Error Error `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != tc.want {
+				t.Fatalf("got %+v, want %+v", body.Error, tc.want)
+			}
+		})
+	}
+}